@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// actionCableSubprotocols are offered to Action Cable servers, as its
+// JavaScript client does.
+var actionCableSubprotocols = []string{"actioncable-v1-json", "actioncable-unsupported"}
+
+// checkActionCableFlags validates -actioncable and its options, and offers
+// the Action Cable subprotocols unless -protocol does.
+func checkActionCableFlags() error {
+	if !actionCable {
+		if len(actionCableSubscribe) > 0 || actionCablePings {
+			return errors.New("-actioncable-subscribe and -actioncable-pings require -actioncable")
+		}
+		return nil
+	}
+	if command != "" {
+		return fmt.Errorf("-actioncable is not supported by %s", command)
+	}
+	for _, channel := range actionCableSubscribe {
+		if _, err := actionCableIdentifier(channel, ""); err != nil {
+			return fmt.Errorf("-actioncable-subscribe: %v", err)
+		}
+	}
+	if protocol == "" {
+		protocol = strings.Join(actionCableSubprotocols, ",")
+	}
+	return selectAppProtocol("-actioncable", func() appSession {
+		return &actionCableSession{}
+	})
+}
+
+// actionCableIdentifier returns the identifier of a channel: channel itself
+// if it is a JSON object, like {"channel":"ChatChannel","room":1}, or else
+// the object of the channel's name and the JSON object params.
+func actionCableIdentifier(channel, params string) (string, error) {
+	if strings.HasPrefix(channel, "{") {
+		var b bytes.Buffer
+		if err := json.Compact(&b, []byte(channel)); err != nil {
+			return "", fmt.Errorf("invalid channel identifier %s", channel)
+		}
+		return b.String(), nil
+	}
+	identifier := map[string]interface{}{}
+	if params != "" && json.Unmarshal([]byte(params), &identifier) != nil {
+		return "", errors.New("the channel parameters must be a JSON object")
+	}
+	identifier["channel"] = channel
+	data, _ := json.Marshal(identifier)
+	return string(data), nil
+}
+
+// actionCableLabel returns how a channel is shown: its name if its
+// identifier has no parameters, or else its identifier.
+func actionCableLabel(identifier string) string {
+	var id map[string]interface{}
+	json.Unmarshal([]byte(identifier), &id)
+	if channel, ok := id["channel"].(string); ok && len(id) == 1 {
+		return channel
+	}
+	return identifier
+}
+
+// actionCableSession speaks the Action Cable protocol of Rails, subscribing
+// to the channels of -actioncable-subscribe once welcomed. The messages
+// broadcast to the subscriptions are shown as their channel and message,
+// and the pings of the server are hidden unless -actioncable-pings. Input
+// lines are commands:
+//
+//	subscribe <channel> [params]
+//	unsubscribe <channel>
+//	perform <channel> <action> [data]
+//	message <channel> <data>
+//
+// where a channel is its name, or its identifier as a JSON object.
+type actionCableSession struct {
+	mu            sync.Mutex
+	welcomed      bool
+	queued        []message // the commands sent before the server welcomed the client
+	subscriptions []string  // the identifiers of the channels subscribed to
+}
+
+func (s *actionCableSession) open(ctx context.Context, send func(message)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, channel := range actionCableSubscribe {
+		identifier, _ := actionCableIdentifier(channel, "")
+		s.queued = append(s.queued, s.subscribe(identifier))
+	}
+}
+
+func (s *actionCableSession) subscribe(identifier string) message {
+	s.subscriptions = append(s.subscriptions, identifier)
+	return jsonMessage(map[string]string{"command": "subscribe", "identifier": identifier})
+}
+
+// subscribed returns the identifier of a channel given by name, which is
+// the first subscription to the channel of the name if any.
+func (s *actionCableSession) subscribed(channel string) (string, error) {
+	if !strings.HasPrefix(channel, "{") {
+		for _, identifier := range s.subscriptions {
+			var id struct {
+				Channel string `json:"channel"`
+			}
+			if json.Unmarshal([]byte(identifier), &id) == nil && id.Channel == channel {
+				return identifier, nil
+			}
+		}
+	}
+	return actionCableIdentifier(channel, "")
+}
+
+func (s *actionCableSession) input(line string) ([]message, error) {
+	command, args, _ := strings.Cut(strings.TrimSpace(line), " ")
+	command = strings.ToLower(command)
+	channel, rest := cutChannel(strings.TrimSpace(args))
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var msg message
+	switch command {
+	case "subscribe":
+		if channel == "" {
+			return nil, errors.New("usage: subscribe <channel> [params]")
+		}
+		identifier, err := actionCableIdentifier(channel, rest)
+		if err != nil {
+			return nil, err
+		}
+		msg = s.subscribe(identifier)
+	case "unsubscribe":
+		if channel == "" {
+			return nil, errors.New("usage: unsubscribe <channel>")
+		}
+		identifier, err := s.subscribed(channel)
+		if err != nil {
+			return nil, err
+		}
+		for i, id := range s.subscriptions {
+			if id == identifier {
+				s.subscriptions = append(s.subscriptions[:i], s.subscriptions[i+1:]...)
+				break
+			}
+		}
+		msg = jsonMessage(map[string]string{"command": "unsubscribe", "identifier": identifier})
+	case "perform", "message":
+		var action string
+		if command == "perform" {
+			action, rest, _ = strings.Cut(rest, " ")
+			rest = strings.TrimSpace(rest)
+		}
+		switch {
+		case command == "perform" && (channel == "" || action == ""):
+			return nil, errors.New("usage: perform <channel> <action> [data]")
+		case command == "message" && (channel == "" || rest == ""):
+			return nil, errors.New("usage: message <channel> <data>")
+		}
+		data := map[string]interface{}{}
+		if rest != "" && json.Unmarshal([]byte(rest), &data) != nil {
+			return nil, errors.New("the data must be a JSON object")
+		}
+		if action != "" {
+			data["action"] = action
+		}
+		identifier, err := s.subscribed(channel)
+		if err != nil {
+			return nil, err
+		}
+		encoded, _ := json.Marshal(data)
+		msg = jsonMessage(map[string]string{"command": "message", "identifier": identifier, "data": string(encoded)})
+	default:
+		return nil, errors.New("unknown Action Cable command, expected subscribe, unsubscribe, perform or message")
+	}
+	if !s.welcomed {
+		s.queued = append(s.queued, msg)
+		return nil, nil
+	}
+	return []message{msg}, nil
+}
+
+// cutChannel cuts the channel at the start of s, a name or a JSON object,
+// from the rest of s.
+func cutChannel(s string) (channel, rest string) {
+	if strings.HasPrefix(s, "{") {
+		dec := json.NewDecoder(strings.NewReader(s))
+		var v json.RawMessage
+		if dec.Decode(&v) == nil {
+			n := dec.InputOffset()
+			return s[:n], strings.TrimSpace(s[n:])
+		}
+	}
+	channel, rest, _ = strings.Cut(s, " ")
+	return channel, strings.TrimSpace(rest)
+}
+
+func (s *actionCableSession) receive(msg message, send func(message)) ([]message, error) {
+	if msg.messageType != TextMessage {
+		return []message{msg}, nil
+	}
+	var m struct {
+		Type       string          `json:"type"`
+		Identifier string          `json:"identifier"`
+		Message    json.RawMessage `json:"message"`
+		Reason     string          `json:"reason"`
+		Reconnect  *bool           `json:"reconnect"`
+	}
+	if err := json.Unmarshal(msg.data, &m); err != nil {
+		return []message{msg}, nil
+	}
+	switch m.Type {
+	case "welcome":
+		s.mu.Lock()
+		s.welcomed = true
+		queued := s.queued
+		s.queued = nil
+		s.mu.Unlock()
+		printLine("welcomed by the server")
+		for _, q := range queued {
+			send(q)
+		}
+		return nil, nil
+	case "ping":
+		if !actionCablePings {
+			return nil, nil
+		}
+		return []message{msg}, nil
+	case "confirm_subscription":
+		printLine("subscribed to %s", actionCableLabel(m.Identifier))
+		return nil, nil
+	case "reject_subscription":
+		s.mu.Lock()
+		for i, id := range s.subscriptions {
+			if id == m.Identifier {
+				s.subscriptions = append(s.subscriptions[:i], s.subscriptions[i+1:]...)
+				break
+			}
+		}
+		s.mu.Unlock()
+		return nil, fmt.Errorf("subscription to %s rejected", actionCableLabel(m.Identifier))
+	case "disconnect":
+		line := "disconnected by the server"
+		if m.Reason != "" {
+			line += ": " + m.Reason
+		}
+		if m.Reconnect != nil && !*m.Reconnect {
+			line += ", not to reconnect"
+		}
+		printLine("%s", line)
+		return nil, nil
+	}
+	if m.Identifier != "" && m.Message != nil {
+		msg.data = []byte(actionCableLabel(m.Identifier) + formatArgs([]json.RawMessage{m.Message}))
+	}
+	return []message{msg}, nil
+}
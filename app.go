@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// appSession speaks an application protocol layered on WebSocket, like
+// graphql-transport-ws, on a connection: it opens the protocol's session,
+// wraps input lines in the protocol's messages and unwraps the messages
+// received for display.
+type appSession interface {
+	// open sends the messages opening the session, once connected. ctx is
+	// done when the connection is.
+	open(ctx context.Context, send func(message))
+	// input returns the messages an input line is sent as.
+	input(line string) ([]message, error)
+	// receive handles a received message, answering it with send if the
+	// protocol requires, and returns the messages to show in its place.
+	receive(msg message, send func(message)) ([]message, error)
+}
+
+var (
+	// newAppSession starts a session of the application protocol selected
+	// on the command line, for a new connection. It is nil if none is.
+	newAppSession func() appSession
+
+	// appFlag is the flag that selected the application protocol.
+	appFlag string
+
+	// appNegotiate is called before dialing a URL with the application
+	// protocols that negotiate the connection over HTTP first. It returns
+	// the URL to dial, and headers to send with the handshake.
+	appNegotiate func(url string) (string, http.Header, error)
+)
+
+// selectAppProtocol selects the application protocol of a flag, unless
+// another flag selected one already.
+func selectAppProtocol(name string, newSession func() appSession) error {
+	if appFlag != "" {
+		return fmt.Errorf("%s cannot be combined with %s", name, appFlag)
+	}
+	newAppSession, appFlag = newSession, name
+	return nil
+}
+
+// dialApp dials url, after negotiating the connection if the application
+// protocol requires.
+func dialApp(url string) (Conn, error) {
+	var extra http.Header
+	if appNegotiate != nil {
+		var err error
+		if url, extra, err = appNegotiate(url); err != nil {
+			return nil, &dialError{err}
+		}
+	}
+	return dial(url, protocol, origin, extra)
+}
+
+// negotiationClient returns the HTTP client of the requests negotiating
+// a connection, with the TLS options of the handshake, and the headers to
+// send with them: those of -H, the credentials and the cookie.
+func negotiationClient() (*http.Client, http.Header, error) {
+	header, err := parseHeaders(headers)
+	if err != nil {
+		return nil, nil, err
+	}
+	setAuthorization(header)
+	if strings.Contains(cookie, "=") {
+		header.Add("Cookie", cookie)
+	}
+	tlsConfig, err := newTLSConfig()
+	if err != nil {
+		return nil, nil, err
+	}
+	return &http.Client{Timeout: 30 * time.Second, Transport: &http.Transport{TLSClientConfig: tlsConfig}}, header, nil
+}
+
+// inputMessages returns the messages an input line is sent as: wrapped by
+// app, unless it is nil or the line starts with an escape of parseInput.
+func inputMessages(app appSession, line string) ([]message, error) {
+	if app == nil || strings.HasPrefix(line, `\`) {
+		msg, err := parseInput(line)
+		if err != nil {
+			return nil, err
+		}
+		return []message{msg}, nil
+	}
+	return app.input(line)
+}
+
+// receiveMessage returns the messages to show for a received message:
+// unwrapped by app, or the message itself if app is nil.
+func receiveMessage(app appSession, msg message, send func(message)) ([]message, error) {
+	if app == nil {
+		return []message{msg}, nil
+	}
+	return app.receive(msg, send)
+}
+
+// parseArgs parses the arguments of an input line, like the event or
+// method it calls, as a sequence of JSON values. If they are not JSON, the
+// whole of s is a single string argument.
+func parseArgs(s string) []interface{} {
+	args := []interface{}{}
+	dec := json.NewDecoder(strings.NewReader(s))
+	dec.UseNumber()
+	for {
+		var v interface{}
+		err := dec.Decode(&v)
+		if err == nil {
+			args = append(args, v)
+			continue
+		}
+		if !errors.Is(err, io.EOF) {
+			return []interface{}{strings.TrimSpace(s)}
+		}
+		return args
+	}
+}
+
+// formatArgs formats the arguments of an event or a call, each after a
+// space.
+func formatArgs(args []json.RawMessage) string {
+	var b bytes.Buffer
+	for _, a := range args {
+		b.WriteByte(' ')
+		json.Compact(&b, a)
+	}
+	return b.String()
+}
+
+// jsonMessage returns a text message holding v as JSON.
+func jsonMessage(v interface{}) message {
+	data, _ := json.Marshal(v)
+	return message{messageType: TextMessage, data: data}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	neturl "net/url"
+	"strings"
+)
+
+// checkAuthFlags validates -basic, -bearer, -digest, -oauth2-token-url and
+// -aws-sigv4, of which at most one may be given, and the flags that go with
+// them.
+func checkAuthFlags() error {
+	n := 0
+	for _, flag := range []string{basicAuth, bearerToken, digestAuth, oauth2TokenURL, awsSigV4} {
+		if flag != "" {
+			n++
+		}
+	}
+	if n > 1 {
+		return errors.New("-basic, -bearer, -digest, -oauth2-token-url and -aws-sigv4 cannot be combined")
+	}
+	if oauth2TokenURL != "" && oauth2ClientID == "" {
+		return errors.New("-oauth2-token-url needs -client-id")
+	}
+	if basicAuth != "" && !strings.Contains(basicAuth, ":") {
+		return fmt.Errorf("invalid -basic %q, expected user:password", basicAuth)
+	}
+	if digestAuth != "" && !strings.Contains(digestAuth, ":") {
+		return fmt.Errorf("invalid -digest %q, expected user:password", digestAuth)
+	}
+	if region, service, _ := strings.Cut(awsSigV4, ":"); awsSigV4 != "" && (region == "" || strings.Contains(service, ":")) {
+		return fmt.Errorf("invalid -aws-sigv4 %q, expected region or region:service", awsSigV4)
+	}
+	return nil
+}
+
+// setAuthorization sets the Authorization header of the handshake for
+// -basic and -bearer. Digest authentication needs the server's challenge
+// first, see digestRetry.
+func setAuthorization(header http.Header) {
+	switch {
+	case basicAuth != "":
+		header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(basicAuth)))
+	case bearerToken != "":
+		header.Set("Authorization", "Bearer "+bearerToken)
+	}
+}
+
+// digestRetry sets the Authorization header answering the digest challenge
+// of a 401 response to the handshake with url, and reports whether the
+// handshake should be retried.
+func digestRetry(header http.Header, url string, resp *http.Response) (bool, error) {
+	if digestAuth == "" || resp == nil || resp.StatusCode != http.StatusUnauthorized {
+		return false, nil
+	}
+	var challenge string
+	for _, value := range resp.Header.Values("WWW-Authenticate") {
+		if strings.HasPrefix(strings.ToLower(value), "digest ") {
+			challenge = value
+		}
+	}
+	if challenge == "" {
+		return false, nil
+	}
+
+	u, err := neturl.Parse(url)
+	if err != nil {
+		return false, err
+	}
+	method := http.MethodGet
+	if useHTTP2 {
+		method = http.MethodConnect
+	}
+	user, password, _ := strings.Cut(digestAuth, ":")
+	auth, err := digestAuthorization(challenge, method, u.RequestURI(), user, password)
+	if err != nil {
+		return false, err
+	}
+	header.Set("Authorization", auth)
+	return true, nil
+}
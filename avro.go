@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/linkedin/goavro/v2"
+)
+
+// avroDecoder decodes Avro messages with a local schema, or with schemas
+// fetched from a Confluent-style schema registry. Registry messages start
+// with a zero byte and the 4-byte big-endian schema ID.
+type avroDecoder struct {
+	codec    *goavro.Codec
+	registry string
+	client   *http.Client
+	codecs   map[uint32]*goavro.Codec
+}
+
+func newAvroDecoder(schemaFile, registry string) (*avroDecoder, error) {
+	if schemaFile == "" && registry == "" {
+		return nil, fmt.Errorf("-decode avro requires -avro-schema or -schema-registry")
+	}
+	d := &avroDecoder{
+		registry: strings.TrimSuffix(registry, "/"),
+		client:   &http.Client{Timeout: 10 * time.Second},
+		codecs:   map[uint32]*goavro.Codec{},
+	}
+	if schemaFile != "" {
+		schema, err := os.ReadFile(schemaFile)
+		if err != nil {
+			return nil, err
+		}
+		if d.codec, err = goavro.NewCodec(string(schema)); err != nil {
+			return nil, fmt.Errorf("parsing %s: %v", schemaFile, err)
+		}
+	}
+	return d, nil
+}
+
+func (d *avroDecoder) decode(data []byte) ([]byte, error) {
+	framed := len(data) >= 5 && data[0] == 0
+	if d.registry != "" {
+		if !framed {
+			return nil, fmt.Errorf("message does not start with a schema ID")
+		}
+		codec, err := d.registryCodec(binary.BigEndian.Uint32(data[1:5]))
+		if err != nil {
+			return nil, err
+		}
+		return avroToJSON(codec, data[5:])
+	}
+
+	b, err := avroToJSON(d.codec, data)
+	if err != nil && framed {
+		// The message may carry a schema ID even though the schema is local.
+		if b, err2 := avroToJSON(d.codec, data[5:]); err2 == nil {
+			return b, nil
+		}
+	}
+	return b, err
+}
+
+func avroToJSON(codec *goavro.Codec, data []byte) ([]byte, error) {
+	native, rest, err := codec.NativeFromBinary(data)
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) > 0 {
+		return nil, fmt.Errorf("%d bytes of trailing data", len(rest))
+	}
+	return codec.TextualFromNative(nil, native)
+}
+
+// registryCodec returns the codec for a schema ID, fetching the schema from
+// the registry the first time it is seen.
+func (d *avroDecoder) registryCodec(id uint32) (*goavro.Codec, error) {
+	if codec, ok := d.codecs[id]; ok {
+		return codec, nil
+	}
+	resp, err := d.client.Get(fmt.Sprintf("%s/schemas/ids/%d", d.registry, id))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching schema %d: %s", id, resp.Status)
+	}
+	var body struct {
+		Schema string `json:"schema"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, fmt.Errorf("fetching schema %d: %v", id, err)
+	}
+	codec, err := goavro.NewCodec(body.Schema)
+	if err != nil {
+		return nil, fmt.Errorf("parsing schema %d: %v", id, err)
+	}
+	d.codecs[id] = codec
+	return codec, nil
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"unicode"
+	"unicode/utf8"
+)
+
+// maxBase64Depth limits how deeply nested base64 is decoded.
+const maxBase64Depth = 8
+
+var base64Encodings = []*base64.Encoding{
+	base64.StdEncoding,
+	base64.URLEncoding,
+	base64.RawStdEncoding,
+	base64.RawURLEncoding,
+}
+
+// decodeBase64Payload is the -decode base64 decoder. A payload that is
+// base64-encoded text is decoded, as are base64 strings nested in JSON, at
+// any depth. Payloads without base64 are returned unchanged.
+func decodeBase64Payload(data []byte) ([]byte, error) {
+	v, changed := expandBase64(string(data), 0)
+	if !changed {
+		return data, nil
+	}
+	if s, ok := v.(string); ok {
+		return []byte(s), nil
+	}
+	return marshalJSON(v)
+}
+
+// expandBase64 decodes s if it looks like base64-encoded text. If s, or what
+// it decodes to, is a JSON object or array, the strings in it are expanded
+// in turn and the JSON value is returned.
+func expandBase64(s string, depth int) (interface{}, bool) {
+	if depth > maxBase64Depth {
+		return s, false
+	}
+	if v, ok := parseJSONContainer(s); ok {
+		return expandJSON(v, depth)
+	}
+	text, ok := decodeBase64Text(s)
+	if !ok {
+		return s, false
+	}
+	v, _ := expandBase64(text, depth+1)
+	return v, true
+}
+
+// expandJSON expands the base64 strings in a JSON value, reporting whether
+// there were any.
+func expandJSON(v interface{}, depth int) (interface{}, bool) {
+	changed := false
+	switch v := v.(type) {
+	case string:
+		if text, ok := decodeBase64Text(v); ok {
+			e, _ := expandBase64(text, depth+1)
+			return e, true
+		}
+	case []interface{}:
+		for i := range v {
+			var c bool
+			v[i], c = expandJSON(v[i], depth)
+			changed = changed || c
+		}
+	case map[string]interface{}:
+		for k := range v {
+			var c bool
+			v[k], c = expandJSON(v[k], depth)
+			changed = changed || c
+		}
+	}
+	return v, changed
+}
+
+func parseJSONContainer(s string) (interface{}, bool) {
+	trimmed := bytes.TrimSpace([]byte(s))
+	if len(trimmed) == 0 || (trimmed[0] != '{' && trimmed[0] != '[') {
+		return nil, false
+	}
+	dec := json.NewDecoder(bytes.NewReader(trimmed))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil || dec.More() {
+		return nil, false
+	}
+	return v, true
+}
+
+// decodeBase64Text decodes s if it is base64 in any of the common variants
+// and decodes to printable text. Requiring text keeps ordinary words and
+// identifiers that happen to be valid base64 from being decoded.
+func decodeBase64Text(s string) (string, bool) {
+	if len(s) < 8 {
+		return "", false
+	}
+	for _, enc := range base64Encodings {
+		b, err := enc.Strict().DecodeString(s)
+		if err == nil && isPrintable(b) {
+			return string(b), true
+		}
+	}
+	return "", false
+}
+
+func isPrintable(b []byte) bool {
+	if len(b) == 0 || !utf8.Valid(b) {
+		return false
+	}
+	for _, r := range string(b) {
+		if !unicode.IsPrint(r) && r != '\t' && r != '\n' && r != '\r' {
+			return false
+		}
+	}
+	return true
+}
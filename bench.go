@@ -0,0 +1,382 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/HdrHistogram/hdrhistogram-go"
+)
+
+// checkBenchFlags validates the flags of bench.
+func checkBenchFlags() error {
+	if command != "bench" {
+		return nil
+	}
+	switch {
+	case len(urls) > 1:
+		return errors.New("bench takes a single URL")
+	case benchRate <= 0:
+		return errors.New("-rate must be positive")
+	case benchDuration <= 0:
+		return errors.New("-duration must be positive")
+	case rampUp < 0:
+		return errors.New("-ramp-up must not be negative")
+	case churnRate < 0:
+		return errors.New("-churn must not be negative")
+	case handshakeOnly && churnRate == 0:
+		return errors.New("-handshake-only requires -churn")
+	case recordFile != "" || harFileName != "" || pcapFile != "":
+		return errors.New("-record, -har and -pcap are not supported by bench")
+	}
+	if _, err := parseInput(expandMessage(benchMessage, 1, 1)); err != nil {
+		return fmt.Errorf("-message: %v", err)
+	}
+	return checkSoakFlags()
+}
+
+// expandMessage expands the placeholders of a message template such as
+// -message for message seq of connection conn: {{conn}} and {{seq}} are
+// their numbers, {{ts}} is the time in Unix milliseconds and {{rand}} a
+// random number.
+func expandMessage(template string, conn, seq int) string {
+	return strings.NewReplacer(
+		"{{conn}}", strconv.Itoa(conn),
+		"{{seq}}", strconv.Itoa(seq),
+		"{{ts}}", strconv.FormatInt(time.Now().UnixMilli(), 10),
+		"{{rand}}", strconv.FormatInt(rand.Int63(), 10),
+	).Replace(template)
+}
+
+// benchStats collects the results of bench.
+type benchStats struct {
+	mu                      sync.Mutex
+	opened, failed, dropped int
+	errors                  map[string]int
+
+	sent, received           int
+	bytesSent, bytesReceived int
+
+	// The histograms of the handshake times and latencies, and of the
+	// latencies corrected for coordinated omission at the -rate interval,
+	// hold any number of samples in a fixed size.
+	handshakes, latencies, corrected *hdrhistogram.Histogram
+	interval                         time.Duration
+
+	soak soakStats
+}
+
+// newBenchStats returns the stats of a bench sending messages every
+// interval, or 0 for churned connections, which send one each.
+func newBenchStats(interval time.Duration) *benchStats {
+	return &benchStats{
+		errors:     map[string]int{},
+		handshakes: newLatencyHistogram(),
+		latencies:  newLatencyHistogram(),
+		corrected:  newLatencyHistogram(),
+		interval:   interval,
+		soak:       soakStats{reconnects: newLatencyHistogram()},
+	}
+}
+
+// recordLatency records the latency of a message. s.mu must be held.
+func (s *benchStats) recordLatency(d time.Duration) {
+	// Samples out of range are dropped.
+	s.latencies.RecordValue(int64(d))
+	s.corrected.RecordCorrectedValue(int64(d), int64(s.interval))
+}
+
+func (s *benchStats) fail(err error, dropped bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if dropped {
+		s.dropped++
+	} else {
+		s.failed++
+	}
+	s.errors[err.Error()]++
+}
+
+// runBench opens -connections connections to the URL, spread over
+// -ramp-up, each sending -message at -rate until -duration has passed
+// since the last one was opened, or with -churn churns connections for
+// -duration, or with -soak keeps them open for -duration, and prints the
+// results. The latency of a message is the time until the connection
+// receives a message, with the messages received paired with those sent in
+// order, as with an echo server or a request/response protocol.
+func runBench() int {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	start := time.Now()
+	// Churned connections send a single message each.
+	var interval time.Duration
+	if churnRate == 0 {
+		interval = time.Duration(float64(time.Second) / benchRate)
+	}
+	stats := newBenchStats(interval)
+	if soak {
+		ctx, cancel := context.WithDeadline(ctx, start.Add(rampUp+benchDuration))
+		defer cancel()
+		printLine("soaking %s with %d connections at %v messages/s each for %v, reporting every %v...",
+			yellow(url), connections, benchRate, benchDuration, soakInterval)
+		go reportSoak(ctx, stats, start)
+		var wg sync.WaitGroup
+		for i := range connections {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				select {
+				case <-time.After(rampUp * time.Duration(i) / time.Duration(connections)):
+					soakConn(ctx, i+1, stats)
+				case <-ctx.Done():
+				}
+			}()
+		}
+		wg.Wait()
+	} else if churnRate > 0 {
+		ctx, cancel := context.WithDeadline(ctx, start.Add(benchDuration))
+		defer cancel()
+		churn(ctx, stats)
+	} else {
+		ctx, cancel := context.WithDeadline(ctx, start.Add(rampUp+benchDuration))
+		defer cancel()
+		printLine("benchmarking %s with %d connections at %v messages/s each for %v...",
+			yellow(url), connections, benchRate, benchDuration)
+		var wg sync.WaitGroup
+		for i := range connections {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				select {
+				case <-time.After(rampUp * time.Duration(i) / time.Duration(connections)):
+					benchConn(ctx, i+1, stats)
+				case <-ctx.Done():
+				}
+			}()
+		}
+		wg.Wait()
+	}
+	stats.print(time.Since(start))
+	reportHistograms(stats.latencies, stats.corrected, start)
+	statsd.flush()
+	tracer.flush()
+	if stats.opened == 0 {
+		return exitError
+	}
+	return exitOK
+}
+
+// benchConn drives a connection of bench until ctx is done or it drops. It
+// returns when the connection opened, or the zero time if it failed to, and
+// why it ended.
+func benchConn(ctx context.Context, n int, stats *benchStats) (time.Time, error) {
+	dialStart := time.Now()
+	ws, err := dial(url, protocol, origin, nil)
+	if err != nil {
+		stats.fail(err, false)
+		return time.Time{}, err
+	}
+	defer ws.Close()
+	opened := time.Now()
+	stats.mu.Lock()
+	stats.opened++
+	stats.handshakes.RecordValue(int64(opened.Sub(dialStart)))
+	stats.mu.Unlock()
+
+	// pending holds when the messages not answered yet were sent.
+	var mu sync.Mutex
+	var pending []time.Time
+	readErr := make(chan error, 1)
+	go func() {
+		var seq soakSequencer
+		for {
+			_, data, err := ws.ReadMessage()
+			if err != nil {
+				readErr <- err
+				return
+			}
+			now := time.Now()
+			mu.Lock()
+			var sentAt time.Time
+			if len(pending) > 0 {
+				sentAt, pending = pending[0], pending[1:]
+			}
+			mu.Unlock()
+
+			stats.mu.Lock()
+			stats.received++
+			stats.bytesReceived += len(data)
+			if !sentAt.IsZero() {
+				stats.recordLatency(now.Sub(sentAt))
+			}
+			stats.mu.Unlock()
+			if soakSeqCode != nil {
+				seq.check(n, data, stats)
+			}
+		}
+	}()
+
+	ticker := time.NewTicker(time.Duration(float64(time.Second) / benchRate))
+	defer ticker.Stop()
+	for seq := 1; ; seq++ {
+		select {
+		case <-ticker.C:
+		case err := <-readErr:
+			stats.fail(err, true)
+			return opened, err
+		case <-ctx.Done():
+			ws.WriteControl(CloseMessage, FormatCloseMessage(1000, ""), time.Now().Add(time.Second))
+			select {
+			case <-readErr:
+			case <-time.After(closeTimeout):
+			}
+			return opened, ctx.Err()
+		}
+		// Validated by checkBenchFlags.
+		msg, _ := parseInput(expandMessage(benchMessage, n, seq))
+		mu.Lock()
+		pending = append(pending, time.Now())
+		mu.Unlock()
+		if err := ws.WriteMessage(msg.messageType, msg.data); err != nil {
+			stats.fail(err, true)
+			return opened, err
+		}
+		stats.mu.Lock()
+		stats.sent++
+		stats.bytesSent += len(msg.data)
+		stats.mu.Unlock()
+	}
+}
+
+// churn opens -churn connections per second until ctx is done, to stress
+// the server's accept path. Each sends -message once, waits for a message
+// back and closes, or with -handshake-only closes the TCP connection right
+// after the upgrade.
+func churn(ctx context.Context, stats *benchStats) {
+	mode := "sending a message each"
+	if handshakeOnly {
+		mode = "handshake only"
+	}
+	printLine("churning %v connections/s to %s for %v, %s...", churnRate, yellow(url), benchDuration, mode)
+	ticker := time.NewTicker(time.Duration(float64(time.Second) / churnRate))
+	defer ticker.Stop()
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	for n := 1; ; n++ {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			churnConn(n, stats)
+		}()
+	}
+}
+
+// churnConn opens, uses and closes a connection of churn.
+func churnConn(n int, stats *benchStats) {
+	dialStart := time.Now()
+	ws, err := dial(url, protocol, origin, nil)
+	if err != nil {
+		stats.fail(err, false)
+		return
+	}
+	defer ws.Close()
+	stats.mu.Lock()
+	stats.opened++
+	stats.handshakes.RecordValue(int64(time.Since(dialStart)))
+	stats.mu.Unlock()
+	if handshakeOnly {
+		return
+	}
+
+	msg, _ := parseInput(expandMessage(benchMessage, n, 1))
+	sentAt := time.Now()
+	if err := ws.WriteMessage(msg.messageType, msg.data); err != nil {
+		stats.fail(err, true)
+		return
+	}
+	stats.mu.Lock()
+	stats.sent++
+	stats.bytesSent += len(msg.data)
+	stats.mu.Unlock()
+	ws.SetReadDeadline(time.Now().Add(closeTimeout))
+	_, data, err := ws.ReadMessage()
+	if err != nil {
+		stats.fail(err, true)
+		return
+	}
+	stats.mu.Lock()
+	stats.received++
+	stats.bytesReceived += len(data)
+	stats.recordLatency(time.Since(sentAt))
+	stats.mu.Unlock()
+
+	// The server's close frame ends the closing handshake.
+	ws.WriteControl(CloseMessage, FormatCloseMessage(1000, ""), time.Now().Add(closeTimeout))
+	for {
+		if _, _, err := ws.ReadMessage(); err != nil {
+			var ce *CloseError
+			if !errors.As(err, &ce) {
+				stats.fail(err, true)
+			}
+			return
+		}
+	}
+}
+
+// print prints the results of bench after running for elapsed.
+func (s *benchStats) print(elapsed time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	seconds := elapsed.Seconds()
+	attempted := s.opened + s.failed
+	var success float64
+	if attempted > 0 {
+		success = 100 * float64(s.opened) / float64(attempted)
+	}
+	printLine("connections: %d opened, %d failed (%.1f%% success), %d dropped", s.opened, s.failed, success, s.dropped)
+	printLine("messages:    %d sent (%.1f/s), %d received (%.1f/s)", s.sent, float64(s.sent)/seconds, s.received, float64(s.received)/seconds)
+	printLine("bytes:       %d sent (%.0f/s), %d received (%.0f/s)", s.bytesSent, float64(s.bytesSent)/seconds, s.bytesReceived, float64(s.bytesReceived)/seconds)
+	printLine("handshake:   %s", formatHistogramPercentiles(s.handshakes))
+	printLine("latency:     %s", formatHistogramPercentiles(s.latencies))
+
+	reasons := make([]string, 0, len(s.errors))
+	for reason := range s.errors {
+		reasons = append(reasons, reason)
+	}
+	sort.Slice(reasons, func(i, j int) bool { return s.errors[reasons[i]] > s.errors[reasons[j]] })
+	for _, reason := range reasons {
+		printLine("  %dx %s", s.errors[reason], red(reason))
+	}
+	if soak {
+		s.printSoak()
+	}
+}
+
+// formatPercentiles formats the median, 95th and 99th percentiles and the
+// maximum of samples.
+func formatPercentiles(samples []time.Duration) string {
+	if len(samples) == 0 {
+		return "no samples"
+	}
+	sorted := append([]time.Duration{}, samples...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	percentile := func(p float64) time.Duration {
+		return sorted[int(math.Ceil(p/100*float64(len(sorted))))-1].Round(time.Microsecond)
+	}
+	return fmt.Sprintf("p50 %v, p95 %v, p99 %v, max %v", percentile(50), percentile(95), percentile(99), percentile(100))
+}
@@ -0,0 +1,25 @@
+package main
+
+import "github.com/fxamacker/cbor/v2"
+
+// cborEncMode encodes deterministically, with sorted map keys and the
+// smallest encoding of each value.
+var cborEncMode, _ = cbor.CoreDetEncOptions().EncMode()
+
+func decodeCBOR(data []byte) ([]byte, error) {
+	var v interface{}
+	if err := cbor.Unmarshal(data, &v); err != nil {
+		return nil, err
+	}
+	return marshalJSON(toJSON(v))
+}
+
+// diagnoseCBOR renders data in CBOR diagnostic notation (RFC 8949 section 8).
+func diagnoseCBOR(data []byte) ([]byte, error) {
+	diag, err := cbor.Diagnose(data)
+	return []byte(diag), err
+}
+
+func encodeCBOR(v interface{}) ([]byte, error) {
+	return cborEncMode.Marshal(v)
+}
@@ -0,0 +1,664 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/bufbuild/protocompile"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// centrifugoProtobufSubprotocol selects the protobuf client protocol of
+// Centrifugo; the JSON one is the default.
+const centrifugoProtobufSubprotocol = "centrifuge-protobuf"
+
+// centrifugoProto is the part of the client protocol schema of Centrifuge,
+// the library of Centrifugo, that wsd speaks. The JSON protocol has the
+// same fields, with the bytes fields holding JSON.
+const centrifugoProto = `
+syntax = "proto3";
+
+package centrifugal.centrifuge.protocol;
+
+message Error {
+  uint32 code = 1;
+  string message = 2;
+  bool temporary = 3;
+}
+
+message Command {
+  uint32 id = 1;
+  ConnectRequest connect = 4;
+  SubscribeRequest subscribe = 5;
+  UnsubscribeRequest unsubscribe = 6;
+  PublishRequest publish = 7;
+  RPCRequest rpc = 13;
+  RefreshRequest refresh = 14;
+}
+
+message Reply {
+  uint32 id = 1;
+  Error error = 2;
+  Push push = 4;
+  ConnectResult connect = 5;
+  SubscribeResult subscribe = 6;
+  UnsubscribeResult unsubscribe = 7;
+  PublishResult publish = 8;
+  RPCResult rpc = 13;
+  RefreshResult refresh = 14;
+}
+
+message Push {
+  string channel = 2;
+  Publication pub = 4;
+  Join join = 5;
+  Leave leave = 6;
+  Unsubscribe unsubscribe = 7;
+  Message message = 8;
+  Subscribe subscribe = 9;
+  Connect connect = 10;
+  Disconnect disconnect = 11;
+  Refresh refresh = 12;
+}
+
+message ClientInfo {
+  string user = 1;
+  string client = 2;
+  bytes conn_info = 3;
+  bytes chan_info = 4;
+}
+
+message Publication {
+  bytes data = 4;
+  ClientInfo info = 5;
+  uint64 offset = 6;
+  map<string, string> tags = 7;
+}
+
+message Join {
+  ClientInfo info = 1;
+}
+
+message Leave {
+  ClientInfo info = 1;
+}
+
+message Unsubscribe {
+  uint32 code = 2;
+  string reason = 3;
+}
+
+message Subscribe {
+  bool recoverable = 1;
+  string epoch = 4;
+  uint64 offset = 5;
+  bool positioned = 6;
+  bytes data = 7;
+}
+
+message Message {
+  bytes data = 1;
+}
+
+message Connect {
+  string client = 1;
+  string version = 2;
+  bytes data = 3;
+  map<string, SubscribeResult> subs = 4;
+  bool expires = 5;
+  uint32 ttl = 6;
+  uint32 ping = 7;
+  bool pong = 8;
+}
+
+message Disconnect {
+  uint32 code = 1;
+  string reason = 2;
+}
+
+message Refresh {
+  bool expires = 1;
+  uint32 ttl = 2;
+}
+
+message ConnectRequest {
+  string token = 1;
+  bytes data = 2;
+  string name = 4;
+  string version = 5;
+}
+
+message ConnectResult {
+  string client = 1;
+  string version = 2;
+  bool expires = 3;
+  uint32 ttl = 4;
+  bytes data = 5;
+  map<string, SubscribeResult> subs = 6;
+  uint32 ping = 7;
+  bool pong = 8;
+}
+
+message RefreshRequest {
+  string token = 1;
+}
+
+message RefreshResult {
+  string client = 1;
+  string version = 2;
+  bool expires = 3;
+  uint32 ttl = 4;
+}
+
+message SubscribeRequest {
+  string channel = 1;
+  string token = 2;
+}
+
+message SubscribeResult {
+  bool expires = 1;
+  uint32 ttl = 2;
+  bool recoverable = 3;
+  string epoch = 6;
+  repeated Publication publications = 7;
+  bool recovered = 8;
+  uint64 offset = 9;
+}
+
+message UnsubscribeRequest {
+  string channel = 1;
+}
+
+message UnsubscribeResult {}
+
+message PublishRequest {
+  string channel = 1;
+  bytes data = 2;
+}
+
+message PublishResult {}
+
+message RPCRequest {
+  bytes data = 1;
+  string method = 2;
+}
+
+message RPCResult {
+  bytes data = 1;
+}
+`
+
+// centrifugoCommand and centrifugoReply describe the messages of the
+// protobuf protocol, once compiled.
+var centrifugoCommand, centrifugoReply protoreflect.MessageDescriptor
+
+// checkCentrifugoFlags validates -centrifugo and its options, and compiles
+// the schema of the protobuf protocol if selected, offering its
+// subprotocol unless -protocol does.
+func checkCentrifugoFlags() error {
+	if !centrifugo {
+		if flagGiven("centrifugo-protocol") || centrifugoToken != "" || len(centrifugoSubscriptions) > 0 {
+			return errors.New("-centrifugo-protocol, -centrifugo-token and -centrifugo-subscribe require -centrifugo")
+		}
+		return nil
+	}
+	switch {
+	case command != "":
+		return fmt.Errorf("-centrifugo is not supported by %s", command)
+	case centrifugoProtocol != "json" && centrifugoProtocol != "protobuf":
+		return fmt.Errorf("unknown -centrifugo-protocol %q, expected json or protobuf", centrifugoProtocol)
+	}
+	if centrifugoProtocol == "protobuf" {
+		compiler := protocompile.Compiler{
+			Resolver: &protocompile.SourceResolver{
+				Accessor: protocompile.SourceAccessorFromMap(map[string]string{"client.proto": centrifugoProto}),
+			},
+		}
+		files, err := compiler.Compile(context.Background(), "client.proto")
+		if err != nil {
+			return err
+		}
+		messages := files[0].Messages()
+		centrifugoCommand, centrifugoReply = messages.ByName("Command"), messages.ByName("Reply")
+		if protocol == "" {
+			protocol = centrifugoProtobufSubprotocol
+		}
+	}
+	return selectAppProtocol("-centrifugo", func() appSession {
+		return &centrifugoSession{pending: map[int]centrifugoCall{}}
+	})
+}
+
+// centrifugoCall is a command sent awaiting its reply.
+type centrifugoCall struct {
+	method string // the command, or the method of an RPC
+	target string // the channel of the command, if any
+	sentAt time.Time
+}
+
+// centrifugoPush is a push of the server, asynchronous to the commands.
+type centrifugoPush struct {
+	Channel string `json:"channel"`
+	Pub     *struct {
+		Data json.RawMessage `json:"data"`
+	} `json:"pub"`
+	Join        *centrifugoPresence `json:"join"`
+	Leave       *centrifugoPresence `json:"leave"`
+	Unsubscribe *struct {
+		Code   int    `json:"code"`
+		Reason string `json:"reason"`
+	} `json:"unsubscribe"`
+	Message *struct {
+		Data json.RawMessage `json:"data"`
+	} `json:"message"`
+	Subscribe  json.RawMessage `json:"subscribe"`
+	Disconnect *struct {
+		Code   int    `json:"code"`
+		Reason string `json:"reason"`
+	} `json:"disconnect"`
+	Refresh *struct {
+		Expires bool `json:"expires"`
+		TTL     int  `json:"ttl"`
+	} `json:"refresh"`
+}
+
+type centrifugoPresence struct {
+	Info struct {
+		User   string `json:"user"`
+		Client string `json:"client"`
+	} `json:"info"`
+}
+
+// centrifugoMessage is a reply of the server: to a command, with its ID,
+// or a push.
+type centrifugoMessage struct {
+	ID    int `json:"id"`
+	Error *struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+	Push    *centrifugoPush `json:"push"`
+	Connect *struct {
+		Client  string                     `json:"client"`
+		Version string                     `json:"version"`
+		Expires bool                       `json:"expires"`
+		TTL     int                        `json:"ttl"`
+		Ping    int                        `json:"ping"`
+		Pong    bool                       `json:"pong"`
+		Subs    map[string]json.RawMessage `json:"subs"`
+	} `json:"connect"`
+	Subscribe *struct {
+		Publications []struct {
+			Data json.RawMessage `json:"data"`
+		} `json:"publications"`
+	} `json:"subscribe"`
+	RPC *struct {
+		Data json.RawMessage `json:"data"`
+	} `json:"rpc"`
+	Refresh *struct {
+		Expires bool `json:"expires"`
+		TTL     int  `json:"ttl"`
+	} `json:"refresh"`
+}
+
+// centrifugoSession speaks the client protocol of Centrifugo, JSON or
+// protobuf after -centrifugo-protocol, connecting with the token of
+// -centrifugo-token and subscribing to the channels of
+// -centrifugo-subscribe. Publications are shown as their channel and data,
+// and the results of RPCs with their method. The server's pings are
+// answered and hidden. Input lines are commands:
+//
+//	subscribe <channel> [token]
+//	unsubscribe <channel>
+//	publish <channel> <data>
+//	rpc <method> [data]
+//	refresh <token>
+//
+// Data that is not JSON is sent as a string with the JSON protocol, and as
+// is with protobuf.
+type centrifugoSession struct {
+	mu        sync.Mutex
+	connected bool
+	queued    []message // the commands sent before the server connected the client
+	lastID    int
+	pending   map[int]centrifugoCall
+	buf       []byte // the start of a protobuf reply split across messages
+}
+
+func (s *centrifugoSession) open(ctx context.Context, send func(message)) {
+	connect := map[string]interface{}{"name": "wsd"}
+	if centrifugoToken != "" {
+		connect["token"] = centrifugoToken
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	send(s.command("connect", "", "connect", connect))
+	for _, channel := range centrifugoSubscriptions {
+		s.queued = append(s.queued, s.command("subscribe", channel, "subscribe", map[string]interface{}{"channel": channel}))
+	}
+}
+
+// command returns a command of method with the next ID, and records it
+// pending. name is the command's field, which holds request.
+func (s *centrifugoSession) command(method, target, name string, request map[string]interface{}) message {
+	s.lastID++
+	s.pending[s.lastID] = centrifugoCall{method: method, target: target, sentAt: time.Now()}
+	return centrifugoEncode(map[string]interface{}{"id": s.lastID, name: request})
+}
+
+// centrifugoData returns s as the data of a command: itself if it is JSON
+// or the protocol protobuf, or else as a JSON string.
+func centrifugoData(s string) json.RawMessage {
+	if json.Valid([]byte(s)) || centrifugoCommand != nil {
+		return json.RawMessage(s)
+	}
+	data, _ := json.Marshal(s)
+	return data
+}
+
+func (s *centrifugoSession) input(line string) ([]message, error) {
+	command, args, _ := strings.Cut(strings.TrimSpace(line), " ")
+	command = strings.ToLower(command)
+	target, rest, _ := strings.Cut(strings.TrimSpace(args), " ")
+	rest = strings.TrimSpace(rest)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var msg message
+	switch command {
+	case "subscribe":
+		if target == "" {
+			return nil, errors.New("usage: subscribe <channel> [token]")
+		}
+		request := map[string]interface{}{"channel": target}
+		if rest != "" {
+			request["token"] = rest
+		}
+		msg = s.command(command, target, command, request)
+	case "unsubscribe":
+		if target == "" {
+			return nil, errors.New("usage: unsubscribe <channel>")
+		}
+		msg = s.command(command, target, command, map[string]interface{}{"channel": target})
+	case "publish":
+		if target == "" || rest == "" {
+			return nil, errors.New("usage: publish <channel> <data>")
+		}
+		msg = s.command(command, target, command, map[string]interface{}{"channel": target, "data": centrifugoData(rest)})
+	case "rpc":
+		if target == "" {
+			return nil, errors.New("usage: rpc <method> [data]")
+		}
+		if rest == "" {
+			rest = "{}"
+		}
+		msg = s.command(target, "", command, map[string]interface{}{"method": target, "data": centrifugoData(rest)})
+	case "refresh":
+		if target == "" {
+			return nil, errors.New("usage: refresh <token>")
+		}
+		msg = s.command(command, "", command, map[string]interface{}{"token": target})
+	default:
+		return nil, errors.New("unknown Centrifugo command, expected subscribe, unsubscribe, publish, rpc or refresh")
+	}
+	if !s.connected {
+		s.queued = append(s.queued, msg)
+		return nil, nil
+	}
+	return []message{msg}, nil
+}
+
+// centrifugoEncode encodes a command in the protocol of
+// -centrifugo-protocol: as a JSON object, or as a protobuf Command preceded
+// by its length.
+func centrifugoEncode(command map[string]interface{}) message {
+	if centrifugoCommand == nil {
+		return jsonMessage(command)
+	}
+	m := dynamicpb.NewMessage(centrifugoCommand)
+	setProtoFields(m, command)
+	data, _ := proto.Marshal(m)
+	return message{messageType: BinaryMessage, data: append(binary.AppendUvarint(nil, uint64(len(data))), data...)}
+}
+
+// setProtoFields sets the fields of m to the values of fields, by name:
+// messages as maps, and bytes as JSON.
+func setProtoFields(m protoreflect.Message, fields map[string]interface{}) {
+	for name, v := range fields {
+		fd := m.Descriptor().Fields().ByName(protoreflect.Name(name))
+		if fd == nil {
+			continue
+		}
+		switch v := v.(type) {
+		case map[string]interface{}:
+			setProtoFields(m.Mutable(fd).Message(), v)
+		case json.RawMessage:
+			m.Set(fd, protoreflect.ValueOfBytes(v))
+		case string:
+			m.Set(fd, protoreflect.ValueOfString(v))
+		case int:
+			m.Set(fd, protoreflect.ValueOfUint32(uint32(v)))
+		}
+	}
+}
+
+// protoJSON returns the fields of m set, by name, as JSON values: bytes as
+// the JSON they hold, or else as a string, hex-encoded if not valid UTF-8.
+func protoJSON(m protoreflect.Message) map[string]interface{} {
+	fields := map[string]interface{}{}
+	m.Range(func(fd protoreflect.FieldDescriptor, v protoreflect.Value) bool {
+		switch {
+		case fd.IsMap():
+			entries := map[string]interface{}{}
+			v.Map().Range(func(k protoreflect.MapKey, v protoreflect.Value) bool {
+				entries[k.String()] = protoValue(fd.MapValue(), v)
+				return true
+			})
+			fields[string(fd.Name())] = entries
+		case fd.IsList():
+			var items []interface{}
+			for i := 0; i < v.List().Len(); i++ {
+				items = append(items, protoValue(fd, v.List().Get(i)))
+			}
+			fields[string(fd.Name())] = items
+		default:
+			fields[string(fd.Name())] = protoValue(fd, v)
+		}
+		return true
+	})
+	return fields
+}
+
+func protoValue(fd protoreflect.FieldDescriptor, v protoreflect.Value) interface{} {
+	switch fd.Kind() {
+	case protoreflect.MessageKind:
+		return protoJSON(v.Message())
+	case protoreflect.BytesKind:
+		b := v.Bytes()
+		switch {
+		case json.Valid(b):
+			return json.RawMessage(b)
+		case utf8.Valid(b):
+			return string(b)
+		}
+		return hex.EncodeToString(b)
+	}
+	return v.Interface()
+}
+
+func (s *centrifugoSession) receive(msg message, send func(message)) ([]message, error) {
+	replies, err := s.replies(msg)
+	if err != nil {
+		return nil, err
+	}
+	var shown []message
+	for _, r := range replies {
+		if r == nil {
+			// A ping, answered with a pong.
+			send(centrifugoEncode(map[string]interface{}{}))
+			continue
+		}
+		for _, text := range s.reply(r, msg, send) {
+			m := msg
+			m.messageType, m.data = TextMessage, []byte(text)
+			shown = append(shown, m)
+		}
+	}
+	return shown, nil
+}
+
+// replies decodes the replies in a message: JSON objects on lines of their
+// own, or protobuf Replies preceded by their length. Pings are nil.
+func (s *centrifugoSession) replies(msg message) ([]*centrifugoMessage, error) {
+	var replies []*centrifugoMessage
+	if centrifugoReply == nil {
+		for _, line := range bytes.Split(msg.data, []byte("\n")) {
+			if len(bytes.TrimSpace(line)) == 0 {
+				continue
+			}
+			if bytes.Equal(bytes.TrimSpace(line), []byte("{}")) {
+				replies = append(replies, nil)
+				continue
+			}
+			var r centrifugoMessage
+			if err := json.Unmarshal(line, &r); err != nil {
+				return replies, fmt.Errorf("invalid Centrifugo reply %q: %v", truncate(string(line), 60), err)
+			}
+			replies = append(replies, &r)
+		}
+		return replies, nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b := append(s.buf, msg.data...)
+	for len(b) > 0 {
+		n, size := binary.Uvarint(b)
+		if size <= 0 || uint64(len(b)-size) < n {
+			break
+		}
+		m := dynamicpb.NewMessage(centrifugoReply)
+		if err := proto.Unmarshal(b[size:size+int(n)], m); err != nil {
+			s.buf = nil
+			return replies, fmt.Errorf("invalid Centrifugo reply: %v", err)
+		}
+		b = b[size+int(n):]
+		if n == 0 {
+			replies = append(replies, nil)
+			continue
+		}
+		data, _ := json.Marshal(protoJSON(m))
+		var r centrifugoMessage
+		json.Unmarshal(data, &r)
+		replies = append(replies, &r)
+	}
+	s.buf = b
+	return replies, nil
+}
+
+// reply handles a reply received in msg, returning the texts to show for
+// it.
+func (s *centrifugoSession) reply(r *centrifugoMessage, msg message, send func(message)) []string {
+	if r.ID == 0 {
+		if r.Push != nil {
+			return s.push(r.Push)
+		}
+		return nil
+	}
+	s.mu.Lock()
+	call, ok := s.pending[r.ID]
+	delete(s.pending, r.ID)
+	s.mu.Unlock()
+	name := call.method
+	if call.target != "" {
+		name += " " + call.target
+	}
+	latency := msg.time.Sub(call.sentAt).Round(time.Microsecond)
+	switch {
+	case !ok:
+		printLine("reply %d to no pending command", r.ID)
+	case r.Error != nil:
+		printError(fmt.Errorf("%s (%v) failed: %d %s", name, latency, r.Error.Code, r.Error.Message))
+	case r.Connect != nil:
+		c := r.Connect
+		s.mu.Lock()
+		s.connected = true
+		queued := s.queued
+		s.queued = nil
+		s.mu.Unlock()
+		line := fmt.Sprintf("connected as client %s to Centrifugo %s", c.Client, c.Version)
+		if c.Ping > 0 {
+			line += fmt.Sprintf(", pinged every %v", time.Duration(c.Ping)*time.Second)
+		}
+		printLine("%s", line)
+		if c.Expires {
+			printLine("the connection expires in %v: refresh it with a new token", time.Duration(c.TTL)*time.Second)
+		}
+		for channel := range c.Subs {
+			printLine("subscribed to %s by the server", channel)
+		}
+		for _, q := range queued {
+			send(q)
+		}
+	case r.Subscribe != nil:
+		printLine("subscribed to %s (%v)", call.target, latency)
+		// The publications recovered.
+		var pubs []string
+		for _, p := range r.Subscribe.Publications {
+			pubs = append(pubs, call.target+formatArgs([]json.RawMessage{orEmptyJSON(p.Data)}))
+		}
+		return pubs
+	case r.RPC != nil:
+		return []string{fmt.Sprintf("%s %d (%v)%s", call.method, r.ID, latency, formatArgs([]json.RawMessage{orEmptyJSON(r.RPC.Data)}))}
+	case r.Refresh != nil:
+		if r.Refresh.Expires {
+			printLine("connection refreshed, expiring in %v", time.Duration(r.Refresh.TTL)*time.Second)
+		} else {
+			printLine("connection refreshed")
+		}
+	default:
+		printLine("%s (%v)", name, latency)
+	}
+	return nil
+}
+
+// push handles a push, returning the texts to show for it.
+func (s *centrifugoSession) push(p *centrifugoPush) []string {
+	switch {
+	case p.Pub != nil:
+		return []string{p.Channel + formatArgs([]json.RawMessage{orEmptyJSON(p.Pub.Data)})}
+	case p.Message != nil:
+		return []string{"message" + formatArgs([]json.RawMessage{orEmptyJSON(p.Message.Data)})}
+	case p.Join != nil:
+		printLine("%s: %s joined (client %s)", p.Channel, p.Join.Info.User, p.Join.Info.Client)
+	case p.Leave != nil:
+		printLine("%s: %s left (client %s)", p.Channel, p.Leave.Info.User, p.Leave.Info.Client)
+	case p.Subscribe != nil:
+		printLine("subscribed to %s by the server", p.Channel)
+	case p.Unsubscribe != nil:
+		printLine("unsubscribed from %s by the server: %d %s", p.Channel, p.Unsubscribe.Code, p.Unsubscribe.Reason)
+	case p.Disconnect != nil:
+		printLine("disconnected by the server: %d %s", p.Disconnect.Code, p.Disconnect.Reason)
+	case p.Refresh != nil:
+		printLine("the connection expires in %v: refresh it with a new token", time.Duration(p.Refresh.TTL)*time.Second)
+	}
+	return nil
+}
+
+// orEmptyJSON returns data, or an empty JSON string if it is empty.
+func orEmptyJSON(data json.RawMessage) json.RawMessage {
+	if len(data) == 0 {
+		return json.RawMessage(`""`)
+	}
+	return data
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// checkShowCerts validates -show-certs and -show-certs-format.
+func checkShowCerts() error {
+	switch showCerts {
+	case "", "summary", "full":
+	default:
+		return fmt.Errorf("unknown -show-certs level %q, expected summary or full", showCerts)
+	}
+	switch showCertsFormat {
+	case "text", "json":
+		return nil
+	}
+	return fmt.Errorf("unknown -show-certs-format %q, expected text or json", showCertsFormat)
+}
+
+// certInfo describes a certificate, as shown by -show-certs. The fields
+// after Fingerprint are only set at the full level.
+type certInfo struct {
+	Position    string    `json:"position"`
+	Subject     string    `json:"subject"`
+	Issuer      string    `json:"issuer"`
+	NotBefore   time.Time `json:"not_before"`
+	NotAfter    time.Time `json:"not_after"`
+	Names       []string  `json:"names,omitempty"`
+	PublicKey   string    `json:"public_key"`
+	Fingerprint string    `json:"sha256"`
+
+	Version               int             `json:"version,omitempty"`
+	Serial                string          `json:"serial,omitempty"`
+	SignatureAlgorithm    string          `json:"signature_algorithm,omitempty"`
+	KeyUsage              []string        `json:"key_usage,omitempty"`
+	ExtKeyUsage           []string        `json:"ext_key_usage,omitempty"`
+	IsCA                  *bool           `json:"is_ca,omitempty"`
+	MaxPathLen            *int            `json:"max_path_len,omitempty"`
+	SubjectKeyID          string          `json:"subject_key_id,omitempty"`
+	AuthorityKeyID        string          `json:"authority_key_id,omitempty"`
+	OCSPServers           []string        `json:"ocsp_servers,omitempty"`
+	IssuingCertificateURL []string        `json:"issuing_certificate_urls,omitempty"`
+	CRLDistributionPoints []string        `json:"crl_distribution_points,omitempty"`
+	Policies              []string        `json:"policies,omitempty"`
+	Extensions            []certExtension `json:"extensions,omitempty"`
+	Signature             string          `json:"signature,omitempty"`
+}
+
+type certExtension struct {
+	OID      string `json:"oid"`
+	Name     string `json:"name,omitempty"`
+	Critical bool   `json:"critical,omitempty"`
+}
+
+// printCerts prints the certificates the server presented, at the
+// -show-certs level.
+func printCerts(cs tls.ConnectionState) {
+	full := showCerts == "full"
+	for i, cert := range cs.PeerCertificates {
+		info := describeCert(cert, i, len(cs.PeerCertificates), full)
+		switch {
+		case jsonOutput:
+			emit(event{Event: "certificate", Certificate: cert.Subject.String(), Cert: &info})
+		case showCertsFormat == "json":
+			b, _ := json.Marshal(info)
+			printLine("%s", b)
+		default:
+			printCertInfo(i, &info, full)
+		}
+	}
+}
+
+func describeCert(cert *x509.Certificate, i, n int, full bool) certInfo {
+	info := certInfo{
+		Position:    "intermediate",
+		Subject:     cert.Subject.String(),
+		Issuer:      cert.Issuer.String(),
+		NotBefore:   cert.NotBefore,
+		NotAfter:    cert.NotAfter,
+		PublicKey:   describePublicKey(cert.PublicKey),
+		Fingerprint: fingerprint(cert.Raw),
+	}
+	switch {
+	case i == 0:
+		info.Position = "leaf"
+	case i == n-1 && isSelfSigned(cert):
+		info.Position = "root"
+	}
+	info.Names = append(info.Names, cert.DNSNames...)
+	for _, ip := range cert.IPAddresses {
+		info.Names = append(info.Names, ip.String())
+	}
+	info.Names = append(info.Names, cert.EmailAddresses...)
+	for _, uri := range cert.URIs {
+		info.Names = append(info.Names, uri.String())
+	}
+	if !full {
+		return info
+	}
+
+	info.Version = cert.Version
+	info.Serial = strings.ToUpper(cert.SerialNumber.Text(16))
+	info.SignatureAlgorithm = cert.SignatureAlgorithm.String()
+	for bit, name := range keyUsages {
+		if cert.KeyUsage&(1<<bit) != 0 {
+			info.KeyUsage = append(info.KeyUsage, name)
+		}
+	}
+	for _, usage := range cert.ExtKeyUsage {
+		name, ok := extKeyUsages[usage]
+		if !ok {
+			name = fmt.Sprintf("%d", usage)
+		}
+		info.ExtKeyUsage = append(info.ExtKeyUsage, name)
+	}
+	for _, oid := range cert.UnknownExtKeyUsage {
+		info.ExtKeyUsage = append(info.ExtKeyUsage, oid.String())
+	}
+	if cert.BasicConstraintsValid {
+		info.IsCA = &cert.IsCA
+		if cert.IsCA && (cert.MaxPathLen > 0 || cert.MaxPathLenZero) {
+			info.MaxPathLen = &cert.MaxPathLen
+		}
+	}
+	info.SubjectKeyID = hex.EncodeToString(cert.SubjectKeyId)
+	info.AuthorityKeyID = hex.EncodeToString(cert.AuthorityKeyId)
+	info.OCSPServers = cert.OCSPServer
+	info.IssuingCertificateURL = cert.IssuingCertificateURL
+	info.CRLDistributionPoints = cert.CRLDistributionPoints
+	for _, policy := range cert.Policies {
+		info.Policies = append(info.Policies, policy.String())
+	}
+	for _, ext := range cert.Extensions {
+		info.Extensions = append(info.Extensions, certExtension{
+			OID:      ext.Id.String(),
+			Name:     extensionNames[ext.Id.String()],
+			Critical: ext.Critical,
+		})
+	}
+	info.Signature = hex.EncodeToString(cert.Signature)
+	return info
+}
+
+func printCertInfo(i int, info *certInfo, full bool) {
+	printLine("certificate %d (%s): %s", i, info.Position, yellow(info.Subject))
+	printLine("  issuer: %s", info.Issuer)
+	validity := green("valid")
+	now := time.Now()
+	switch {
+	case now.Before(info.NotBefore):
+		validity = red("not yet valid")
+	case now.After(info.NotAfter):
+		validity = red("expired")
+	}
+	printLine("  validity: %s to %s, %s", info.NotBefore.UTC().Format(time.RFC3339), info.NotAfter.UTC().Format(time.RFC3339), validity)
+	if len(info.Names) > 0 {
+		printLine("  names: %s", strings.Join(info.Names, ", "))
+	}
+	printLine("  public key: %s", info.PublicKey)
+	printLine("  sha256: %s", info.Fingerprint)
+	if !full {
+		return
+	}
+
+	printLine("  version: %d", info.Version)
+	printLine("  serial: %s", info.Serial)
+	printLine("  signature algorithm: %s", info.SignatureAlgorithm)
+	printList("key usage", info.KeyUsage)
+	printList("extended key usage", info.ExtKeyUsage)
+	if info.IsCA != nil {
+		if info.MaxPathLen != nil {
+			printLine("  ca: %t, max path length %d", *info.IsCA, *info.MaxPathLen)
+		} else {
+			printLine("  ca: %t", *info.IsCA)
+		}
+	}
+	if info.SubjectKeyID != "" {
+		printLine("  subject key id: %s", info.SubjectKeyID)
+	}
+	if info.AuthorityKeyID != "" {
+		printLine("  authority key id: %s", info.AuthorityKeyID)
+	}
+	printList("ocsp", info.OCSPServers)
+	printList("ca issuers", info.IssuingCertificateURL)
+	printList("crl", info.CRLDistributionPoints)
+	printList("policies", info.Policies)
+	printLine("  extensions:")
+	for _, ext := range info.Extensions {
+		line := "    " + ext.OID
+		if ext.Name != "" {
+			line += " (" + ext.Name + ")"
+		}
+		if ext.Critical {
+			line += ", " + magenta("critical")
+		}
+		printLine("%s", line)
+	}
+	printLine("  signature: %s", info.Signature)
+}
+
+func printList(name string, values []string) {
+	if len(values) > 0 {
+		printLine("  %s: %s", name, strings.Join(values, ", "))
+	}
+}
+
+// fingerprint returns the SHA-256 hash of a DER certificate in the
+// colon-separated form used by openssl.
+func fingerprint(der []byte) string {
+	sum := sha256.Sum256(der)
+	parts := make([]string, len(sum))
+	for i, b := range sum {
+		parts[i] = fmt.Sprintf("%02X", b)
+	}
+	return strings.Join(parts, ":")
+}
+
+func describePublicKey(key interface{}) string {
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		return fmt.Sprintf("RSA %d bits", key.N.BitLen())
+	case *ecdsa.PublicKey:
+		return "ECDSA " + key.Curve.Params().Name
+	case ed25519.PublicKey:
+		return "Ed25519"
+	}
+	return fmt.Sprintf("%T", key)
+}
+
+// keyUsages are the names of the x509.KeyUsage bits, by bit.
+var keyUsages = []string{
+	"digital signature",
+	"content commitment",
+	"key encipherment",
+	"data encipherment",
+	"key agreement",
+	"certificate sign",
+	"CRL sign",
+	"encipher only",
+	"decipher only",
+}
+
+var extKeyUsages = map[x509.ExtKeyUsage]string{
+	x509.ExtKeyUsageAny:                            "any",
+	x509.ExtKeyUsageServerAuth:                     "server auth",
+	x509.ExtKeyUsageClientAuth:                     "client auth",
+	x509.ExtKeyUsageCodeSigning:                    "code signing",
+	x509.ExtKeyUsageEmailProtection:                "email protection",
+	x509.ExtKeyUsageIPSECEndSystem:                 "IPsec end system",
+	x509.ExtKeyUsageIPSECTunnel:                    "IPsec tunnel",
+	x509.ExtKeyUsageIPSECUser:                      "IPsec user",
+	x509.ExtKeyUsageTimeStamping:                   "time stamping",
+	x509.ExtKeyUsageOCSPSigning:                    "OCSP signing",
+	x509.ExtKeyUsageMicrosoftServerGatedCrypto:     "Microsoft server gated crypto",
+	x509.ExtKeyUsageNetscapeServerGatedCrypto:      "Netscape server gated crypto",
+	x509.ExtKeyUsageMicrosoftCommercialCodeSigning: "Microsoft commercial code signing",
+	x509.ExtKeyUsageMicrosoftKernelCodeSigning:     "Microsoft kernel code signing",
+}
+
+var extensionNames = map[string]string{
+	"2.5.29.14":               "subject key identifier",
+	"2.5.29.15":               "key usage",
+	"2.5.29.17":               "subject alternative name",
+	"2.5.29.18":               "issuer alternative name",
+	"2.5.29.19":               "basic constraints",
+	"2.5.29.30":               "name constraints",
+	"2.5.29.31":               "CRL distribution points",
+	"2.5.29.32":               "certificate policies",
+	"2.5.29.35":               "authority key identifier",
+	"2.5.29.37":               "extended key usage",
+	"1.3.6.1.5.5.7.1.1":       "authority information access",
+	"1.3.6.1.5.5.7.1.24":      "TLS feature",
+	"1.3.6.1.4.1.11129.2.4.2": "signed certificate timestamps",
+	"1.3.6.1.4.1.11129.2.4.3": "precertificate poison",
+}
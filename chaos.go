@@ -0,0 +1,117 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// chaos is set by -chaos, or nil if it is not given.
+var chaos *chaosMonkey
+
+// chaosMonkey disrupts the frames written to connections at random, each
+// disruption with its own probability per frame: delay holds the frame for
+// up to -chaos-delay, drop closes the TCP connection instead of writing it,
+// garbage writes random bytes before it, and stall writes half of it and
+// the rest after -chaos-stall.
+type chaosMonkey struct {
+	delay, drop, garbage, stall float64
+
+	mu   sync.Mutex
+	rand *rand.Rand
+}
+
+// errChaosDrop is returned for a write when -chaos drops the connection.
+var errChaosDrop = errors.New("connection dropped by -chaos")
+
+// checkChaosFlags parses -chaos, a comma-separated list of disruptions with
+// their probabilities, e.g. delay=0.2,drop=0.01.
+func checkChaosFlags() error {
+	if chaosSpec == "" {
+		return nil
+	}
+	if command == "serve" || command == "mock" {
+		return fmt.Errorf("-chaos is not supported by %s", command)
+	}
+	m := &chaosMonkey{}
+	for _, item := range strings.Split(chaosSpec, ",") {
+		name, value, ok := strings.Cut(strings.TrimSpace(item), "=")
+		p, err := strconv.ParseFloat(value, 64)
+		if !ok || err != nil || p < 0 || p > 1 {
+			return fmt.Errorf("invalid -chaos %q, expected a disruption and a probability from 0 to 1, e.g. drop=0.01", item)
+		}
+		switch name {
+		case "delay":
+			m.delay = p
+		case "drop":
+			m.drop = p
+		case "garbage":
+			m.garbage = p
+		case "stall":
+			m.stall = p
+		default:
+			return fmt.Errorf("unknown -chaos disruption %q, expected delay, drop, garbage or stall", name)
+		}
+	}
+	if chaosDelay <= 0 || chaosStall <= 0 {
+		return errors.New("-chaos-delay and -chaos-stall must be positive")
+	}
+	seed := chaosSeed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	m.rand = rand.New(rand.NewSource(seed))
+	chaos = m
+	return nil
+}
+
+// hit reports whether a disruption of probability p happens.
+func (m *chaosMonkey) hit(p float64) bool {
+	if p == 0 {
+		return false
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.rand.Float64() < p
+}
+
+// write writes the encoded frame b to conn, disrupted at random.
+func (m *chaosMonkey) write(conn net.Conn, b []byte) error {
+	if m.hit(m.drop) {
+		printLine("chaos: dropping the connection")
+		conn.Close()
+		return errChaosDrop
+	}
+	if m.hit(m.delay) {
+		m.mu.Lock()
+		d := time.Duration(m.rand.Int63n(int64(chaosDelay)))
+		m.mu.Unlock()
+		printLine("chaos: delaying a frame by %v", d.Round(time.Millisecond))
+		time.Sleep(d)
+	}
+	if m.hit(m.garbage) {
+		m.mu.Lock()
+		garbage := make([]byte, 1+m.rand.Intn(16))
+		m.rand.Read(garbage)
+		m.mu.Unlock()
+		printLine("chaos: sending %d garbage bytes", len(garbage))
+		if _, err := conn.Write(garbage); err != nil {
+			return err
+		}
+	}
+	if len(b) > 1 && m.hit(m.stall) {
+		printLine("chaos: stalling mid-frame for %v", chaosStall)
+		if _, err := conn.Write(b[:len(b)/2]); err != nil {
+			return err
+		}
+		time.Sleep(chaosStall)
+		b = b[len(b)/2:]
+	}
+	_, err := conn.Write(b)
+	return err
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+	"unicode/utf8"
+)
+
+// errInterrupted is returned when wsd is interrupted while waiting for the
+// peer's close frame.
+var errInterrupted = errors.New("interrupted")
+
+// closeOnSignal starts the closing handshake when wsd receives SIGINT or
+// SIGTERM. The peer's close frame is received by the read loop, which ends
+// the connection. If it does not arrive within timeout, or a second signal is
+// received, an error is returned.
+func closeOnSignal(ctx context.Context, ws Conn, code int, reason string, timeout time.Duration) error {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
+	select {
+	case <-signals:
+	case <-ctx.Done():
+		return nil
+	}
+
+	printLine("closing connection with %s %s...", yellow(code), yellow(reason))
+	deadline := time.Now().Add(timeout)
+	if err := ws.WriteControl(CloseMessage, FormatCloseMessage(code, reason), deadline); err != nil {
+		return err
+	}
+
+	select {
+	case <-ctx.Done():
+		return nil
+	case <-signals:
+		return errInterrupted
+	case <-time.After(timeout):
+		return &timeoutError{fmt.Sprintf("no close frame received within %v", timeout)}
+	}
+}
+
+// maxCloseReason is the longest close reason that fits in a control frame,
+// after the code.
+const maxCloseReason = 123
+
+// checkCloseFrame checks that a close frame of code and reason may be sent:
+// that the code is one of 1000-1003, 1007-1014 and 3000-4999, and that the
+// reason is UTF-8 of at most 123 bytes.
+func checkCloseFrame(code int, reason string) error {
+	switch {
+	case code >= 1000 && code <= 1003, code >= 1007 && code <= 1014, code >= 3000 && code <= 4999:
+	default:
+		return fmt.Errorf("close code %d cannot be sent, expected 1000-1003, 1007-1014 or 3000-4999", code)
+	}
+	if len(reason) > maxCloseReason {
+		return fmt.Errorf("close reason is %d bytes long, at most %d fit in a close frame", len(reason), maxCloseReason)
+	}
+	if !utf8.ValidString(reason) {
+		return errors.New("close reason is not valid UTF-8")
+	}
+	return nil
+}
+
+// checkCloseFlags validates -close-code and -close-reason.
+func checkCloseFlags() error {
+	if err := checkCloseFrame(closeCode, ""); err != nil {
+		return fmt.Errorf("-close-code: %v", err)
+	}
+	if err := checkCloseFrame(closeCode, closeReason); err != nil {
+		return fmt.Errorf("-close-reason: %v", err)
+	}
+	return nil
+}
+
+var closeCodeTexts = map[int]string{
+	1000: "normal closure",
+	1001: "going away",
+	1002: "protocol error",
+	1003: "unsupported data",
+	1005: "no status received",
+	1006: "abnormal closure",
+	1007: "invalid payload data",
+	1008: "policy violation",
+	1009: "message too big",
+	1010: "mandatory extension",
+	1011: "internal server error",
+	1012: "service restart",
+	1013: "try again later",
+	1014: "bad gateway",
+	1015: "TLS handshake",
+}
+
+// closeCodeText returns a description of a close status code.
+func closeCodeText(code int) string {
+	if text, ok := closeCodeTexts[code]; ok {
+		return text
+	}
+	switch {
+	case code >= 3000 && code <= 3999:
+		return "registered"
+	case code >= 4000 && code <= 4999:
+		return "private use"
+	}
+	return "unknown"
+}
+
+// formatClose describes a close frame, e.g. `1000 (normal closure) "bye"`.
+func formatClose(code int, reason string) string {
+	s := fmt.Sprintf("%d (%s)", code, closeCodeText(code))
+	if reason != "" {
+		s += fmt.Sprintf(" %q", reason)
+	}
+	return s
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// frameWriter is implemented by connections that can write hand-crafted
+// frames and raw bytes, bypassing the usual message framing.
+type frameWriter interface {
+	WriteFrame(f frame) error
+	WriteRaw(b []byte) error
+}
+
+const commandHelp = `commands:
+  /ping [payload]                 send a ping frame
+  /pong [payload]                 send an unsolicited pong frame
+  /close [code [reason]]          send a close frame
+  /fragment <size> <payload>      send payload as a text message in frames of size bytes
+  /frame <opcode> <flags> [data]  send a single frame; flags is "-" or a comma separated
+                                  list of fin, rsv1, rsv2, rsv3, nomask and len=<n>
+  /raw <hex>                      write raw bytes to the connection
+  /help                           show this help`
+
+// runCommand executes a slash command entered at the prompt.
+func runCommand(ws Conn, line string) error {
+	name, args, _ := strings.Cut(line, " ")
+	deadline := time.Now().Add(5 * time.Second)
+
+	switch name {
+	case "/ping":
+		return ws.WriteControl(PingMessage, []byte(args), deadline)
+	case "/pong":
+		return ws.WriteControl(PongMessage, []byte(args), deadline)
+	case "/close":
+		return runClose(ws, args, deadline)
+	case "/fragment":
+		return runFragment(ws, args)
+	case "/frame":
+		return runFrame(ws, args)
+	case "/raw":
+		fw, err := frameWriterOf(ws)
+		if err != nil {
+			return err
+		}
+		b, err := hex.DecodeString(strings.Join(strings.Fields(args), ""))
+		if err != nil {
+			return fmt.Errorf("invalid hex: %v", err)
+		}
+		return fw.WriteRaw(b)
+	case "/help":
+		fmt.Fprintln(statusOut(), commandHelp)
+		return nil
+	}
+	return fmt.Errorf("unknown command %s, see /help", name)
+}
+
+func frameWriterOf(ws Conn) (frameWriter, error) {
+	fw, ok := ws.(frameWriter)
+	if !ok {
+		return nil, fmt.Errorf("connection does not support raw frames")
+	}
+	return fw, nil
+}
+
+// runClose sends a close frame. Codes and reasons that are invalid on the
+// wire are refused; /frame sends those.
+func runClose(ws Conn, args string, deadline time.Time) error {
+	if args == "" {
+		return ws.WriteControl(CloseMessage, nil, deadline)
+	}
+	codeArg, reason, _ := strings.Cut(args, " ")
+	code, err := strconv.Atoi(codeArg)
+	if err != nil {
+		return fmt.Errorf("invalid close code %q", codeArg)
+	}
+	if err := checkCloseFrame(code, reason); err != nil {
+		return err
+	}
+	return ws.WriteControl(CloseMessage, FormatCloseMessage(code, reason), deadline)
+}
+
+func runFragment(ws Conn, args string) error {
+	fw, err := frameWriterOf(ws)
+	if err != nil {
+		return err
+	}
+	sizeArg, payload, _ := strings.Cut(args, " ")
+	size, err := strconv.Atoi(sizeArg)
+	if err != nil || size <= 0 {
+		return fmt.Errorf("usage: /fragment <size> <payload>")
+	}
+
+	opcode := TextMessage
+	data := []byte(payload)
+	for first := true; first || len(data) > 0; first = false {
+		n := min(size, len(data))
+		f := frame{fin: n == len(data), opcode: opcode, masked: true, payload: data[:n]}
+		if err := fw.WriteFrame(f); err != nil {
+			return err
+		}
+		opcode, data = continuationFrame, data[n:]
+	}
+	return nil
+}
+
+func runFrame(ws Conn, args string) error {
+	fw, err := frameWriterOf(ws)
+	if err != nil {
+		return err
+	}
+	fields := strings.SplitN(args, " ", 3)
+	if len(fields) < 2 {
+		return fmt.Errorf("usage: /frame <opcode> <flags> [data]")
+	}
+	opcode, err := strconv.ParseUint(fields[0], 0, 4)
+	if err != nil {
+		return fmt.Errorf("invalid opcode %q", fields[0])
+	}
+
+	f := frame{opcode: int(opcode), masked: true}
+	if len(fields) == 3 {
+		f.payload = []byte(fields[2])
+	}
+	if fields[1] != "-" {
+		for _, flag := range strings.Split(fields[1], ",") {
+			switch {
+			case flag == "fin":
+				f.fin = true
+			case flag == "rsv1":
+				f.rsv1 = true
+			case flag == "rsv2":
+				f.rsv2 = true
+			case flag == "rsv3":
+				f.rsv3 = true
+			case flag == "nomask":
+				f.masked = false
+			case strings.HasPrefix(flag, "len="):
+				if f.length, err = strconv.ParseUint(flag[len("len="):], 0, 64); err != nil {
+					return fmt.Errorf("invalid length %q", flag)
+				}
+			default:
+				return fmt.Errorf("unknown frame flag %q", flag)
+			}
+		}
+	}
+	return fw.WriteFrame(f)
+}
@@ -0,0 +1,572 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// checkConformanceFlags validates the flags of conformance.
+func checkConformanceFlags() error {
+	if command != "conformance" {
+		if cases != "" {
+			return errors.New("-cases requires conformance")
+		}
+		return nil
+	}
+	switch {
+	case len(urls) > 1:
+		return errors.New("conformance takes a single URL")
+	case caseTimeout <= 0:
+		return errors.New("-case-timeout must be positive")
+	case compression:
+		return errors.New("-compression is not supported by conformance, whose cases set the reserved bits")
+	case webTransport:
+		return errors.New("-webtransport is not supported by conformance")
+	case chaosSpec != "":
+		return errors.New("-chaos is not supported by conformance")
+	case recordFile != "" || harFileName != "" || pcapFile != "":
+		return errors.New("-record, -har and -pcap are not supported by conformance")
+	}
+	if len(selectCases(conformanceCases())) == 0 {
+		return fmt.Errorf("-cases %q matches no case", cases)
+	}
+	return nil
+}
+
+// caseOutcome is the outcome of a conformance case. Like Autobahn's, a
+// non-strict outcome is a server that behaves acceptably but not as the RFC
+// recommends, e.g. failing the connection without a close frame.
+type caseOutcome int
+
+const (
+	casePassed caseOutcome = iota
+	caseNonStrict
+	caseFailed
+)
+
+func (o caseOutcome) String() string {
+	return [...]string{"pass", "non-strict", "fail"}[o]
+}
+
+type caseResult struct {
+	outcome caseOutcome
+	detail  string
+}
+
+func passed() caseResult {
+	return caseResult{outcome: casePassed}
+}
+
+func nonStrict(format string, a ...interface{}) caseResult {
+	return caseResult{caseNonStrict, fmt.Sprintf(format, a...)}
+}
+
+func failed(format string, a ...interface{}) caseResult {
+	return caseResult{caseFailed, fmt.Sprintf(format, a...)}
+}
+
+// conformanceCase is a check of RFC 6455 against an echo server, run on a
+// connection of its own.
+type conformanceCase struct {
+	id, name string
+	run      func(c *caseConn) caseResult
+}
+
+// conformanceCases returns the cases of conformance, in sections like
+// those of the Autobahn test suite.
+func conformanceCases() []conformanceCase {
+	var cs []conformanceCase
+	add := func(id, name string, run func(c *caseConn) caseResult) {
+		cs = append(cs, conformanceCase{id, name, run})
+	}
+	sizes := []int{0, 125, 126, 65535, 65536}
+
+	// 1: Framing.
+	for i, n := range sizes {
+		payload := bytes.Repeat([]byte("*"), n)
+		add(fmt.Sprintf("1.1.%d", i+1), fmt.Sprintf("text message of %d bytes is echoed", n), func(c *caseConn) caseResult {
+			c.send(dataFrame(TextMessage, true, payload))
+			return c.expectEcho(TextMessage, payload)
+		})
+	}
+	for i, n := range sizes {
+		payload := bytes.Repeat([]byte{0xfe}, n)
+		add(fmt.Sprintf("1.2.%d", i+1), fmt.Sprintf("binary message of %d bytes is echoed", n), func(c *caseConn) caseResult {
+			c.send(dataFrame(BinaryMessage, true, payload))
+			return c.expectEcho(BinaryMessage, payload)
+		})
+	}
+	add("1.3.1", "unmasked frame fails the connection", func(c *caseConn) caseResult {
+		c.send(frame{fin: true, opcode: TextMessage, payload: []byte("unmasked")})
+		return c.expectFailure(1002)
+	})
+
+	// 2: Pings and pongs.
+	add("2.1", "ping without payload is answered", func(c *caseConn) caseResult {
+		c.send(dataFrame(PingMessage, true, nil))
+		return c.expectPong(nil)
+	})
+	add("2.2", "ping with 125-byte payload is answered", func(c *caseConn) caseResult {
+		payload := bytes.Repeat([]byte("*"), 125)
+		c.send(dataFrame(PingMessage, true, payload))
+		return c.expectPong(payload)
+	})
+	add("2.3", "ping with binary payload is answered", func(c *caseConn) caseResult {
+		payload := []byte{0x00, 0xff, 0xfe, 0xfd, 0xfc, 0xfb, 0x00, 0xff}
+		c.send(dataFrame(PingMessage, true, payload))
+		return c.expectPong(payload)
+	})
+	add("2.4", "ping with 126-byte payload fails the connection", func(c *caseConn) caseResult {
+		c.send(dataFrame(PingMessage, true, bytes.Repeat([]byte("*"), 126)))
+		return c.expectFailure(1002)
+	})
+	add("2.5", "fragmented ping fails the connection", func(c *caseConn) caseResult {
+		c.send(dataFrame(PingMessage, false, []byte("frag")), dataFrame(continuationFrame, true, []byte("ment")))
+		return c.expectFailure(1002)
+	})
+	add("2.6", "unsolicited pong is ignored", func(c *caseConn) caseResult {
+		c.send(dataFrame(PongMessage, true, []byte("unsolicited")), dataFrame(TextMessage, true, []byte("after pong")))
+		return c.expectEcho(TextMessage, []byte("after pong"))
+	})
+	add("2.7", "each of 10 pings is answered", func(c *caseConn) caseResult {
+		for i := 0; i < 10; i++ {
+			c.send(dataFrame(PingMessage, true, []byte(fmt.Sprint("ping ", i))))
+		}
+		for i := 0; i < 10; i++ {
+			if r := c.expectPong([]byte(fmt.Sprint("ping ", i))); r.outcome != casePassed {
+				return r
+			}
+		}
+		return passed()
+	})
+
+	// 3: Reserved bits.
+	for i, rsv := range []struct {
+		name   string
+		opcode int
+		f      func(*frame)
+	}{
+		{"RSV1 on a text frame", TextMessage, func(f *frame) { f.rsv1 = true }},
+		{"RSV2 on a binary frame", BinaryMessage, func(f *frame) { f.rsv2 = true }},
+		{"RSV3 on a ping", PingMessage, func(f *frame) { f.rsv3 = true }},
+		{"all reserved bits on a text frame", TextMessage, func(f *frame) { f.rsv1, f.rsv2, f.rsv3 = true, true, true }},
+	} {
+		add(fmt.Sprintf("3.%d", i+1), rsv.name+" fails the connection", func(c *caseConn) caseResult {
+			f := dataFrame(rsv.opcode, true, []byte("reserved"))
+			rsv.f(&f)
+			c.send(f)
+			return c.expectFailure(1002)
+		})
+	}
+
+	// 4: Opcodes.
+	for i, opcode := range []int{3, 7, 0xb, 0xf} {
+		add(fmt.Sprintf("4.%d", i+1), fmt.Sprintf("reserved opcode %#x fails the connection", opcode), func(c *caseConn) caseResult {
+			c.send(dataFrame(opcode, true, []byte("reserved")))
+			return c.expectFailure(1002)
+		})
+	}
+
+	// 5: Fragmentation.
+	add("5.1", "text message in 2 fragments is echoed", func(c *caseConn) caseResult {
+		c.send(dataFrame(TextMessage, false, []byte("frag")), dataFrame(continuationFrame, true, []byte("ment")))
+		return c.expectEcho(TextMessage, []byte("fragment"))
+	})
+	add("5.2", "text message in 1-byte fragments is echoed", func(c *caseConn) caseResult {
+		payload := []byte("fragmented into single bytes")
+		for i := range payload {
+			opcode := continuationFrame
+			if i == 0 {
+				opcode = TextMessage
+			}
+			c.send(dataFrame(opcode, i == len(payload)-1, payload[i:i+1]))
+		}
+		return c.expectEcho(TextMessage, payload)
+	})
+	add("5.3", "message with empty fragments is echoed", func(c *caseConn) caseResult {
+		c.send(dataFrame(BinaryMessage, false, nil), dataFrame(continuationFrame, false, []byte("middle")),
+			dataFrame(continuationFrame, true, nil))
+		return c.expectEcho(BinaryMessage, []byte("middle"))
+	})
+	add("5.4", "ping between fragments is answered", func(c *caseConn) caseResult {
+		c.send(dataFrame(TextMessage, false, []byte("frag")), dataFrame(PingMessage, true, []byte("between")),
+			dataFrame(continuationFrame, true, []byte("ment")))
+		if r := c.expectPong([]byte("between")); r.outcome != casePassed {
+			return r
+		}
+		return c.expectEcho(TextMessage, []byte("fragment"))
+	})
+	add("5.5", "continuation without a message fails the connection", func(c *caseConn) caseResult {
+		c.send(dataFrame(continuationFrame, true, []byte("orphan")))
+		return c.expectFailure(1002)
+	})
+	add("5.6", "message started within a fragmented message fails the connection", func(c *caseConn) caseResult {
+		c.send(dataFrame(TextMessage, false, []byte("first")), dataFrame(TextMessage, true, []byte("second")))
+		return c.expectFailure(1002)
+	})
+
+	// 6: UTF-8.
+	add("6.1", "text message with multi-byte characters is echoed", func(c *caseConn) caseResult {
+		payload := []byte("κόσμε, 世界, 🌍")
+		c.send(dataFrame(TextMessage, true, payload))
+		return c.expectEcho(TextMessage, payload)
+	})
+	add("6.2", "character split across fragments is echoed", func(c *caseConn) caseResult {
+		payload := []byte("🌍")
+		c.send(dataFrame(TextMessage, false, payload[:2]), dataFrame(continuationFrame, true, payload[2:]))
+		return c.expectEcho(TextMessage, payload)
+	})
+	for i, invalid := range []struct {
+		name    string
+		payload []byte
+	}{
+		{"invalid byte", []byte("invalid \xff byte")},
+		{"truncated character", []byte("truncated \xe2\x82")},
+		{"overlong encoding", []byte("overlong \xc0\xaf")},
+		{"surrogate half", []byte("surrogate \xed\xa0\x80")},
+		{"code point beyond U+10FFFF", []byte("beyond \xf4\x90\x80\x80")},
+	} {
+		add(fmt.Sprintf("6.%d", i+3), fmt.Sprintf("text message with %s fails the connection", invalid.name), func(c *caseConn) caseResult {
+			c.send(dataFrame(TextMessage, true, invalid.payload))
+			return c.expectFailure(1007)
+		})
+	}
+	add("6.8", "invalid UTF-8 in the last fragment fails the connection", func(c *caseConn) caseResult {
+		c.send(dataFrame(TextMessage, false, []byte("valid, ")), dataFrame(continuationFrame, true, []byte("invalid \xff")))
+		return c.expectFailure(1007)
+	})
+
+	// 7: Closing.
+	add("7.1.1", "close without payload is answered", func(c *caseConn) caseResult {
+		c.send(dataFrame(CloseMessage, true, nil))
+		return c.expectClose(1000)
+	})
+	add("7.1.2", "close with a 123-byte reason is answered", func(c *caseConn) caseResult {
+		c.send(dataFrame(CloseMessage, true, FormatCloseMessage(1000, strings.Repeat("*", 123))))
+		return c.expectClose(1000)
+	})
+	add("7.1.3", "message after close is not echoed", func(c *caseConn) caseResult {
+		c.send(dataFrame(CloseMessage, true, FormatCloseMessage(1000, "")), dataFrame(TextMessage, true, []byte("after close")))
+		return c.expectClose(1000)
+	})
+	add("7.1.4", "close with a 1-byte payload fails the connection", func(c *caseConn) caseResult {
+		c.send(dataFrame(CloseMessage, true, []byte{0x03}))
+		return c.expectFailure(1002)
+	})
+	add("7.1.5", "close with an invalid UTF-8 reason fails the connection", func(c *caseConn) caseResult {
+		c.send(dataFrame(CloseMessage, true, FormatCloseMessage(1000, "invalid \xff")))
+		return c.expectFailure(1007)
+	})
+	for i, code := range []int{1000, 1001, 1002, 1003, 1007, 1008, 1009, 1010, 1011, 3000, 3999, 4000, 4999} {
+		add(fmt.Sprintf("7.2.%d", i+1), fmt.Sprintf("close with code %d is answered", code), func(c *caseConn) caseResult {
+			c.send(dataFrame(CloseMessage, true, FormatCloseMessage(code, "")))
+			return c.expectClose(1000, code)
+		})
+	}
+	for i, code := range []int{0, 999, 1004, 1005, 1006, 1015, 1016, 2999, 5000, 65535} {
+		add(fmt.Sprintf("7.3.%d", i+1), fmt.Sprintf("close with invalid code %d fails the connection", code), func(c *caseConn) caseResult {
+			// Not FormatCloseMessage, which sends 1005 as no status code.
+			c.send(dataFrame(CloseMessage, true, binary.BigEndian.AppendUint16(nil, uint16(code))))
+			return c.expectFailure(1002)
+		})
+	}
+
+	// 8: Limits.
+	add("8.1", "1 MiB text message in one frame is echoed", func(c *caseConn) caseResult {
+		payload := bytes.Repeat([]byte("*"), 1<<20)
+		c.send(dataFrame(TextMessage, true, payload))
+		return c.expectEcho(TextMessage, payload)
+	})
+	add("8.2", "1 MiB binary message in 64 KiB fragments is echoed", func(c *caseConn) caseResult {
+		payload := bytes.Repeat([]byte{0xfe}, 1<<20)
+		for i := 0; i < len(payload); i += 64 << 10 {
+			opcode := continuationFrame
+			if i == 0 {
+				opcode = BinaryMessage
+			}
+			c.send(dataFrame(opcode, i+64<<10 == len(payload), payload[i:i+64<<10]))
+		}
+		return c.expectEcho(BinaryMessage, payload)
+	})
+	add("8.3", "1000 messages sent at once are echoed in order", func(c *caseConn) caseResult {
+		for i := 0; i < 1000; i++ {
+			c.send(dataFrame(TextMessage, true, []byte(fmt.Sprint("message ", i))))
+		}
+		for i := 0; i < 1000; i++ {
+			if r := c.expectEcho(TextMessage, []byte(fmt.Sprint("message ", i))); r.outcome != casePassed {
+				return r
+			}
+		}
+		return passed()
+	})
+	return cs
+}
+
+// selectCases returns the cases selected by -cases, a comma-separated list
+// of case IDs and sections, or all of them if it is not given.
+func selectCases(all []conformanceCase) []conformanceCase {
+	if cases == "" {
+		return all
+	}
+	var selected []conformanceCase
+	for _, c := range all {
+		for _, id := range strings.Split(cases, ",") {
+			id = strings.TrimSpace(id)
+			if c.id == id || strings.HasPrefix(c.id, id+".") {
+				selected = append(selected, c)
+				break
+			}
+		}
+	}
+	return selected
+}
+
+// dataFrame returns a masked client frame.
+func dataFrame(opcode int, fin bool, payload []byte) frame {
+	return frame{fin: fin, opcode: opcode, masked: true, payload: payload}
+}
+
+// runConformance runs the selected cases against the server, which is
+// expected to echo the messages it receives, and reports their outcomes.
+func runConformance() int {
+	selected := selectCases(conformanceCases())
+	printLine("running %d conformance cases against %s...", len(selected), yellow(url))
+	var counts [3]int
+	for _, cc := range selected {
+		r := runCase(cc)
+		counts[r.outcome]++
+		if jsonOutput {
+			emit(event{Event: "case", Case: cc.id, Message: cc.name, Outcome: r.outcome.String(), Reason: r.detail})
+			continue
+		}
+		label := fmt.Sprintf("%-10s", r.outcome)
+		switch r.outcome {
+		case casePassed:
+			label = green(label)
+		case caseNonStrict:
+			label = yellow(label)
+		default:
+			label = red(label)
+		}
+		line := fmt.Sprintf("%s %-7s %s", label, cc.id, cc.name)
+		if r.detail != "" {
+			line += faint(": " + r.detail)
+		}
+		printLine("%s", line)
+	}
+	printLine("cases: %d passed, %d non-strict, %d failed", counts[casePassed], counts[caseNonStrict], counts[caseFailed])
+	statsd.flush()
+	tracer.flush()
+	if counts[caseFailed] > 0 {
+		return exitFailCondition
+	}
+	return exitOK
+}
+
+// runCase runs a case on a connection of its own, within -case-timeout.
+func runCase(cc conformanceCase) caseResult {
+	ws, err := dial(url, protocol, origin, nil)
+	if err != nil {
+		return failed("connecting: %v", err)
+	}
+	defer ws.Close()
+	fc, ok := ws.(*frameConn)
+	if !ok {
+		return failed("not a WebSocket over TCP connection")
+	}
+	fc.conn.SetDeadline(time.Now().Add(caseTimeout))
+	c := &caseConn{frameConn: fc}
+	r := cc.run(c)
+	if r.outcome == casePassed && !c.closeSent && !c.closeReceived {
+		fc.WriteControl(CloseMessage, FormatCloseMessage(1000, ""), time.Now().Add(time.Second))
+	}
+	return r
+}
+
+// caseConn is the connection of a conformance case, on which frames are
+// sent and read as they are, without the checks of frameConn.
+type caseConn struct {
+	*frameConn
+	closeSent, closeReceived bool
+}
+
+// send writes frames, ignoring errors: a server that failed the connection
+// early is caught reading its response.
+func (c *caseConn) send(frames ...frame) {
+	for _, f := range frames {
+		if f.opcode == CloseMessage {
+			c.closeSent = true
+		}
+		if err := c.WriteFrame(f); err != nil {
+			return
+		}
+	}
+}
+
+// next reads the next frame, passing it to the frame hook of -frames and
+// the like.
+func (c *caseConn) next() (frame, error) {
+	f, err := readFrame(c.br, 0)
+	if err != nil {
+		return f, err
+	}
+	if c.frameHook != nil {
+		c.frameHook(false, f)
+	}
+	if f.opcode == CloseMessage {
+		c.closeReceived = true
+	}
+	return f, err
+}
+
+// expectEcho checks that the next data message the server sends is an echo
+// of payload.
+func (c *caseConn) expectEcho(opcode int, payload []byte) caseResult {
+	var (
+		messageType = -1
+		data        []byte
+	)
+	for {
+		f, err := c.next()
+		if err != nil {
+			return failed("no echo: %s", describeReadError(err))
+		}
+		if f.opcode == CloseMessage {
+			return failed("closed with %s instead of echoing", describeClosePayload(f.payload))
+		}
+		if isControl(f.opcode) {
+			continue
+		}
+		if messageType < 0 {
+			messageType = f.opcode
+		}
+		data = append(data, f.payload...)
+		if !f.fin {
+			continue
+		}
+		switch {
+		case messageType != opcode:
+			return failed("echoed a %s message to a %s message", opcodeName(messageType), opcodeName(opcode))
+		case !bytes.Equal(data, payload):
+			return failed("echoed %d bytes differing from the %d sent", len(data), len(payload))
+		}
+		return passed()
+	}
+}
+
+// expectPong checks that the server answers a ping with payload, ignoring
+// the data messages before the pong.
+func (c *caseConn) expectPong(payload []byte) caseResult {
+	for {
+		f, err := c.next()
+		if err != nil {
+			return failed("no pong: %s", describeReadError(err))
+		}
+		switch f.opcode {
+		case PongMessage:
+			if !bytes.Equal(f.payload, payload) {
+				return failed("pong of %d bytes differing from the %d of the ping", len(f.payload), len(payload))
+			}
+			return passed()
+		case CloseMessage:
+			return failed("closed with %s instead of answering the ping", describeClosePayload(f.payload))
+		}
+	}
+}
+
+// expectFailure checks that the server fails the connection with a close
+// frame with one of codes. Failing it with another code, or without a close
+// frame, is non-strict.
+func (c *caseConn) expectFailure(codes ...int) caseResult {
+	for {
+		f, err := c.next()
+		if err != nil {
+			if isTimeout(err) {
+				return failed("connection still open after %v", caseTimeout)
+			}
+			return nonStrict("dropped the connection without a close frame")
+		}
+		switch {
+		case f.opcode == CloseMessage:
+			if code, ok := closeStatus(f.payload); ok && containsInt(codes, code) {
+				return passed()
+			}
+			return nonStrict("closed with %s, expected %d", describeClosePayload(f.payload), codes[0])
+		case !isControl(f.opcode):
+			return failed("accepted the invalid frame and sent a %s message", opcodeName(f.opcode))
+		}
+	}
+}
+
+// expectClose checks that the server answers the close frame sent with one
+// with one of codes, or without a code if none was sent, and then closes the
+// TCP connection.
+func (c *caseConn) expectClose(codes ...int) caseResult {
+	for {
+		f, err := c.next()
+		if err != nil {
+			return failed("no close frame: %s", describeReadError(err))
+		}
+		if f.opcode != CloseMessage {
+			if !isControl(f.opcode) {
+				return failed("sent a %s message after the close frame", opcodeName(f.opcode))
+			}
+			continue
+		}
+		code, ok := closeStatus(f.payload)
+		if ok && !containsInt(codes, code) {
+			return failed("answered with %s", describeClosePayload(f.payload))
+		}
+		if _, err := c.next(); err == nil || isTimeout(err) {
+			return nonStrict("did not close the TCP connection after the close frame")
+		}
+		return passed()
+	}
+}
+
+// closeStatus returns the status code of a close frame's payload, if it has
+// one.
+func closeStatus(payload []byte) (int, bool) {
+	if len(payload) < 2 {
+		return 0, false
+	}
+	return int(binary.BigEndian.Uint16(payload)), true
+}
+
+func describeClosePayload(payload []byte) string {
+	code, ok := closeStatus(payload)
+	if !ok {
+		return "no status code"
+	}
+	return formatClose(code, string(payload[2:]))
+}
+
+func describeReadError(err error) string {
+	switch {
+	case isTimeout(err):
+		return fmt.Sprintf("nothing received within %v", caseTimeout)
+	case errors.Is(err, io.EOF):
+		return "connection closed"
+	}
+	return err.Error()
+}
+
+func isTimeout(err error) bool {
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
+
+func containsInt(list []int, n int) bool {
+	for _, v := range list {
+		if v == n {
+			return true
+		}
+	}
+	return false
+}
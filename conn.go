@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+// Message types as defined by RFC 6455. The numbers match the frame opcodes.
+const (
+	TextMessage   = 1
+	BinaryMessage = 2
+	CloseMessage  = 8
+	PingMessage   = 9
+	PongMessage   = 10
+)
+
+// Conn is a WebSocket connection. It hides the WebSocket implementation from
+// the rest of wsd, so that the transport can be swapped without touching the
+// read/write loops.
+type Conn interface {
+	// ReadMessage reads the next complete data message, reassembling
+	// fragmented messages. Control frames are handled by the implementation.
+	ReadMessage() (messageType int, data []byte, err error)
+
+	// WriteMessage writes a complete data message.
+	WriteMessage(messageType int, data []byte) error
+
+	// WriteControl writes a control frame (close, ping or pong).
+	WriteControl(messageType int, data []byte, deadline time.Time) error
+
+	// Subprotocol returns the subprotocol selected by the server, or "" if
+	// none was selected.
+	Subprotocol() string
+
+	// SetReadDeadline sets the deadline for future reads. A zero value
+	// means reads will not time out.
+	SetReadDeadline(t time.Time) error
+
+	// SetWriteDeadline sets the deadline for future writes. A zero value
+	// means writes will not time out.
+	SetWriteDeadline(t time.Time) error
+
+	// SetPongHandler sets the handler called for pong frames received from
+	// the peer. The handler is called from ReadMessage.
+	SetPongHandler(h func(appData string) error)
+
+	// Close closes the underlying network connection without sending a
+	// close frame.
+	Close() error
+}
+
+// CloseError is returned by ReadMessage when the peer sent a close frame.
+type CloseError struct {
+	Code int
+	Text string
+}
+
+func (e *CloseError) Error() string {
+	return fmt.Sprintf("websocket: close %d %s", e.Code, e.Text)
+}
+
+// FormatCloseMessage formats code and text as the payload of a close frame.
+// Code 1005 (no status received) is sent as an empty payload.
+func FormatCloseMessage(code int, text string) []byte {
+	if code == 1005 {
+		return []byte{}
+	}
+	buf := make([]byte, 2+len(text))
+	binary.BigEndian.PutUint16(buf, uint16(code))
+	copy(buf[2:], text)
+	return buf
+}
+
+// wireSizer is implemented by connections that can report the size on the
+// wire of the last message read, which differs from the message size when it
+// was compressed.
+type wireSizer interface {
+	lastWireSize() int
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	neturl "net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// cookieJar is an http.CookieJar that can be loaded from and saved to a
+// Netscape-format cookie file, as used by curl and wget.
+type cookieJar struct {
+	mu      sync.Mutex
+	cookies []*jarCookie
+}
+
+type jarCookie struct {
+	http.Cookie
+	// hostOnly is set for cookies without a Domain attribute. They are
+	// only sent to the host that set them.
+	hostOnly bool
+}
+
+// SetCookies implements http.CookieJar.
+func (j *cookieJar) SetCookies(u *neturl.URL, cookies []*http.Cookie) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	for _, c := range cookies {
+		jc := &jarCookie{Cookie: *c}
+		if jc.Domain == "" {
+			jc.Domain = u.Hostname()
+			jc.hostOnly = true
+		} else {
+			jc.Domain = strings.TrimPrefix(strings.ToLower(jc.Domain), ".")
+			if !domainMatch(u.Hostname(), jc.Domain) {
+				continue
+			}
+		}
+		if jc.Path == "" || !strings.HasPrefix(jc.Path, "/") {
+			jc.Path = defaultCookiePath(u.Path)
+		}
+		if jc.MaxAge > 0 {
+			jc.Expires = time.Now().Add(time.Duration(jc.MaxAge) * time.Second)
+		}
+		j.remove(jc)
+		if jc.MaxAge >= 0 && !jc.expired() {
+			j.cookies = append(j.cookies, jc)
+		}
+	}
+}
+
+// Cookies implements http.CookieJar.
+func (j *cookieJar) Cookies(u *neturl.URL) []*http.Cookie {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	secure := u.Scheme == "https" || u.Scheme == "wss"
+	path := u.Path
+	if path == "" {
+		path = "/"
+	}
+
+	var cookies []*http.Cookie
+	for _, c := range j.cookies {
+		switch {
+		case c.expired():
+		case c.Secure && !secure:
+		case c.hostOnly && c.Domain != u.Hostname():
+		case !c.hostOnly && !domainMatch(u.Hostname(), c.Domain):
+		case !pathMatch(path, c.Path):
+		default:
+			cookies = append(cookies, &http.Cookie{Name: c.Name, Value: c.Value})
+		}
+	}
+	return cookies
+}
+
+func (j *cookieJar) remove(c *jarCookie) {
+	for i, old := range j.cookies {
+		if old.Name == c.Name && old.Domain == c.Domain && old.Path == c.Path {
+			j.cookies = append(j.cookies[:i], j.cookies[i+1:]...)
+			return
+		}
+	}
+}
+
+func (c *jarCookie) expired() bool {
+	return !c.Expires.IsZero() && c.Expires.Before(time.Now())
+}
+
+func domainMatch(host, domain string) bool {
+	host = strings.ToLower(host)
+	return host == domain || strings.HasSuffix(host, "."+domain)
+}
+
+func pathMatch(path, cookiePath string) bool {
+	if !strings.HasPrefix(path, cookiePath) {
+		return false
+	}
+	return len(path) == len(cookiePath) || strings.HasSuffix(cookiePath, "/") || path[len(cookiePath)] == '/'
+}
+
+func defaultCookiePath(path string) string {
+	i := strings.LastIndexByte(path, '/')
+	if i <= 0 {
+		return "/"
+	}
+	return path[:i]
+}
+
+// load reads cookies from a Netscape-format cookie file. A missing file is
+// not an error.
+func (j *cookieJar) load(filename string) error {
+	f, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := scanner.Text()
+		httpOnly := strings.HasPrefix(line, "#HttpOnly_")
+		if httpOnly {
+			line = line[len("#HttpOnly_"):]
+		}
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Split(line, "\t")
+		if len(fields) != 7 {
+			return fmt.Errorf("%s:%d: expected 7 tab-separated fields", filename, n)
+		}
+		expires, err := strconv.ParseInt(fields[4], 10, 64)
+		if err != nil {
+			return fmt.Errorf("%s:%d: invalid expiry: %v", filename, n, err)
+		}
+
+		c := &jarCookie{
+			Cookie: http.Cookie{
+				Domain:   strings.TrimPrefix(fields[0], "."),
+				Path:     fields[2],
+				Secure:   fields[3] == "TRUE",
+				Name:     fields[5],
+				Value:    fields[6],
+				HttpOnly: httpOnly,
+			},
+			hostOnly: fields[1] != "TRUE",
+		}
+		if expires != 0 {
+			c.Expires = time.Unix(expires, 0)
+		}
+		if !c.expired() {
+			j.cookies = append(j.cookies, c)
+		}
+	}
+	return scanner.Err()
+}
+
+// save writes all cookies to a Netscape-format cookie file.
+func (j *cookieJar) save(filename string) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	var b strings.Builder
+	b.WriteString("# Netscape HTTP Cookie File\n# Written by wsd.\n\n")
+	for _, c := range j.cookies {
+		if c.expired() {
+			continue
+		}
+		domain, includeSubdomains := c.Domain, "FALSE"
+		if !c.hostOnly {
+			domain, includeSubdomains = "."+domain, "TRUE"
+		}
+		if c.HttpOnly {
+			domain = "#HttpOnly_" + domain
+		}
+		var expires int64
+		if !c.Expires.IsZero() {
+			expires = c.Expires.Unix()
+		}
+		fmt.Fprintf(&b, "%s\t%s\t%s\t%s\t%d\t%s\t%s\n",
+			domain, includeSubdomains, c.Path, strings.ToUpper(strconv.FormatBool(c.Secure)), expires, c.Name, c.Value)
+	}
+	return os.WriteFile(filename, []byte(b.String()), 0600)
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/itchyny/gojq"
+)
+
+// calls pairs the requests sent with -correlate with their responses, or is
+// nil if it is not given.
+var calls *callTracker
+
+// checkCorrelateFlags validates -correlate and its options.
+func checkCorrelateFlags() error {
+	if !correlate {
+		if flagGiven("correlate-id") || flagGiven("correlate-timeout") {
+			return errors.New("-correlate-id and -correlate-timeout require -correlate")
+		}
+		return nil
+	}
+	switch {
+	case command != "":
+		return fmt.Errorf("-correlate is not supported by %s", command)
+	case connections > 1:
+		return errors.New("-correlate does not support -connections")
+	case correlateTimeout <= 0:
+		return errors.New("-correlate-timeout must be positive")
+	}
+	query, err := gojq.Parse(correlateID)
+	if err != nil {
+		return fmt.Errorf("invalid -correlate-id %q: %v", correlateID, err)
+	}
+	code, err := gojq.Compile(query)
+	if err != nil {
+		return fmt.Errorf("invalid -correlate-id %q: %v", correlateID, err)
+	}
+	calls = &callTracker{id: code, pending: map[string]*pendingCall{}}
+	return nil
+}
+
+// callTracker pairs the requests sent with the responses carrying the same
+// ID, extracted from both by the -correlate-id expression. Sent messages
+// without an ID, like notifications, and received ones, like server pushes,
+// are not tracked.
+type callTracker struct {
+	id *gojq.Code
+
+	mu       sync.Mutex
+	sent     int
+	pending  map[string]*pendingCall // the unanswered requests by their ID
+	expired  map[string]bool         // the IDs of the timed out requests
+	orphaned int
+	timedOut int
+	samples  []time.Duration
+}
+
+// pendingCall is a request awaiting its response.
+type pendingCall struct {
+	method string
+	sentAt time.Time
+}
+
+// messageID returns the ID of a JSON message as JSON, to compare the IDs
+// 1 and "1" as different, and the message's method if it has one.
+func (t *callTracker) messageID(data []byte) (id, method string, ok bool) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return "", "", false
+	}
+	result, ok := t.id.Run(v).Next()
+	if _, isErr := result.(error); !ok || isErr || result == nil {
+		return "", "", false
+	}
+	b, err := json.Marshal(result)
+	if err != nil {
+		return "", "", false
+	}
+	if obj, isObj := v.(map[string]interface{}); isObj {
+		method, _ = obj["method"].(string)
+	}
+	return string(b), method, true
+}
+
+// request records a sent message as a request awaiting its response if it
+// has an ID. A nil tracker records nothing.
+func (t *callTracker) request(msg message) {
+	if t == nil || msg.messageType != TextMessage {
+		return
+	}
+	id, method, ok := t.messageID(msg.data)
+	if !ok {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.sent++
+	if _, ok := t.pending[id]; ok {
+		printError(fmt.Errorf("request %s sent while another with the same ID is pending", id))
+	}
+	delete(t.expired, id)
+	t.pending[id] = &pendingCall{method: method, sentAt: time.Now()}
+}
+
+// response pairs a received message with the request it answers if it has
+// an ID, printing the call's latency, or flagging the message as orphaned
+// if no request with its ID is pending. A nil tracker does nothing.
+func (t *callTracker) response(msg message) {
+	if t == nil || msg.messageType != TextMessage {
+		return
+	}
+	id, _, ok := t.messageID(msg.data)
+	if !ok {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	call, ok := t.pending[id]
+	if !ok {
+		status, note := "orphaned", "no pending request with this ID"
+		if t.expired[id] {
+			// Counted as timed out already.
+			delete(t.expired, id)
+			status, note = "late", "the request timed out"
+		} else {
+			t.orphaned++
+		}
+		if jsonOutput {
+			emit(event{Event: "call", Conn: msg.conn, ID: id, Outcome: status})
+			return
+		}
+		printLine("%s", yellow(fmt.Sprintf("%s response %s: %s", status, id, note)))
+		return
+	}
+	delete(t.pending, id)
+	d := msg.time.Sub(call.sentAt)
+	t.samples = append(t.samples, d)
+
+	if jsonOutput {
+		emit(event{Event: "call", Conn: msg.conn, ID: id, Method: call.method, Outcome: "answered",
+			RTT: float64(d) / float64(time.Millisecond)})
+		return
+	}
+	name := id
+	if call.method != "" {
+		name += " " + call.method
+	}
+	printLine("call %s: %s", name, green(d.Round(time.Microsecond)))
+}
+
+// expireLoop flags the requests unanswered after -correlate-timeout, until
+// ctx is done.
+func (t *callTracker) expireLoop(ctx context.Context) error {
+	ticker := time.NewTicker(min(correlateTimeout/10+time.Millisecond, time.Second))
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			t.expire(now)
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+func (t *callTracker) expire(now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var ids []string
+	for id, call := range t.pending {
+		if now.Sub(call.sentAt) >= correlateTimeout {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		call := t.pending[id]
+		delete(t.pending, id)
+		if t.expired == nil {
+			t.expired = map[string]bool{}
+		}
+		t.expired[id] = true
+		t.timedOut++
+		if jsonOutput {
+			emit(event{Event: "call", ID: id, Method: call.method, Outcome: "timeout"})
+			continue
+		}
+		name := id
+		if call.method != "" {
+			name += " " + call.method
+		}
+		printLine("%s", red(fmt.Sprintf("call %s: no response within %v", name, correlateTimeout)))
+	}
+}
+
+// summary prints the calls made and answered and the percentiles of their
+// latencies, and exports them with -latency-hdr and -latency-csv. A nil
+// tracker prints nothing.
+func (t *callTracker) summary() {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.sent == 0 && t.orphaned == 0 {
+		return
+	}
+	if !jsonOutput {
+		printLine("calls: %d sent, %d answered, %d timed out, %d unanswered, %d orphaned responses",
+			t.sent, len(t.samples), t.timedOut, len(t.pending), t.orphaned)
+		if len(t.samples) > 0 {
+			printLine("calls: avg %v, %s", average(t.samples), formatPercentiles(t.samples))
+		}
+	}
+	reportLatencies(t.samples, 0, connectedAt)
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"unicode/utf8"
+)
+
+// payloadDecoder turns a received binary payload into JSON, or another
+// readable form, for display.
+type payloadDecoder func(data []byte) ([]byte, error)
+
+// payloadEncoder encodes a JSON value read from stdin into a binary payload.
+type payloadEncoder func(v interface{}) ([]byte, error)
+
+var (
+	// decoder and encoder are selected on the command line, or nil.
+	decoder payloadDecoder
+	encoder payloadEncoder
+
+	// decodeText is set if the decoder applies to text messages too.
+	decodeText bool
+)
+
+// setupDecoder selects the decoder for received messages, and the encoder
+// for sent ones, from the flags.
+func setupDecoder() error {
+	switch decode {
+	case "":
+	case "msgpack":
+		decoder, encoder = decodeMsgpack, encodeMsgpack
+	case "cbor":
+		decoder, encoder = decodeCBOR, encodeCBOR
+	case "cbor-diag":
+		decoder, encoder = diagnoseCBOR, encodeCBOR
+	case "base64":
+		decoder, decodeText = decodeBase64Payload, true
+	case "avro":
+		d, err := newAvroDecoder(avroSchema, schemaRegistry)
+		if err != nil {
+			return err
+		}
+		decoder = d.decode
+	default:
+		return fmt.Errorf("unknown -decode format %q, expected msgpack, cbor, cbor-diag, avro or base64", decode)
+	}
+
+	if protoFile == "" {
+		if protoType != "" {
+			return fmt.Errorf("-proto-type requires -proto")
+		}
+		return nil
+	}
+	if protoType == "" {
+		return fmt.Errorf("-proto requires -proto-type")
+	}
+	if decode != "" {
+		return fmt.Errorf("-proto and -decode cannot be combined")
+	}
+	var err error
+	decoder, err = loadProtoDecoder(protoFile, protoType)
+	if err != nil {
+		return fmt.Errorf("loading %s: %v", protoFile, err)
+	}
+	return nil
+}
+
+// decodeMessage decompresses a received binary message as selected by
+// -decompress and decodes it into a JSON text message. Decompressed messages
+// that are not decoded become text messages if they are valid UTF-8. If
+// decoding fails, msg is returned along with the error.
+func decodeMessage(msg message) (message, error) {
+	if msg.messageType != BinaryMessage {
+		if decodeText && decoder != nil {
+			data, err := decoder(msg.data)
+			if err != nil {
+				return msg, fmt.Errorf("decoding text message: %v", err)
+			}
+			msg.data = data
+		}
+		return msg, nil
+	}
+	data, ok, err := decompressPayload(msg.data)
+	if err != nil {
+		return msg, err
+	}
+	if ok {
+		msg.data, msg.wireSize = data, len(data)
+		if decoder == nil && utf8.Valid(data) {
+			msg.messageType = TextMessage
+		}
+	}
+
+	if decoder == nil {
+		return msg, nil
+	}
+	data, err = decoder(msg.data)
+	if err != nil {
+		return msg, fmt.Errorf("decoding binary message: %v", err)
+	}
+	msg.data, msg.wireSize = data, len(data)
+	if utf8.Valid(data) {
+		msg.messageType = TextMessage
+	}
+	return msg, nil
+}
+
+// encodeJSONInput encodes an input line holding a JSON value with encoder.
+func encodeJSONInput(line string) (message, error) {
+	dec := json.NewDecoder(bytes.NewReader([]byte(line)))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil || dec.More() {
+		return message{}, fmt.Errorf("input is not JSON, use \\text to send it as is")
+	}
+	data, err := encoder(fromJSON(v))
+	if err != nil {
+		return message{}, err
+	}
+	return message{messageType: BinaryMessage, data: data}, nil
+}
+
+// fromJSON converts the numbers in a value decoded with UseNumber into
+// integers where possible, so that encoders can use compact representations.
+func fromJSON(v interface{}) interface{} {
+	switch v := v.(type) {
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i
+		}
+		f, _ := v.Float64()
+		return f
+	case []interface{}:
+		for i := range v {
+			v[i] = fromJSON(v[i])
+		}
+	case map[string]interface{}:
+		for k := range v {
+			v[k] = fromJSON(v[k])
+		}
+	}
+	return v
+}
+
+// toJSON converts a decoded value into one encoding/json can marshal: map
+// keys become strings and byte strings become base64.
+func toJSON(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			m[fmt.Sprint(k)] = toJSON(e)
+		}
+		return m
+	case map[string]interface{}:
+		for k := range v {
+			v[k] = toJSON(v[k])
+		}
+	case []interface{}:
+		for i := range v {
+			v[i] = toJSON(v[i])
+		}
+	case []byte:
+		return base64.StdEncoding.EncodeToString(v)
+	case *big.Int:
+		return json.Number(v.String())
+	case big.Int:
+		return json.Number(v.String())
+	}
+	return v
+}
+
+// marshalJSON marshals v without escaping HTML characters.
+func marshalJSON(v interface{}) ([]byte, error) {
+	var b bytes.Buffer
+	enc := json.NewEncoder(&b)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(b.Bytes(), []byte("\n")), nil
+}
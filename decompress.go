@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"unicode/utf8"
+
+	"github.com/andybalholm/brotli"
+)
+
+// checkDecompress validates -decompress.
+func checkDecompress() error {
+	switch decompressMode {
+	case "", "auto", "gzip", "deflate", "br":
+		return nil
+	}
+	return fmt.Errorf("unknown -decompress format %q, expected auto, gzip, deflate or br", decompressMode)
+}
+
+// decompressPayload decompresses an application-level compressed payload as
+// selected by -decompress. ok is false if the payload was left as is, which
+// in auto mode means it was not recognized as compressed.
+func decompressPayload(data []byte) (out []byte, ok bool, err error) {
+	switch decompressMode {
+	case "gzip":
+		out, err = readAllFrom(gzip.NewReader(bytes.NewReader(data)))
+	case "deflate":
+		out, err = inflateAny(data)
+	case "br":
+		out, err = readAll(brotli.NewReader(bytes.NewReader(data)))
+	case "auto":
+		switch {
+		case bytes.HasPrefix(data, []byte{0x1f, 0x8b}):
+			out, err = readAllFrom(gzip.NewReader(bytes.NewReader(data)))
+		case isZlibHeader(data):
+			out, err = readAllFrom(zlib.NewReader(bytes.NewReader(data)))
+		default:
+			// Brotli has no magic number, so only accept payloads that
+			// decompress cleanly into text.
+			out, err = readAll(brotli.NewReader(bytes.NewReader(data)))
+			if err != nil || len(out) == 0 || !utf8.Valid(out) {
+				return data, false, nil
+			}
+		}
+	default:
+		return data, false, nil
+	}
+	if err != nil {
+		return data, false, fmt.Errorf("decompressing: %v", err)
+	}
+	return out, true, nil
+}
+
+// isZlibHeader reports whether data starts with a zlib header using deflate
+// (RFC 1950 section 2.2).
+func isZlibHeader(data []byte) bool {
+	return len(data) >= 2 && data[0]&0x0f == 8 && data[0]>>4 <= 7 && (uint16(data[0])<<8|uint16(data[1]))%31 == 0
+}
+
+// inflateAny decompresses zlib-wrapped or raw deflate data, as both are
+// used under the name deflate.
+func inflateAny(data []byte) ([]byte, error) {
+	if isZlibHeader(data) {
+		if out, err := readAllFrom(zlib.NewReader(bytes.NewReader(data))); err == nil {
+			return out, nil
+		}
+	}
+	return readAll(flate.NewReader(bytes.NewReader(data)))
+}
+
+func readAllFrom(r io.Reader, err error) ([]byte, error) {
+	if err != nil {
+		return nil, err
+	}
+	return readAll(r)
+}
+
+// readAll reads a decompressed payload, enforcing -max-message-size.
+func readAll(r io.Reader) ([]byte, error) {
+	if maxMessageSize <= 0 {
+		return io.ReadAll(r)
+	}
+	out, err := io.ReadAll(io.LimitReader(r, maxMessageSize+1))
+	if err == nil && int64(len(out)) > maxMessageSize {
+		return nil, errMessageTooLarge
+	}
+	return out, err
+}
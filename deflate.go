@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// deflateParams are the parameters of the permessage-deflate extension
+// (RFC 7692). A zero window size means the default of 15 bits.
+type deflateParams struct {
+	serverNoContextTakeover bool
+	clientNoContextTakeover bool
+	serverMaxWindowBits     int
+	clientMaxWindowBits     int
+}
+
+// offer formats p as a Sec-WebSocket-Extensions offer.
+func (p deflateParams) offer() string {
+	s := "permessage-deflate"
+	if p.serverNoContextTakeover {
+		s += "; server_no_context_takeover"
+	}
+	if p.clientNoContextTakeover {
+		s += "; client_no_context_takeover"
+	}
+	if p.serverMaxWindowBits != 0 {
+		s += "; server_max_window_bits=" + strconv.Itoa(p.serverMaxWindowBits)
+	}
+	if p.clientMaxWindowBits != 0 {
+		s += "; client_max_window_bits=" + strconv.Itoa(p.clientMaxWindowBits)
+	}
+	return s
+}
+
+// parseDeflateResponse parses the permessage-deflate parameters the server
+// accepted, and checks them against what was offered.
+func parseDeflateResponse(params []string, offered deflateParams) (deflateParams, error) {
+	var p deflateParams
+	for _, param := range params {
+		name, value, _ := strings.Cut(param, "=")
+		name = strings.TrimSpace(name)
+		value = strings.Trim(strings.TrimSpace(value), `"`)
+
+		var err error
+		switch name {
+		case "server_no_context_takeover":
+			p.serverNoContextTakeover = true
+		case "client_no_context_takeover":
+			p.clientNoContextTakeover = true
+		case "server_max_window_bits":
+			p.serverMaxWindowBits, err = parseWindowBits(value)
+		case "client_max_window_bits":
+			if offered.clientMaxWindowBits == 0 {
+				return p, fmt.Errorf("server sent client_max_window_bits, which was not offered")
+			}
+			p.clientMaxWindowBits, err = parseWindowBits(value)
+		default:
+			return p, fmt.Errorf("unknown permessage-deflate parameter %q", name)
+		}
+		if err != nil {
+			return p, err
+		}
+	}
+	return p, nil
+}
+
+func parseWindowBits(s string) (int, error) {
+	bits, err := strconv.Atoi(s)
+	if err != nil || bits < 8 || bits > 15 {
+		return 0, fmt.Errorf("invalid window bits %q", s)
+	}
+	return bits, nil
+}
+
+// deflateTail completes a message compressed with a sync flush: the flush
+// marker stripped by the sender, followed by an empty final block.
+var deflateTail = []byte{0x00, 0x00, 0xff, 0xff, 0x01, 0x00, 0x00, 0xff, 0xff}
+
+const maxWindow = 1 << 15
+
+// inflater decompresses received messages. With context takeover, the last
+// 32KB of output is kept as the dictionary for the next message.
+type inflater struct {
+	noContextTakeover bool
+	window            []byte
+}
+
+func (f *inflater) inflate(p []byte, limit int64) ([]byte, error) {
+	r := flate.NewReaderDict(io.MultiReader(bytes.NewReader(p), bytes.NewReader(deflateTail)), f.window)
+	defer r.Close()
+
+	var src io.Reader = r
+	if limit > 0 {
+		src = io.LimitReader(r, limit+1)
+	}
+	out, err := io.ReadAll(src)
+	if err != nil {
+		return nil, err
+	}
+	if limit > 0 && int64(len(out)) > limit {
+		return nil, errMessageTooLarge
+	}
+
+	if !f.noContextTakeover {
+		f.window = append(f.window, out...)
+		if len(f.window) > maxWindow {
+			f.window = append([]byte(nil), f.window[len(f.window)-maxWindow:]...)
+		}
+	}
+	return out, nil
+}
+
+// deflater compresses sent messages.
+type deflater struct {
+	noContextTakeover bool
+	// windowBits limits the window the server can decompress with. The
+	// flate package always uses a 32KB window, so with a smaller window
+	// only messages that fit into it are compressed, without context.
+	windowBits int
+	buf        bytes.Buffer
+	w          *flate.Writer
+}
+
+// deflate compresses p. It reports false if p should be sent uncompressed.
+func (d *deflater) deflate(p []byte) ([]byte, bool) {
+	small := d.windowBits != 0 && d.windowBits < 15
+	if small && len(p) > 1<<d.windowBits {
+		return p, false
+	}
+
+	if d.w == nil {
+		d.w, _ = flate.NewWriter(&d.buf, flate.DefaultCompression)
+	} else if d.noContextTakeover || small {
+		d.w.Reset(&d.buf)
+	}
+	d.buf.Reset()
+	d.w.Write(p)
+	d.w.Flush()
+
+	out := append([]byte(nil), bytes.TrimSuffix(d.buf.Bytes(), deflateTail[:4])...)
+	d.buf.Reset()
+	return out, true
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestDeflateRoundTrip(t *testing.T) {
+	for _, takeover := range []bool{true, false} {
+		d := &deflater{noContextTakeover: !takeover}
+		f := &inflater{noContextTakeover: !takeover}
+		var sizes []int
+		for i := 0; i < 3; i++ {
+			msg := []byte(strings.Repeat("the quick brown fox jumps over the lazy dog ", 20))
+			payload, ok := d.deflate(msg)
+			if !ok {
+				t.Fatal("message not compressed")
+			}
+			sizes = append(sizes, len(payload))
+			out, err := f.inflate(payload, 0)
+			if err != nil {
+				t.Fatalf("takeover %v, message %d: %v", takeover, i, err)
+			}
+			if !bytes.Equal(out, msg) {
+				t.Fatalf("takeover %v, message %d: round trip differs", takeover, i)
+			}
+		}
+		// With context takeover, repeated messages refer to the ones before.
+		if takeover && sizes[1] >= sizes[0] {
+			t.Errorf("with context takeover, sizes %v do not shrink", sizes)
+		}
+		if !takeover && sizes[1] != sizes[0] {
+			t.Errorf("without context takeover, sizes %v differ", sizes)
+		}
+	}
+}
+
+func TestInflateNeedsContext(t *testing.T) {
+	// A message compressed against the previous one cannot be inflated by
+	// a receiver that dropped its context.
+	d := &deflater{}
+	msg := []byte(strings.Repeat("context takeover ", 30))
+	first, _ := d.deflate(msg)
+	second, _ := d.deflate(msg)
+	f := &inflater{noContextTakeover: true}
+	if _, err := f.inflate(first, 0); err != nil {
+		t.Fatal(err)
+	}
+	if out, err := f.inflate(second, 0); err == nil && bytes.Equal(out, msg) {
+		t.Error("inflated a message needing context without it")
+	}
+}
+
+func TestInflateWindow(t *testing.T) {
+	d := &deflater{}
+	f := &inflater{}
+	for i := 0; i < 3; i++ {
+		msg := bytes.Repeat([]byte{byte('a' + i)}, maxWindow)
+		payload, _ := d.deflate(msg)
+		if _, err := f.inflate(payload, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(f.window) != maxWindow {
+		t.Errorf("window is %d bytes, want %d", len(f.window), maxWindow)
+	}
+}
+
+func TestInflateLimit(t *testing.T) {
+	payload, _ := (&deflater{}).deflate(make([]byte, 1000))
+	if _, err := (&inflater{}).inflate(payload, 999); err != errMessageTooLarge {
+		t.Errorf("got %v, want %v", err, errMessageTooLarge)
+	}
+	if out, err := (&inflater{}).inflate(payload, 1000); err != nil || len(out) != 1000 {
+		t.Errorf("at the limit: %d bytes, %v", len(out), err)
+	}
+}
+
+func TestDeflateSmallWindow(t *testing.T) {
+	d := &deflater{windowBits: 9}
+	large := make([]byte, 1<<9+1)
+	if payload, ok := d.deflate(large); ok || !bytes.Equal(payload, large) {
+		t.Error("message larger than the window compressed")
+	}
+	small := []byte(strings.Repeat("x", 100))
+	for i := 0; i < 2; i++ {
+		payload, ok := d.deflate(small)
+		if !ok {
+			t.Fatal("message fitting the window not compressed")
+		}
+		// Without context, each message inflates on its own.
+		if out, err := (&inflater{noContextTakeover: true}).inflate(payload, 0); err != nil || !bytes.Equal(out, small) {
+			t.Errorf("message %d: %q, %v", i, out, err)
+		}
+	}
+}
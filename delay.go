@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"time"
+)
+
+// checkDelayFlags validates -delay and -jitter.
+func checkDelayFlags() error {
+	if sendDelay < 0 || jitter < 0 {
+		return errors.New("-delay and -jitter must not be negative")
+	}
+	return nil
+}
+
+// holdMessages returns a channel carrying the messages of out, each held
+// for -delay plus a random time up to -jitter after it was sent on out.
+// Messages keep their order, so one held longer holds up those after it.
+func holdMessages(ctx context.Context, out <-chan message) <-chan message {
+	type heldMessage struct {
+		message
+		due time.Time
+	}
+	queue := make(chan heldMessage, 1024)
+	go func() {
+		for {
+			select {
+			case msg := <-out:
+				hold := sendDelay
+				if jitter > 0 {
+					hold += time.Duration(rand.Int63n(int64(jitter)))
+				}
+				select {
+				case queue <- heldMessage{msg, time.Now().Add(hold)}:
+				case <-ctx.Done():
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	held := make(chan message)
+	go func() {
+		for {
+			var m heldMessage
+			select {
+			case m = <-queue:
+			case <-ctx.Done():
+				return
+			}
+			timer := time.NewTimer(time.Until(m.due))
+			select {
+			case <-timer.C:
+			case <-ctx.Done():
+				timer.Stop()
+				return
+			}
+			select {
+			case held <- m.message:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return held
+}
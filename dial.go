@@ -0,0 +1,383 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	neturl "net/url"
+	"strings"
+	"time"
+)
+
+// dial connects to the WebSocket server at url. Redirects returned in
+// response to the upgrade request are followed, up to -max-redirects,
+// without the credentials and cookies given once they lead to another host,
+// and with -digest a digest authentication challenge is answered. The headers
+// in extra are sent unless given with -H. The outcome is recorded for
+// -metrics-listen.
+func dial(url, protocol, origin string, extra http.Header) (Conn, error) {
+	start := time.Now()
+	ws, err := dialURL(url, protocol, origin, extra)
+	metrics.dialed(ws, time.Since(start), err)
+	return ws, err
+}
+
+// dialURL does the work of dial.
+func dialURL(url, protocol, origin string, extra http.Header) (Conn, error) {
+	header, err := parseHeaders(headers)
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range extra {
+		if header.Get(name) == "" {
+			header[http.CanonicalHeaderKey(name)] = values
+		}
+	}
+	if hostHeader != "" {
+		header.Set("Host", hostHeader)
+	}
+	if header.Get("Origin") == "" {
+		header.Set("Origin", origin)
+	}
+	setAuthorization(header)
+	if oauth2TokenURL != "" {
+		if url, err = applyOAuth2Token(url, header); err != nil {
+			return nil, err
+		}
+	}
+	var awsCreds *awsCredentials
+	if awsSigV4 != "" {
+		if awsCreds, err = loadAWSCredentials(); err != nil {
+			return nil, err
+		}
+	}
+
+	jar := &cookieJar{}
+	if strings.Contains(cookie, "=") {
+		header.Add("Cookie", cookie)
+	} else if cookie != "" {
+		if err := jar.load(cookie); err != nil {
+			return nil, err
+		}
+	}
+	if cookieJarFile != "" {
+		if err := jar.load(cookieJarFile); err != nil {
+			return nil, err
+		}
+	}
+
+	tlsConfig, err := newTLSConfig()
+	if err != nil {
+		return nil, err
+	}
+	if webTransport {
+		return dialWebTransport(url, protocol, header, tlsConfig)
+	}
+
+	// The digest challenge is answered once, and again after a redirect to
+	// the same host. Credentials are not sent to other hosts, as by curl.
+	redirects, digestAnswered, trusted := 0, false, true
+	for {
+		// Each redirect target needs its own signature.
+		if awsCreds != nil {
+			if err := signSigV4(header, url, awsCreds, time.Now()); err != nil {
+				return nil, err
+			}
+		}
+		ws, resp, err := dialOnce(url, protocol, header, jar, tlsConfig)
+		if cookieJarFile != "" {
+			if err := jar.save(cookieJarFile); err != nil {
+				printError(err)
+			}
+		}
+		if err == nil {
+			if compression {
+				printCompression(ws, resp)
+			}
+			return ws, nil
+		}
+
+		if !digestAnswered && (digestAuth == "" || trusted) {
+			retry, authErr := digestRetry(header, url, resp)
+			if authErr != nil {
+				return nil, authErr
+			}
+			if retry {
+				digestAnswered = true
+				continue
+			}
+		}
+
+		location, ok := redirectLocation(resp)
+		if !ok {
+			return nil, err
+		}
+		if redirects >= maxRedirects {
+			return nil, &handshakeError{fmt.Sprintf("stopped after %d redirects", maxRedirects)}
+		}
+		printLine("%s redirected to %s", resp.Status, yellow(location))
+		if trusted && !sameHost(url, location) {
+			trusted = false
+			awsCreds = nil
+			for _, name := range []string{"Authorization", "Cookie", "X-Amz-Date", "X-Amz-Security-Token"} {
+				header.Del(name)
+			}
+		}
+		url = location
+		redirects++
+		digestAnswered = false
+	}
+}
+
+// dialOnce performs a single WebSocket handshake with url.
+func dialOnce(url, protocol string, header http.Header, jar http.CookieJar, tlsConfig *tls.Config) (ws *frameConn, resp *http.Response, err error) {
+	u, err := neturl.Parse(url)
+	if err != nil {
+		return nil, nil, err
+	}
+	var useTLS bool
+	port := "80"
+	switch u.Scheme {
+	case "ws":
+	case "wss":
+		useTLS, port = true, "443"
+	default:
+		return nil, nil, fmt.Errorf("unsupported URL scheme %q, expected ws or wss", u.Scheme)
+	}
+	addr := u.Host
+	if u.Port() == "" {
+		addr = net.JoinHostPort(u.Hostname(), port)
+	}
+
+	proxyURL, err := proxyFor(u)
+	if err != nil {
+		return nil, nil, err
+	}
+	resolveMap, err := parseResolve(resolve)
+	if err != nil {
+		return nil, nil, err
+	}
+	nd := &netDialer{proxy: proxyURL, tlsConfig: tlsConfig, resolve: resolveMap}
+	trace := tracer.start(url)
+	if showTiming || trace != nil {
+		nd.timing = &connTiming{}
+	}
+	if trace != nil {
+		header.Set("Traceparent", trace.traceparent())
+		defer func() { trace.connected(nd.timing, ws, resp, err) }()
+	}
+
+	ctx := context.Background()
+	if handshakeTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, handshakeTimeout)
+		defer cancel()
+	}
+
+	var conn net.Conn
+	if useTLS {
+		conn, err = nd.dialTLS(ctx, "tcp", addr)
+	} else {
+		conn, err = nd.dialTCP(ctx, "tcp", addr)
+	}
+	if err != nil {
+		if showTiming {
+			nd.timing.print(url)
+		}
+		return nil, nil, &dialError{err}
+	}
+	if tc, ok := conn.(*tls.Conn); ok {
+		cs := tc.ConnectionState()
+		switch {
+		case useHTTP2 && cs.NegotiatedProtocol != "h2":
+			conn.Close()
+			return nil, nil, &handshakeError{"the server does not support HTTP/2, ALPN selected " + orNone(cs.NegotiatedProtocol)}
+		case !useHTTP2 && cs.NegotiatedProtocol == "h2":
+			conn.Close()
+			return nil, nil, &handshakeError{"the server selected h2 with ALPN, but the upgrade needs HTTP/1.1, use -http2"}
+		}
+		inspectTLS(cs)
+	}
+	conn = throttle(conn)
+
+	var tap *handshakeTap
+	if showHandshake || jsonOutput || recorder != nil || capture != nil {
+		if useHTTP2 {
+			tap = newH2Tap(conn)
+		} else {
+			tap = &handshakeTap{Conn: conn}
+		}
+		conn = tap
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	protocols := splitProtocols(protocol)
+	if showJWT {
+		inspectJWTs("URL", []byte(url))
+		inspectHeaderJWTs("request", header)
+	}
+	upgradeStart := time.Now()
+	trace.upgrading()
+	if useHTTP2 {
+		ws, resp, err = h2Handshake(conn, u, protocols, header, jar, tap)
+	} else {
+		ws, resp, err = clientHandshake(conn, u, protocols, header, jar)
+	}
+	if nd.timing != nil {
+		nd.timing.upgrade = time.Since(upgradeStart)
+	}
+	if showTiming {
+		nd.timing.print(url)
+	}
+	if showJWT && resp != nil {
+		inspectHeaderJWTs("response", resp.Header)
+	}
+	recorder.handshake(url, tap, resp)
+	capture.handshake(tap)
+	if jsonOutput {
+		emitHandshake(url, tap, resp)
+	} else if showHandshake {
+		printHandshake(tap, resp)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, resp, err
+	}
+	conn.SetDeadline(time.Time{})
+	ws.skipUTF8Validation = noUTF8Validation
+	var hooks []func(sent bool, f frame)
+	if jsonOutput {
+		hooks = append(hooks, emitFrame)
+	} else if showFrames {
+		hooks = append(hooks, printFrame)
+	}
+	if trafficLog != nil {
+		hooks = append(hooks, logFrame)
+	}
+	if recorder != nil {
+		hooks = append(hooks, recordFrame)
+	}
+	if capture != nil {
+		hooks = append(hooks, captureFrame)
+	}
+	if trace != nil {
+		hooks = append(hooks, trace.frame)
+		ws.closeHooks = append(ws.closeHooks, trace.closed)
+	}
+	if metrics != nil {
+		hooks = append(hooks, meterFrame)
+	}
+	ws.frameHook = chainFrameHooks(hooks)
+	ws.chaos = chaos
+	ws.msgLimit = newRateLimiter(msgRate)
+	return ws, resp, nil
+}
+
+// inspectTLS shows what the TLS flags ask for about an established
+// connection.
+func inspectTLS(cs tls.ConnectionState) {
+	if alpn != "" {
+		printALPN(cs)
+	}
+	if showCerts != "" {
+		printCerts(cs)
+	}
+	if showSCTs {
+		printSCTs(cs)
+	}
+	if checkRevocation != "" {
+		printRevocation(cs)
+	}
+	if saveCertsDir != "" {
+		if err := saveCerts(cs, saveCertsDir); err != nil {
+			printError(fmt.Errorf("saving certificates: %v", err))
+		}
+	}
+}
+
+// splitProtocols splits the comma-separated -protocol list.
+func splitProtocols(protocol string) []string {
+	var protocols []string
+	for _, p := range strings.Split(protocol, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			protocols = append(protocols, p)
+		}
+	}
+	return protocols
+}
+
+// redirectLocation returns the WebSocket URL a handshake response redirects
+// to, if any.
+func redirectLocation(resp *http.Response) (string, bool) {
+	if resp == nil {
+		return "", false
+	}
+	switch resp.StatusCode {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther,
+		http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+	default:
+		return "", false
+	}
+
+	location, err := resp.Location()
+	if err != nil {
+		return "", false
+	}
+	switch location.Scheme {
+	case "http":
+		location.Scheme = "ws"
+	case "https":
+		location.Scheme = "wss"
+	}
+	return location.String(), true
+}
+
+// sameHost reports whether the URLs a and b have the same host and port.
+func sameHost(a, b string) bool {
+	ua, err := neturl.Parse(a)
+	if err != nil {
+		return false
+	}
+	ub, err := neturl.Parse(b)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(ua.Hostname(), ub.Hostname()) && effectivePort(ua) == effectivePort(ub)
+}
+
+// effectivePort returns the port of u, or the default port of its scheme.
+func effectivePort(u *neturl.URL) string {
+	if port := u.Port(); port != "" {
+		return port
+	}
+	switch u.Scheme {
+	case "wss", "https":
+		return "443"
+	}
+	return "80"
+}
+
+// parseHeaders parses curl-style "Name: value" header lines.
+func parseHeaders(lines []string) (http.Header, error) {
+	header := http.Header{}
+	for _, line := range lines {
+		i := strings.IndexByte(line, ':')
+		if i <= 0 {
+			return nil, fmt.Errorf("invalid header %q, expected \"Name: value\"", line)
+		}
+		header.Add(strings.TrimSpace(line[:i]), strings.TrimSpace(line[i+1:]))
+	}
+	return header, nil
+}
+
+func printCompression(ws *frameConn, resp *http.Response) {
+	if ws.inflate == nil {
+		printLine("warning: server did not negotiate %s", yellow("permessage-deflate"))
+		return
+	}
+	printLine("using compression %s", green(strings.Join(resp.Header.Values("Sec-WebSocket-Extensions"), ", ")))
+}
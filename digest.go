@@ -0,0 +1,115 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"strings"
+)
+
+// digestAuthorization computes the credentials for an HTTP digest
+// authentication challenge (RFC 7616) as found in a WWW-Authenticate or
+// Proxy-Authenticate header.
+func digestAuthorization(challenge, method, uri, username, password string) (string, error) {
+	params := parseAuthParams(strings.TrimSpace(challenge[len("digest"):]))
+
+	var newHash func() hash.Hash
+	algorithm := params["algorithm"]
+	switch strings.ToUpper(algorithm) {
+	case "", "MD5":
+		newHash = md5.New
+	case "SHA-256":
+		newHash = sha256.New
+	default:
+		return "", fmt.Errorf("unsupported digest algorithm %q", algorithm)
+	}
+	h := func(s string) string {
+		sum := newHash()
+		sum.Write([]byte(s))
+		return hex.EncodeToString(sum.Sum(nil))
+	}
+
+	realm, nonce := params["realm"], params["nonce"]
+	ha1 := h(username + ":" + realm + ":" + password)
+	ha2 := h(method + ":" + uri)
+
+	fields := []string{
+		fmt.Sprintf("username=%q", username),
+		fmt.Sprintf("realm=%q", realm),
+		fmt.Sprintf("nonce=%q", nonce),
+		fmt.Sprintf("uri=%q", uri),
+	}
+
+	qops := strings.Split(params["qop"], ",")
+	if params["qop"] == "" {
+		fields = append(fields, fmt.Sprintf("response=%q", h(ha1+":"+nonce+":"+ha2)))
+	} else {
+		var qop string
+		for _, q := range qops {
+			if strings.TrimSpace(q) == "auth" {
+				qop = "auth"
+			}
+		}
+		if qop == "" {
+			return "", fmt.Errorf("unsupported digest qop %q", params["qop"])
+		}
+		b := make([]byte, 8)
+		rand.Read(b)
+		cnonce := hex.EncodeToString(b)
+		nc := "00000001"
+		response := h(ha1 + ":" + nonce + ":" + nc + ":" + cnonce + ":" + qop + ":" + ha2)
+		fields = append(fields,
+			"qop="+qop,
+			"nc="+nc,
+			fmt.Sprintf("cnonce=%q", cnonce),
+			fmt.Sprintf("response=%q", response),
+		)
+	}
+	if algorithm != "" {
+		fields = append(fields, "algorithm="+algorithm)
+	}
+	if opaque, ok := params["opaque"]; ok {
+		fields = append(fields, fmt.Sprintf("opaque=%q", opaque))
+	}
+	return "Digest " + strings.Join(fields, ", "), nil
+}
+
+// parseAuthParams parses the comma separated key=value pairs of an HTTP
+// authentication challenge. Values may be quoted.
+func parseAuthParams(s string) map[string]string {
+	params := map[string]string{}
+	for s != "" {
+		s = strings.TrimLeft(s, " ,")
+		i := strings.IndexByte(s, '=')
+		if i < 0 {
+			break
+		}
+		key := strings.ToLower(strings.TrimSpace(s[:i]))
+		s = s[i+1:]
+
+		var value string
+		if strings.HasPrefix(s, `"`) {
+			end := 1
+			for end < len(s) && s[end] != '"' {
+				if s[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			value = strings.NewReplacer(`\"`, `"`, `\\`, `\`).Replace(s[1:min(end, len(s))])
+			s = s[min(end+1, len(s)):]
+		} else {
+			end := strings.IndexByte(s, ',')
+			if end < 0 {
+				end = len(s)
+			}
+			value = strings.TrimSpace(s[:end])
+			s = s[end:]
+		}
+		params[key] = value
+	}
+	return params
+}
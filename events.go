@@ -0,0 +1,209 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// jsonOutput is set by -output jsonl. Every event is then written to stdout
+// as a JSON object on a line of its own instead of being printed for humans.
+var jsonOutput bool
+
+// event is a single line of -output jsonl.
+type event struct {
+	Time      time.Time `json:"time"`
+	Event     string    `json:"event"`
+	Conn      string    `json:"conn,omitempty"`
+	Direction string    `json:"direction,omitempty"`
+	Opcode    string    `json:"opcode,omitempty"`
+
+	// Frame header fields, for frame events.
+	Fin  *bool  `json:"fin,omitempty"`
+	RSV  string `json:"rsv,omitempty"`
+	Mask string `json:"mask,omitempty"`
+
+	Case    string `json:"case,omitempty"`
+	Outcome string `json:"outcome,omitempty"`
+	ID      string `json:"id,omitempty"`
+	Method  string `json:"method,omitempty"`
+
+	Seq      int     `json:"seq,omitempty"`
+	Size     *int    `json:"size,omitempty"`
+	WireSize int     `json:"wire_size,omitempty"`
+	Payload  *string `json:"payload,omitempty"`
+	Encoding string  `json:"encoding,omitempty"`
+
+	URL         string      `json:"url,omitempty"`
+	Subprotocol string      `json:"subprotocol,omitempty"`
+	ALPN        string      `json:"alpn,omitempty"`
+	Status      int         `json:"status,omitempty"`
+	Request     string      `json:"request,omitempty"`
+	Response    string      `json:"response,omitempty"`
+	Headers     http.Header `json:"headers,omitempty"`
+
+	Code   int         `json:"code,omitempty"`
+	Reason string      `json:"reason,omitempty"`
+	RTT    float64     `json:"rtt_ms,omitempty"`
+	Timing *timingInfo `json:"timing,omitempty"`
+
+	Certificate string    `json:"certificate,omitempty"`
+	Cert        *certInfo `json:"cert,omitempty"`
+	Revocation  string    `json:"revocation,omitempty"`
+
+	Source string    `json:"source,omitempty"`
+	JWT    *jwtToken `json:"jwt,omitempty"`
+	SCT    *sctInfo  `json:"sct,omitempty"`
+
+	Version    int    `json:"version,omitempty"`
+	Message    string `json:"message,omitempty"`
+	Error      string `json:"error,omitempty"`
+	ExitStatus *int   `json:"exit_status,omitempty"`
+}
+
+var (
+	eventMu  sync.Mutex
+	eventOut = newEventEncoder()
+)
+
+func newEventEncoder() *json.Encoder {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetEscapeHTML(false)
+	return enc
+}
+
+// emit writes e to stdout, stamping it with the current time.
+func emit(e event) {
+	e.Time = time.Now()
+
+	eventMu.Lock()
+	defer eventMu.Unlock()
+	eventOut.Encode(e)
+}
+
+// setPayload sets the payload of e. Payloads that are not valid UTF-8 are
+// base64 encoded.
+func (e *event) setPayload(data []byte) {
+	size := len(data)
+	e.Size = &size
+	payload := string(data)
+	if !utf8.Valid(data) {
+		payload = base64.StdEncoding.EncodeToString(data)
+		e.Encoding = "base64"
+	}
+	e.Payload = &payload
+}
+
+func direction(sent bool) string {
+	if sent {
+		return "out"
+	}
+	return "in"
+}
+
+// emitMessage emits a data message sent or received.
+func emitMessage(sent bool, msg message) {
+	emit(messageEvent(sent, msg))
+}
+
+func messageEvent(sent bool, msg message) event {
+	e := event{
+		Event:     "message",
+		Conn:      msg.conn,
+		Direction: direction(sent),
+		Opcode:    strings.ToLower(opcodeName(msg.messageType)),
+		Seq:       msg.seq,
+	}
+	e.setPayload(msg.data)
+	if compression && msg.wireSize != len(msg.data) {
+		e.WireSize = msg.wireSize
+	}
+	return e
+}
+
+// emitFrame is the frame hook in -output jsonl mode. Control frames are
+// emitted as ping, pong and close events, and with -frames every frame
+// header is emitted as well.
+func emitFrame(sent bool, f frame) {
+	if showFrames {
+		emit(frameEvent(sent, f))
+	}
+
+	switch f.opcode {
+	case PingMessage, PongMessage:
+		e := event{Event: strings.ToLower(opcodeName(f.opcode)), Direction: direction(sent)}
+		e.setPayload(f.payload)
+		emit(e)
+	case CloseMessage:
+		e := event{Event: "close", Direction: direction(sent), Code: 1005}
+		if len(f.payload) >= 2 {
+			e.Code = int(binary.BigEndian.Uint16(f.payload))
+			e.Reason = string(f.payload[2:])
+		}
+		emit(e)
+	}
+}
+
+// frameEvent returns the header fields of a frame as a frame event.
+func frameEvent(sent bool, f frame) event {
+	fin := f.fin
+	size := len(f.payload)
+	e := event{
+		Event:     "frame",
+		Direction: direction(sent),
+		Opcode:    strings.ToLower(opcodeName(f.opcode)),
+		Fin:       &fin,
+		RSV:       fmt.Sprintf("%d%d%d", bit(f.rsv1), bit(f.rsv2), bit(f.rsv3)),
+		Size:      &size,
+	}
+	if f.masked {
+		e.Mask = hex.EncodeToString(f.maskKey[:])
+	}
+	return e
+}
+
+// emitHandshake emits the response to an upgrade request. The raw request
+// and response headers are included if they were recorded.
+func emitHandshake(url string, tap *handshakeTap, resp *http.Response) {
+	emit(handshakeEvent(url, tap, resp))
+}
+
+func handshakeEvent(url string, tap *handshakeTap, resp *http.Response) event {
+	e := event{Event: "handshake", URL: url}
+	if tap != nil {
+		e.Request = tap.request.String()
+		e.Response = tap.response.String()
+	}
+	if resp != nil {
+		e.Status = resp.StatusCode
+		e.Headers = resp.Header
+		e.Subprotocol = resp.Header.Get("Sec-WebSocket-Protocol")
+	}
+	return e
+}
+
+// emitExit emits why the connection ended along with the exit status.
+func emitExit(err error, status int) {
+	emit(exitEvent(err, status))
+}
+
+func exitEvent(err error, status int) event {
+	e := event{Event: "exit", ExitStatus: &status}
+	if err != nil {
+		e.Error = err.Error()
+	}
+	var ce *CloseError
+	if errors.As(err, &ce) {
+		e.Code, e.Reason = ce.Code, ce.Text
+	}
+	return e
+}
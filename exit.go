@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Exit statuses.
+const (
+	exitOK            = 0
+	exitError         = 1
+	exitUsage         = 2
+	exitConnect       = 3
+	exitTLS           = 4
+	exitHandshake     = 5
+	exitAbnormalClose = 6
+	exitTimeout       = 7
+	exitFailCondition = 8
+	exitInterrupted   = 130
+)
+
+// handshakeError is returned when the server rejects or botches the upgrade
+// request.
+type handshakeError struct {
+	reason string
+}
+
+func (e *handshakeError) Error() string {
+	return "websocket: bad handshake: " + e.reason
+}
+
+// dialError wraps errors opening the network connection to the server.
+type dialError struct {
+	err error
+}
+
+func (e *dialError) Error() string { return e.err.Error() }
+func (e *dialError) Unwrap() error { return e.err }
+
+// timeoutError is returned when the peer does not respond in time.
+type timeoutError struct {
+	msg string
+}
+
+func (e *timeoutError) Error() string { return e.msg }
+func (e *timeoutError) Timeout() bool { return true }
+
+// isRemoteTLSAlert reports whether err is a TLS alert sent by the server,
+// such as the one rejecting a missing or untrusted client certificate. With
+// TLS 1.3 it arrives after the handshake, on the first read.
+func isRemoteTLSAlert(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "remote error"
+}
+
+// exitStatus returns the exit status for the error that ended wsd.
+func exitStatus(err error) int {
+	var (
+		ce        *CloseError
+		he        *handshakeError
+		de        *dialError
+		cond      *conditionMet
+		replayErr *replayError
+		goldenErr *goldenError
+		timeout   interface{ Timeout() bool }
+		verifyErr *tls.CertificateVerificationError
+		unknownCA x509.UnknownAuthorityError
+		hostErr   x509.HostnameError
+		invalid   x509.CertificateInvalidError
+		alert     tls.AlertError
+		pinErr    pinError
+		record    tls.RecordHeaderError
+	)
+	switch {
+	case err == nil:
+		return exitOK
+	case errors.As(err, &cond):
+		if cond.fail {
+			return exitFailCondition
+		}
+		return exitOK
+	case errors.As(err, &replayErr), errors.As(err, &goldenErr):
+		return exitFailCondition
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return exitAbnormalClose
+	case errors.As(err, &ce):
+		if ce.Code == 1000 || ce.Code == 1001 || ce.Code == 1005 {
+			return exitOK
+		}
+		return exitAbnormalClose
+	case errors.Is(err, errInterrupted):
+		return exitInterrupted
+	case errors.As(err, &he):
+		return exitHandshake
+	case errors.As(err, &verifyErr), errors.As(err, &unknownCA), errors.As(err, &hostErr),
+		errors.As(err, &invalid), errors.As(err, &alert), errors.As(err, &record), errors.As(err, &pinErr),
+		isRemoteTLSAlert(err):
+		return exitTLS
+	case errors.Is(err, context.DeadlineExceeded),
+		errors.As(err, &timeout) && timeout.Timeout():
+		return exitTimeout
+	case errors.As(err, &de):
+		return exitConnect
+	}
+	var ne net.Error
+	if errors.As(err, &ne) {
+		return exitAbnormalClose
+	}
+	return exitError
+}
+
+// exitCondition is a condition given with -exit-on or -fail-on.
+type exitCondition struct {
+	spec string
+	fail bool
+
+	// count is the number of messages to receive, or 0.
+	count int
+	// pattern is matched against received messages, if set.
+	pattern *regexp.Regexp
+	// closeCode is the close code to wait for, or 0.
+	closeCode int
+}
+
+// parseExitCondition parses a condition:
+//
+//	message       a message is received
+//	messages=N    N messages are received
+//	match=REGEXP  a received message matches REGEXP
+//	close=CODE    the server closes the connection with CODE
+func parseExitCondition(spec string, fail bool) (*exitCondition, error) {
+	c := &exitCondition{spec: spec, fail: fail}
+	name, value, _ := strings.Cut(spec, "=")
+
+	var err error
+	switch name {
+	case "message":
+		c.count = 1
+	case "messages":
+		if c.count, err = strconv.Atoi(value); err != nil || c.count <= 0 {
+			return nil, fmt.Errorf("invalid condition %q: expected a positive count", spec)
+		}
+	case "match":
+		if c.pattern, err = regexp.Compile(value); err != nil {
+			return nil, fmt.Errorf("invalid condition %q: %v", spec, err)
+		}
+	case "close":
+		if c.closeCode, err = strconv.Atoi(value); err != nil {
+			return nil, fmt.Errorf("invalid condition %q: expected a close code", spec)
+		}
+	default:
+		return nil, fmt.Errorf("unknown condition %q", spec)
+	}
+	return c, nil
+}
+
+// conditionMet ends the connection when an exit condition is met.
+type conditionMet struct {
+	*exitCondition
+	// cause is the error that met the condition, if any.
+	cause error
+}
+
+func (c *conditionMet) Error() string {
+	if c.fail {
+		return "fail condition met: " + c.spec
+	}
+	return "exit condition met: " + c.spec
+}
+
+func (c *conditionMet) Unwrap() error { return c.cause }
+
+// exitWatcher checks received messages and close frames against the exit
+// conditions.
+type exitWatcher struct {
+	conditions []*exitCondition
+	received   int
+}
+
+func newExitWatcher(exitOn, failOn []string) (*exitWatcher, error) {
+	w := &exitWatcher{}
+	for _, specs := range []struct {
+		list []string
+		fail bool
+	}{{exitOn, false}, {failOn, true}} {
+		for _, spec := range specs.list {
+			c, err := parseExitCondition(spec, specs.fail)
+			if err != nil {
+				return nil, err
+			}
+			w.conditions = append(w.conditions, c)
+		}
+	}
+	return w, nil
+}
+
+// message returns a non-nil error if receiving msg meets a condition.
+func (w *exitWatcher) message(msg message) error {
+	w.received++
+	for _, c := range w.conditions {
+		if (c.count > 0 && w.received >= c.count) || (c.pattern != nil && c.pattern.Match(msg.data)) {
+			return &conditionMet{exitCondition: c}
+		}
+	}
+	return nil
+}
+
+// close returns a non-nil error if the close error meets a condition.
+func (w *exitWatcher) close(err error) error {
+	var ce *CloseError
+	if !errors.As(err, &ce) {
+		return err
+	}
+	for _, c := range w.conditions {
+		if c.closeCode == ce.Code {
+			return &conditionMet{exitCondition: c, cause: err}
+		}
+	}
+	return err
+}
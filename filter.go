@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	"github.com/itchyny/gojq"
+)
+
+// filterCode is the compiled -filter expression, or nil.
+var filterCode *gojq.Code
+
+// compileFilter compiles the jq expression given by -filter.
+func compileFilter(expr string) error {
+	query, err := gojq.Parse(expr)
+	if err != nil {
+		return fmt.Errorf("invalid filter %q: %v", expr, err)
+	}
+	filterCode, err = gojq.Compile(query)
+	if err != nil {
+		return fmt.Errorf("invalid filter %q: %v", expr, err)
+	}
+	return nil
+}
+
+// filterMessage runs -filter on a received message, returning a text message
+// for each value the filter produces. Messages that are not JSON are passed
+// through unchanged; a filter producing no values, e.g. select(...), drops the
+// message.
+func filterMessage(msg message) ([]message, error) {
+	if filterCode == nil || msg.messageType != TextMessage {
+		return []message{msg}, nil
+	}
+	dec := json.NewDecoder(bytes.NewReader(msg.data))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil || dec.More() {
+		return []message{msg}, nil
+	}
+
+	var out []message
+	iter := filterCode.Run(v)
+	for {
+		v, ok := iter.Next()
+		if !ok {
+			return out, nil
+		}
+		if err, ok := v.(error); ok {
+			return out, fmt.Errorf("filter: %v", err)
+		}
+		data, err := gojq.Marshal(v)
+		if err != nil {
+			return out, fmt.Errorf("filter: %v", err)
+		}
+		filtered := msg
+		filtered.data, filtered.wireSize = data, len(data)
+		out = append(out, filtered)
+	}
+}
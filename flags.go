@@ -0,0 +1,236 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"gopkg.in/yaml.v3"
+)
+
+// stringList is a flag.Value collecting the values of a repeatable flag.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ", ")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// sendFileList is the flag.Value of -send-file, which adds the contents of
+// each file to the -send messages, keeping the order of the two flags. Text
+// files lose a trailing newline.
+type sendFileList struct {
+	send *stringList
+}
+
+// sendFiles marks the -send messages read by -send-file, by index, which
+// are sent as they are rather than interpolated.
+var sendFiles = map[int]bool{}
+
+func (l sendFileList) String() string {
+	return ""
+}
+
+func (l sendFileList) Set(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	sendFiles[len(*l.send)] = true
+	if utf8.Valid(data) {
+		text := strings.TrimSuffix(strings.TrimSuffix(string(data), "\n"), "\r")
+		return l.send.Set(`\text ` + text)
+	}
+	return l.send.Set(`\base64 ` + base64.StdEncoding.EncodeToString(data))
+}
+
+// envName returns the environment variable for a flag: WSD_ followed by the
+// flag name in upper case, with dashes and camel case turned into
+// underscores, e.g. WSD_MAX_REDIRECTS and WSD_INSECURE_SKIP_VERIFY.
+func envName(flagName string) string {
+	var b strings.Builder
+	b.WriteString("WSD_")
+	for i, r := range flagName {
+		switch {
+		case r == '-':
+			b.WriteByte('_')
+		case unicode.IsUpper(r) && i > 0:
+			b.WriteByte('_')
+			b.WriteRune(r)
+		default:
+			b.WriteRune(unicode.ToUpper(r))
+		}
+	}
+	return b.String()
+}
+
+// envAliases are further environment variables setting flags, by flag name.
+var envAliases = map[string]string{"insecureSkipVerify": "WSD_INSECURE"}
+
+// envNames returns the environment variables of a flag: its own, then its
+// alias if any.
+func envNames(flagName string) []string {
+	names := []string{envName(flagName)}
+	if alias, ok := envAliases[flagName]; ok {
+		names = append(names, alias)
+	}
+	return names
+}
+
+// lookupEnv returns the first set environment variable of a flag and its
+// value.
+func lookupEnv(flagName string) (name, value string, ok bool) {
+	for _, name := range envNames(flagName) {
+		if value, ok := os.LookupEnv(name); ok {
+			return name, value, true
+		}
+	}
+	return "", "", false
+}
+
+// listEnvNames adds the environment variables of each flag to its usage,
+// for -help.
+func listEnvNames() {
+	flag.VisitAll(func(f *flag.Flag) {
+		f.Usage += " (env " + strings.Join(envNames(f.Name), ", ") + ")"
+	})
+}
+
+// applyEnv sets the flags not given on the command line from their WSD_*
+// environment variables. Repeatable flags take one value per line.
+func applyEnv() error {
+	// Aliases such as -i and -show-handshake share their variable, so flags
+	// are told apart by it rather than by name.
+	given := map[flag.Value]bool{}
+	flag.Visit(func(f *flag.Flag) { given[f.Value] = true })
+
+	var err error
+	flag.VisitAll(func(f *flag.Flag) {
+		name, value, ok := lookupEnv(f.Name)
+		if !ok || given[f.Value] || err != nil {
+			return
+		}
+		given[f.Value] = true
+		values := []string{value}
+		if _, repeatable := f.Value.(*stringList); repeatable {
+			values = strings.Split(strings.TrimSuffix(value, "\n"), "\n")
+		}
+		for _, v := range values {
+			if setErr := f.Value.Set(v); setErr != nil {
+				err = fmt.Errorf("invalid value %q for %s: %v", v, name, setErr)
+				return
+			}
+		}
+	})
+	return err
+}
+
+// configFlags are the flags set by the -config file, by name.
+var configFlags = map[string]bool{}
+
+// applyConfig sets the flags given neither on the command line nor in the
+// environment from the -config file, a YAML mapping of flag names to
+// values, such as
+//
+//	url: wss://example.com/ws
+//	insecureSkipVerify: true
+//	H:
+//	  - "Authorization: Bearer x"
+//	  - "X-Client: wsd"
+//
+// Repeatable flags take a list of values.
+func applyConfig() error {
+	if configFile == "" {
+		return nil
+	}
+	data, err := os.ReadFile(configFile)
+	if err != nil {
+		return err
+	}
+	var config map[string]yaml.Node
+	if err := yaml.Unmarshal(data, &config); err != nil {
+		return fmt.Errorf("%s: %v", configFile, err)
+	}
+
+	// Flags are told apart by their value, as by applyEnv.
+	given := map[flag.Value]bool{}
+	flag.Visit(func(f *flag.Flag) { given[f.Value] = true })
+	flag.VisitAll(func(f *flag.Flag) {
+		if _, _, ok := lookupEnv(f.Name); ok {
+			given[f.Value] = true
+		}
+	})
+
+	names := make([]string, 0, len(config))
+	for name := range config {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		f := flag.Lookup(name)
+		switch {
+		case f == nil:
+			return fmt.Errorf("%s: unknown flag %q", configFile, name)
+		case name == "config":
+			return fmt.Errorf("%s: config cannot be set in the config file", configFile)
+		case given[f.Value]:
+			continue
+		}
+		given[f.Value] = true
+		configFlags[name] = true
+
+		node := config[name]
+		values := []*yaml.Node{&node}
+		if node.Kind == yaml.SequenceNode {
+			if _, repeatable := f.Value.(*stringList); !repeatable {
+				return fmt.Errorf("%s: %s takes a single value", configFile, name)
+			}
+			values = node.Content
+		}
+		for _, v := range values {
+			if v.Kind != yaml.ScalarNode {
+				return fmt.Errorf("%s: invalid value for %s, expected a string, number or boolean", configFile, name)
+			}
+			if err := f.Value.Set(v.Value); err != nil {
+				return fmt.Errorf("%s: invalid value %q for %s: %v", configFile, v.Value, name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// parseURLArgs sets urls from the arguments, which are URLs to try in turn,
+// or else from -url.
+func parseURLArgs() error {
+	if flag.NArg() == 0 {
+		urls = []string{url}
+		return nil
+	}
+	var urlGiven bool
+	flag.Visit(func(f *flag.Flag) { urlGiven = urlGiven || f.Name == "url" })
+	if urlGiven {
+		return errors.New("give the URL either with -url or as arguments")
+	}
+	urls = flag.Args()
+	url = urls[0]
+	return nil
+}
+
+// flagGiven reports whether a flag was given, on the command line, in its
+// environment variable or in the -config file.
+func flagGiven(name string) bool {
+	var given bool
+	flag.Visit(func(f *flag.Flag) { given = given || f.Name == name })
+	_, _, inEnv := lookupEnv(name)
+	return given || inEnv || configFlags[name]
+}
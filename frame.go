@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// continuationFrame is the opcode of a frame continuing a fragmented message.
+const continuationFrame = 0
+
+// frame is a single WebSocket frame as defined in RFC 6455 section 5.2.
+type frame struct {
+	fin     bool
+	rsv1    bool
+	rsv2    bool
+	rsv3    bool
+	opcode  int
+	masked  bool
+	maskKey [4]byte
+	payload []byte
+
+	// length is the payload length announced in the header. It differs
+	// from len(payload) only for deliberately malformed frames.
+	length uint64
+}
+
+func isControl(opcode int) bool {
+	return opcode >= CloseMessage
+}
+
+var errFrameTooLarge = errors.New("frame payload exceeds read limit")
+
+// readFrame reads a frame from r and unmasks its payload. Payloads larger
+// than limit are rejected; a limit of 0 means no limit.
+func readFrame(r *bufio.Reader, limit int64) (frame, error) {
+	var f frame
+	var header [2]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return f, err
+	}
+	f.fin = header[0]&0x80 != 0
+	f.rsv1 = header[0]&0x40 != 0
+	f.rsv2 = header[0]&0x20 != 0
+	f.rsv3 = header[0]&0x10 != 0
+	f.opcode = int(header[0] & 0x0f)
+	f.masked = header[1]&0x80 != 0
+	f.length = uint64(header[1] & 0x7f)
+
+	switch f.length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return f, unexpectedEOF(err)
+		}
+		f.length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return f, unexpectedEOF(err)
+		}
+		f.length = binary.BigEndian.Uint64(ext[:])
+	}
+
+	if f.masked {
+		if _, err := io.ReadFull(r, f.maskKey[:]); err != nil {
+			return f, unexpectedEOF(err)
+		}
+	}
+
+	if f.length > 1<<63-1 || (limit > 0 && f.length > uint64(limit)) {
+		return f, errFrameTooLarge
+	}
+	payload, err := readPayload(r, f.length)
+	if err != nil {
+		return f, unexpectedEOF(err)
+	}
+	f.payload = payload
+	if f.masked {
+		maskBytes(f.maskKey, f.payload)
+	}
+	return f, nil
+}
+
+// payloadChunk is the most allocated for a payload before its bytes arrive.
+const payloadChunk = 64 << 10
+
+// readPayload reads a payload of n bytes from r. Large payloads are read in
+// chunks, growing the buffer as they arrive, so that the length announced
+// by the peer is not allocated up front.
+func readPayload(r io.Reader, n uint64) ([]byte, error) {
+	if n <= payloadChunk {
+		b := make([]byte, n)
+		_, err := io.ReadFull(r, b)
+		return b, err
+	}
+	var b bytes.Buffer
+	b.Grow(payloadChunk)
+	if _, err := io.CopyN(&b, r, int64(n)); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// appendFrame encodes f, masking the payload if f.masked is set. If f.length
+// is 0 the actual payload length is announced.
+func appendFrame(b []byte, f frame) []byte {
+	var b0 byte
+	if f.fin {
+		b0 |= 0x80
+	}
+	if f.rsv1 {
+		b0 |= 0x40
+	}
+	if f.rsv2 {
+		b0 |= 0x20
+	}
+	if f.rsv3 {
+		b0 |= 0x10
+	}
+	b0 |= byte(f.opcode) & 0x0f
+
+	length := f.length
+	if length == 0 {
+		length = uint64(len(f.payload))
+	}
+	var b1 byte
+	if f.masked {
+		b1 |= 0x80
+	}
+	switch {
+	case length <= 125:
+		b = append(b, b0, b1|byte(length))
+	case length <= 0xffff:
+		b = append(b, b0, b1|126)
+		b = binary.BigEndian.AppendUint16(b, uint16(length))
+	default:
+		b = append(b, b0, b1|127)
+		b = binary.BigEndian.AppendUint64(b, length)
+	}
+
+	if f.masked {
+		b = append(b, f.maskKey[:]...)
+		start := len(b)
+		b = append(b, f.payload...)
+		maskBytes(f.maskKey, b[start:])
+	} else {
+		b = append(b, f.payload...)
+	}
+	return b
+}
+
+// newMaskKey returns a random masking key for a client frame.
+func newMaskKey() [4]byte {
+	var key [4]byte
+	if _, err := rand.Read(key[:]); err != nil {
+		panic(err)
+	}
+	return key
+}
+
+func maskBytes(key [4]byte, b []byte) {
+	for i := range b {
+		b[i] ^= key[i&3]
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+)
+
+func TestFrameRoundTrip(t *testing.T) {
+	for _, n := range []int{0, 1, 125, 126, 0xffff, 0x10000, 3*payloadChunk + 7} {
+		payload := bytes.Repeat([]byte("wsd"), n/3+1)[:n]
+		for _, masked := range []bool{false, true} {
+			in := frame{fin: true, opcode: BinaryMessage, masked: masked, payload: payload}
+			if masked {
+				in.maskKey = newMaskKey()
+			}
+			b := appendFrame(nil, in)
+			out, err := readFrame(bufio.NewReader(bytes.NewReader(b)), 0)
+			if err != nil {
+				t.Fatalf("length %d, masked %v: %v", n, masked, err)
+			}
+			if !out.fin || out.opcode != BinaryMessage || out.masked != masked || out.length != uint64(n) {
+				t.Errorf("length %d, masked %v: got header %+v", n, masked, out)
+			}
+			if !bytes.Equal(out.payload, payload) {
+				t.Errorf("length %d, masked %v: payload differs", n, masked)
+			}
+		}
+	}
+}
+
+func TestFrameHeaderBits(t *testing.T) {
+	b := appendFrame(nil, frame{rsv1: true, rsv3: true, opcode: PingMessage, payload: []byte("hi")})
+	f, err := readFrame(bufio.NewReader(bytes.NewReader(b)), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.fin || !f.rsv1 || f.rsv2 || !f.rsv3 || f.opcode != PingMessage || !isControl(f.opcode) {
+		t.Errorf("got %+v", f)
+	}
+}
+
+// header127 returns the header of an unmasked binary frame announcing a
+// payload of length bytes with the 64-bit extended length.
+func header127(length uint64) []byte {
+	b := []byte{0x82, 127}
+	return binary.BigEndian.AppendUint64(b, length)
+}
+
+func TestFrameOversizedLength(t *testing.T) {
+	for _, length := range []uint64{1<<63 - 16, 1 << 40, payloadChunk + 1} {
+		b := append(header127(length), "short"...)
+		_, err := readFrame(bufio.NewReader(bytes.NewReader(b)), 0)
+		if err != io.ErrUnexpectedEOF {
+			t.Errorf("length %#x: got %v, want %v", length, err, io.ErrUnexpectedEOF)
+		}
+	}
+	_, err := readFrame(bufio.NewReader(bytes.NewReader(header127(1<<64-1))), 0)
+	if err != errFrameTooLarge {
+		t.Errorf("length 2^64-1: got %v, want %v", err, errFrameTooLarge)
+	}
+}
+
+func TestFrameReadLimit(t *testing.T) {
+	b := appendFrame(nil, frame{fin: true, opcode: TextMessage, payload: make([]byte, 200)})
+	if _, err := readFrame(bufio.NewReader(bytes.NewReader(b)), 100); err != errFrameTooLarge {
+		t.Errorf("got %v, want %v", err, errFrameTooLarge)
+	}
+	if _, err := readFrame(bufio.NewReader(bytes.NewReader(b)), 200); err != nil {
+		t.Errorf("payload at the limit: %v", err)
+	}
+}
+
+func TestFrameTruncated(t *testing.T) {
+	b := appendFrame(nil, frame{fin: true, opcode: TextMessage, masked: true, maskKey: newMaskKey(), payload: make([]byte, 300)})
+	if _, err := readFrame(bufio.NewReader(bytes.NewReader(nil)), 0); err != io.EOF {
+		t.Errorf("empty input: got %v, want %v", err, io.EOF)
+	}
+	for _, n := range []int{1, 3, 5, len(b) - 1} {
+		if _, err := readFrame(bufio.NewReader(bytes.NewReader(b[:n])), 0); err != io.ErrUnexpectedEOF {
+			t.Errorf("%d of %d bytes: got %v, want %v", n, len(b), err, io.ErrUnexpectedEOF)
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+var opcodeNames = map[int]string{
+	continuationFrame: "CONT",
+	TextMessage:       "TEXT",
+	BinaryMessage:     "BINARY",
+	CloseMessage:      "CLOSE",
+	PingMessage:       "PING",
+	PongMessage:       "PONG",
+}
+
+func opcodeName(opcode int) string {
+	if name, ok := opcodeNames[opcode]; ok {
+		return name
+	}
+	return fmt.Sprintf("RESERVED(%#x)", opcode)
+}
+
+// printFrame prints the header fields of a frame sent or received on the
+// wire, as shown by -frames.
+func printFrame(sent bool, f frame) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%-6s fin=%d rsv=%d%d%d len=%d", opcodeName(f.opcode), bit(f.fin), bit(f.rsv1), bit(f.rsv2), bit(f.rsv3), len(f.payload))
+	if f.masked {
+		fmt.Fprintf(&b, " mask=%x", f.maskKey)
+	}
+	if sent {
+		printLine("→ %s", yellow(b.String()))
+	} else {
+		printLine("← %s", cyan(b.String()))
+	}
+}
+
+func bit(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// chainFrameHooks returns a frame hook calling each of hooks in turn, or nil
+// if there are none.
+func chainFrameHooks(hooks []func(sent bool, f frame)) func(sent bool, f frame) {
+	switch len(hooks) {
+	case 0:
+		return nil
+	case 1:
+		return hooks[0]
+	}
+	return func(sent bool, f frame) {
+		for _, hook := range hooks {
+			hook(sent, f)
+		}
+	}
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/rand"
+	"strings"
+	"time"
+)
+
+// fuzzMutation is a kind of invalid input fuzz sends, generated at random.
+type fuzzMutation struct {
+	name string
+	gen  func(r *rand.Rand) fuzzInput
+}
+
+// fuzzInput is the bytes sent on a connection by fuzz. If halfClose is set
+// the sending side of the connection is closed after them, as the server
+// waits for more.
+type fuzzInput struct {
+	desc      string
+	data      []byte
+	halfClose bool
+}
+
+var fuzzMutations = []fuzzMutation{
+	{"opcode", func(r *rand.Rand) fuzzInput {
+		opcode := []int{3, 4, 5, 6, 7, 0xb, 0xc, 0xd, 0xe, 0xf}[r.Intn(10)]
+		payload := randomBytes(r, r.Intn(65))
+		return fuzzInput{desc: fmt.Sprintf("opcode %#x, %d-byte payload", opcode, len(payload)),
+			data: encodeFrame(dataFrame(opcode, r.Intn(2) == 0, payload))}
+	}},
+	{"rsv", func(r *rand.Rand) fuzzInput {
+		f := dataFrame(randomOpcode(r, TextMessage, BinaryMessage, PingMessage), true, []byte("reserved"))
+		rsv := 1 + r.Intn(7)
+		f.rsv1, f.rsv2, f.rsv3 = rsv&4 != 0, rsv&2 != 0, rsv&1 != 0
+		return fuzzInput{desc: fmt.Sprintf("rsv=%03b on %s", rsv, opcodeName(f.opcode)), data: encodeFrame(f)}
+	}},
+	{"control-size", func(r *rand.Rand) fuzzInput {
+		f := dataFrame(randomOpcode(r, PingMessage, PongMessage, CloseMessage), true, randomBytes(r, 126+r.Intn(1024)))
+		if f.opcode == CloseMessage {
+			binary.BigEndian.PutUint16(f.payload, 1000)
+		}
+		return fuzzInput{desc: fmt.Sprintf("%s with %d-byte payload", opcodeName(f.opcode), len(f.payload)), data: encodeFrame(f)}
+	}},
+	{"control-fragment", func(r *rand.Rand) fuzzInput {
+		opcode := randomOpcode(r, PingMessage, PongMessage, CloseMessage)
+		return fuzzInput{desc: fmt.Sprintf("%s without FIN", opcodeName(opcode)),
+			data: append(encodeFrame(dataFrame(opcode, false, []byte{0x03, 0xe8})), encodeFrame(dataFrame(continuationFrame, true, []byte("ment")))...)}
+	}},
+	{"unmasked", func(r *rand.Rand) fuzzInput {
+		f := frame{fin: true, opcode: randomOpcode(r, TextMessage, BinaryMessage, PingMessage), payload: []byte("server-style")}
+		return fuzzInput{desc: fmt.Sprintf("unmasked %s frame", opcodeName(f.opcode)), data: encodeFrame(f)}
+	}},
+	{"truncated", func(r *rand.Rand) fuzzInput {
+		f := dataFrame(randomOpcode(r, TextMessage, BinaryMessage), true, randomBytes(r, r.Intn(200)))
+		f.length = uint64(len(f.payload) + 1 + r.Intn(1000))
+		return fuzzInput{desc: fmt.Sprintf("announces %d bytes, sends %d", f.length, len(f.payload)), data: encodeFrame(f), halfClose: true}
+	}},
+	{"truncated-header", func(r *rand.Rand) fuzzInput {
+		full := encodeFrame(dataFrame(BinaryMessage, true, randomBytes(r, []int{10, 200, 70000}[r.Intn(3)])))
+		headerLen := len(full) - int(frameLength(full))
+		cut := 1 + r.Intn(headerLen-1)
+		return fuzzInput{desc: fmt.Sprintf("header cut after %d of %d bytes", cut, headerLen), data: full[:cut], halfClose: true}
+	}},
+	{"huge-length", func(r *rand.Rand) fuzzInput {
+		f := dataFrame(randomOpcode(r, TextMessage, BinaryMessage), true, nil)
+		f.length = []uint64{1 << 31, 1 << 32, 1 << 62, 1<<63 - 1, 1 << 63, 1<<64 - 1}[r.Intn(6)]
+		return fuzzInput{desc: fmt.Sprintf("announces %d bytes", f.length), data: encodeFrame(f)}
+	}},
+	{"long-length", func(r *rand.Rand) fuzzInput {
+		payload := randomText(r, r.Intn(126))
+		bits := []int{16, 64}[r.Intn(2)]
+		data := []byte{0x81}
+		if bits == 16 {
+			data = binary.BigEndian.AppendUint16(append(data, 0x80|126), uint16(len(payload)))
+		} else {
+			data = binary.BigEndian.AppendUint64(append(data, 0x80|127), uint64(len(payload)))
+		}
+		key := newMaskKey()
+		data = append(data, key[:]...)
+		start := len(data)
+		data = append(data, payload...)
+		maskBytes(key, data[start:])
+		return fuzzInput{desc: fmt.Sprintf("%d-byte payload with %d-bit length", len(payload), bits), data: data}
+	}},
+	{"continuation", func(r *rand.Rand) fuzzInput {
+		if r.Intn(2) == 0 {
+			return fuzzInput{desc: "continuation without a message",
+				data: encodeFrame(dataFrame(continuationFrame, r.Intn(2) == 0, []byte("orphan")))}
+		}
+		return fuzzInput{desc: "message started within a fragmented message",
+			data: append(encodeFrame(dataFrame(TextMessage, false, []byte("first"))), encodeFrame(dataFrame(BinaryMessage, true, []byte("second")))...)}
+	}},
+	{"utf8", func(r *rand.Rand) fuzzInput {
+		invalid := [][]byte{{0xff}, {0xc0, 0xaf}, {0xed, 0xa0, 0x80}, {0xf4, 0x90, 0x80, 0x80}, {0xe2, 0x82}, {0x80}}[r.Intn(6)]
+		payload := append(append(randomText(r, r.Intn(32)), invalid...), randomText(r, r.Intn(32))...)
+		return fuzzInput{desc: fmt.Sprintf("text with % x", invalid), data: encodeFrame(dataFrame(TextMessage, true, payload))}
+	}},
+	{"close", func(r *rand.Rand) fuzzInput {
+		switch r.Intn(3) {
+		case 0:
+			return fuzzInput{desc: "1-byte close payload", data: encodeFrame(dataFrame(CloseMessage, true, []byte{0x03}))}
+		case 1:
+			code := []int{0, 999, 1004, 1005, 1006, 1015, 2999, 5000}[r.Intn(8)]
+			return fuzzInput{desc: fmt.Sprintf("close code %d", code),
+				data: encodeFrame(dataFrame(CloseMessage, true, binary.BigEndian.AppendUint16(nil, uint16(code))))}
+		}
+		return fuzzInput{desc: "close reason with invalid UTF-8",
+			data: encodeFrame(dataFrame(CloseMessage, true, append(binary.BigEndian.AppendUint16(nil, 1000), 0xff, 0xfe)))}
+	}},
+	{"garbage", func(r *rand.Rand) fuzzInput {
+		data := randomBytes(r, 1+r.Intn(64))
+		return fuzzInput{desc: fmt.Sprintf("%d random bytes", len(data)), data: data, halfClose: true}
+	}},
+}
+
+// checkFuzzFlags validates the flags of fuzz.
+func checkFuzzFlags() error {
+	if command != "fuzz" {
+		if flagGiven("iterations") || flagGiven("seed") || mutations != "" {
+			return errors.New("-iterations, -seed and -mutations require fuzz")
+		}
+		return nil
+	}
+	switch {
+	case len(urls) > 1:
+		return errors.New("fuzz takes a single URL")
+	case fuzzIterations <= 0:
+		return errors.New("-iterations must be positive")
+	case caseTimeout <= 0:
+		return errors.New("-case-timeout must be positive")
+	case webTransport:
+		return errors.New("-webtransport is not supported by fuzz")
+	case chaosSpec != "":
+		return errors.New("-chaos is not supported by fuzz")
+	case recordFile != "" || harFileName != "" || pcapFile != "":
+		return errors.New("-record, -har and -pcap are not supported by fuzz")
+	}
+	_, err := selectMutations()
+	return err
+}
+
+// selectMutations returns the mutations of -mutations, or all of them if it
+// is not given.
+func selectMutations() ([]fuzzMutation, error) {
+	if mutations == "" {
+		return fuzzMutations, nil
+	}
+	var selected []fuzzMutation
+	for _, name := range strings.Split(mutations, ",") {
+		name = strings.TrimSpace(name)
+		found := false
+		for _, m := range fuzzMutations {
+			if m.name == name {
+				selected, found = append(selected, m), true
+			}
+		}
+		if !found {
+			names := make([]string, len(fuzzMutations))
+			for i, m := range fuzzMutations {
+				names[i] = m.name
+			}
+			return nil, fmt.Errorf("unknown mutation %q, expected one of %s", name, strings.Join(names, ", "))
+		}
+	}
+	return selected, nil
+}
+
+// fuzzResponse is how the server responded to an input of fuzz: it closed
+// the connection with a close frame, dropped it without one, kept it open,
+// or accepted the input by responding to it.
+type fuzzResponse struct {
+	kind   string
+	code   int
+	reason string
+}
+
+// suspicious reports whether the response is a spec violation: all inputs
+// of fuzz must fail the connection.
+func (r fuzzResponse) suspicious() bool {
+	return r.kind == "open" || r.kind == "accepted"
+}
+
+func (r fuzzResponse) String() string {
+	switch r.kind {
+	case "closed":
+		if r.code == 0 {
+			return "closed without status code"
+		}
+		return "closed with " + formatClose(r.code, r.reason)
+	case "dropped":
+		return "dropped the connection"
+	case "open":
+		return fmt.Sprintf("kept the connection open for %v", caseTimeout)
+	}
+	return r.reason
+}
+
+// runFuzz sends -iterations random invalid inputs, each on a connection of
+// its own, and reports how the server responded to each. It stops early if
+// the server becomes unreachable, which likely means it crashed.
+func runFuzz() int {
+	selected, _ := selectMutations()
+	seed := fuzzSeed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	r := rand.New(rand.NewSource(seed))
+	printLine("fuzzing %s with %d inputs, seed %d...", yellow(url), fuzzIterations, seed)
+
+	counts := map[string]map[string]int{}
+	suspicious, crashed := 0, false
+	for n := 1; n <= fuzzIterations; n++ {
+		m := selected[r.Intn(len(selected))]
+		in := m.gen(r)
+		resp, err := fuzzOnce(in)
+		if err != nil {
+			if n == 1 {
+				printError(err)
+				return exitStatus(err)
+			}
+			printLine("%s after input %d: %v", red("server unreachable"), n-1, err)
+			crashed = true
+			break
+		}
+		if counts[m.name] == nil {
+			counts[m.name] = map[string]int{}
+		}
+		counts[m.name][resp.kind]++
+		if resp.suspicious() {
+			suspicious++
+		}
+
+		if jsonOutput {
+			payload := hex.EncodeToString(in.data)
+			emit(event{Event: "fuzz", Seq: n, Case: m.name, Message: in.desc, Outcome: resp.kind,
+				Code: resp.code, Reason: resp.reason, Payload: &payload, Encoding: "hex"})
+			continue
+		}
+		result := green(resp.String())
+		if resp.suspicious() {
+			result = red(resp.String())
+		}
+		printLine("%4d %-16s %-44s %s", n, m.name, in.desc, result)
+	}
+
+	for _, m := range selected {
+		if c := counts[m.name]; c != nil {
+			printLine("%-17s %d closed, %d dropped, %d open, %d accepted", m.name+":", c["closed"], c["dropped"], c["open"], c["accepted"])
+		}
+	}
+	printLine("%d suspicious responses; rerun with -seed %d to reproduce", suspicious, seed)
+	statsd.flush()
+	tracer.flush()
+	if crashed || suspicious > 0 {
+		return exitFailCondition
+	}
+	return exitOK
+}
+
+// fuzzOnce sends in on a new connection and returns how the server
+// responded. An error is returned only if connecting failed.
+func fuzzOnce(in fuzzInput) (fuzzResponse, error) {
+	ws, err := dial(url, protocol, origin, nil)
+	if err != nil {
+		return fuzzResponse{}, err
+	}
+	defer ws.Close()
+	fc, ok := ws.(*frameConn)
+	if !ok {
+		return fuzzResponse{}, errors.New("not a WebSocket over TCP connection")
+	}
+	fc.conn.SetDeadline(time.Now().Add(caseTimeout))
+	c := &caseConn{frameConn: fc}
+	if c.WriteRaw(in.data) == nil && in.halfClose {
+		if cw, ok := fc.conn.(interface{ CloseWrite() error }); ok {
+			cw.CloseWrite()
+		}
+	}
+	for {
+		f, err := c.next()
+		switch {
+		case isTimeout(err):
+			return fuzzResponse{kind: "open"}, nil
+		case err != nil:
+			return fuzzResponse{kind: "dropped"}, nil
+		case f.opcode == CloseMessage:
+			code, _ := closeStatus(f.payload)
+			resp := fuzzResponse{kind: "closed", code: code}
+			if code != 0 {
+				resp.reason = string(f.payload[2:])
+			}
+			return resp, nil
+		case f.opcode == PingMessage:
+			continue
+		}
+		return fuzzResponse{kind: "accepted", reason: fmt.Sprintf("responded with a %s frame of %d bytes", opcodeName(f.opcode), len(f.payload))}, nil
+	}
+}
+
+// encodeFrame encodes f, generating a masking key if it is masked.
+func encodeFrame(f frame) []byte {
+	if f.masked {
+		f.maskKey = newMaskKey()
+	}
+	return appendFrame(nil, f)
+}
+
+// frameLength returns the payload length announced in the header of the
+// encoded frame b.
+func frameLength(b []byte) uint64 {
+	switch n := b[1] & 0x7f; n {
+	case 126:
+		return uint64(binary.BigEndian.Uint16(b[2:]))
+	case 127:
+		return binary.BigEndian.Uint64(b[2:])
+	default:
+		return uint64(n)
+	}
+}
+
+func randomOpcode(r *rand.Rand, opcodes ...int) int {
+	return opcodes[r.Intn(len(opcodes))]
+}
+
+func randomBytes(r *rand.Rand, n int) []byte {
+	b := make([]byte, n)
+	r.Read(b)
+	return b
+}
+
+// randomText returns n random printable ASCII characters.
+func randomText(r *rand.Rand, n int) []byte {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = byte(' ' + r.Intn('~'-' '+1))
+	}
+	return b
+}
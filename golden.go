@@ -0,0 +1,339 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// golden records the messages received for -expect-golden in client mode,
+// or is nil if it is not given.
+var golden *goldenRecorder
+
+// goldenIgnore is the parsed -golden-ignore.
+var goldenIgnore [][]string
+
+// checkGoldenFlags validates -expect-golden and its options.
+func checkGoldenFlags() error {
+	switch {
+	case expectGolden == "" && (goldenIgnoreSpec != "" || updateGolden):
+		return errors.New("-golden-ignore and -update-golden require -expect-golden")
+	case expectGolden == "":
+		return nil
+	case command != "" && command != "test":
+		return fmt.Errorf("-expect-golden is not supported by %s", command)
+	case connections > 1:
+		return errors.New("-expect-golden does not support -connections")
+	}
+	if goldenIgnoreSpec != "" {
+		for _, path := range strings.Split(goldenIgnoreSpec, ",") {
+			path = strings.TrimPrefix(strings.TrimSpace(path), ".")
+			if path == "" {
+				return fmt.Errorf("invalid -golden-ignore %q", goldenIgnoreSpec)
+			}
+			goldenIgnore = append(goldenIgnore, strings.Split(path, "."))
+		}
+	}
+	if err := os.MkdirAll(expectGolden, 0o755); err != nil {
+		return fmt.Errorf("-expect-golden: %v", err)
+	}
+	if command == "" {
+		golden = &goldenRecorder{path: filepath.Join(expectGolden, goldenName(url)+".jsonl")}
+	}
+	return nil
+}
+
+// goldenName returns the name of the golden file of a URL: its host and
+// path, with the characters unsafe in file names replaced.
+func goldenName(u string) string {
+	u = u[strings.Index(u, "://")+len("://"):]
+	u, _, _ = strings.Cut(u, "?")
+	return strings.Trim(strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '.' {
+			return r
+		}
+		return '_'
+	}, u), "_")
+}
+
+// goldenRecorder collects the messages received in a session, to write
+// them to its golden file if there is none, or else compare them with it.
+type goldenRecorder struct {
+	path string
+
+	mu       sync.Mutex
+	received []message
+}
+
+// record records a received message. A nil recorder records nothing.
+func (g *goldenRecorder) record(msg message) {
+	if g == nil {
+		return
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.received = append(g.received, message{messageType: msg.messageType, data: msg.data})
+}
+
+// goldenError is returned when the messages received differ from the
+// golden ones.
+type goldenError struct {
+	path                          string
+	differed, missing, unexpected int
+}
+
+func (e *goldenError) Error() string {
+	return fmt.Sprintf("messages differ from %s: %d differed, %d missing, %d unexpected", e.path, e.differed, e.missing, e.unexpected)
+}
+
+// finish writes the golden file if there is none or with -update-golden,
+// and otherwise compares the messages received with it, printing each
+// difference. A nil recorder does nothing.
+func (g *goldenRecorder) finish() error {
+	if g == nil {
+		return nil
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	want, err := readGolden(g.path)
+	if errors.Is(err, os.ErrNotExist) || updateGolden {
+		if err := writeGolden(g.path, g.received); err != nil {
+			return err
+		}
+		printLine("recorded %d golden messages to %s", len(g.received), yellow(g.path))
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	e := &goldenError{path: g.path}
+	for i, msg := range g.received {
+		if i >= len(want) {
+			e.unexpected++
+			printError(fmt.Errorf("message %d is not in %s: %s", i+1, g.path, formatMessage(msg)))
+			continue
+		}
+		if diffs := diffGolden(want[i], goldenValueOf(msg)); len(diffs) > 0 {
+			e.differed++
+			printError(fmt.Errorf("message %d differs from %s: %s", i+1, g.path, strings.Join(diffs, "; ")))
+		}
+	}
+	if e.missing = max(len(want)-len(g.received), 0); e.missing > 0 {
+		printError(fmt.Errorf("%d messages of %s were not received", e.missing, g.path))
+	}
+	if e.differed+e.missing+e.unexpected > 0 {
+		return e
+	}
+	printLine("%d messages matched %s", len(g.received), yellow(g.path))
+	return nil
+}
+
+// goldenLine is a line of a golden file, a JSON object holding a message:
+// text that is JSON as json, other text as text and binary data as binary,
+// base64-encoded.
+type goldenLine struct {
+	JSON   json.RawMessage `json:"json,omitempty"`
+	Text   *string         `json:"text,omitempty"`
+	Binary []byte          `json:"binary,omitempty"`
+}
+
+// goldenValue is a message as compared: its decoded JSON, or else its text
+// or binary data.
+type goldenValue struct {
+	json   interface{}
+	isJSON bool
+	text   string
+	binary bool
+}
+
+func goldenValueOf(msg message) goldenValue {
+	if msg.messageType == BinaryMessage {
+		return goldenValue{text: string(msg.data), binary: true}
+	}
+	var v interface{}
+	if json.Unmarshal(msg.data, &v) == nil {
+		return goldenValue{json: v, isJSON: true}
+	}
+	return goldenValue{text: string(msg.data)}
+}
+
+func readGolden(path string) ([]goldenValue, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var values []goldenValue
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(nil, int(max(maxMessageSize, 1<<20))*2)
+	for n := 1; scanner.Scan(); n++ {
+		var line goldenLine
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, n, err)
+		}
+		switch {
+		case line.JSON != nil:
+			var v interface{}
+			json.Unmarshal(line.JSON, &v)
+			values = append(values, goldenValue{json: v, isJSON: true})
+		case line.Text != nil:
+			values = append(values, goldenValue{text: *line.Text})
+		default:
+			values = append(values, goldenValue{text: string(line.Binary), binary: true})
+		}
+	}
+	return values, scanner.Err()
+}
+
+func writeGolden(path string, messages []message) error {
+	var b bytes.Buffer
+	enc := json.NewEncoder(&b)
+	enc.SetEscapeHTML(false)
+	for _, msg := range messages {
+		var line goldenLine
+		var compact bytes.Buffer
+		switch {
+		case msg.messageType == BinaryMessage:
+			line.Binary = msg.data
+			if line.Binary == nil {
+				line.Binary = []byte{}
+			}
+		case json.Valid(msg.data) && json.Compact(&compact, msg.data) == nil:
+			line.JSON = compact.Bytes()
+		default:
+			text := string(msg.data)
+			line.Text = &text
+		}
+		if err := enc.Encode(line); err != nil {
+			return err
+		}
+	}
+	return os.WriteFile(path, b.Bytes(), 0o644)
+}
+
+// diffGolden describes how got differs from want, ignoring the fields of
+// -golden-ignore.
+func diffGolden(want, got goldenValue) []string {
+	switch {
+	case want.isJSON && got.isJSON:
+		for _, path := range goldenIgnore {
+			want.json = ignoreField(want.json, path)
+			got.json = ignoreField(got.json, path)
+		}
+		return diffJSON("", want.json, got.json, nil)
+	case want.isJSON || got.isJSON || want.binary != got.binary || want.text != got.text:
+		return []string{fmt.Sprintf("got %s, golden %s", got, want)}
+	}
+	return nil
+}
+
+func (v goldenValue) String() string {
+	switch {
+	case v.isJSON:
+		data, _ := json.Marshal(v.json)
+		return string(data)
+	case v.binary:
+		return "binary " + base64.StdEncoding.EncodeToString([]byte(v.text))
+	case !utf8.ValidString(v.text):
+		return strconv.QuoteToASCII(v.text)
+	}
+	return strconv.Quote(v.text)
+}
+
+// ignoreField returns v without the field at path, whose elements are
+// object keys or array indexes, or * for any.
+func ignoreField(v interface{}, path []string) interface{} {
+	if len(path) == 0 {
+		return nil
+	}
+	switch v := v.(type) {
+	case map[string]interface{}:
+		c := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			switch {
+			case path[0] != "*" && path[0] != k:
+				c[k] = e
+			case len(path) > 1:
+				c[k] = ignoreField(e, path[1:])
+			}
+		}
+		return c
+	case []interface{}:
+		c := make([]interface{}, len(v))
+		for i, e := range v {
+			c[i] = e
+			if path[0] == "*" || path[0] == strconv.Itoa(i) {
+				c[i] = ignoreField(e, path[1:])
+			}
+		}
+		return c
+	}
+	return v
+}
+
+// diffJSON appends the differences between the JSON values want and got at
+// path to diffs.
+func diffJSON(path string, want, got interface{}, diffs []string) []string {
+	show := func(v interface{}) string {
+		data, _ := json.Marshal(v)
+		return truncate(string(data), 60)
+	}
+	at := path
+	if at == "" {
+		at = "."
+	}
+	switch w := want.(type) {
+	case map[string]interface{}:
+		g, ok := got.(map[string]interface{})
+		if !ok {
+			break
+		}
+		keys := make([]string, 0, len(w)+len(g))
+		for k := range w {
+			keys = append(keys, k)
+		}
+		for k := range g {
+			if _, ok := w[k]; !ok {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			wv, inWant := w[k]
+			gv, inGot := g[k]
+			switch {
+			case !inGot:
+				diffs = append(diffs, fmt.Sprintf("%s.%s missing", path, k))
+			case !inWant:
+				diffs = append(diffs, fmt.Sprintf("%s.%s unexpected: %s", path, k, show(gv)))
+			default:
+				diffs = diffJSON(path+"."+k, wv, gv, diffs)
+			}
+		}
+		return diffs
+	case []interface{}:
+		g, ok := got.([]interface{})
+		if !ok || len(g) != len(w) {
+			break
+		}
+		for i := range w {
+			diffs = diffJSON(fmt.Sprintf("%s[%d]", path, i), w[i], g[i], diffs)
+		}
+		return diffs
+	}
+	if !reflect.DeepEqual(want, got) {
+		diffs = append(diffs, fmt.Sprintf("%s: %s, golden %s", at, show(got), show(want)))
+	}
+	return diffs
+}
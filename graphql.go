@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// graphqlSubprotocol is the subprotocol of GraphQL over WebSocket, as
+// specified by https://github.com/enisdenjo/graphql-ws/blob/master/PROTOCOL.md.
+const graphqlSubprotocol = "graphql-transport-ws"
+
+// checkGraphQLFlags validates -graphql and its options, and offers the
+// graphql-transport-ws subprotocol unless -protocol does.
+func checkGraphQLFlags() error {
+	if graphqlQuery == "" {
+		if graphqlVariables != "" || graphqlInit != "" {
+			return errors.New("-graphql-variables and -graphql-init require -graphql")
+		}
+		return nil
+	}
+	if command != "" {
+		return fmt.Errorf("-graphql is not supported by %s", command)
+	}
+	for _, f := range []struct{ name, value string }{{"-graphql-variables", graphqlVariables}, {"-graphql-init", graphqlInit}} {
+		var v map[string]interface{}
+		if f.value != "" && json.Unmarshal([]byte(f.value), &v) != nil {
+			return fmt.Errorf("%s must be a JSON object", f.name)
+		}
+	}
+	if protocol == "" {
+		protocol = graphqlSubprotocol
+	} else if !contains(strings.Split(protocol, ","), graphqlSubprotocol) {
+		return fmt.Errorf("-graphql requires -protocol to offer %s", graphqlSubprotocol)
+	}
+	return selectAppProtocol("-graphql", func() appSession { return &graphqlSession{} })
+}
+
+// graphqlMessage is a message of graphql-transport-ws.
+type graphqlMessage struct {
+	ID      string          `json:"id,omitempty"`
+	Type    string          `json:"type"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+// graphqlRequest is the payload of a subscribe message.
+type graphqlRequest struct {
+	Query     string          `json:"query"`
+	Variables json.RawMessage `json:"variables,omitempty"`
+}
+
+// graphqlSession runs the operations of -graphql and of the input lines as
+// graphql-transport-ws subscriptions, showing only the payloads of their
+// results. An input line is a GraphQL document, or a JSON subscribe payload
+// like {"query": "...", "variables": {...}}.
+type graphqlSession struct {
+	mu     sync.Mutex
+	lastID int
+	acked  bool
+	queued []message // the subscriptions sent before the server acknowledged
+}
+
+func (s *graphqlSession) open(ctx context.Context, send func(message)) {
+	send(jsonMessage(graphqlMessage{Type: "connection_init", Payload: json.RawMessage(graphqlInit)}))
+	payload, _ := json.Marshal(graphqlRequest{Query: graphqlQuery, Variables: json.RawMessage(graphqlVariables)})
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.queued = append(s.queued, s.subscribe(payload))
+}
+
+func (s *graphqlSession) input(line string) ([]message, error) {
+	payload := []byte(line)
+	var req map[string]interface{}
+	if json.Unmarshal(payload, &req) != nil {
+		// A GraphQL document, which is never valid JSON.
+		payload, _ = json.Marshal(graphqlRequest{Query: line})
+	} else if _, ok := req["query"].(string); !ok {
+		return nil, errors.New(`subscribe payload has no "query"`)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	msg := s.subscribe(payload)
+	if !s.acked {
+		// The server closes the connection on subscriptions sent earlier.
+		s.queued = append(s.queued, msg)
+		return nil, nil
+	}
+	return []message{msg}, nil
+}
+
+// subscribe returns the subscribe message of an operation, with the next
+// ID.
+func (s *graphqlSession) subscribe(payload []byte) message {
+	s.lastID++
+	return jsonMessage(graphqlMessage{ID: strconv.Itoa(s.lastID), Type: "subscribe", Payload: payload})
+}
+
+func (s *graphqlSession) receive(msg message, send func(message)) ([]message, error) {
+	var m graphqlMessage
+	if msg.messageType != TextMessage || json.Unmarshal(msg.data, &m) != nil || m.Type == "" {
+		return []message{msg}, nil
+	}
+	switch m.Type {
+	case "connection_ack":
+		s.mu.Lock()
+		s.acked = true
+		queued := s.queued
+		s.queued = nil
+		s.mu.Unlock()
+		printLine("connection acknowledged")
+		for _, q := range queued {
+			send(q)
+		}
+		return nil, nil
+	case "ping":
+		send(jsonMessage(graphqlMessage{Type: "pong", Payload: m.Payload}))
+		return nil, nil
+	case "pong":
+		return nil, nil
+	case "next":
+		msg.data = m.Payload
+		return []message{msg}, nil
+	case "error":
+		var errs []struct {
+			Message string `json:"message"`
+		}
+		json.Unmarshal(m.Payload, &errs)
+		var texts []string
+		for _, e := range errs {
+			texts = append(texts, e.Message)
+		}
+		if len(texts) == 0 {
+			texts = append(texts, string(m.Payload))
+		}
+		return nil, fmt.Errorf("operation %s failed: %s", m.ID, strings.Join(texts, "; "))
+	case "complete":
+		printLine("operation %s complete", m.ID)
+		return nil, nil
+	}
+	return []message{msg}, nil
+}
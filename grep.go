@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/fatih/color"
+)
+
+var (
+	grepPatterns  []*regexp.Regexp
+	grepVPatterns []*regexp.Regexp
+	matchColor    = color.New(color.FgRed, color.Bold).SprintFunc()
+)
+
+// compileGreps compiles the -grep and -grep-v regular expressions.
+func compileGreps() error {
+	var err error
+	if grepPatterns, err = compilePatterns("grep", grep); err != nil {
+		return err
+	}
+	grepVPatterns, err = compilePatterns("grep-v", grepV)
+	return err
+}
+
+func compilePatterns(name string, exprs []string) ([]*regexp.Regexp, error) {
+	var res []*regexp.Regexp
+	for _, expr := range exprs {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid -%s expression %q: %v", name, expr, err)
+		}
+		res = append(res, re)
+	}
+	return res, nil
+}
+
+// shown reports whether a received message passes -grep and -grep-v: it
+// must match one of the -grep expressions, if any, and none of the -grep-v
+// expressions.
+func shown(msg message) bool {
+	for _, re := range grepVPatterns {
+		if re.Match(msg.data) {
+			return false
+		}
+	}
+	if len(grepPatterns) == 0 {
+		return true
+	}
+	for _, re := range grepPatterns {
+		if re.Match(msg.data) {
+			return true
+		}
+	}
+	return false
+}
+
+// highlight colors s with base, except for matches of the -grep
+// expressions, which are highlighted.
+func highlight(s string, base func(a ...interface{}) string) string {
+	if len(grepPatterns) == 0 {
+		return base(s)
+	}
+
+	// Mark the bytes matched by any expression, then color runs of marked
+	// and unmarked bytes.
+	marked := make([]bool, len(s))
+	for _, re := range grepPatterns {
+		for _, m := range re.FindAllStringIndex(s, -1) {
+			for i := m[0]; i < m[1]; i++ {
+				marked[i] = true
+			}
+		}
+	}
+
+	var b strings.Builder
+	for start := 0; start < len(s); {
+		end := start
+		for end < len(s) && marked[end] == marked[start] {
+			end++
+		}
+		if marked[start] {
+			b.WriteString(matchColor(s[start:end]))
+		} else {
+			b.WriteString(base(s[start:end]))
+		}
+		start = end
+	}
+	return b.String()
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	neturl "net/url"
+	"strings"
+)
+
+var endOfHeader = []byte("\r\n\r\n")
+
+// keyGUID is used to compute Sec-WebSocket-Accept (RFC 6455 section 1.3).
+const keyGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// clientHandshake sends the upgrade request for u over conn and validates
+// the server's response. The response is returned even if the handshake
+// failed, so that callers can inspect redirects.
+func clientHandshake(conn net.Conn, u *neturl.URL, protocols []string, header http.Header, jar http.CookieJar) (*frameConn, *http.Response, error) {
+	var nonce [16]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return nil, nil, err
+	}
+	key := base64.StdEncoding.EncodeToString(nonce[:])
+
+	req, offer := newUpgradeRequest(u, protocols, header, jar)
+	req.Method = http.MethodGet
+	req.Proto, req.ProtoMajor, req.ProtoMinor = "HTTP/1.1", 1, 1
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Key", key)
+
+	if err := req.Write(conn); err != nil {
+		return nil, nil, err
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return nil, nil, err
+	}
+	storeCookies(jar, req.URL, resp)
+
+	if resp.StatusCode != http.StatusSwitchingProtocols ||
+		!headerContains(resp.Header, "Upgrade", "websocket") ||
+		!headerContains(resp.Header, "Connection", "upgrade") {
+		return nil, resp, &handshakeError{resp.Status}
+	}
+	sum := sha1.Sum([]byte(key + keyGUID))
+	if resp.Header.Get("Sec-WebSocket-Accept") != base64.StdEncoding.EncodeToString(sum[:]) {
+		return nil, resp, &handshakeError{"invalid Sec-WebSocket-Accept"}
+	}
+
+	ws, err := newClientConn(conn, br, resp, protocols, offer)
+	return ws, resp, err
+}
+
+// newUpgradeRequest returns the parts of the opening handshake request that
+// HTTP/1.1 and HTTP/2 have in common, along with the permessage-deflate
+// parameters offered.
+func newUpgradeRequest(u *neturl.URL, protocols []string, header http.Header, jar http.CookieJar) (*http.Request, deflateParams) {
+	httpURL := *u
+	if u.Scheme == "wss" {
+		httpURL.Scheme = "https"
+	} else {
+		httpURL.Scheme = "http"
+	}
+
+	req := &http.Request{
+		URL:    &httpURL,
+		Header: http.Header{},
+		Host:   u.Host,
+	}
+	for name, values := range header {
+		if name == "Host" {
+			req.Host = values[0]
+			continue
+		}
+		req.Header[name] = values
+	}
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	if len(protocols) > 0 {
+		req.Header.Set("Sec-WebSocket-Protocol", strings.Join(protocols, ", "))
+	}
+	offer := deflateParams{
+		serverNoContextTakeover: serverNoContextTakeover,
+		clientNoContextTakeover: clientNoContextTakeover,
+		serverMaxWindowBits:     serverMaxWindowBits,
+		clientMaxWindowBits:     clientMaxWindowBits,
+	}
+	if compression {
+		req.Header.Set("Sec-WebSocket-Extensions", offer.offer())
+	}
+	if jar != nil {
+		for _, c := range jar.Cookies(&httpURL) {
+			req.AddCookie(c)
+		}
+	}
+	return req, offer
+}
+
+func storeCookies(jar http.CookieJar, u *neturl.URL, resp *http.Response) {
+	if jar != nil {
+		if cookies := resp.Cookies(); len(cookies) > 0 {
+			jar.SetCookies(u, cookies)
+		}
+	}
+}
+
+// newClientConn checks the subprotocol and extensions the server selected
+// in its handshake response and returns the WebSocket connection.
+func newClientConn(conn net.Conn, br *bufio.Reader, resp *http.Response, protocols []string, offer deflateParams) (*frameConn, error) {
+	subprotocol := resp.Header.Get("Sec-WebSocket-Protocol")
+	if subprotocol != "" && !contains(protocols, subprotocol) {
+		return nil, &handshakeError{fmt.Sprintf("server selected subprotocol %q, which was not offered", subprotocol)}
+	}
+
+	ws := newFrameConn(conn, br, subprotocol)
+	for _, ext := range parseExtensions(resp.Header) {
+		if ext[0] != "permessage-deflate" || !compression || ws.inflate != nil {
+			return nil, &handshakeError{fmt.Sprintf("server selected extension %q, which was not offered", ext[0])}
+		}
+		params, err := parseDeflateResponse(ext[1:], offer)
+		if err != nil {
+			return nil, &handshakeError{err.Error()}
+		}
+		ws.inflate = &inflater{noContextTakeover: params.serverNoContextTakeover}
+		ws.deflate = &deflater{noContextTakeover: params.clientNoContextTakeover, windowBits: params.clientMaxWindowBits}
+	}
+	return ws, nil
+}
+
+// parseExtensions parses the Sec-WebSocket-Extensions header into a list of
+// extensions, each given as its name followed by its parameters.
+func parseExtensions(header http.Header) [][]string {
+	var extensions [][]string
+	for _, value := range header.Values("Sec-WebSocket-Extensions") {
+		for _, ext := range strings.Split(value, ",") {
+			var fields []string
+			for _, field := range strings.Split(ext, ";") {
+				if field = strings.TrimSpace(field); field != "" {
+					fields = append(fields, field)
+				}
+			}
+			if len(fields) > 0 {
+				extensions = append(extensions, fields)
+			}
+		}
+	}
+	return extensions
+}
+
+// headerContains reports whether the comma separated header contains token,
+// ignoring case.
+func headerContains(header http.Header, name, token string) bool {
+	for _, value := range header.Values(name) {
+		for _, t := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// handshakeTap records the HTTP upgrade request and response exchanged over
+// a connection. Once both are complete, it passes data through untouched.
+type handshakeTap struct {
+	net.Conn
+	request      bytes.Buffer
+	response     bytes.Buffer
+	requestDone  bool
+	responseDone bool
+}
+
+func (t *handshakeTap) Write(p []byte) (int, error) {
+	if !t.requestDone {
+		t.request.Write(p)
+		t.requestDone = bytes.Contains(t.request.Bytes(), endOfHeader)
+	}
+	return t.Conn.Write(p)
+}
+
+func (t *handshakeTap) Read(p []byte) (int, error) {
+	n, err := t.Conn.Read(p)
+	if !t.responseDone && n > 0 {
+		t.response.Write(p[:n])
+		if i := bytes.Index(t.response.Bytes(), endOfHeader); i >= 0 {
+			t.response.Truncate(i + len(endOfHeader))
+			t.responseDone = true
+		}
+	}
+	return n, err
+}
+
+// printHandshake prints the recorded upgrade request and response, followed
+// by the negotiated subprotocol and extensions.
+func printHandshake(tap *handshakeTap, resp *http.Response) {
+	printHeaderLines(yellow("> "), tap.request.Bytes())
+	printHeaderLines(cyan("< "), tap.response.Bytes())
+
+	if !upgraded(resp) {
+		return
+	}
+	printLine("subprotocol: %s", orNone(resp.Header.Get("Sec-WebSocket-Protocol")))
+	printLine("extensions: %s\n", orNone(strings.Join(resp.Header.Values("Sec-WebSocket-Extensions"), ", ")))
+}
+
+// upgraded reports whether resp accepted the opening handshake, with 101
+// Switching Protocols over HTTP/1.1 or 200 OK to an extended CONNECT over
+// HTTP/2.
+func upgraded(resp *http.Response) bool {
+	if resp == nil {
+		return false
+	}
+	if resp.ProtoMajor == 2 {
+		return resp.StatusCode == http.StatusOK
+	}
+	return resp.StatusCode == http.StatusSwitchingProtocols
+}
+
+func printHeaderLines(prefix string, header []byte) {
+	scanner := bufio.NewScanner(bytes.NewReader(header))
+	for scanner.Scan() {
+		if scanner.Text() != "" {
+			printLine("%s%s", prefix, scanner.Text())
+		}
+	}
+	if len(header) > 0 {
+		printLine("")
+	}
+}
+
+func orNone(s string) string {
+	if s == "" {
+		return "(none)"
+	}
+	return s
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	neturl "net/url"
+	"strings"
+	"testing"
+)
+
+// acceptKey returns the Sec-WebSocket-Accept of a key.
+func acceptKey(key string) string {
+	sum := sha1.Sum([]byte(key + keyGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// handshakeWith runs the client handshake against a server answering the
+// upgrade request with respond, which returns the response to write. It
+// returns the request the server received along with the outcome.
+func handshakeWith(t *testing.T, protocols []string, respond func(req *http.Request) string) (*http.Request, *frameConn, error) {
+	t.Helper()
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	reqs := make(chan *http.Request, 1)
+	go func() {
+		req, err := http.ReadRequest(bufio.NewReader(server))
+		if err != nil {
+			close(reqs)
+			return
+		}
+		reqs <- req
+		server.Write([]byte(respond(req)))
+	}()
+	u, _ := neturl.Parse("ws://example.com/chat?room=1")
+	ws, _, err := clientHandshake(client, u, protocols, http.Header{"Origin": {"http://example.com"}}, nil)
+	return <-reqs, ws, err
+}
+
+// switching returns a 101 response accepting the key of req, with extra
+// header lines.
+func switching(req *http.Request, extra ...string) string {
+	lines := append([]string{
+		"HTTP/1.1 101 Switching Protocols",
+		"Upgrade: websocket",
+		"Connection: Upgrade",
+		"Sec-WebSocket-Accept: " + acceptKey(req.Header.Get("Sec-WebSocket-Key")),
+	}, extra...)
+	return strings.Join(lines, "\r\n") + "\r\n\r\n"
+}
+
+func TestClientHandshake(t *testing.T) {
+	req, ws, err := handshakeWith(t, []string{"chat", "superchat"}, func(req *http.Request) string {
+		return switching(req, "Sec-WebSocket-Protocol: superchat")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ws.Subprotocol() != "superchat" {
+		t.Errorf("subprotocol %q, want superchat", ws.Subprotocol())
+	}
+	for name, want := range map[string]string{
+		"Upgrade":                "websocket",
+		"Connection":             "Upgrade",
+		"Sec-WebSocket-Version":  "13",
+		"Sec-WebSocket-Protocol": "chat, superchat",
+		"Origin":                 "http://example.com",
+	} {
+		if got := req.Header.Get(name); got != want {
+			t.Errorf("%s: %q, want %q", name, got, want)
+		}
+	}
+	if req.Host != "example.com" || req.URL.RequestURI() != "/chat?room=1" {
+		t.Errorf("requested %s%s", req.Host, req.URL.RequestURI())
+	}
+	if key, err := base64.StdEncoding.DecodeString(req.Header.Get("Sec-WebSocket-Key")); err != nil || len(key) != 16 {
+		t.Errorf("Sec-WebSocket-Key %q is not 16 bytes in base64", req.Header.Get("Sec-WebSocket-Key"))
+	}
+}
+
+func TestClientHandshakeAcceptKey(t *testing.T) {
+	// The example of RFC 6455 section 1.3.
+	if got := acceptKey("dGhlIHNhbXBsZSBub25jZQ=="); got != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("accept key %q", got)
+	}
+	_, _, err := handshakeWith(t, nil, func(req *http.Request) string {
+		return strings.Join([]string{
+			"HTTP/1.1 101 Switching Protocols",
+			"Upgrade: websocket",
+			"Connection: Upgrade",
+			"Sec-WebSocket-Accept: s3pPLMBiTxaQ9kYGzzhZRbK+xOo=",
+		}, "\r\n") + "\r\n\r\n"
+	})
+	var he *handshakeError
+	if !errors.As(err, &he) || !strings.Contains(err.Error(), "Sec-WebSocket-Accept") {
+		t.Errorf("got %v, want an invalid Sec-WebSocket-Accept error", err)
+	}
+}
+
+func TestClientHandshakeFailures(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		respond func(req *http.Request) string
+	}{
+		{"not upgraded", func(req *http.Request) string {
+			return "HTTP/1.1 403 Forbidden\r\nContent-Length: 0\r\n\r\n"
+		}},
+		{"no Upgrade header", func(req *http.Request) string {
+			return strings.Replace(switching(req), "Upgrade: websocket\r\n", "", 1)
+		}},
+		{"no Connection header", func(req *http.Request) string {
+			return strings.Replace(switching(req), "Connection: Upgrade\r\n", "", 1)
+		}},
+		{"subprotocol not offered", func(req *http.Request) string {
+			return switching(req, "Sec-WebSocket-Protocol: other")
+		}},
+		{"extension not offered", func(req *http.Request) string {
+			return switching(req, "Sec-WebSocket-Extensions: permessage-deflate")
+		}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			_, ws, err := handshakeWith(t, []string{"chat"}, tt.respond)
+			var he *handshakeError
+			if !errors.As(err, &he) || ws != nil {
+				t.Errorf("got %v, want a handshake error", err)
+			}
+		})
+	}
+}
+
+func TestParseDeflateResponse(t *testing.T) {
+	for _, tt := range []struct {
+		params  string
+		offered deflateParams
+		want    deflateParams
+		err     bool
+	}{
+		{"", deflateParams{}, deflateParams{}, false},
+		{"server_no_context_takeover; client_no_context_takeover", deflateParams{},
+			deflateParams{serverNoContextTakeover: true, clientNoContextTakeover: true}, false},
+		{"server_max_window_bits=10", deflateParams{}, deflateParams{serverMaxWindowBits: 10}, false},
+		{`client_max_window_bits="9"`, deflateParams{clientMaxWindowBits: 12}, deflateParams{clientMaxWindowBits: 9}, false},
+		{"client_max_window_bits=9", deflateParams{}, deflateParams{}, true},
+		{"server_max_window_bits=7", deflateParams{}, deflateParams{}, true},
+		{"server_max_window_bits=16", deflateParams{}, deflateParams{}, true},
+		{"unknown", deflateParams{}, deflateParams{}, true},
+	} {
+		var params []string
+		if tt.params != "" {
+			params = strings.Split(tt.params, ";")
+		}
+		got, err := parseDeflateResponse(params, tt.offered)
+		if (err != nil) != tt.err || (err == nil && got != tt.want) {
+			t.Errorf("%q: got %+v, %v", tt.params, got, err)
+		}
+	}
+}
+
+func TestDeflateOffer(t *testing.T) {
+	p := deflateParams{clientNoContextTakeover: true, serverMaxWindowBits: 10}
+	want := "permessage-deflate; client_no_context_takeover; server_max_window_bits=10"
+	if got := p.offer(); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	ext := parseExtensions(http.Header{"Sec-Websocket-Extensions": {fmt.Sprintf("%s, x-other", want)}})
+	if len(ext) != 2 || len(ext[0]) != 3 || ext[0][0] != "permessage-deflate" || ext[1][0] != "x-other" {
+		t.Errorf("parsed %q", ext)
+	}
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	neturl "net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The HAR 1.2 format, with the _resourceType and _webSocketMessages
+// extensions with which Chrome DevTools exports WebSocket traffic. Only the
+// parts wsd writes or reads are declared.
+type harFile struct {
+	Log harLog `json:"log"`
+}
+
+type harLog struct {
+	Version string     `json:"version"`
+	Creator harCreator `json:"creator"`
+	Pages   []struct{} `json:"pages"`
+	Entries []harEntry `json:"entries"`
+}
+
+type harCreator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type harEntry struct {
+	StartedDateTime   time.Time      `json:"startedDateTime"`
+	Time              float64        `json:"time"`
+	Request           harRequest     `json:"request"`
+	Response          harResponse    `json:"response"`
+	Cache             struct{}       `json:"cache"`
+	Timings           harTimings     `json:"timings"`
+	ResourceType      string         `json:"_resourceType,omitempty"`
+	WebSocketMessages []harWSMessage `json:"_webSocketMessages,omitempty"`
+}
+
+type harRequest struct {
+	Method      string         `json:"method"`
+	URL         string         `json:"url"`
+	HTTPVersion string         `json:"httpVersion"`
+	Headers     []harNameValue `json:"headers"`
+	QueryString []harNameValue `json:"queryString"`
+	Cookies     []harNameValue `json:"cookies"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+}
+
+type harResponse struct {
+	Status      int            `json:"status"`
+	StatusText  string         `json:"statusText"`
+	HTTPVersion string         `json:"httpVersion"`
+	Headers     []harNameValue `json:"headers"`
+	Cookies     []harNameValue `json:"cookies"`
+	Content     harContent     `json:"content"`
+	RedirectURL string         `json:"redirectURL"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+}
+
+type harNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type harContent struct {
+	Size     int    `json:"size"`
+	MimeType string `json:"mimeType"`
+}
+
+type harTimings struct {
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+}
+
+// harWSMessage is a WebSocket message in the form of Chrome DevTools: time
+// is in seconds since the epoch, and binary data (opcode 2) is base64
+// encoded.
+type harWSMessage struct {
+	Type   string  `json:"type"`
+	Time   float64 `json:"time"`
+	Opcode int     `json:"opcode"`
+	Data   string  `json:"data"`
+}
+
+// newHARLog returns an empty HAR log written by wsd.
+func newHARLog() *harLog {
+	return &harLog{
+		Version: "1.2",
+		Creator: harCreator{Name: "wsd", Version: Version},
+		Pages:   []struct{}{},
+		Entries: []harEntry{},
+	}
+}
+
+// add adds a recorded event to the log: a handshake starts an entry, and
+// messages are added to the entry of the latest handshake.
+func (l *harLog) add(e event) {
+	switch e.Event {
+	case "handshake":
+		if e.Status != 0 {
+			l.Entries = append(l.Entries, harHandshake(e))
+		}
+	case "message":
+		if len(l.Entries) == 0 {
+			return
+		}
+		m := harWSMessage{Type: "receive", Time: float64(e.Time.UnixNano()) / 1e9, Opcode: TextMessage, Data: *e.Payload}
+		if e.Direction == "out" {
+			m.Type = "send"
+		}
+		if e.Opcode == "binary" {
+			m.Opcode = BinaryMessage
+			if e.Encoding != "base64" {
+				m.Data = base64.StdEncoding.EncodeToString([]byte(*e.Payload))
+			}
+		}
+		entry := &l.Entries[len(l.Entries)-1]
+		entry.WebSocketMessages = append(entry.WebSocketMessages, m)
+	}
+}
+
+// harHandshake returns the entry of a handshake event, with the headers as
+// they were sent and received if the raw handshake was recorded.
+func harHandshake(e event) harEntry {
+	entry := harEntry{
+		StartedDateTime: e.Time,
+		Request: harRequest{
+			Method:      http.MethodGet,
+			URL:         e.URL,
+			HTTPVersion: "HTTP/1.1",
+			Headers:     []harNameValue{},
+			QueryString: []harNameValue{},
+			Cookies:     []harNameValue{},
+			HeadersSize: -1,
+		},
+		Response: harResponse{
+			Status:      e.Status,
+			StatusText:  http.StatusText(e.Status),
+			HTTPVersion: "HTTP/1.1",
+			Headers:     []harNameValue{},
+			Cookies:     []harNameValue{},
+			HeadersSize: -1,
+		},
+		ResourceType: "websocket",
+	}
+	if u, err := neturl.Parse(e.URL); err == nil {
+		for name, values := range u.Query() {
+			for _, value := range values {
+				entry.Request.QueryString = append(entry.Request.QueryString, harNameValue{name, value})
+			}
+		}
+		sort.Slice(entry.Request.QueryString, func(i, j int) bool {
+			return entry.Request.QueryString[i].Name < entry.Request.QueryString[j].Name
+		})
+	}
+	if e.Request != "" {
+		start, headers := parseRawHeaders(e.Request)
+		if fields := strings.Fields(start); len(fields) == 3 {
+			entry.Request.Method, entry.Request.HTTPVersion = fields[0], fields[2]
+		}
+		entry.Request.Headers = headers
+	}
+	if e.Response != "" {
+		start, headers := parseRawHeaders(e.Response)
+		if version, _, ok := strings.Cut(start, " "); ok {
+			entry.Response.HTTPVersion = version
+		}
+		entry.Response.Headers = headers
+	} else {
+		for name, values := range e.Headers {
+			for _, value := range values {
+				entry.Response.Headers = append(entry.Response.Headers, harNameValue{name, value})
+			}
+		}
+	}
+	entry.Response.RedirectURL = e.Headers.Get("Location")
+	return entry
+}
+
+// parseRawHeaders splits a recorded request or response into its start line
+// and header fields, in their original order.
+func parseRawHeaders(raw string) (string, []harNameValue) {
+	lines := strings.Split(strings.TrimRight(raw, "\r\n"), "\r\n")
+	headers := []harNameValue{}
+	for _, line := range lines[1:] {
+		if name, value, ok := strings.Cut(line, ": "); ok {
+			headers = append(headers, harNameValue{name, value})
+		}
+	}
+	return lines[0], headers
+}
+
+// writeHAR writes the log to path.
+func writeHAR(path string, l *harLog) error {
+	data, err := json.MarshalIndent(harFile{Log: *l}, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0644)
+}
+
+// loadHAR reads the first WebSocket entry of a HAR file for replay, such as
+// one exported by Chrome DevTools.
+func loadHAR(path string) (*recording, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var har harFile
+	if err := json.Unmarshal(data, &har); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	for _, entry := range har.Log.Entries {
+		if entry.ResourceType != "websocket" && entry.WebSocketMessages == nil {
+			continue
+		}
+		rec := &recording{url: entry.Request.URL}
+		for _, h := range entry.Response.Headers {
+			if strings.EqualFold(h.Name, "Sec-WebSocket-Protocol") {
+				rec.subprotocol = h.Value
+			}
+		}
+		for i, m := range entry.WebSocketMessages {
+			sec, frac := math.Modf(m.Time)
+			msg := recordedMessage{
+				sent:    m.Type == "send",
+				message: message{messageType: TextMessage, data: []byte(m.Data), time: time.Unix(int64(sec), int64(frac*1e9))},
+			}
+			msg.at = max(msg.time.Sub(entry.StartedDateTime), 0)
+			switch m.Opcode {
+			case TextMessage:
+			case BinaryMessage:
+				msg.messageType = BinaryMessage
+				if msg.data, err = base64.StdEncoding.DecodeString(m.Data); err != nil {
+					return nil, fmt.Errorf("%s: message %d: invalid base64 data: %v", path, i+1, err)
+				}
+			default:
+				continue
+			}
+			rec.messages = append(rec.messages, msg)
+		}
+		return rec, nil
+	}
+	return nil, fmt.Errorf("%s has no WebSocket entries", path)
+}
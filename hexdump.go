@@ -0,0 +1,37 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// xxdDump formats data like xxd: an offset, 16 bytes in groups of two and
+// the bytes as ASCII, with non-printable bytes shown as dots.
+func xxdDump(data []byte) string {
+	var b strings.Builder
+	for offset := 0; offset < len(data); offset += 16 {
+		line := data[offset:min(offset+16, len(data))]
+		fmt.Fprintf(&b, "%08x: ", offset)
+		for i := 0; i < 16; i++ {
+			if i < len(line) {
+				fmt.Fprintf(&b, "%02x", line[i])
+			} else {
+				b.WriteString("  ")
+			}
+			if i%2 == 1 {
+				b.WriteByte(' ')
+			}
+		}
+		b.WriteByte(' ')
+		for _, c := range line {
+			if c < 0x20 || c > 0x7e {
+				c = '.'
+			}
+			b.WriteByte(c)
+		}
+		if offset+16 < len(data) {
+			b.WriteByte('\n')
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,408 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	neturl "net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/hpack"
+)
+
+// settingEnableConnectProtocol is SETTINGS_ENABLE_CONNECT_PROTOCOL, with
+// which a server announces support for extended CONNECT (RFC 8441 section 3).
+const settingEnableConnectProtocol http2.SettingID = 0x8
+
+// h2StreamID is the ID of the one stream opened on the connection.
+const h2StreamID = 1
+
+// h2Handshake bootstraps a WebSocket over an HTTP/2 connection with an
+// extended CONNECT request (RFC 8441). The connection must already speak
+// HTTP/2: negotiated with ALPN for wss, or with prior knowledge for ws. If
+// tap is set, the request and response are rendered into it in HTTP/1.1
+// style, since the HTTP/2 frames themselves are binary.
+//
+// Only the single stream carrying the WebSocket is opened, so this is a
+// minimal HTTP/2 client rather than a general one.
+func h2Handshake(conn net.Conn, u *neturl.URL, protocols []string, header http.Header, jar http.CookieJar, tap *handshakeTap) (*frameConn, *http.Response, error) {
+	req, offer := newUpgradeRequest(u, protocols, header, jar)
+	req.Method = http.MethodConnect
+	req.Proto, req.ProtoMajor, req.ProtoMinor = "HTTP/2.0", 2, 0
+
+	s := newH2Stream(conn)
+	if err := s.start(); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	if tap != nil {
+		fmt.Fprintf(&tap.request, "CONNECT %s HTTP/2\r\n:protocol: websocket\r\n:authority: %s\r\n", req.URL.RequestURI(), req.Host)
+		req.Header.Write(&tap.request)
+		tap.request.WriteString("\r\n")
+	}
+	resp, err := s.roundTrip(req)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	if tap != nil {
+		fmt.Fprintf(&tap.response, "HTTP/2 %d\r\n", resp.StatusCode)
+		resp.Header.Write(&tap.response)
+		tap.response.WriteString("\r\n")
+	}
+	storeCookies(jar, req.URL, resp)
+
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, resp, &handshakeError{resp.Status}
+	}
+	ws, err := newClientConn(s, nil, resp, protocols, offer)
+	if err != nil {
+		conn.Close()
+	}
+	return ws, resp, err
+}
+
+// newH2Tap returns a tap for the HTTP/2 handshake, which h2Handshake fills
+// in itself.
+func newH2Tap(conn net.Conn) *handshakeTap {
+	return &handshakeTap{Conn: conn, requestDone: true, responseDone: true}
+}
+
+// h2Stream is the HTTP/2 stream of an extended CONNECT request, used as the
+// net.Conn carrying the WebSocket frames. A goroutine reads the frames of
+// the connection, buffering stream data and answering settings and pings.
+// That goroutine reads regardless of deadlines, so these bound the waits
+// of Read and Write instead, and write deadlines also apply to the
+// underlying connection.
+type h2Stream struct {
+	net.Conn
+	fr  *http2.Framer
+	wmu sync.Mutex // serializes writing frames
+
+	mu   sync.Mutex
+	cond *sync.Cond
+	data bytes.Buffer
+	err  error // why reading stopped
+
+	readDeadline, writeDeadline time.Time
+	readTimer, writeTimer       *time.Timer // wake waiters at the deadlines
+
+	// Flow control (RFC 9113 section 5.2): how much data may be sent on
+	// the connection and on the stream, the initial stream window the
+	// latter started from and the largest frame.
+	connWindow    int64
+	streamWindow  int64
+	initialWindow int64
+	maxFrameSize  uint32
+
+	settings        chan struct{} // closed when the server's first SETTINGS arrive
+	connectProtocol bool
+	headers         chan *http2.MetaHeadersFrame
+}
+
+func newH2Stream(conn net.Conn) *h2Stream {
+	s := &h2Stream{
+		Conn:          conn,
+		fr:            http2.NewFramer(conn, conn),
+		connWindow:    65535,
+		streamWindow:  65535,
+		initialWindow: 65535,
+		maxFrameSize:  16384,
+		settings:      make(chan struct{}),
+		headers:       make(chan *http2.MetaHeadersFrame, 1),
+	}
+	s.cond = sync.NewCond(&s.mu)
+	s.fr.ReadMetaHeaders = hpack.NewDecoder(4096, nil)
+	return s
+}
+
+// start sends the connection preface and waits for the server's settings,
+// which must allow extended CONNECT.
+func (s *h2Stream) start() error {
+	if _, err := io.WriteString(s.Conn, http2.ClientPreface); err != nil {
+		return err
+	}
+	if err := s.fr.WriteSettings(http2.Setting{ID: http2.SettingEnablePush, Val: 0}); err != nil {
+		return err
+	}
+	go s.readLoop()
+
+	<-s.settings
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return s.err
+	}
+	if !s.connectProtocol {
+		return &handshakeError{"the server does not support WebSockets over HTTP/2 (RFC 8441)"}
+	}
+	return nil
+}
+
+// roundTrip sends the extended CONNECT request and waits for the response
+// headers.
+func (s *h2Stream) roundTrip(req *http.Request) (*http.Response, error) {
+	var block bytes.Buffer
+	enc := hpack.NewEncoder(&block)
+	enc.WriteField(hpack.HeaderField{Name: ":method", Value: http.MethodConnect})
+	enc.WriteField(hpack.HeaderField{Name: ":protocol", Value: "websocket"})
+	enc.WriteField(hpack.HeaderField{Name: ":scheme", Value: req.URL.Scheme})
+	enc.WriteField(hpack.HeaderField{Name: ":authority", Value: req.Host})
+	enc.WriteField(hpack.HeaderField{Name: ":path", Value: req.URL.RequestURI()})
+	for name, values := range req.Header {
+		for _, value := range values {
+			enc.WriteField(hpack.HeaderField{Name: strings.ToLower(name), Value: value})
+		}
+	}
+	if block.Len() > int(s.maxFrameSize) {
+		return nil, errors.New("request headers too large for one HTTP/2 frame")
+	}
+
+	s.wmu.Lock()
+	err := s.fr.WriteHeaders(http2.HeadersFrameParam{StreamID: h2StreamID, BlockFragment: block.Bytes(), EndHeaders: true})
+	s.wmu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	f, ok := <-s.headers
+	if !ok {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return nil, s.err
+	}
+	status, err := strconv.Atoi(f.PseudoValue("status"))
+	if err != nil {
+		return nil, &handshakeError{"invalid :status in response"}
+	}
+	resp := &http.Response{
+		Status:     fmt.Sprintf("%d %s", status, http.StatusText(status)),
+		StatusCode: status,
+		Proto:      "HTTP/2.0",
+		ProtoMajor: 2,
+		Header:     http.Header{},
+		Body:       http.NoBody,
+		Request:    req,
+	}
+	for _, field := range f.RegularFields() {
+		resp.Header.Add(http.CanonicalHeaderKey(field.Name), field.Value)
+	}
+	return resp, nil
+}
+
+func (s *h2Stream) readLoop() {
+	settingsSeen := false
+	gotHeaders := false
+	fail := func(err error) {
+		s.mu.Lock()
+		if s.err == nil {
+			s.err = err
+		}
+		s.cond.Broadcast()
+		s.mu.Unlock()
+		if !settingsSeen {
+			close(s.settings)
+		}
+		if !gotHeaders {
+			close(s.headers)
+		}
+	}
+
+	for {
+		f, err := s.fr.ReadFrame()
+		if err != nil {
+			fail(err)
+			return
+		}
+		switch f := f.(type) {
+		case *http2.SettingsFrame:
+			if f.IsAck() {
+				continue
+			}
+			s.mu.Lock()
+			f.ForeachSetting(func(setting http2.Setting) error {
+				switch setting.ID {
+				case http2.SettingInitialWindowSize:
+					s.streamWindow += int64(setting.Val) - s.initialWindow
+					s.initialWindow = int64(setting.Val)
+				case http2.SettingMaxFrameSize:
+					s.maxFrameSize = setting.Val
+				case settingEnableConnectProtocol:
+					s.connectProtocol = setting.Val == 1
+				}
+				return nil
+			})
+			s.cond.Broadcast()
+			s.mu.Unlock()
+			s.wmu.Lock()
+			s.fr.WriteSettingsAck()
+			s.wmu.Unlock()
+			if !settingsSeen {
+				settingsSeen = true
+				close(s.settings)
+			}
+		case *http2.PingFrame:
+			if !f.IsAck() {
+				s.wmu.Lock()
+				s.fr.WritePing(true, f.Data)
+				s.wmu.Unlock()
+			}
+		case *http2.WindowUpdateFrame:
+			s.mu.Lock()
+			if f.StreamID == 0 {
+				s.connWindow += int64(f.Increment)
+			} else {
+				s.streamWindow += int64(f.Increment)
+			}
+			s.cond.Broadcast()
+			s.mu.Unlock()
+		case *http2.MetaHeadersFrame:
+			// Further headers are trailers, which are of no interest.
+			if !gotHeaders {
+				gotHeaders = true
+				s.headers <- f
+				close(s.headers)
+			}
+			if f.StreamEnded() {
+				fail(io.EOF)
+				return
+			}
+		case *http2.DataFrame:
+			s.mu.Lock()
+			s.data.Write(f.Data())
+			s.cond.Broadcast()
+			s.mu.Unlock()
+			if f.StreamEnded() {
+				fail(io.EOF)
+				return
+			}
+		case *http2.RSTStreamFrame:
+			fail(fmt.Errorf("http2: stream reset by server: %v", f.ErrCode))
+			return
+		case *http2.GoAwayFrame:
+			if f.ErrCode != http2.ErrCodeNo {
+				fail(fmt.Errorf("http2: connection closed by server: %v", f.ErrCode))
+			} else {
+				fail(io.EOF)
+			}
+			return
+		}
+	}
+}
+
+func (s *h2Stream) SetDeadline(t time.Time) error {
+	s.SetReadDeadline(t)
+	return s.SetWriteDeadline(t)
+}
+
+func (s *h2Stream) SetReadDeadline(t time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.readDeadline = t
+	s.readTimer = s.resetTimer(s.readTimer, t)
+	return nil
+}
+
+func (s *h2Stream) SetWriteDeadline(t time.Time) error {
+	s.mu.Lock()
+	s.writeDeadline = t
+	s.writeTimer = s.resetTimer(s.writeTimer, t)
+	s.mu.Unlock()
+	return s.Conn.SetWriteDeadline(t)
+}
+
+// resetTimer stops timer and returns one waking the waiters on s.cond at
+// the deadline t, or nil if there is none. s.mu must be held.
+func (s *h2Stream) resetTimer(timer *time.Timer, t time.Time) *time.Timer {
+	if timer != nil {
+		timer.Stop()
+	}
+	if t.IsZero() {
+		return nil
+	}
+	// A deadline already passed wakes the waiters right away.
+	return time.AfterFunc(time.Until(t), func() {
+		s.mu.Lock()
+		s.cond.Broadcast()
+		s.mu.Unlock()
+	})
+}
+
+// expired reports whether the deadline t has passed.
+func expired(t time.Time) bool {
+	return !t.IsZero() && !time.Now().Before(t)
+}
+
+func (s *h2Stream) Read(p []byte) (int, error) {
+	s.mu.Lock()
+	for s.data.Len() == 0 && s.err == nil && !expired(s.readDeadline) {
+		s.cond.Wait()
+	}
+	if s.data.Len() == 0 {
+		err := s.err
+		if err == nil {
+			err = os.ErrDeadlineExceeded
+		}
+		s.mu.Unlock()
+		return 0, err
+	}
+	n, _ := s.data.Read(p)
+	s.mu.Unlock()
+	if n == 0 {
+		return 0, nil
+	}
+
+	// Data is only acknowledged once consumed, so that the server cannot
+	// send more than is buffered.
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	if err := s.fr.WriteWindowUpdate(0, uint32(n)); err != nil {
+		return n, err
+	}
+	return n, s.fr.WriteWindowUpdate(h2StreamID, uint32(n))
+}
+
+func (s *h2Stream) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		s.mu.Lock()
+		for (s.connWindow <= 0 || s.streamWindow <= 0) && s.err == nil && !expired(s.writeDeadline) {
+			s.cond.Wait()
+		}
+		if s.err == nil && (s.connWindow <= 0 || s.streamWindow <= 0) {
+			s.mu.Unlock()
+			return written, os.ErrDeadlineExceeded
+		}
+		// The server may end its side of the stream while this side is
+		// still writing, e.g. a close frame in reply to its own.
+		if s.err != nil && (s.err != io.EOF || s.connWindow <= 0 || s.streamWindow <= 0) {
+			err := s.err
+			s.mu.Unlock()
+			return written, err
+		}
+		n := int64(len(p))
+		n = min(n, s.connWindow, s.streamWindow, int64(s.maxFrameSize))
+		s.connWindow -= n
+		s.streamWindow -= n
+		s.mu.Unlock()
+
+		s.wmu.Lock()
+		err := s.fr.WriteData(h2StreamID, false, p[:n])
+		s.wmu.Unlock()
+		if err != nil {
+			return written, err
+		}
+		written += int(n)
+		p = p[n:]
+	}
+	return written, nil
+}
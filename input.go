@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// message is a single WebSocket data message.
+type message struct {
+	messageType int
+	data        []byte
+
+	// wireSize is the payload size on the wire, if known.
+	wireSize int
+
+	// seq numbers the messages in each direction, starting at 1. time is
+	// when the message was received.
+	seq  int
+	time time.Time
+
+	// conn labels the connection of the message with -connections.
+	conn string
+}
+
+// parseInput turns a line read from stdin into a message.
+//
+// A line may start with an escape selecting how the rest of the line is
+// interpreted:
+//
+//	\text <payload>    send payload as a text message
+//	\texthex <payload> send hex-encoded payload as a text message, which need
+//	                   not be valid UTF-8
+//	\hex <payload>     send hex-encoded payload as a binary message
+//	\base64 <payload>  send base64-encoded payload as a binary message
+//
+// Lines starting with "/" are commands, see runCommand.
+//
+// A leading "\\" sends the line, minus one backslash, as is. Lines without an
+// escape are sent as text messages, as hex-encoded binary messages when
+// -binary is set, or as JSON encoded into a binary format by -decode.
+func parseInput(line string) (message, error) {
+	if strings.HasPrefix(line, `\\`) {
+		return encodeInput(line[1:], binaryMode)
+	}
+	if strings.HasPrefix(line, `\`) {
+		escape, payload := line[1:], ""
+		if i := strings.IndexByte(escape, ' '); i >= 0 {
+			escape, payload = escape[:i], escape[i+1:]
+		}
+		switch escape {
+		case "text":
+			return message{messageType: TextMessage, data: []byte(payload)}, nil
+		case "texthex":
+			msg, err := decodeHex(payload)
+			msg.messageType = TextMessage
+			return msg, err
+		case "hex":
+			return decodeHex(payload)
+		case "base64":
+			return decodeBase64(payload)
+		}
+		return message{}, fmt.Errorf("unknown escape \\%s", escape)
+	}
+	return encodeInput(line, binaryMode)
+}
+
+func encodeInput(line string, binary bool) (message, error) {
+	if binary {
+		return decodeHex(line)
+	}
+	if encoder != nil {
+		return encodeJSONInput(line)
+	}
+	return message{messageType: TextMessage, data: []byte(line)}, nil
+}
+
+// invalidUTF8Sequence is appended to text messages by -invalid-utf8. 0xc3
+// starts a two byte sequence, which 0x28 does not continue.
+var invalidUTF8Sequence = []byte{0xc3, 0x28}
+
+func decodeHex(s string) (message, error) {
+	data, err := hex.DecodeString(strings.Join(strings.Fields(s), ""))
+	if err != nil {
+		return message{}, fmt.Errorf("invalid hex payload: %v", err)
+	}
+	return message{messageType: BinaryMessage, data: data}, nil
+}
+
+func decodeBase64(s string) (message, error) {
+	data, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+	if err != nil {
+		return message{}, fmt.Errorf("invalid base64 payload: %v", err)
+	}
+	return message{messageType: BinaryMessage, data: data}, nil
+}
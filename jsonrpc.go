@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// checkJSONRPCFlags validates -jsonrpc.
+func checkJSONRPCFlags() error {
+	if !jsonRPC {
+		return nil
+	}
+	if command != "" {
+		return fmt.Errorf("-jsonrpc is not supported by %s", command)
+	}
+	return selectAppProtocol("-jsonrpc", func() appSession {
+		return &jsonRPCSession{pending: map[string]jsonRPCCall{}}
+	})
+}
+
+// jsonRPCCall is a request sent awaiting its response.
+type jsonRPCCall struct {
+	method string
+	sentAt time.Time
+}
+
+// jsonRPCMessage is a JSON-RPC 2.0 request, notification or response.
+type jsonRPCMessage struct {
+	JSONRPC *string         `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Method  *string         `json:"method"`
+	Params  json.RawMessage `json:"params"`
+	Result  json.RawMessage `json:"result"`
+	Error   json.RawMessage `json:"error"`
+}
+
+// jsonRPCError is the error of a response.
+type jsonRPCError struct {
+	Code    *int            `json:"code"`
+	Message *string         `json:"message"`
+	Data    json.RawMessage `json:"data"`
+}
+
+// jsonRPCSession speaks JSON-RPC 2.0. An input line is a request, of a
+// method followed by its parameters:
+//
+//	eth_getBalance "0x407d73d8a49eeb85d32cf465507dd71d507100c1" "latest"
+//
+// sent with the next ID. A single JSON object or array is sent as the
+// parameters by name or by position, and other arguments as the array of
+// them; arguments that are not JSON are a single string. A line that is a
+// JSON object or array is sent as is, as a request or a batch. Responses
+// are validated, and shown as the method, ID and latency of their request
+// followed by their result pretty-printed.
+type jsonRPCSession struct {
+	mu      sync.Mutex
+	lastID  int
+	pending map[string]jsonRPCCall // the requests by ID, as JSON
+}
+
+// open sends nothing: JSON-RPC has no session.
+func (s *jsonRPCSession) open(ctx context.Context, send func(message)) {}
+
+func (s *jsonRPCSession) input(line string) ([]message, error) {
+	line = strings.TrimSpace(line)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if strings.HasPrefix(line, "{") || strings.HasPrefix(line, "[") {
+		if !json.Valid([]byte(line)) {
+			return nil, errors.New("invalid JSON")
+		}
+		// Requests given in full, recorded for their responses.
+		for _, raw := range jsonRPCBatch([]byte(line)) {
+			var m jsonRPCMessage
+			json.Unmarshal(raw, &m)
+			if m.Method != nil && len(m.ID) > 0 {
+				s.pending[string(compactJSON(m.ID))] = jsonRPCCall{method: *m.Method, sentAt: time.Now()}
+			}
+		}
+		return []message{{messageType: TextMessage, data: []byte(line)}}, nil
+	}
+
+	method, rest, _ := strings.Cut(line, " ")
+	if method == "" {
+		return nil, errors.New("usage: <method> [params...]")
+	}
+	s.lastID++
+	request := map[string]interface{}{"jsonrpc": "2.0", "id": s.lastID, "method": method}
+	switch params := parseArgs(rest); len(params) {
+	case 0:
+	case 1:
+		switch params[0].(type) {
+		case map[string]interface{}, []interface{}:
+			request["params"] = params[0]
+		default:
+			request["params"] = params
+		}
+	default:
+		request["params"] = params
+	}
+	s.pending[fmt.Sprint(s.lastID)] = jsonRPCCall{method: method, sentAt: time.Now()}
+	return []message{jsonMessage(request)}, nil
+}
+
+// jsonRPCBatch returns the messages of data: the elements of a batch, or
+// data itself.
+func jsonRPCBatch(data []byte) []json.RawMessage {
+	var batch []json.RawMessage
+	if json.Unmarshal(data, &batch) == nil {
+		return batch
+	}
+	return []json.RawMessage{data}
+}
+
+func (s *jsonRPCSession) receive(msg message, send func(message)) ([]message, error) {
+	if msg.messageType != TextMessage || !json.Valid(msg.data) {
+		printError(errors.New("invalid JSON-RPC response: not JSON"))
+		return []message{msg}, nil
+	}
+	var shown []message
+	for _, raw := range jsonRPCBatch(bytes.TrimSpace(msg.data)) {
+		text, err := s.response(raw, msg)
+		if err != nil {
+			printError(err)
+		}
+		if text != "" {
+			m := msg
+			m.data = []byte(text)
+			shown = append(shown, m)
+		}
+	}
+	return shown, nil
+}
+
+// response validates a response, or a notification of the server, returning
+// the text to show for it: the response itself if invalid, with the error
+// found, or the error of the response.
+func (s *jsonRPCSession) response(raw json.RawMessage, msg message) (string, error) {
+	var m jsonRPCMessage
+	switch {
+	case json.Unmarshal(raw, &m) != nil:
+		return string(raw), errors.New("invalid JSON-RPC response: not a JSON object")
+	case m.JSONRPC == nil || *m.JSONRPC != "2.0":
+		return string(raw), errors.New(`invalid JSON-RPC response: jsonrpc is not "2.0"`)
+	}
+	if m.Method != nil {
+		// A notification, or a request, of the server.
+		return *m.Method + formatJSONRPCValue(m.Params), nil
+	}
+	if string(m.Error) == "null" {
+		// Sent with the result by some servers.
+		m.Error = nil
+	}
+	switch {
+	case len(m.ID) == 0:
+		return string(raw), errors.New("invalid JSON-RPC response: no id")
+	case (m.Result == nil) == (m.Error == nil):
+		return string(raw), errors.New("invalid JSON-RPC response: not exactly one of result and error")
+	}
+
+	id := string(compactJSON(m.ID))
+	s.mu.Lock()
+	call, ok := s.pending[id]
+	delete(s.pending, id)
+	s.mu.Unlock()
+	name := "response " + id
+	if ok {
+		name = fmt.Sprintf("%s %s (%v)", call.method, id, msg.time.Sub(call.sentAt).Round(time.Microsecond))
+	}
+
+	if m.Error != nil {
+		var e jsonRPCError
+		if json.Unmarshal(m.Error, &e) != nil || e.Code == nil || e.Message == nil {
+			return "", fmt.Errorf("%s failed with an invalid error %s", name, compactJSON(m.Error))
+		}
+		text := fmt.Sprintf("%s failed: %d %s", name, *e.Code, *e.Message)
+		if len(e.Data) > 0 {
+			text += formatArgs([]json.RawMessage{e.Data})
+		}
+		return "", errors.New(text)
+	}
+	return name + formatJSONRPCValue(m.Result), nil
+}
+
+// formatJSONRPCValue formats a result or parameters after a space: objects
+// and arrays pretty-printed on the following lines.
+func formatJSONRPCValue(v json.RawMessage) string {
+	if len(v) == 0 {
+		return ""
+	}
+	if pretty, ok := prettyJSON(v); ok {
+		return "\n" + pretty
+	}
+	return formatArgs([]json.RawMessage{v})
+}
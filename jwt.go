@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// jwtPattern matches compact JWS tokens. Headers and claims are JSON objects,
+// so their base64url encodings start with "eyJ".
+var jwtPattern = regexp.MustCompile(`eyJ[A-Za-z0-9_-]+\.eyJ[A-Za-z0-9_-]+\.[A-Za-z0-9_-]*`)
+
+// jwtToken is a decoded JWT, as shown by -jwt.
+type jwtToken struct {
+	Alg     string          `json:"alg"`
+	Header  json.RawMessage `json:"header"`
+	Claims  json.RawMessage `json:"claims"`
+	Expires *time.Time      `json:"expires,omitempty"`
+}
+
+var (
+	jwtMu   sync.Mutex
+	jwtSeen = map[string]bool{}
+)
+
+// inspectJWTs prints the JWTs found in data, each only the first time it is
+// seen. source says where the data came from. Signatures are not verified.
+func inspectJWTs(source string, data []byte) {
+	for _, raw := range jwtPattern.FindAll(data, -1) {
+		jwtMu.Lock()
+		seen := jwtSeen[string(raw)]
+		jwtSeen[string(raw)] = true
+		jwtMu.Unlock()
+		if seen {
+			continue
+		}
+
+		token, err := parseJWT(string(raw))
+		if err != nil {
+			continue
+		}
+		if jsonOutput {
+			emit(event{Event: "jwt", Source: source, JWT: token})
+			continue
+		}
+		printJWT(source, token)
+	}
+}
+
+// inspectHeaderJWTs inspects the values of HTTP headers for JWTs.
+func inspectHeaderJWTs(source string, header http.Header) {
+	names := make([]string, 0, len(header))
+	for name := range header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, value := range header[name] {
+			inspectJWTs(source+" header "+name, []byte(value))
+		}
+	}
+}
+
+func parseJWT(raw string) (*jwtToken, error) {
+	parts := strings.Split(raw, ".")
+	header, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, err
+	}
+	claims, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, err
+	}
+	if !json.Valid(header) || !json.Valid(claims) {
+		return nil, fmt.Errorf("invalid JWT")
+	}
+
+	token := &jwtToken{Header: compactJSON(header), Claims: compactJSON(claims)}
+	var h struct {
+		Alg string `json:"alg"`
+	}
+	json.Unmarshal(header, &h)
+	token.Alg = h.Alg
+	var c struct {
+		Exp *json.Number `json:"exp"`
+	}
+	if json.Unmarshal(claims, &c) == nil && c.Exp != nil {
+		if exp, err := c.Exp.Float64(); err == nil {
+			t := time.Unix(int64(exp), 0)
+			token.Expires = &t
+		}
+	}
+	return token, nil
+}
+
+func compactJSON(data []byte) json.RawMessage {
+	var b bytes.Buffer
+	json.Compact(&b, data)
+	return b.Bytes()
+}
+
+func printJWT(source string, token *jwtToken) {
+	printLine("jwt in %s, signed with %s", source, yellow(orNone(token.Alg)))
+	printLine("  header: %s", token.Header)
+	printLine("  claims: %s", token.Claims)
+	if token.Expires == nil {
+		printLine("  does not expire")
+		return
+	}
+	if left := time.Until(*token.Expires).Round(time.Second); left > 0 {
+		printLine("  expires %s (in %s)", token.Expires.Format(time.RFC3339), green(left))
+	} else {
+		printLine("  expired %s (%s ago)", token.Expires.Format(time.RFC3339), red(-left))
+	}
+}
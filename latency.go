@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/HdrHistogram/hdrhistogram-go"
+)
+
+// checkLatencyFlags validates -latency-hdr and -latency-csv.
+func checkLatencyFlags() error {
+	if (latencyHDR != "" || latencyCSV != "") && command != "bench" && !rttMode && !correlate {
+		return errors.New("-latency-hdr and -latency-csv require bench, -rtt or -correlate")
+	}
+	return nil
+}
+
+// newLatencyHistogram returns an empty HdrHistogram of latencies in
+// nanoseconds, from a microsecond to an hour with three significant digits.
+// Its size is fixed however many samples it records.
+func newLatencyHistogram() *hdrhistogram.Histogram {
+	return hdrhistogram.New(int64(time.Microsecond), int64(time.Hour), 3)
+}
+
+// latencyHistogram returns the HdrHistogram of samples. If interval, the
+// time between the messages measured, is not 0, it is corrected for
+// coordinated omission: a sample longer than interval means the messages
+// that should have been sent meanwhile were not, and is recorded along with
+// the samples they would have had.
+func latencyHistogram(samples []time.Duration, interval time.Duration) *hdrhistogram.Histogram {
+	h := newLatencyHistogram()
+	for _, d := range samples {
+		// Samples out of range are dropped, as they are by the percentiles.
+		h.RecordCorrectedValue(int64(d), int64(interval))
+	}
+	return h
+}
+
+// reportLatencies reports samples with reportHistograms. The samples were
+// taken from start on, with messages meant to be sent every interval.
+func reportLatencies(samples []time.Duration, interval time.Duration, start time.Time) {
+	reportHistograms(latencyHistogram(samples, 0), latencyHistogram(samples, interval), start)
+}
+
+// reportHistograms prints the percentiles of the latencies corrected for
+// coordinated omission if that adds samples to h, and writes the corrected
+// histogram to -latency-hdr and -latency-csv. The latencies were measured
+// from start on.
+func reportHistograms(h, corrected *hdrhistogram.Histogram, start time.Time) {
+	if h.TotalCount() == 0 {
+		return
+	}
+	if corrected.TotalCount() > h.TotalCount() {
+		printLine("corrected:   %s (%d samples added for coordinated omission)",
+			formatHistogramPercentiles(corrected), corrected.TotalCount()-h.TotalCount())
+	}
+	corrected.SetStartTimeMs(start.UnixMilli())
+	corrected.SetEndTimeMs(time.Now().UnixMilli())
+	if latencyHDR != "" {
+		if err := writeLatencyHDR(latencyHDR, corrected); err != nil {
+			printError(err)
+		}
+	}
+	if latencyCSV != "" {
+		if err := writeLatencyCSV(latencyCSV, corrected); err != nil {
+			printError(err)
+		}
+	}
+}
+
+// formatHistogramPercentiles formats the median, 95th and 99th percentiles
+// and the maximum of h, like formatPercentiles.
+func formatHistogramPercentiles(h *hdrhistogram.Histogram) string {
+	if h.TotalCount() == 0 {
+		return "no samples"
+	}
+	percentile := func(p float64) time.Duration {
+		return time.Duration(h.ValueAtPercentile(p)).Round(time.Microsecond)
+	}
+	return fmt.Sprintf("p50 %v, p95 %v, p99 %v, max %v", percentile(50), percentile(95), percentile(99),
+		time.Duration(h.Max()).Round(time.Microsecond))
+}
+
+// writeLatencyHDR writes h to file as an HdrHistogram log with a single
+// interval, which HistogramLogProcessor and the other HdrHistogram tools
+// can merge with those of other runs.
+func writeLatencyHDR(file string, h *hdrhistogram.Histogram) error {
+	f, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	w := hdrhistogram.NewHistogramLogWriter(f)
+	w.SetBaseTime(h.StartTimeMs())
+	if err := w.OutputLogFormatVersion(); err != nil {
+		return err
+	}
+	if err := w.OutputStartTime(h.StartTimeMs()); err != nil {
+		return err
+	}
+	if err := w.OutputLegend(); err != nil {
+		return err
+	}
+	if err := w.OutputIntervalHistogram(h); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// writeLatencyCSV writes the percentile distribution of h to file as CSV,
+// with the columns of HdrHistogram's percentile output: the latency in
+// milliseconds, the percentile, the number of samples up to the latency
+// and 1/(1-percentile), for plotting on a logarithmic axis.
+func writeLatencyCSV(file string, h *hdrhistogram.Histogram) error {
+	f, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	w := csv.NewWriter(f)
+	w.Write([]string{"latency_ms", "percentile", "total_count", "inverted_percentile"})
+	for _, b := range h.CumulativeDistributionWithTicks(5) {
+		percentile := b.Quantile / 100
+		inverted := "inf"
+		if percentile < 1 {
+			inverted = strconv.FormatFloat(1/(1-percentile), 'f', 2, 64)
+		}
+		w.Write([]string{
+			strconv.FormatFloat(float64(b.ValueAt)/float64(time.Millisecond), 'f', 3, 64),
+			strconv.FormatFloat(percentile, 'f', 6, 64),
+			strconv.FormatInt(b.Count, 10),
+			inverted,
+		})
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return err
+	}
+	return f.Close()
+}
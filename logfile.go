@@ -0,0 +1,192 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// logTimeFormat is the format of the timestamps in -log-file.
+const logTimeFormat = "2006-01-02T15:04:05.000000Z07:00"
+
+// trafficLog is the -log-file, or nil if there is none.
+var trafficLog *rotatingLog
+
+// rotatingLog appends a line for every message and control frame sent or
+// received to a file. The file is rotated once it reaches a maximum size or
+// age: it is renamed with the time of rotation inserted before its
+// extension, and a new one is started.
+type rotatingLog struct {
+	path     string
+	maxSize  int64
+	maxAge   time.Duration
+	maxFiles int
+	dumpDir  string
+
+	mu     sync.Mutex
+	f      *os.File
+	size   int64
+	opened time.Time
+	dumps  int
+	err    error // why logging stopped
+}
+
+// checkLogFlags validates -log-file and the flags that go with it.
+func checkLogFlags() error {
+	if logFile == "" {
+		if logMaxSize != 0 || logRotate != 0 || logMaxFiles != 0 || logDumpDir != "" {
+			return errors.New("-log-max-size, -log-rotate, -log-max-files and -log-dump-dir require -log-file")
+		}
+		return nil
+	}
+	if logMaxSize < 0 || logRotate < 0 || logMaxFiles < 0 {
+		return errors.New("-log-max-size, -log-rotate and -log-max-files must not be negative")
+	}
+	return nil
+}
+
+// openTrafficLog opens the -log-file, if any.
+func openTrafficLog() error {
+	if logFile == "" {
+		return nil
+	}
+	l := &rotatingLog{
+		path:     logFile,
+		maxSize:  logMaxSize,
+		maxAge:   logRotate,
+		maxFiles: logMaxFiles,
+		dumpDir:  logDumpDir,
+	}
+	if l.dumpDir != "" {
+		if err := os.MkdirAll(l.dumpDir, 0755); err != nil {
+			return err
+		}
+	}
+	if err := l.open(); err != nil {
+		return err
+	}
+	trafficLog = l
+	return nil
+}
+
+func (l *rotatingLog) open() error {
+	f, err := os.OpenFile(l.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	l.f, l.size, l.opened = f, info.Size(), time.Now()
+	return nil
+}
+
+// rotate renames the current file and starts a new one, removing the oldest
+// rotated files beyond -log-max-files.
+func (l *rotatingLog) rotate() error {
+	l.f.Close()
+	ext := filepath.Ext(l.path)
+	base := strings.TrimSuffix(l.path, ext)
+	if err := os.Rename(l.path, base+"-"+time.Now().Format("2006-01-02T15-04-05.000")+ext); err != nil {
+		return err
+	}
+	if l.maxFiles > 0 {
+		rotated, _ := filepath.Glob(base + "-*" + ext)
+		// The timestamps sort in chronological order.
+		sort.Strings(rotated)
+		for len(rotated) > l.maxFiles {
+			os.Remove(rotated[0])
+			rotated = rotated[1:]
+		}
+	}
+	return l.open()
+}
+
+// write appends a line to the log, rotating it first if it is due. If
+// writing fails, the error is reported and logging stops.
+func (l *rotatingLog) write(line string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.err != nil {
+		return
+	}
+	err := func() error {
+		if l.size > 0 && (l.maxSize > 0 && l.size+int64(len(line)) > l.maxSize ||
+			l.maxAge > 0 && time.Since(l.opened) >= l.maxAge) {
+			if err := l.rotate(); err != nil {
+				return err
+			}
+		}
+		n, err := l.f.WriteString(line)
+		l.size += int64(n)
+		return err
+	}()
+	if err != nil {
+		l.err = err
+		printError(fmt.Errorf("writing -log-file, logging stopped: %v", err))
+	}
+}
+
+// message logs a message or control frame sent or received at t. Text is
+// logged quoted and binary data hex encoded, or with -log-dump-dir written to
+// a file of its own, whose name is logged instead.
+func (l *rotatingLog) message(sent bool, opcode int, data []byte, t time.Time) {
+	if l == nil {
+		return
+	}
+	var payload string
+	switch {
+	case opcode == TextMessage:
+		payload = strconv.Quote(string(data))
+	case opcode == CloseMessage:
+		code, reason := 1005, ""
+		if len(data) >= 2 {
+			code, reason = int(binary.BigEndian.Uint16(data)), string(data[2:])
+		}
+		payload = formatClose(code, reason)
+	case l.dumpDir != "" && (opcode == BinaryMessage || opcode == continuationFrame):
+		payload = l.dump(sent, data)
+	default:
+		payload = hex.EncodeToString(data)
+	}
+	l.write(fmt.Sprintf("%s %-3s %s %d %s\n", t.Format(logTimeFormat), direction(sent), opcodeName(opcode), len(data), payload))
+}
+
+// dump writes binary data to a file of its own in the -log-dump-dir and
+// returns its path.
+func (l *rotatingLog) dump(sent bool, data []byte) string {
+	l.mu.Lock()
+	l.dumps++
+	path := filepath.Join(l.dumpDir, fmt.Sprintf("%06d-%s.bin", l.dumps, direction(sent)))
+	l.mu.Unlock()
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		printError(fmt.Errorf("dumping message: %v", err))
+	}
+	return path
+}
+
+// note logs something that happened to the connection, such as connecting.
+func (l *rotatingLog) note(format string, args ...interface{}) {
+	if l == nil {
+		return
+	}
+	l.write(fmt.Sprintf("%s *   %s\n", time.Now().Format(logTimeFormat), fmt.Sprintf(format, args...)))
+}
+
+// logFrame is the frame hook that logs control frames. Data frames are logged
+// as the messages they make up.
+func logFrame(sent bool, f frame) {
+	if f.opcode >= CloseMessage {
+		trafficLog.message(sent, f.opcode, f.payload, time.Now())
+	}
+}
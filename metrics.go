@@ -0,0 +1,183 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// metrics collects the metrics of -metrics-listen and -statsd, or is nil if
+// neither is given.
+var metrics *metricSet
+
+// metricBuckets are the upper bounds in seconds of the buckets of the
+// duration histograms.
+var metricBuckets = []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// checkMetricsFlags validates -metrics-listen.
+func checkMetricsFlags() error {
+	switch {
+	case metricsListen == "":
+		return nil
+	case command == "serve" || command == "mock" || command == "replay":
+		return fmt.Errorf("-metrics-listen is not supported by %s", command)
+	case webTransport:
+		return errors.New("-metrics-listen does not support -webtransport")
+	}
+	metrics = newMetricSet()
+	return nil
+}
+
+// metricSet holds the metrics of the connections wsd dials.
+type metricSet struct {
+	open       atomic.Int64
+	connects   atomic.Int64
+	failures   atomic.Int64
+	reconnects atomic.Int64
+
+	// Data messages and their payload bytes on the wire, received and sent.
+	messages [2]atomic.Int64
+	bytes    [2]atomic.Int64
+
+	handshake, rtt *durationHistogram
+}
+
+func newMetricSet() *metricSet {
+	return &metricSet{handshake: newDurationHistogram(), rtt: newDurationHistogram()}
+}
+
+// serve serves the metrics on -metrics-listen at /metrics in the
+// Prometheus text format, if it is given.
+func (m *metricSet) serve() error {
+	if metricsListen == "" {
+		return nil
+	}
+	ln, err := net.Listen("tcp", metricsListen)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		m.write(w)
+	})
+	go http.Serve(ln, mux)
+	printBanner("serving metrics on %s", green("http://"+ln.Addr().String()+"/metrics"))
+	return nil
+}
+
+// dialed records the outcome of dialing a connection that took d.
+func (m *metricSet) dialed(ws Conn, d time.Duration, err error) {
+	if m == nil {
+		return
+	}
+	if err != nil {
+		m.failures.Add(1)
+		return
+	}
+	m.connects.Add(1)
+	m.handshake.observe(d)
+	statsd.timing("handshake", d)
+	if fc, ok := ws.(*frameConn); ok {
+		m.open.Add(1)
+		fc.closeHooks = append(fc.closeHooks, func() { m.open.Add(-1) })
+	}
+}
+
+// reconnected records that a connection that dropped was replaced.
+func (m *metricSet) reconnected() {
+	if m != nil {
+		m.reconnects.Add(1)
+	}
+}
+
+// observeRTT records a round-trip time, of a ping or an -rtt probe.
+func (m *metricSet) observeRTT(d time.Duration) {
+	if m != nil {
+		m.rtt.observe(d)
+		statsd.timing("rtt", d)
+	}
+}
+
+// meterFrame is the frame hook that counts the data messages and bytes.
+func meterFrame(sent bool, f frame) {
+	if f.opcode >= CloseMessage {
+		return
+	}
+	dir := 0
+	if sent {
+		dir = 1
+	}
+	if f.fin {
+		metrics.messages[dir].Add(1)
+	}
+	metrics.bytes[dir].Add(int64(len(f.payload)))
+}
+
+// write writes the metrics in the Prometheus text format.
+func (m *metricSet) write(w io.Writer) {
+	metric := func(name, typ, help string) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+	}
+	metric("wsd_connections", "gauge", "WebSocket connections open.")
+	fmt.Fprintf(w, "wsd_connections %d\n", m.open.Load())
+	metric("wsd_connects_total", "counter", "WebSocket connections established.")
+	fmt.Fprintf(w, "wsd_connects_total %d\n", m.connects.Load())
+	metric("wsd_connect_failures_total", "counter", "Failed attempts to establish a WebSocket connection.")
+	fmt.Fprintf(w, "wsd_connect_failures_total %d\n", m.failures.Load())
+	metric("wsd_reconnects_total", "counter", "WebSocket connections re-established after dropping.")
+	fmt.Fprintf(w, "wsd_reconnects_total %d\n", m.reconnects.Load())
+	metric("wsd_messages_total", "counter", "Data messages received and sent.")
+	fmt.Fprintf(w, "wsd_messages_total{direction=\"received\"} %d\n", m.messages[0].Load())
+	fmt.Fprintf(w, "wsd_messages_total{direction=\"sent\"} %d\n", m.messages[1].Load())
+	metric("wsd_bytes_total", "counter", "Payload bytes of the data messages received and sent, as on the wire.")
+	fmt.Fprintf(w, "wsd_bytes_total{direction=\"received\"} %d\n", m.bytes[0].Load())
+	fmt.Fprintf(w, "wsd_bytes_total{direction=\"sent\"} %d\n", m.bytes[1].Load())
+	metric("wsd_handshake_duration_seconds", "histogram", "Time to establish a WebSocket connection, from dialing to the end of the upgrade.")
+	m.handshake.write(w, "wsd_handshake_duration_seconds")
+	metric("wsd_rtt_seconds", "histogram", "Round-trip times of pings and -rtt probes.")
+	m.rtt.write(w, "wsd_rtt_seconds")
+}
+
+// durationHistogram is a Prometheus histogram of durations, with
+// metricBuckets.
+type durationHistogram struct {
+	mu     sync.Mutex
+	counts []int64 // by bucket, not cumulative, with +Inf last
+	sum    float64
+}
+
+func newDurationHistogram() *durationHistogram {
+	return &durationHistogram{counts: make([]int64, len(metricBuckets)+1)}
+}
+
+func (h *durationHistogram) observe(d time.Duration) {
+	s := d.Seconds()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.counts[sort.SearchFloat64s(metricBuckets, s)]++
+	h.sum += s
+}
+
+// write writes the buckets, sum and count of h as the metric name.
+func (h *durationHistogram) write(w io.Writer, name string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var total int64
+	for i, c := range h.counts {
+		total += c
+		le := "+Inf"
+		if i < len(metricBuckets) {
+			le = strconv.FormatFloat(metricBuckets[i], 'g', -1, 64)
+		}
+		fmt.Fprintf(w, "%s_bucket{le=%q} %d\n", name, le, total)
+	}
+	fmt.Fprintf(w, "%s_sum %g\n%s_count %d\n", name, h.sum, name, total)
+}
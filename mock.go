@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// checkMockFlags validates -mock-match.
+func checkMockFlags() error {
+	switch mockMatch {
+	case "message", "sequence":
+		return nil
+	}
+	return fmt.Errorf("unknown -mock-match %q, expected message or sequence", mockMatch)
+}
+
+// mockResponse is a message the server sent in a recording, delay after the
+// client message it answers, or after connecting.
+type mockResponse struct {
+	delay time.Duration
+	message
+}
+
+// mockServer serves the server side of a recording to every client that
+// connects.
+type mockServer struct {
+	rec *recording
+
+	// greeting is what the server sent before the client's first message.
+	// For -mock-match message, responses holds what it sent after each
+	// client message, by message: a message sent several times has several
+	// lists of responses, which are used in turn.
+	greeting  []mockResponse
+	responses map[string][][]mockResponse
+}
+
+func newMockServer(rec *recording) *mockServer {
+	s := &mockServer{rec: rec, responses: map[string][][]mockResponse{}}
+	var key string
+	var since time.Duration
+	for _, m := range rec.messages {
+		if m.sent {
+			key, since = mockKey(m.message), m.at
+			s.responses[key] = append(s.responses[key], nil)
+			continue
+		}
+		r := mockResponse{delay: m.at - since, message: m.message}
+		if lists := s.responses[key]; key != "" {
+			lists[len(lists)-1] = append(lists[len(lists)-1], r)
+		} else {
+			s.greeting = append(s.greeting, r)
+		}
+	}
+	return s
+}
+
+func mockKey(msg message) string {
+	return fmt.Sprint(msg.messageType, ":", string(msg.data))
+}
+
+// runMock serves the recording on -listen until interrupted.
+func runMock(rec *recording) error {
+	s := newMockServer(rec)
+	printLine("serving %s on %s, matching responses by %s", yellow(rec.url), yellow(listenAddr), mockMatch)
+	return listenAndServe(s)
+}
+
+func (s *mockServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var protocols []string
+	if s.rec.subprotocol != "" {
+		protocols = []string{s.rec.subprotocol}
+	}
+	ws, err := acceptWebSocket(w, r, protocols)
+	if err != nil {
+		printError(fmt.Errorf("%s: %v", r.RemoteAddr, err))
+		return
+	}
+	defer ws.Close()
+	client := r.RemoteAddr
+	printLine("%s connected to %s", yellow(client), r.URL.Path)
+
+	ctx, cancel := context.WithCancelCause(context.Background())
+	defer cancel(nil)
+	in := make(chan message)
+	go func() {
+		for {
+			messageType, data, err := ws.ReadMessage()
+			if err != nil {
+				cancel(err)
+				return
+			}
+			select {
+			case in <- message{messageType: messageType, data: data}:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	if mockMatch == "sequence" {
+		err = s.sequence(ctx, ws, in)
+	} else {
+		err = s.match(ctx, ws, in, client)
+	}
+	if err == nil {
+		<-ctx.Done()
+		err = context.Cause(ctx)
+	}
+	printLine("%s disconnected: %v", yellow(client), err)
+}
+
+// sequence sends what the server sent in the recording in order. Before
+// each response, it waits for as many messages from the client as it had
+// received at that point of the recording, and then for the recorded time
+// since the message before it.
+func (s *mockServer) sequence(ctx context.Context, ws *frameConn, in <-chan message) error {
+	var last time.Duration
+	for _, m := range s.rec.messages {
+		if m.sent {
+			select {
+			case <-in:
+			case <-ctx.Done():
+				return nil
+			}
+		} else {
+			if !mockWait(ctx, m.at-last) {
+				return nil
+			}
+			if err := ws.WriteMessage(m.messageType, m.data); err != nil {
+				return err
+			}
+		}
+		last = m.at
+	}
+	// Any further messages from the client are ignored.
+	for {
+		select {
+		case <-in:
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// match sends the greeting, then answers each client message with what the
+// server sent after the same message in the recording, at the recorded
+// times after it.
+func (s *mockServer) match(ctx context.Context, ws *frameConn, in <-chan message, client string) error {
+	go s.respond(ctx, ws, s.greeting)
+	used := map[string]int{}
+	for {
+		var msg message
+		select {
+		case msg = <-in:
+		case <-ctx.Done():
+			return nil
+		}
+		key := mockKey(msg)
+		lists := s.responses[key]
+		if len(lists) == 0 {
+			printLine("%s sent a message that is not in the recording: %s", yellow(client), formatMessage(msg))
+			continue
+		}
+		go s.respond(ctx, ws, lists[used[key]%len(lists)])
+		used[key]++
+	}
+}
+
+func (s *mockServer) respond(ctx context.Context, ws *frameConn, responses []mockResponse) {
+	var last time.Duration
+	for _, r := range responses {
+		if !mockWait(ctx, r.delay-last) {
+			return
+		}
+		last = r.delay
+		if ws.WriteMessage(r.messageType, r.data) != nil {
+			return
+		}
+	}
+}
+
+// mockWait waits for a recorded delay, scaled by -speed, unless -no-delay
+// is given. It reports whether ctx is still live.
+func mockWait(ctx context.Context, d time.Duration) bool {
+	if noDelay || d <= 0 {
+		return ctx.Err() == nil
+	}
+	select {
+	case <-time.After(time.Duration(float64(d) / replaySpeed)):
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
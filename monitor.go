@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"regexp"
+	"runtime"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// maxReconnectDelay is the longest monitor waits before reconnecting.
+const maxReconnectDelay = time.Minute
+
+// heartbeatRegexp is the compiled -heartbeat.
+var heartbeatRegexp *regexp.Regexp
+
+// checkMonitorFlags validates the flags of monitor.
+func checkMonitorFlags() error {
+	if command != "monitor" {
+		if heartbeat != "" || onFailure != "" || onRecovery != "" || webhook != "" {
+			return errors.New("-heartbeat, -on-failure, -on-recovery and -webhook require monitor")
+		}
+		return nil
+	}
+	switch {
+	case len(urls) > 1:
+		return errors.New("monitor takes a single URL")
+	case heartbeatTimeout <= 0:
+		return errors.New("-heartbeat-timeout must be positive")
+	case connections > 1:
+		return errors.New("-connections is not supported by monitor")
+	case recordFile != "" || harFileName != "" || pcapFile != "":
+		return errors.New("-record, -har and -pcap are not supported by monitor")
+	}
+	var err error
+	if heartbeatRegexp, err = regexp.Compile(heartbeat); err != nil {
+		return fmt.Errorf("invalid -heartbeat %q: %v", heartbeat, err)
+	}
+	for _, line := range send {
+		if _, err := parseInput(line); err != nil {
+			return fmt.Errorf("-send: %v", err)
+		}
+	}
+	return nil
+}
+
+// monitor keeps a connection to the URL open, reconnecting as needed, and
+// checks that heartbeat messages keep arriving. When it goes down, or up
+// again after being down, it runs -on-failure or -on-recovery and calls
+// -webhook.
+type monitor struct {
+	up    bool
+	known bool // whether up has been determined
+	since time.Time
+	hooks sync.WaitGroup
+}
+
+// runMonitor monitors the URL until interrupted.
+func runMonitor() int {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	printLine("monitoring %s, expecting a heartbeat every %v...", yellow(url), heartbeatTimeout)
+	m := &monitor{}
+	delay := time.Second
+	for attempt := 0; ; attempt++ {
+		if attempt > 0 {
+			metrics.reconnected()
+		}
+		err := m.session(ctx)
+		if ctx.Err() != nil {
+			break
+		}
+		if m.up {
+			delay = time.Second
+		}
+		m.setState(false, err.Error())
+		printLine("reconnecting in %v...", delay)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		delay = min(2*delay, maxReconnectDelay)
+	}
+	m.hooks.Wait()
+	statsd.flush()
+	tracer.flush()
+	return exitOK
+}
+
+// session connects and checks the heartbeats until ctx is done or the
+// connection fails, and returns why it failed.
+func (m *monitor) session(ctx context.Context) error {
+	ws, err := dial(url, protocol, origin, nil)
+	if err != nil {
+		return err
+	}
+	defer ws.Close()
+	for _, line := range send {
+		// Validated by checkMonitorFlags.
+		msg, _ := parseInput(line)
+		if err := ws.WriteMessage(msg.messageType, msg.data); err != nil {
+			return err
+		}
+	}
+
+	failed, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	heartbeats := make(chan struct{}, 1)
+	go func() {
+		for {
+			_, data, err := ws.ReadMessage()
+			if err != nil {
+				cancel(err)
+				return
+			}
+			if heartbeatRegexp.Match(data) {
+				select {
+				case heartbeats <- struct{}{}:
+				default:
+				}
+			}
+		}
+	}()
+	if pingInterval > 0 {
+		go func() {
+			if err := pingLoop(failed, ws, pingInterval, pongTimeout); err != nil {
+				cancel(err)
+			}
+		}()
+	}
+
+	timer := time.NewTimer(heartbeatTimeout)
+	defer timer.Stop()
+	for {
+		select {
+		case <-heartbeats:
+			m.setState(true, "heartbeat received")
+			timer.Reset(heartbeatTimeout)
+		case <-timer.C:
+			ws.WriteControl(CloseMessage, FormatCloseMessage(1000, ""), time.Now().Add(time.Second))
+			return &timeoutError{fmt.Sprintf("no heartbeat received within %v", heartbeatTimeout)}
+		case <-ctx.Done():
+			ws.WriteControl(CloseMessage, FormatCloseMessage(1000, ""), time.Now().Add(time.Second))
+			return ctx.Err()
+		case <-failed.Done():
+			return context.Cause(failed)
+		}
+	}
+}
+
+// setState records whether the URL is up, printing and running the hooks
+// for a change. Going down is only reported once, and coming up only after
+// being down.
+func (m *monitor) setState(up bool, reason string) {
+	if m.known && m.up == up {
+		return
+	}
+	wasKnown := m.known
+	m.up, m.known = up, true
+	var downFor time.Duration
+	if !m.since.IsZero() {
+		downFor = time.Since(m.since)
+	}
+	m.since = time.Now()
+
+	state := "down"
+	if up {
+		state = "up"
+	}
+	if jsonOutput {
+		emit(event{Event: state, URL: url, Reason: reason})
+	} else if up {
+		printLine("%s %s", green("up:"), reason)
+	} else {
+		printLine("%s %s", red("down:"), reason)
+	}
+	if up && !wasKnown {
+		return
+	}
+	if up {
+		reason = fmt.Sprintf("%s after being down for %v", reason, downFor.Round(time.Second))
+	}
+	m.runHooks(state, reason)
+}
+
+// runHooks runs -on-failure or -on-recovery and calls -webhook in the
+// background.
+func (m *monitor) runHooks(state, reason string) {
+	command := onFailure
+	if state == "up" {
+		command = onRecovery
+	}
+	if command != "" {
+		m.hooks.Add(1)
+		go func() {
+			defer m.hooks.Done()
+			if err := runHookCommand(command, state, reason); err != nil {
+				printError(fmt.Errorf("running %q: %v", command, err))
+			}
+		}()
+	}
+	if webhook != "" {
+		m.hooks.Add(1)
+		go func() {
+			defer m.hooks.Done()
+			if err := callWebhook(state, reason); err != nil {
+				printError(fmt.Errorf("calling -webhook: %v", err))
+			}
+		}()
+	}
+}
+
+// runHookCommand runs a shell command with the state, the reason for it and
+// the URL in the environment variables WSD_HOOK_STATE, WSD_HOOK_REASON and
+// WSD_HOOK_URL, named so that a wsd run by the command does not read them as
+// flags.
+func runHookCommand(command, state, reason string) error {
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.Command("cmd", "/C", command)
+	} else {
+		cmd = exec.Command("sh", "-c", command)
+	}
+	cmd.Env = append(os.Environ(), "WSD_HOOK_STATE="+state, "WSD_HOOK_REASON="+reason, "WSD_HOOK_URL="+url)
+	cmd.Stdout, cmd.Stderr = os.Stderr, os.Stderr
+	return cmd.Run()
+}
+
+// callWebhook posts the state, the reason for it and the URL to -webhook as
+// a JSON object.
+func callWebhook(state, reason string) error {
+	body, err := json.Marshal(map[string]string{
+		"state":  state,
+		"reason": reason,
+		"url":    url,
+		"time":   time.Now().Format(time.RFC3339),
+	})
+	if err != nil {
+		return err
+	}
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Post(webhook, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return errors.New(resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,403 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// MQTT 3.1.1 control packet types, the high nibble of a packet's first byte.
+const (
+	mqttConnect     = 1
+	mqttConnack     = 2
+	mqttPublish     = 3
+	mqttPuback      = 4
+	mqttPubrec      = 5
+	mqttPubrel      = 6
+	mqttPubcomp     = 7
+	mqttSubscribe   = 8
+	mqttSuback      = 9
+	mqttUnsubscribe = 10
+	mqttUnsuback    = 11
+	mqttPingreq     = 12
+	mqttPingresp    = 13
+	mqttDisconnect  = 14
+)
+
+// mqttConnackCodes describe the return codes of CONNACK refusing a
+// connection.
+var mqttConnackCodes = map[byte]string{
+	1: "unacceptable protocol version",
+	2: "identifier rejected",
+	3: "server unavailable",
+	4: "bad user name or password",
+	5: "not authorized",
+}
+
+// checkMQTTFlags validates -mqtt and its options, and offers the mqtt
+// subprotocol unless -protocol does.
+func checkMQTTFlags() error {
+	if !mqtt {
+		if mqttClientID != "" || mqttLogin != "" || flagGiven("mqtt-keepalive") || flagGiven("mqtt-qos") || len(mqttSubscriptions) > 0 {
+			return errors.New("-mqtt-client-id, -mqtt-login, -mqtt-keepalive, -mqtt-qos and -mqtt-subscribe require -mqtt")
+		}
+		return nil
+	}
+	switch {
+	case command != "":
+		return fmt.Errorf("-mqtt is not supported by %s", command)
+	case mqttKeepalive < 0 || mqttKeepalive > 0xffff*time.Second:
+		return errors.New("-mqtt-keepalive must be between 0 and 18h12m15s")
+	case mqttQoS < 0 || mqttQoS > 2:
+		return errors.New("-mqtt-qos must be 0, 1 or 2")
+	}
+	if protocol == "" {
+		protocol = "mqtt"
+	}
+	return selectAppProtocol("-mqtt", func() appSession {
+		id := mqttClientID
+		if id == "" {
+			id = fmt.Sprintf("wsd-%08x", rand.Uint32())
+		}
+		return &mqttSession{clientID: id, filters: map[uint16]string{}}
+	})
+}
+
+// mqttPacket is an MQTT control packet.
+type mqttPacket struct {
+	typ   byte
+	flags byte
+	body  []byte
+}
+
+// message returns the packet as a binary message, after its fixed header
+// of its type and flags and the length of its body.
+func (p mqttPacket) message() message {
+	b := []byte{p.typ<<4 | p.flags}
+	for n := len(p.body); ; {
+		digit := byte(n % 128)
+		if n /= 128; n > 0 {
+			digit |= 0x80
+		}
+		b = append(b, digit)
+		if n == 0 {
+			break
+		}
+	}
+	return message{messageType: BinaryMessage, data: append(b, p.body...)}
+}
+
+// parseMQTTPacket parses the packet at the start of b, returning the bytes
+// after it, or ok false if b does not hold all of it yet.
+func parseMQTTPacket(b []byte) (p mqttPacket, rest []byte, ok bool, err error) {
+	var n, shift int
+	header := b[0]
+	for i := 1; ; i++ {
+		if i > 4 {
+			return p, nil, false, errors.New("invalid MQTT remaining length")
+		}
+		if i >= len(b) {
+			return p, b, false, nil
+		}
+		n |= int(b[i]&0x7f) << shift
+		shift += 7
+		if b[i]&0x80 == 0 {
+			b = b[i+1:]
+			break
+		}
+	}
+	if len(b) < n {
+		return p, nil, false, nil
+	}
+	return mqttPacket{typ: header >> 4, flags: header & 0x0f, body: b[:n]}, b[n:], true, nil
+}
+
+func appendMQTTString(b []byte, s string) []byte {
+	b = binary.BigEndian.AppendUint16(b, uint16(len(s)))
+	return append(b, s...)
+}
+
+func readMQTTString(b []byte) (string, []byte, bool) {
+	if len(b) < 2 || len(b) < 2+int(binary.BigEndian.Uint16(b)) {
+		return "", nil, false
+	}
+	n := 2 + int(binary.BigEndian.Uint16(b))
+	return string(b[2:n]), b[n:], true
+}
+
+// packetID returns the packet identifier at the start of a packet's body.
+func (p mqttPacket) packetID() uint16 {
+	if len(p.body) < 2 {
+		return 0
+	}
+	return binary.BigEndian.Uint16(p.body)
+}
+
+// mqttSession speaks MQTT 3.1.1, connecting with the credentials of
+// -mqtt-login, subscribing to the topic filters of -mqtt-subscribe and
+// pinging the broker every -mqtt-keepalive. Messages published to the
+// subscriptions are shown as their topic, QoS and payload, and input lines
+// are commands:
+//
+//	subscribe <filter> [qos]
+//	unsubscribe <filter>
+//	publish <topic> <payload>
+//	disconnect
+type mqttSession struct {
+	ctx      context.Context
+	clientID string
+
+	mu        sync.Mutex
+	connected bool
+	queued    []message // the packets sent before the broker accepted the connection
+	lastID    uint16
+	filters   map[uint16]string // the filters of the pending subscriptions by packet ID
+	buf       []byte            // the start of a packet split across messages
+}
+
+func (s *mqttSession) open(ctx context.Context, send func(message)) {
+	s.ctx = ctx
+	flags := byte(0x02) // clean session
+	var payload []byte
+	payload = appendMQTTString(payload, s.clientID)
+	if mqttLogin != "" {
+		user, password, hasPassword := strings.Cut(mqttLogin, ":")
+		flags |= 0x80
+		payload = appendMQTTString(payload, user)
+		if hasPassword {
+			flags |= 0x40
+			payload = appendMQTTString(payload, password)
+		}
+	}
+	body := appendMQTTString(nil, "MQTT")
+	body = append(body, 4, flags)
+	body = binary.BigEndian.AppendUint16(body, uint16(mqttKeepalive/time.Second))
+	send(mqttPacket{typ: mqttConnect, body: append(body, payload...)}.message())
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, filter := range mqttSubscriptions {
+		s.queued = append(s.queued, s.subscribe(filter, byte(mqttQoS)))
+	}
+}
+
+// nextID returns the next packet identifier, which is never 0.
+func (s *mqttSession) nextID() uint16 {
+	if s.lastID++; s.lastID == 0 {
+		s.lastID++
+	}
+	return s.lastID
+}
+
+func (s *mqttSession) subscribe(filter string, qos byte) message {
+	id := s.nextID()
+	s.filters[id] = filter
+	body := binary.BigEndian.AppendUint16(nil, id)
+	body = append(appendMQTTString(body, filter), qos)
+	return mqttPacket{typ: mqttSubscribe, flags: 0x02, body: body}.message()
+}
+
+func (s *mqttSession) input(line string) ([]message, error) {
+	command, args, _ := strings.Cut(strings.TrimSpace(line), " ")
+	args = strings.TrimSpace(args)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var msg message
+	switch strings.ToLower(command) {
+	case "subscribe":
+		fields := strings.Fields(args)
+		qos, err := mqttQoS, error(nil)
+		if len(fields) == 2 {
+			qos, err = strconv.Atoi(fields[1])
+		}
+		if len(fields) == 0 || len(fields) > 2 || err != nil || qos < 0 || qos > 2 {
+			return nil, errors.New("usage: subscribe <filter> [qos]")
+		}
+		msg = s.subscribe(fields[0], byte(qos))
+	case "unsubscribe":
+		if args == "" {
+			return nil, errors.New("usage: unsubscribe <filter>")
+		}
+		body := binary.BigEndian.AppendUint16(nil, s.nextID())
+		msg = mqttPacket{typ: mqttUnsubscribe, flags: 0x02, body: appendMQTTString(body, args)}.message()
+	case "publish":
+		topic, payload, _ := strings.Cut(args, " ")
+		if topic == "" {
+			return nil, errors.New("usage: publish <topic> <payload>")
+		}
+		body := appendMQTTString(nil, topic)
+		if mqttQoS > 0 {
+			body = binary.BigEndian.AppendUint16(body, s.nextID())
+		}
+		msg = mqttPacket{typ: mqttPublish, flags: byte(mqttQoS) << 1, body: append(body, payload...)}.message()
+	case "disconnect":
+		msg = mqttPacket{typ: mqttDisconnect}.message()
+	default:
+		return nil, errors.New("unknown MQTT command, expected subscribe, unsubscribe, publish or disconnect")
+	}
+	if !s.connected {
+		s.queued = append(s.queued, msg)
+		return nil, nil
+	}
+	return []message{msg}, nil
+}
+
+func (s *mqttSession) receive(msg message, send func(message)) ([]message, error) {
+	if msg.messageType != BinaryMessage {
+		return []message{msg}, nil
+	}
+	s.mu.Lock()
+	b := append(s.buf, msg.data...)
+	var packets []mqttPacket
+	for len(b) > 0 {
+		p, rest, ok, err := parseMQTTPacket(b)
+		if err != nil {
+			s.buf = nil
+			s.mu.Unlock()
+			return nil, err
+		}
+		if !ok {
+			break
+		}
+		packets, b = append(packets, p), rest
+	}
+	s.buf = b
+	s.mu.Unlock()
+
+	var shown []message
+	for _, p := range packets {
+		m, err := s.packet(p, msg, send)
+		if err != nil {
+			return shown, err
+		}
+		shown = append(shown, m...)
+	}
+	return shown, nil
+}
+
+// packet handles a packet received in msg, returning the message published
+// it holds, if any, to show as a text message.
+func (s *mqttSession) packet(p mqttPacket, msg message, send func(message)) ([]message, error) {
+	switch p.typ {
+	case mqttConnack:
+		if len(p.body) < 2 {
+			return nil, errors.New("invalid MQTT CONNACK")
+		}
+		if code := p.body[1]; code != 0 {
+			reason, ok := mqttConnackCodes[code]
+			if !ok {
+				reason = fmt.Sprintf("return code %d", code)
+			}
+			return nil, fmt.Errorf("MQTT connection refused: %s", reason)
+		}
+		s.mu.Lock()
+		s.connected = true
+		queued := s.queued
+		s.queued = nil
+		s.mu.Unlock()
+		session := ""
+		if p.body[0]&0x01 != 0 {
+			session = ", resuming its session"
+		}
+		printLine("connected as %s%s", s.clientID, session)
+		for _, q := range queued {
+			send(q)
+		}
+		if mqttKeepalive > 0 {
+			go s.keepalive(send)
+		}
+		return nil, nil
+	case mqttPublish:
+		return s.publish(p, msg, send)
+	case mqttPuback, mqttPubcomp:
+		printLine("message %d delivered", p.packetID())
+		return nil, nil
+	case mqttPubrec:
+		send(mqttPacket{typ: mqttPubrel, flags: 0x02, body: p.body[:min(2, len(p.body))]}.message())
+		return nil, nil
+	case mqttPubrel:
+		send(mqttPacket{typ: mqttPubcomp, body: p.body[:min(2, len(p.body))]}.message())
+		return nil, nil
+	case mqttSuback:
+		s.mu.Lock()
+		filter := s.filters[p.packetID()]
+		delete(s.filters, p.packetID())
+		s.mu.Unlock()
+		for _, code := range p.body[min(2, len(p.body)):] {
+			if code == 0x80 {
+				printError(fmt.Errorf("subscription to %s refused", filter))
+			} else {
+				printLine("subscribed to %s with QoS %d", filter, code)
+			}
+		}
+		return nil, nil
+	case mqttUnsuback:
+		printLine("unsubscribed")
+		return nil, nil
+	case mqttPingresp:
+		return nil, nil
+	}
+	return nil, fmt.Errorf("unexpected MQTT packet of type %d", p.typ)
+}
+
+// publish acknowledges a PUBLISH packet as its QoS requires, and returns it
+// as a text message of its topic, QoS and payload, hex-encoded if it is not
+// valid UTF-8.
+func (s *mqttSession) publish(p mqttPacket, msg message, send func(message)) ([]message, error) {
+	qos := p.flags >> 1 & 0x03
+	topic, payload, ok := readMQTTString(p.body)
+	if ok && qos > 0 {
+		if len(payload) < 2 {
+			ok = false
+		} else {
+			id := payload[:2]
+			payload = payload[2:]
+			typ := byte(mqttPuback)
+			if qos == 2 {
+				typ = mqttPubrec
+			}
+			send(mqttPacket{typ: typ, body: id}.message())
+		}
+	}
+	if !ok {
+		return nil, errors.New("invalid MQTT PUBLISH")
+	}
+
+	attrs := []string{fmt.Sprintf("qos %d", qos)}
+	if p.flags&0x01 != 0 {
+		attrs = append(attrs, "retained")
+	}
+	if p.flags&0x08 != 0 {
+		attrs = append(attrs, "duplicate")
+	}
+	text := string(payload)
+	if !utf8.Valid(payload) {
+		text = hex.EncodeToString(payload)
+	}
+	msg.messageType = TextMessage
+	msg.data = []byte(fmt.Sprintf("%s [%s] %s", topic, strings.Join(attrs, ", "), text))
+	return []message{msg}, nil
+}
+
+// keepalive pings the broker every -mqtt-keepalive, until the connection
+// is closed.
+func (s *mqttSession) keepalive(send func(message)) {
+	ticker := time.NewTicker(mqttKeepalive)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			send(mqttPacket{typ: mqttPingreq}.message())
+		case <-s.ctx.Done():
+			return
+		}
+	}
+}
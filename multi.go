@@ -0,0 +1,151 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fatih/color"
+)
+
+// connColors tell the connections of -connections apart.
+var connColors = []func(a ...interface{}) string{
+	green,
+	yellow,
+	magenta,
+	color.New(color.FgBlue).SprintFunc(),
+	color.New(color.FgHiGreen).SprintFunc(),
+	color.New(color.FgHiYellow).SprintFunc(),
+	color.New(color.FgHiMagenta).SprintFunc(),
+	color.New(color.FgHiBlue).SprintFunc(),
+}
+
+// checkConnectionsFlags validates -connections.
+func checkConnectionsFlags() error {
+	switch {
+	case connections < 1:
+		return errors.New("-connections must be at least 1")
+	case connections == 1:
+		return nil
+	case command == "replay":
+		return errors.New("-connections is not supported by replay")
+	case recordFile != "" || harFileName != "" || pcapFile != "":
+		return errors.New("-record, -har and -pcap do not support -connections")
+	}
+	return nil
+}
+
+// connPrefix returns the colored prefix of the output of a connection with
+// -connections, or "" for label "".
+func connPrefix(label string) string {
+	if label == "" {
+		return ""
+	}
+	n, _ := strconv.Atoi(label)
+	return connColors[(n-1)%len(connColors)]("["+label+"]") + " "
+}
+
+// runConnections opens -connections connections, each to the first of the
+// URLs that accepts it, and drives them all at once until they have ended.
+// It returns the exit status of the first connection that failed, if any.
+// If a connection cannot be opened, those already open are closed.
+func runConnections(deadline time.Time) int {
+	conns := make([]Conn, connections)
+	for i := range conns {
+		ws, err := tryConnect()
+		if err != nil {
+			for _, ws := range conns[:i] {
+				ws.WriteControl(CloseMessage, FormatCloseMessage(1001, ""), time.Now().Add(time.Second))
+				ws.Close()
+			}
+			return printExit(err)
+		}
+		conns[i] = ws
+		printBanner("%sconnected to %s", connPrefix(strconv.Itoa(i+1)), green(url))
+	}
+	connectedAt = time.Now()
+	printBanner("")
+
+	lines := make([]chan string, len(conns))
+	done := make([]chan struct{}, len(conns))
+	for i := range conns {
+		lines[i], done[i] = make(chan string), make(chan struct{})
+	}
+	go dispatchInput(lines, done)
+
+	var mu sync.Mutex
+	status := exitOK
+	var wg sync.WaitGroup
+	for i, ws := range conns {
+		label := strconv.Itoa(i + 1)
+		// Exit conditions were validated before connecting.
+		watcher, _ := newExitWatcher(exitOn, failOn)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := run(ws, label, lines[i], watcher, deadline)
+			close(done[i])
+			trafficLog.note("connection %s: %v", label, err)
+
+			mu.Lock()
+			defer mu.Unlock()
+			if status == exitOK {
+				status = exitStatus(err)
+			}
+			if jsonOutput {
+				e := exitEvent(err, exitStatus(err))
+				e.Conn = label
+				emit(e)
+				return
+			}
+			reasons := exitReasons(err)
+			if len(reasons) == 0 {
+				reasons = []string{"closed"}
+			}
+			for _, reason := range reasons {
+				printLine("%s✝ %s", connPrefix(label), reason)
+			}
+		}()
+	}
+	wg.Wait()
+	flushSummaries()
+	return status
+}
+
+// dispatchInput reads stdin for runConnections. A line starting with @N,
+// such as "@2 hello", goes to connection N, and any other line to all of
+// them. Lines for connections that have ended are dropped.
+func dispatchInput(lines []chan string, done []chan struct{}) {
+	defer func() {
+		for _, l := range lines {
+			close(l)
+		}
+	}()
+	prompt()
+	for line := range readStdin() {
+		targets := make([]int, len(lines))
+		for i := range targets {
+			targets[i] = i
+		}
+		if rest, ok := strings.CutPrefix(line, "@"); ok {
+			name, payload, _ := strings.Cut(rest, " ")
+			n, err := strconv.Atoi(name)
+			if err != nil || n < 1 || n > len(lines) {
+				printError(fmt.Errorf("no connection %q, expected @1 to @%d", name, len(lines)))
+				prompt()
+				continue
+			}
+			targets, line = []int{n - 1}, payload
+		}
+		for _, i := range targets {
+			select {
+			case lines[i] <- line:
+			case <-done[i]:
+			}
+		}
+		prompt()
+	}
+}
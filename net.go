@@ -0,0 +1,281 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	neturl "net/url"
+	"strings"
+	"time"
+
+	xproxy "golang.org/x/net/proxy"
+)
+
+// netDialer opens the network connection underneath a WebSocket connection,
+// optionally through a proxy.
+type netDialer struct {
+	// proxy is the URL of the HTTP, HTTPS or SOCKS5 proxy to tunnel
+	// through, or nil for a direct connection.
+	proxy     *neturl.URL
+	tlsConfig *tls.Config
+
+	// resolve maps "host:port" to the address to connect to instead, as
+	// given by -resolve.
+	resolve map[string]string
+
+	// timing, if set, records how long connecting takes, for -timing.
+	timing *connTiming
+}
+
+// parseResolve parses -resolve entries of the form host:port:address, as
+// used by curl. IPv6 addresses may be given in brackets.
+func parseResolve(entries []string) (map[string]string, error) {
+	resolve := map[string]string{}
+	for _, entry := range entries {
+		parts := strings.SplitN(entry, ":", 3)
+		if len(parts) != 3 || parts[0] == "" || parts[1] == "" || parts[2] == "" {
+			return nil, fmt.Errorf("invalid -resolve %q, expected host:port:address", entry)
+		}
+		address := strings.TrimSuffix(strings.TrimPrefix(parts[2], "["), "]")
+		if net.ParseIP(address) == nil {
+			return nil, fmt.Errorf("invalid -resolve %q: %q is not an IP address", entry, parts[2])
+		}
+		resolve[net.JoinHostPort(parts[0], parts[1])] = net.JoinHostPort(address, parts[1])
+	}
+	return resolve, nil
+}
+
+// proxyFor returns the proxy to use for the WebSocket URL u. The -socks5 and
+// -proxy flags take precedence over the HTTP_PROXY, HTTPS_PROXY and NO_PROXY
+// environment variables.
+func proxyFor(u *neturl.URL) (*neturl.URL, error) {
+	if socks5 != "" {
+		return parseProxyURL("socks5://" + socks5)
+	}
+	if proxy != "" {
+		return parseProxyURL(proxy)
+	}
+
+	// The environment is keyed by the HTTP scheme matching the WebSocket one.
+	target := *u
+	switch u.Scheme {
+	case "ws":
+		target.Scheme = "http"
+	case "wss":
+		target.Scheme = "https"
+	}
+	return http.ProxyFromEnvironment(&http.Request{URL: &target})
+}
+
+func parseProxyURL(s string) (*neturl.URL, error) {
+	if !strings.Contains(s, "://") {
+		s = "http://" + s
+	}
+	u, err := neturl.Parse(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy URL: %v", err)
+	}
+	return u, nil
+}
+
+// dialTCP opens a TCP connection to addr.
+func (d *netDialer) dialTCP(ctx context.Context, network, addr string) (net.Conn, error) {
+	if resolved, ok := d.resolve[addr]; ok {
+		addr = resolved
+	}
+	if d.proxy != nil {
+		switch d.proxy.Scheme {
+		case "socks5", "socks5h":
+			return d.dialSOCKS5(ctx, network, addr)
+		case "http", "https":
+			return d.dialHTTPProxy(ctx, network, addr)
+		}
+		return nil, fmt.Errorf("unsupported proxy scheme %q", d.proxy.Scheme)
+	}
+	return d.dialDirect(ctx, network, addr)
+}
+
+func (d *netDialer) dialDirect(ctx context.Context, network, addr string) (net.Conn, error) {
+	nd := net.Dialer{Timeout: connectTimeout}
+	if d.timing == nil {
+		return nd.DialContext(ctx, network, addr)
+	}
+
+	// The host is resolved first, so that the lookup is timed separately
+	// from connecting. The addresses are then tried in order.
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	ips, err := net.DefaultResolver.LookupHost(ctx, host)
+	d.timing.dns += time.Since(start)
+	if err != nil {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: err}
+	}
+	start = time.Now()
+	var conn net.Conn
+	for _, ip := range ips {
+		if conn, err = nd.DialContext(ctx, network, net.JoinHostPort(ip, port)); err == nil {
+			break
+		}
+	}
+	d.timing.connect += time.Since(start)
+	return conn, err
+}
+
+// dialTLS opens a TCP connection to addr and performs the TLS handshake.
+func (d *netDialer) dialTLS(ctx context.Context, network, addr string) (net.Conn, error) {
+	conn, err := d.dialTCP(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	if d.timing == nil {
+		return tlsHandshake(ctx, conn, addr, d.tlsConfig)
+	}
+	start := time.Now()
+	conn, err = tlsHandshake(ctx, conn, addr, d.tlsConfig)
+	d.timing.tls = time.Since(start)
+	return conn, err
+}
+
+func tlsHandshake(ctx context.Context, conn net.Conn, addr string, config *tls.Config) (net.Conn, error) {
+	config = config.Clone()
+	if config.ServerName == "" {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		config.ServerName = host
+	}
+
+	tlsConn := tls.Client(conn, config)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// dialSOCKS5 opens a connection to addr through a SOCKS5 proxy. The target
+// host name is resolved by the proxy.
+func (d *netDialer) dialSOCKS5(ctx context.Context, network, addr string) (net.Conn, error) {
+	var auth *xproxy.Auth
+	if user := d.proxy.User; user != nil {
+		password, _ := user.Password()
+		auth = &xproxy.Auth{User: user.Username(), Password: password}
+	}
+	forward := &net.Dialer{Timeout: connectTimeout}
+	dialer, err := xproxy.SOCKS5("tcp", d.proxy.Host, auth, forward)
+	if err != nil {
+		return nil, err
+	}
+	return dialer.(xproxy.ContextDialer).DialContext(ctx, network, addr)
+}
+
+// dialHTTPProxy opens a tunnel to addr through an HTTP proxy using the
+// CONNECT method. Credentials in the proxy URL are sent using basic
+// authentication, or digest authentication if the proxy asks for it.
+func (d *netDialer) dialHTTPProxy(ctx context.Context, network, addr string) (net.Conn, error) {
+	var auth string
+	if user := d.proxy.User; user != nil {
+		password, _ := user.Password()
+		auth = "Basic " + base64.StdEncoding.EncodeToString([]byte(user.Username()+":"+password))
+	}
+
+	conn, resp, err := d.connect(ctx, network, addr, auth)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode == http.StatusProxyAuthRequired && d.proxy.User != nil {
+		challenge := resp.Header.Get("Proxy-Authenticate")
+		if strings.HasPrefix(strings.ToLower(challenge), "digest ") {
+			conn.Close()
+			password, _ := d.proxy.User.Password()
+			auth, err = digestAuthorization(challenge, http.MethodConnect, addr, d.proxy.User.Username(), password)
+			if err != nil {
+				return nil, err
+			}
+			if conn, resp, err = d.connect(ctx, network, addr, auth); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("proxy %s: CONNECT %s: %s", d.proxy.Host, addr, resp.Status)
+	}
+	return conn, nil
+}
+
+// connect sends a CONNECT request for addr to the proxy and reads the
+// response.
+func (d *netDialer) connect(ctx context.Context, network, addr, auth string) (net.Conn, *http.Response, error) {
+	proxyAddr := d.proxy.Host
+	if d.proxy.Port() == "" {
+		if d.proxy.Scheme == "https" {
+			proxyAddr = net.JoinHostPort(proxyAddr, "443")
+		} else {
+			proxyAddr = net.JoinHostPort(proxyAddr, "80")
+		}
+	}
+
+	conn, err := d.dialDirect(ctx, network, proxyAddr)
+	if err != nil {
+		return nil, nil, err
+	}
+	if d.proxy.Scheme == "https" {
+		if conn, err = tlsHandshake(ctx, conn, proxyAddr, &tls.Config{}); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &neturl.URL{Opaque: addr},
+		Host:   addr,
+		Header: http.Header{},
+	}
+	if auth != "" {
+		req.Header.Set("Proxy-Authorization", auth)
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	resp.Body.Close()
+
+	if br.Buffered() > 0 {
+		conn = &bufferedConn{Conn: conn, r: br}
+	}
+	return conn, resp, nil
+}
+
+// bufferedConn is a net.Conn whose reads are served from a bufio.Reader that
+// may already hold data read from the connection.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
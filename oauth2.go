@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	neturl "net/url"
+	"strings"
+	"time"
+)
+
+// errTokenExpiring ends a connection shortly before its OAuth2 access token
+// expires, so that wsd reconnects with a new one.
+var errTokenExpiring = errors.New("access token expiring")
+
+// tokenRefresh is when the connection is to be reestablished with a new
+// access token, or zero if the token does not expire.
+var tokenRefresh time.Time
+
+var oauth2Client = &http.Client{Timeout: 30 * time.Second}
+
+// oauth2Token is a successful token response (RFC 6749 section 5.1).
+type oauth2Token struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int    `json:"expires_in"`
+}
+
+// applyOAuth2Token gets an access token from the -oauth2-token-url and adds
+// it to the handshake with url: in an Authorization header, or in the
+// -oauth2-param query parameter of the URL returned.
+func applyOAuth2Token(url string, header http.Header) (string, error) {
+	token, err := fetchOAuth2Token()
+	if err != nil {
+		return "", &dialError{fmt.Errorf("getting access token from %s: %v", oauth2TokenURL, err)}
+	}
+
+	tokenRefresh = time.Time{}
+	if token.ExpiresIn > 0 {
+		// Reconnect when 90% of the token's lifetime has passed.
+		lifetime := time.Duration(token.ExpiresIn) * time.Second
+		tokenRefresh = time.Now().Add(lifetime - lifetime/10)
+		printLine("got access token from %s, expires in %v", yellow(oauth2TokenURL), lifetime)
+	} else {
+		printLine("got access token from %s", yellow(oauth2TokenURL))
+	}
+
+	if oauth2Param == "" {
+		header.Set("Authorization", "Bearer "+token.AccessToken)
+		return url, nil
+	}
+	u, err := neturl.Parse(url)
+	if err != nil {
+		return "", err
+	}
+	query := u.Query()
+	query.Set(oauth2Param, token.AccessToken)
+	u.RawQuery = query.Encode()
+	return u.String(), nil
+}
+
+// fetchOAuth2Token requests an access token with the client credentials
+// grant (RFC 6749 section 4.4). The client authenticates with HTTP basic
+// authentication, which all token endpoints support.
+func fetchOAuth2Token() (*oauth2Token, error) {
+	form := neturl.Values{"grant_type": {"client_credentials"}}
+	if oauth2Scope != "" {
+		form.Set("scope", oauth2Scope)
+	}
+	req, err := http.NewRequest(http.MethodPost, oauth2TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	// The credentials are form-encoded first (RFC 6749 section 2.3.1).
+	req.SetBasicAuth(neturl.QueryEscape(oauth2ClientID), neturl.QueryEscape(oauth2ClientSecret))
+
+	resp, err := oauth2Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		var e struct {
+			Error       string `json:"error"`
+			Description string `json:"error_description"`
+		}
+		if json.Unmarshal(body, &e) == nil && e.Error != "" {
+			if e.Description != "" {
+				return nil, fmt.Errorf("%s: %s", e.Error, e.Description)
+			}
+			return nil, errors.New(e.Error)
+		}
+		return nil, errors.New(resp.Status)
+	}
+	var token oauth2Token
+	if err := json.Unmarshal(body, &token); err != nil {
+		return nil, fmt.Errorf("invalid token response: %v", err)
+	}
+	if token.AccessToken == "" {
+		return nil, errors.New("invalid token response: no access_token")
+	}
+	if token.TokenType != "" && !strings.EqualFold(token.TokenType, "bearer") {
+		return nil, fmt.Errorf("unsupported token type %q", token.TokenType)
+	}
+	return &token, nil
+}
+
+// refreshToken returns errTokenExpiring once it is time to reconnect with a
+// new access token.
+func refreshToken(ctx context.Context, at time.Time) error {
+	timer := time.NewTimer(time.Until(at))
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return errTokenExpiring
+	case <-ctx.Done():
+		return nil
+	}
+}
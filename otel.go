@@ -0,0 +1,289 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	neturl "net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// otelMaxEvents is the most events recorded on the span of a connection;
+// those beyond are counted as dropped.
+const otelMaxEvents = 1000
+
+// tracer exports the spans of -otel-endpoint, or is nil if it is not given.
+var tracer *otelExporter
+
+// checkOtelFlags validates -otel-endpoint and -otel-messages.
+func checkOtelFlags() error {
+	switch {
+	case otelEndpoint == "" && otelMessages:
+		return errors.New("-otel-messages requires -otel-endpoint")
+	case otelEndpoint == "":
+		return nil
+	case command == "serve" || command == "mock" || command == "replay":
+		return fmt.Errorf("-otel-endpoint is not supported by %s", command)
+	case webTransport:
+		return errors.New("-otel-endpoint does not support -webtransport")
+	}
+	u, err := neturl.Parse(otelEndpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return fmt.Errorf("invalid -otel-endpoint %q, expected an http or https URL", otelEndpoint)
+	}
+	if u.Path == "" || u.Path == "/" {
+		u.Path = "/v1/traces"
+	}
+	tracer = &otelExporter{url: u.String(), client: &http.Client{Timeout: 5 * time.Second}}
+	return nil
+}
+
+// otelExporter sends spans to an OpenTelemetry collector with OTLP over
+// HTTP, encoded as JSON.
+type otelExporter struct {
+	url    string
+	client *http.Client
+	wg     sync.WaitGroup
+}
+
+// The OTLP JSON encoding of spans.
+type (
+	otelSpan struct {
+		TraceID            string          `json:"traceId"`
+		SpanID             string          `json:"spanId"`
+		ParentSpanID       string          `json:"parentSpanId,omitempty"`
+		Name               string          `json:"name"`
+		Kind               int             `json:"kind"`
+		Start              string          `json:"startTimeUnixNano"`
+		End                string          `json:"endTimeUnixNano"`
+		Attributes         []otelAttribute `json:"attributes,omitempty"`
+		Events             []otelEvent     `json:"events,omitempty"`
+		DroppedEventsCount int             `json:"droppedEventsCount,omitempty"`
+		Status             *otelStatus     `json:"status,omitempty"`
+	}
+	otelEvent struct {
+		Time       string          `json:"timeUnixNano"`
+		Name       string          `json:"name"`
+		Attributes []otelAttribute `json:"attributes,omitempty"`
+	}
+	otelAttribute struct {
+		Key   string    `json:"key"`
+		Value otelValue `json:"value"`
+	}
+	otelValue struct {
+		StringValue *string `json:"stringValue,omitempty"`
+		IntValue    *string `json:"intValue,omitempty"`
+	}
+	otelStatus struct {
+		Code    int    `json:"code"`
+		Message string `json:"message,omitempty"`
+	}
+)
+
+// Span kinds and status codes of OTLP.
+const (
+	otelKindInternal = 1
+	otelKindClient   = 3
+	otelStatusError  = 2
+)
+
+func stringAttr(key, value string) otelAttribute {
+	return otelAttribute{key, otelValue{StringValue: &value}}
+}
+
+func intAttr(key string, value int) otelAttribute {
+	s := strconv.Itoa(value)
+	return otelAttribute{key, otelValue{IntValue: &s}}
+}
+
+func unixNano(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
+
+// export sends spans in the background. Failures are reported but do not
+// affect the connection.
+func (e *otelExporter) export(spans ...otelSpan) {
+	body, err := json.Marshal(map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{
+				"attributes": []otelAttribute{stringAttr("service.name", "wsd")},
+			},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]string{"name": "wsd", "version": Version},
+				"spans": spans,
+			}},
+		}},
+	})
+	if err != nil {
+		printError(err)
+		return
+	}
+	e.wg.Add(1)
+	go func() {
+		defer e.wg.Done()
+		resp, err := e.client.Post(e.url, "application/json", bytes.NewReader(body))
+		if err != nil {
+			printError(fmt.Errorf("exporting spans: %v", err))
+			return
+		}
+		resp.Body.Close()
+		if resp.StatusCode/100 != 2 {
+			printError(fmt.Errorf("exporting spans: %s", resp.Status))
+		}
+	}()
+}
+
+// flush waits for the spans being sent. A nil exporter does not wait.
+func (e *otelExporter) flush() {
+	if e != nil {
+		e.wg.Wait()
+	}
+}
+
+// start starts the trace of a connection to url. A nil exporter returns a
+// nil trace.
+func (e *otelExporter) start(url string) *connTrace {
+	if e == nil {
+		return nil
+	}
+	t := &connTrace{url: url, start: time.Now()}
+	rand.Read(t.traceID[:])
+	rand.Read(t.root[:])
+	rand.Read(t.upgrade[:])
+	return t
+}
+
+// connTrace is the trace of a connection: a span for its lifetime, with the
+// messages and close frames as events, and a span for each phase of
+// connecting, reconstructed from their -timing durations.
+type connTrace struct {
+	url            string
+	traceID        [16]byte
+	root, upgrade  [8]byte
+	start          time.Time
+	upgradeStarted time.Time
+
+	mu      sync.Mutex
+	events  []otelEvent
+	dropped int
+	attrs   []otelAttribute
+}
+
+// traceparent returns the W3C traceparent header of the upgrade request,
+// which makes the server's spans children of the upgrade span.
+func (t *connTrace) traceparent() string {
+	return fmt.Sprintf("00-%x-%x-01", t.traceID, t.upgrade)
+}
+
+// upgrading records that the upgrade request is being sent. A nil trace
+// records nothing.
+func (t *connTrace) upgrading() {
+	if t != nil {
+		t.upgradeStarted = time.Now()
+	}
+}
+
+func (t *connTrace) span(id [8]byte, name string, start, end time.Time) otelSpan {
+	s := otelSpan{
+		TraceID: hex.EncodeToString(t.traceID[:]),
+		SpanID:  hex.EncodeToString(id[:]),
+		Name:    name,
+		Kind:    otelKindInternal,
+		Start:   unixNano(start),
+		End:     unixNano(end),
+	}
+	if id != t.root {
+		s.ParentSpanID = hex.EncodeToString(t.root[:])
+	}
+	return s
+}
+
+// connected exports the spans of the phases of connecting, and if that
+// failed the span of the connection too. A nil trace exports nothing.
+func (t *connTrace) connected(timing *connTiming, ws *frameConn, resp *http.Response, err error) {
+	if t == nil {
+		return
+	}
+	var spans []otelSpan
+	phase := func(name string, start time.Time, d time.Duration) time.Time {
+		if d > 0 {
+			var id [8]byte
+			rand.Read(id[:])
+			spans = append(spans, t.span(id, name, start, start.Add(d)))
+		}
+		return start.Add(d)
+	}
+	end := phase("dns lookup", t.start, timing.dns)
+	end = phase("tcp connect", end, timing.connect)
+	phase("tls handshake", end, timing.tls)
+	if !t.upgradeStarted.IsZero() {
+		upgrade := t.span(t.upgrade, "websocket upgrade", t.upgradeStarted, t.upgradeStarted.Add(timing.upgrade))
+		upgrade.Kind = otelKindClient
+		if resp != nil {
+			upgrade.Attributes = append(upgrade.Attributes, intAttr("http.response.status_code", resp.StatusCode))
+		}
+		spans = append(spans, upgrade)
+	}
+
+	t.attrs = []otelAttribute{stringAttr("url.full", t.url), stringAttr("network.protocol.name", "websocket")}
+	if err != nil {
+		root := t.rootSpan(time.Now())
+		root.Status = &otelStatus{Code: otelStatusError, Message: err.Error()}
+		spans = append(spans, root)
+	} else if ws.subprotocol != "" {
+		t.attrs = append(t.attrs, stringAttr("websocket.subprotocol", ws.subprotocol))
+	}
+	tracer.export(spans...)
+}
+
+func (t *connTrace) rootSpan(end time.Time) otelSpan {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	root := t.span(t.root, "websocket "+t.url, t.start, end)
+	root.Kind = otelKindClient
+	root.Attributes = t.attrs
+	root.Events = t.events
+	root.DroppedEventsCount = t.dropped
+	return root
+}
+
+// closed exports the span of the connection once it is closed.
+func (t *connTrace) closed() {
+	tracer.export(t.rootSpan(time.Now()))
+}
+
+// frame is the frame hook that records close frames, and with
+// -otel-messages data messages, as events of the connection.
+func (t *connTrace) frame(sent bool, f frame) {
+	if f.opcode != CloseMessage && (!otelMessages || f.opcode >= CloseMessage) {
+		return
+	}
+	direction := "received"
+	if sent {
+		direction = "sent"
+	}
+	e := otelEvent{Time: unixNano(time.Now()), Name: "message " + direction}
+	if f.opcode == CloseMessage {
+		e.Name = "close " + direction
+		if len(f.payload) >= 2 {
+			e.Attributes = append(e.Attributes, intAttr("websocket.close.code", int(binary.BigEndian.Uint16(f.payload))))
+		}
+	} else {
+		e.Attributes = append(e.Attributes, stringAttr("websocket.opcode", opcodeName(f.opcode)), intAttr("websocket.payload.size", len(f.payload)))
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.events) >= otelMaxEvents {
+		t.dropped++
+		return
+	}
+	t.events = append(t.events, e)
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync/atomic"
+
+	"github.com/mattn/go-isatty"
+)
+
+// interactive is set when stdin is a terminal. Otherwise wsd runs in pipe
+// mode: there is no prompt or banner, received payloads are written to stdout
+// one per line and all other output goes to stderr.
+var interactive = isatty.IsTerminal(os.Stdin.Fd()) || isatty.IsCygwinTerminal(os.Stdin.Fd())
+
+// promptShown is set once the prompt has been printed.
+var promptShown atomic.Bool
+
+// statusOut returns where output other than received payloads goes.
+func statusOut() io.Writer {
+	if interactive {
+		return os.Stdout
+	}
+	return os.Stderr
+}
+
+// prompt prints the input prompt.
+func prompt() {
+	if interactive {
+		defer liveStatus.pause()()
+		fmt.Print("> ")
+		promptShown.Store(true)
+	}
+}
+
+// printLine prints a line of status output. Once the prompt is shown, the
+// line is printed in its place and the prompt is printed again below it.
+func printLine(format string, args ...interface{}) {
+	line := fmt.Sprintf(format, args...)
+	if jsonOutput {
+		emit(event{Event: "info", Message: line})
+		return
+	}
+	defer liveStatus.pause()()
+	if interactive && promptShown.Load() {
+		fmt.Printf("\r%s\n> ", line)
+	} else {
+		fmt.Fprintln(statusOut(), line)
+	}
+}
+
+// printBanner prints connection progress. It is omitted in pipe mode.
+func printBanner(format string, args ...interface{}) {
+	if interactive {
+		fmt.Printf(format+"\n", args...)
+	}
+}
+
+// printError reports an error that does not end the connection.
+func printError(err error) {
+	if jsonOutput {
+		emit(event{Event: "error", Error: err.Error()})
+		return
+	}
+	defer liveStatus.pause()()
+	fmt.Fprintf(statusOut(), "err %v\n", red(err))
+}
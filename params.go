@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	neturl "net/url"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// envReference matches ${NAME}, or $${NAME}, which stands for ${NAME} itself.
+var envReference = regexp.MustCompile(`\$?\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// interpolate replaces each ${NAME} in s with the value of the environment
+// variable NAME, which must be set.
+func interpolate(s string) (string, error) {
+	var err error
+	s = envReference.ReplaceAllStringFunc(s, func(ref string) string {
+		if strings.HasPrefix(ref, "$$") {
+			return ref[1:]
+		}
+		name := ref[2 : len(ref)-1]
+		value, ok := os.LookupEnv(name)
+		if !ok && err == nil {
+			err = fmt.Errorf("environment variable %s is not set", name)
+		}
+		return value
+	})
+	return s, err
+}
+
+// interpolateFlags expands environment variables in the URLs, -H headers,
+// -param values and -send messages, but not in the contents of -send-file,
+// and adds the -param query parameters to the URLs.
+func interpolateFlags() error {
+	var err error
+	for i := range headers {
+		if headers[i], err = interpolate(headers[i]); err != nil {
+			return fmt.Errorf("-H: %v", err)
+		}
+	}
+	for i := range send {
+		if sendFiles[i] {
+			continue
+		}
+		if send[i], err = interpolate(send[i]); err != nil {
+			return fmt.Errorf("-send: %v", err)
+		}
+	}
+	if _, err := paramQuery(); err != nil {
+		return err
+	}
+	for i := range urls {
+		if urls[i], err = expandURL(urls[i]); err != nil {
+			return err
+		}
+	}
+	if len(urls) > 0 {
+		url = urls[0]
+	}
+	return nil
+}
+
+// paramQuery returns the -param query parameters, with environment
+// variables expanded in their values.
+func paramQuery() (neturl.Values, error) {
+	query := neturl.Values{}
+	for _, param := range params {
+		name, value, ok := strings.Cut(param, "=")
+		if !ok || name == "" {
+			return nil, fmt.Errorf("invalid -param %q, expected name=value", param)
+		}
+		value, err := interpolate(value)
+		if err != nil {
+			return nil, fmt.Errorf("-param %s: %v", name, err)
+		}
+		query.Add(name, value)
+	}
+	return query, nil
+}
+
+// expandURL expands environment variables in rawURL and adds the -param
+// query parameters to it.
+func expandURL(rawURL string) (string, error) {
+	rawURL, err := interpolate(rawURL)
+	if err != nil {
+		return "", fmt.Errorf("URL: %v", err)
+	}
+	query, err := paramQuery()
+	if err != nil || len(query) == 0 {
+		return rawURL, err
+	}
+	u, err := neturl.Parse(rawURL)
+	if err != nil {
+		return "", err
+	}
+	q := u.Query()
+	for name, values := range query {
+		q[name] = append(q[name], values...)
+	}
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// pcapng block types and the link type of raw IPv4 packets.
+const (
+	pcapngSectionHeader   = 0x0a0d0d0a
+	pcapngInterface       = 0x00000001
+	pcapngEnhancedPacket  = 0x00000006
+	pcapngByteOrderMagic  = 0x1a2b3c4d
+	linkTypeRaw           = 101
+	pcapMaxSegmentPayload = 65535 - 40
+)
+
+// TCP flags.
+const (
+	tcpFIN = 0x01
+	tcpSYN = 0x02
+	tcpPSH = 0x08
+	tcpACK = 0x10
+)
+
+// capture is the -pcap file, or nil if there is none.
+var capture *pcapWriter
+
+// pcapWriter writes the plaintext of each connection to a pcapng file as a
+// synthetic TCP stream from 10.0.0.1 to port 80 of 10.0.0.2, so that
+// Wireshark dissects the handshake as HTTP and the frames that follow with
+// its WebSocket dissector, without the TLS keys. Each connection is a
+// stream of its own, from a new client port, opened with a three-way
+// handshake and closed with FINs.
+type pcapWriter struct {
+	mu   sync.Mutex
+	f    *os.File
+	err  error // why writing stopped
+	port uint16
+
+	open               bool
+	clientSeq, servSeq uint32
+}
+
+// openCapture creates the -pcap file, if any.
+func openCapture() error {
+	if pcapFile == "" {
+		return nil
+	}
+	if webTransport {
+		return errors.New("-pcap does not support -webtransport")
+	}
+	f, err := os.Create(pcapFile)
+	if err != nil {
+		return err
+	}
+	w := &pcapWriter{f: f, port: 49152}
+
+	var shb []byte
+	shb = binary.LittleEndian.AppendUint32(shb, pcapngByteOrderMagic)
+	shb = binary.LittleEndian.AppendUint16(shb, 1) // major version
+	shb = binary.LittleEndian.AppendUint16(shb, 0) // minor version
+	shb = binary.LittleEndian.AppendUint64(shb, ^uint64(0))
+	w.writeBlock(pcapngSectionHeader, shb)
+
+	var idb []byte
+	idb = binary.LittleEndian.AppendUint16(idb, linkTypeRaw)
+	idb = binary.LittleEndian.AppendUint16(idb, 0) // reserved
+	idb = binary.LittleEndian.AppendUint32(idb, 0) // no snap length
+	w.writeBlock(pcapngInterface, idb)
+
+	if w.err != nil {
+		f.Close()
+		return w.err
+	}
+	capture = w
+	return nil
+}
+
+// handshake starts a stream with the upgrade request and response, closing
+// the previous one.
+func (w *pcapWriter) handshake(tap *handshakeTap) {
+	if w == nil || tap == nil {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.finish()
+
+	w.port++
+	w.clientSeq, w.servSeq = 1000, 5000
+	w.open = true
+	// SYN and FIN count as a byte of the sequence.
+	w.packet(true, tcpSYN, nil)
+	w.clientSeq++
+	w.packet(false, tcpSYN|tcpACK, nil)
+	w.servSeq++
+	w.packet(true, tcpACK, nil)
+	w.data(true, tap.request.Bytes())
+	w.data(false, tap.response.Bytes())
+}
+
+// captureFrame is the frame hook of -pcap.
+func captureFrame(sent bool, f frame) {
+	capture.mu.Lock()
+	defer capture.mu.Unlock()
+	if capture.open {
+		capture.data(sent, appendFrame(nil, f))
+	}
+}
+
+// close closes the last stream.
+func (w *pcapWriter) close() {
+	if w == nil {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.finish()
+}
+
+// finish closes the current stream, if any, with a FIN from either side.
+// w.mu must be held.
+func (w *pcapWriter) finish() {
+	if !w.open {
+		return
+	}
+	w.open = false
+	w.packet(true, tcpFIN|tcpACK, nil)
+	w.clientSeq++
+	w.packet(false, tcpFIN|tcpACK, nil)
+	w.servSeq++
+	w.packet(true, tcpACK, nil)
+}
+
+// data sends data in as many segments as needed. w.mu must be held.
+func (w *pcapWriter) data(fromClient bool, data []byte) {
+	for len(data) > 0 {
+		n := min(len(data), pcapMaxSegmentPayload)
+		w.packet(fromClient, tcpPSH|tcpACK, data[:n])
+		if fromClient {
+			w.clientSeq += uint32(n)
+		} else {
+			w.servSeq += uint32(n)
+		}
+		data = data[n:]
+	}
+}
+
+// packet writes an IPv4 packet with a TCP segment of the current stream.
+// w.mu must be held.
+func (w *pcapWriter) packet(fromClient bool, flags byte, payload []byte) {
+	src, dst := [4]byte{10, 0, 0, 1}, [4]byte{10, 0, 0, 2}
+	srcPort, dstPort := w.port, uint16(80)
+	seq, ack := w.clientSeq, w.servSeq
+	if !fromClient {
+		src, dst = dst, src
+		srcPort, dstPort = dstPort, srcPort
+		seq, ack = ack, seq
+	}
+	if flags&tcpACK == 0 {
+		ack = 0
+	}
+
+	tcp := make([]byte, 20, 20+len(payload))
+	binary.BigEndian.PutUint16(tcp[0:], srcPort)
+	binary.BigEndian.PutUint16(tcp[2:], dstPort)
+	binary.BigEndian.PutUint32(tcp[4:], seq)
+	binary.BigEndian.PutUint32(tcp[8:], ack)
+	tcp[12] = 5 << 4 // data offset in 32-bit words
+	tcp[13] = flags
+	binary.BigEndian.PutUint16(tcp[14:], 65535) // window
+	tcp = append(tcp, payload...)
+
+	// The TCP checksum covers a pseudo-header with the addresses.
+	pseudo := append(append(append([]byte{}, src[:]...), dst[:]...), 0, 6)
+	pseudo = binary.BigEndian.AppendUint16(pseudo, uint16(len(tcp)))
+	binary.BigEndian.PutUint16(tcp[16:], internetChecksum(append(pseudo, tcp...)))
+
+	ip := make([]byte, 20, 20+len(tcp))
+	ip[0] = 0x45 // version 4, 5 words of header
+	binary.BigEndian.PutUint16(ip[2:], uint16(20+len(tcp)))
+	binary.BigEndian.PutUint16(ip[6:], 0x4000) // don't fragment
+	ip[8] = 64                                 // TTL
+	ip[9] = 6                                  // TCP
+	copy(ip[12:], src[:])
+	copy(ip[16:], dst[:])
+	binary.BigEndian.PutUint16(ip[10:], internetChecksum(ip))
+	ip = append(ip, tcp...)
+
+	us := uint64(time.Now().UnixMicro())
+	var epb []byte
+	epb = binary.LittleEndian.AppendUint32(epb, 0) // interface
+	epb = binary.LittleEndian.AppendUint32(epb, uint32(us>>32))
+	epb = binary.LittleEndian.AppendUint32(epb, uint32(us))
+	epb = binary.LittleEndian.AppendUint32(epb, uint32(len(ip)))
+	epb = binary.LittleEndian.AppendUint32(epb, uint32(len(ip)))
+	epb = append(epb, ip...)
+	w.writeBlock(pcapngEnhancedPacket, epb)
+}
+
+// writeBlock writes a pcapng block with its body padded to 32 bits. If
+// writing fails, the error is reported and writing stops.
+func (w *pcapWriter) writeBlock(blockType uint32, body []byte) {
+	if w.err != nil {
+		return
+	}
+	for len(body)%4 != 0 {
+		body = append(body, 0)
+	}
+	length := uint32(12 + len(body))
+	var b []byte
+	b = binary.LittleEndian.AppendUint32(b, blockType)
+	b = binary.LittleEndian.AppendUint32(b, length)
+	b = append(b, body...)
+	b = binary.LittleEndian.AppendUint32(b, length)
+	if _, err := w.f.Write(b); err != nil {
+		w.err = err
+		printError(fmt.Errorf("writing -pcap file, capture stopped: %v", err))
+	}
+}
+
+// internetChecksum is the checksum of IP and TCP headers (RFC 1071).
+func internetChecksum(b []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(b[i:]))
+	}
+	if len(b)%2 == 1 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return ^uint16(sum)
+}
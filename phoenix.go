@@ -0,0 +1,292 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	neturl "net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Phoenix Channels events of the protocol itself.
+const (
+	phoenixJoin  = "phx_join"
+	phoenixLeave = "phx_leave"
+	phoenixReply = "phx_reply"
+	phoenixError = "phx_error"
+	phoenixClose = "phx_close"
+)
+
+// phoenixV1 is whether the URL selects version 1 of the Phoenix serializer,
+// which sends messages as objects instead of arrays.
+var phoenixV1 bool
+
+// checkPhoenixFlags validates -phoenix and its options, and points the URLs
+// at the WebSocket transport of the socket: its path followed by
+// /websocket, with the query selecting version 2 of the serializer unless
+// it selects one.
+func checkPhoenixFlags() error {
+	if !phoenix {
+		if len(phoenixJoins) > 0 || flagGiven("phoenix-heartbeat") {
+			return errors.New("-phoenix-join and -phoenix-heartbeat require -phoenix")
+		}
+		return nil
+	}
+	switch {
+	case command != "":
+		return fmt.Errorf("-phoenix is not supported by %s", command)
+	case phoenixHeartbeat < 0:
+		return errors.New("-phoenix-heartbeat must not be negative")
+	}
+	for i, u := range urls {
+		pu, err := neturl.Parse(u)
+		if err != nil {
+			return err
+		}
+		if !strings.HasSuffix(pu.Path, "/websocket") {
+			pu.Path = strings.TrimSuffix(pu.Path, "/") + "/websocket"
+		}
+		q := pu.Query()
+		if q.Get("vsn") == "" {
+			q.Set("vsn", "2.0.0")
+		}
+		phoenixV1 = strings.HasPrefix(q.Get("vsn"), "1.")
+		pu.RawQuery = q.Encode()
+		urls[i] = pu.String()
+	}
+	url = urls[0]
+	return selectAppProtocol("-phoenix", func() appSession {
+		return &phoenixSession{joinRefs: map[string]string{}, pending: map[string]phoenixPush{}}
+	})
+}
+
+// phoenixMessage is a Phoenix Channels message, encoded by version 2 of
+// the serializer as the array
+//
+//	[join_ref, ref, topic, event, payload]
+//
+// and by version 1 as an object of the same fields. The refs are null in
+// the messages the server broadcasts.
+type phoenixMessage struct {
+	JoinRef *string         `json:"join_ref"`
+	Ref     *string         `json:"ref"`
+	Topic   string          `json:"topic"`
+	Event   string          `json:"event"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+func (m phoenixMessage) message() message {
+	if phoenixV1 {
+		return jsonMessage(m)
+	}
+	return jsonMessage([]interface{}{m.JoinRef, m.Ref, m.Topic, m.Event, m.Payload})
+}
+
+func parsePhoenixMessage(data []byte) (phoenixMessage, error) {
+	var m phoenixMessage
+	var err error
+	if d := strings.TrimSpace(string(data)); strings.HasPrefix(d, "[") {
+		var fields []json.RawMessage
+		if err = json.Unmarshal(data, &fields); err == nil && len(fields) != 5 {
+			err = fmt.Errorf("%d fields instead of 5", len(fields))
+		}
+		for i, p := range []interface{}{&m.JoinRef, &m.Ref, &m.Topic, &m.Event, &m.Payload} {
+			if err == nil {
+				err = json.Unmarshal(fields[i], p)
+			}
+		}
+	} else {
+		err = json.Unmarshal(data, &m)
+	}
+	if err != nil {
+		return m, fmt.Errorf("invalid Phoenix message %q: %v", truncate(string(data), 60), err)
+	}
+	return m, nil
+}
+
+// phoenixPush is a message pushed awaiting its reply.
+type phoenixPush struct {
+	topic  string
+	event  string
+	sentAt time.Time
+}
+
+// phoenixSession speaks the Phoenix Channels protocol, joining the topics
+// of -phoenix-join and sending a heartbeat every -phoenix-heartbeat.
+// Messages are shown as their topic, event and payload, and replies with
+// the push they answer. Input lines are commands:
+//
+//	join <topic> [payload]
+//	leave <topic>
+//	push <topic> <event> [payload]
+type phoenixSession struct {
+	ctx context.Context
+
+	mu       sync.Mutex
+	lastRef  int
+	joinRefs map[string]string // the refs of the joins of the channels joined
+	pending  map[string]phoenixPush
+}
+
+func (s *phoenixSession) open(ctx context.Context, send func(message)) {
+	s.ctx = ctx
+	for _, topic := range phoenixJoins {
+		s.mu.Lock()
+		msg := s.push(topic, phoenixJoin, nil)
+		s.mu.Unlock()
+		send(msg)
+	}
+	if phoenixHeartbeat > 0 {
+		go s.heartbeat(send)
+	}
+}
+
+// push returns a message pushing event on the channel of topic, with the
+// next ref, and records it pending.
+func (s *phoenixSession) push(topic, event string, payload json.RawMessage) message {
+	s.lastRef++
+	ref := strconv.Itoa(s.lastRef)
+	if event == phoenixJoin {
+		s.joinRefs[topic] = ref
+	}
+	if payload == nil {
+		payload = json.RawMessage("{}")
+	}
+	m := phoenixMessage{Ref: &ref, Topic: topic, Event: event, Payload: payload}
+	if joinRef, ok := s.joinRefs[topic]; ok {
+		m.JoinRef = &joinRef
+	}
+	s.pending[ref] = phoenixPush{topic: topic, event: event, sentAt: time.Now()}
+	return m.message()
+}
+
+func (s *phoenixSession) input(line string) ([]message, error) {
+	command, args, _ := strings.Cut(strings.TrimSpace(line), " ")
+	command = strings.ToLower(command)
+	topic, rest, _ := strings.Cut(strings.TrimSpace(args), " ")
+	rest = strings.TrimSpace(rest)
+	event := ""
+	switch command {
+	case "join":
+		event = phoenixJoin
+	case "leave":
+		event, rest = phoenixLeave, ""
+	case "push":
+		event, rest, _ = strings.Cut(rest, " ")
+		rest = strings.TrimSpace(rest)
+	default:
+		return nil, errors.New("unknown Phoenix command, expected join, leave or push")
+	}
+	switch {
+	case topic == "" || event == "":
+		return nil, errors.New("usage: join <topic> [payload], leave <topic> or push <topic> <event> [payload]")
+	case rest != "" && !json.Valid([]byte(rest)):
+		return nil, errors.New("the payload must be JSON")
+	}
+	var payload json.RawMessage
+	if rest != "" {
+		payload = json.RawMessage(rest)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return []message{s.push(topic, event, payload)}, nil
+}
+
+func (s *phoenixSession) receive(msg message, send func(message)) ([]message, error) {
+	if msg.messageType != TextMessage {
+		return []message{msg}, nil
+	}
+	m, err := parsePhoenixMessage(msg.data)
+	if err != nil {
+		return nil, err
+	}
+	switch m.Event {
+	case phoenixReply:
+		return s.reply(m, msg)
+	case phoenixError:
+		s.left(m)
+		return nil, fmt.Errorf("channel %s crashed", m.Topic)
+	case phoenixClose:
+		s.left(m)
+		printLine("left channel %s", m.Topic)
+		return nil, nil
+	}
+	msg.data = []byte(m.Topic + " " + m.Event + formatArgs([]json.RawMessage{m.Payload}))
+	return []message{msg}, nil
+}
+
+// left forgets the channel of m's topic, unless m is about an earlier join
+// of it.
+func (s *phoenixSession) left(m phoenixMessage) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if m.JoinRef == nil || s.joinRefs[m.Topic] == *m.JoinRef {
+		delete(s.joinRefs, m.Topic)
+	}
+}
+
+// reply handles the reply to a push, shown with the push's event and
+// latency, and its status and response. Replies to heartbeats are hidden.
+func (s *phoenixSession) reply(m phoenixMessage, msg message) ([]message, error) {
+	var r struct {
+		Status   string          `json:"status"`
+		Response json.RawMessage `json:"response"`
+	}
+	json.Unmarshal(m.Payload, &r)
+	if r.Response == nil {
+		r.Response = json.RawMessage("{}")
+	}
+	var push phoenixPush
+	var ok bool
+	if m.Ref != nil {
+		s.mu.Lock()
+		push, ok = s.pending[*m.Ref]
+		delete(s.pending, *m.Ref)
+		if ok && push.event == phoenixJoin && r.Status != "ok" {
+			delete(s.joinRefs, m.Topic)
+		}
+		s.mu.Unlock()
+	}
+	if ok && push.event == "heartbeat" && r.Status == "ok" {
+		return nil, nil
+	}
+
+	name := m.Topic + " reply"
+	if ok {
+		name = fmt.Sprintf("%s %s (%v)", m.Topic, push.event, msg.time.Sub(push.sentAt).Round(time.Microsecond))
+	}
+	if r.Status != "ok" {
+		return nil, fmt.Errorf("%s %s:%s", name, r.Status, formatArgs([]json.RawMessage{r.Response}))
+	}
+	msg.data = []byte(name + " " + r.Status + formatArgs([]json.RawMessage{r.Response}))
+	return []message{msg}, nil
+}
+
+// heartbeat sends a heartbeat every -phoenix-heartbeat, reporting the
+// server silent if the previous one is still unanswered, until the
+// connection is closed.
+func (s *phoenixSession) heartbeat(send func(message)) {
+	ticker := time.NewTicker(phoenixHeartbeat)
+	defer ticker.Stop()
+	var last string
+	for {
+		select {
+		case <-ticker.C:
+			s.mu.Lock()
+			if p, ok := s.pending[last]; ok {
+				printError(fmt.Errorf("no heartbeat reply from the server for %v", time.Since(p.sentAt).Round(time.Second)))
+				delete(s.pending, last)
+			}
+			msg := s.push("phoenix", "heartbeat", nil)
+			last = strconv.Itoa(s.lastRef)
+			s.mu.Unlock()
+			send(msg)
+		case <-s.ctx.Done():
+			return
+		}
+	}
+}
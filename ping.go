@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// pingLoop sends a ping every interval and waits up to timeout for the
+// matching pong. The round-trip time of each ping is printed. If a pong does
+// not arrive in time, an error is returned.
+func pingLoop(ctx context.Context, ws Conn, interval, timeout time.Duration) error {
+	pongs := make(chan string, 1)
+	ws.SetPongHandler(func(appData string) error {
+		select {
+		case pongs <- appData:
+		default:
+		}
+		return nil
+	})
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return nil
+		}
+
+		sent := time.Now()
+		payload := strconv.FormatInt(sent.UnixNano(), 10)
+		if err := ws.WriteControl(PingMessage, []byte(payload), sent.Add(timeout)); err != nil {
+			return err
+		}
+		if !awaitPong(ctx, pongs, payload, sent, timeout) {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return &timeoutError{fmt.Sprintf("no pong received within %v", timeout)}
+		}
+	}
+}
+
+func awaitPong(ctx context.Context, pongs <-chan string, payload string, sent time.Time, timeout time.Duration) bool {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		select {
+		case data := <-pongs:
+			// Pongs for earlier pings or unsolicited pongs are ignored.
+			if data != payload {
+				continue
+			}
+			rtt := time.Since(sent).Round(time.Microsecond)
+			metrics.observeRTT(rtt)
+			if jsonOutput {
+				emit(event{Event: "rtt", RTT: float64(rtt) / float64(time.Millisecond)})
+			} else {
+				printLine("ping %s", green(rtt))
+			}
+			return true
+		case <-timer.C:
+			return false
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+
+	"github.com/fatih/color"
+)
+
+var (
+	jsonKey     = color.New(color.FgBlue).SprintFunc()
+	jsonString  = color.New(color.FgGreen).SprintFunc()
+	jsonNumber  = color.New(color.FgCyan).SprintFunc()
+	jsonLiteral = color.New(color.FgMagenta).SprintFunc()
+)
+
+// prettyMessage returns msg pretty-printed if -json-pretty is set and it is a
+// JSON text message.
+func prettyMessage(msg message) (string, bool) {
+	if !jsonPretty || msg.messageType != TextMessage {
+		return "", false
+	}
+	return prettyJSON(msg.data)
+}
+
+// prettyJSON indents and colors data if it is a JSON object or array, as
+// done by -json-pretty. Keys keep the order in which the server sent them.
+func prettyJSON(data []byte) (string, bool) {
+	trimmed := bytes.TrimSpace(data)
+	if len(trimmed) == 0 || (trimmed[0] != '{' && trimmed[0] != '[') || !json.Valid(trimmed) {
+		return "", false
+	}
+
+	p := &jsonPrinter{dec: json.NewDecoder(bytes.NewReader(trimmed))}
+	p.dec.UseNumber()
+	if err := p.value(0); err != nil {
+		return "", false
+	}
+	return p.b.String(), true
+}
+
+type jsonPrinter struct {
+	dec *json.Decoder
+	b   strings.Builder
+}
+
+func (p *jsonPrinter) value(depth int) error {
+	tok, err := p.dec.Token()
+	if err != nil {
+		return err
+	}
+	switch t := tok.(type) {
+	case json.Delim:
+		return p.container(t, depth)
+	case string:
+		p.b.WriteString(jsonString(quoteJSON(t)))
+	case json.Number:
+		p.b.WriteString(jsonNumber(t.String()))
+	case bool:
+		if t {
+			p.b.WriteString(jsonLiteral("true"))
+		} else {
+			p.b.WriteString(jsonLiteral("false"))
+		}
+	case nil:
+		p.b.WriteString(jsonLiteral("null"))
+	}
+	return nil
+}
+
+// container prints an object or array whose opening delimiter open has been
+// read.
+func (p *jsonPrinter) container(open json.Delim, depth int) error {
+	end := "]"
+	if open == '{' {
+		end = "}"
+	}
+	p.b.WriteString(open.String())
+	if !p.dec.More() {
+		p.b.WriteString(end)
+		_, err := p.dec.Token()
+		return err
+	}
+
+	for first := true; p.dec.More(); first = false {
+		if !first {
+			p.b.WriteString(",")
+		}
+		p.b.WriteString("\n" + strings.Repeat("  ", depth+1))
+		if open == '{' {
+			key, err := p.dec.Token()
+			if err != nil {
+				return err
+			}
+			p.b.WriteString(jsonKey(quoteJSON(key.(string))) + ": ")
+		}
+		if err := p.value(depth + 1); err != nil {
+			return err
+		}
+	}
+	p.b.WriteString("\n" + strings.Repeat("  ", depth) + end)
+	_, err := p.dec.Token()
+	return err
+}
+
+// quoteJSON returns s as a JSON string literal.
+func quoteJSON(s string) string {
+	b, _ := marshalJSON(s)
+	return string(b)
+}
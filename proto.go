@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+
+	"github.com/bufbuild/protocompile"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// loadProtoDecoder compiles the .proto file given by -proto and returns a
+// decoder for messages of type typeName. Imports are resolved relative to
+// the file's directory; the well-known types are built in.
+func loadProtoDecoder(file, typeName string) (payloadDecoder, error) {
+	compiler := protocompile.Compiler{
+		Resolver: protocompile.WithStandardImports(&protocompile.SourceResolver{
+			ImportPaths: []string{filepath.Dir(file)},
+		}),
+	}
+	files, err := compiler.Compile(context.Background(), filepath.Base(file))
+	if err != nil {
+		return nil, err
+	}
+	d, err := files.AsResolver().FindDescriptorByName(protoreflect.FullName(typeName))
+	if err != nil {
+		return nil, fmt.Errorf("message type %s not found", typeName)
+	}
+	md, ok := d.(protoreflect.MessageDescriptor)
+	if !ok {
+		return nil, fmt.Errorf("%s is not a message type", typeName)
+	}
+
+	return func(data []byte) ([]byte, error) {
+		m := dynamicpb.NewMessage(md)
+		if err := proto.Unmarshal(data, m); err != nil {
+			return nil, err
+		}
+		b, err := protojson.Marshal(m)
+		if err != nil {
+			return nil, err
+		}
+		// protojson randomizes its whitespace, so normalize it.
+		var compact bytes.Buffer
+		if err := json.Compact(&compact, b); err != nil {
+			return nil, err
+		}
+		return compact.Bytes(), nil
+	}, nil
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	neturl "net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// checkProxyFlags validates -target, which proxy requires and nothing else
+// takes, and the flags proxy does not support.
+func checkProxyFlags() error {
+	if command != "proxy" {
+		if target != "" {
+			return errors.New("-target is only supported by proxy")
+		}
+		return nil
+	}
+	if target == "" {
+		return errors.New("proxy requires -target")
+	}
+	u, err := neturl.Parse(target)
+	if err != nil {
+		return fmt.Errorf("invalid -target: %v", err)
+	}
+	if u.Scheme != "ws" && u.Scheme != "wss" {
+		return fmt.Errorf("unsupported -target scheme %q, expected ws or wss", u.Scheme)
+	}
+	switch {
+	case harFileName != "":
+		return errors.New("-har is not supported by proxy")
+	case pcapFile != "":
+		return errors.New("-pcap is not supported by proxy")
+	case logFile != "":
+		return errors.New("-log-file is not supported by proxy")
+	}
+	return nil
+}
+
+// proxyServer forwards the connections of clients to -target, showing the
+// messages of each in both directions labeled with its number, and
+// manipulating them according to -rules.
+type proxyServer struct {
+	target *neturl.URL
+	rules  []*rule
+	conns  atomic.Int64
+}
+
+// runProxy proxies connections on -listen until interrupted.
+func runProxy() error {
+	s := &proxyServer{}
+	var err error
+	if s.target, err = neturl.Parse(target); err != nil {
+		return err
+	}
+	if rulesFile != "" {
+		if s.rules, err = loadRules(rulesFile); err != nil {
+			return err
+		}
+		for i, r := range s.rules {
+			if r.Action == "" {
+				return fmt.Errorf("%s: rule %d has no action", rulesFile, i+1)
+			}
+		}
+	}
+	printLine("proxying %s to %s", yellow(listenAddr), yellow(target))
+	return listenAndServe(s)
+}
+
+func (s *proxyServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	id := s.conns.Add(1)
+	label := fmt.Sprintf("#%d", id)
+
+	// The client's query, origin, subprotocols and credentials go upstream,
+	// and the subprotocol the server selects is the one accepted.
+	u := *s.target
+	if r.URL.RawQuery != "" {
+		if u.RawQuery != "" {
+			u.RawQuery += "&"
+		}
+		u.RawQuery += r.URL.RawQuery
+	}
+	upstreamURL := u.String()
+	from := r.Header.Get("Origin")
+	if from == "" {
+		from = origin
+	}
+	forwarded := http.Header{}
+	for _, name := range []string{"Cookie", "Authorization"} {
+		if values := r.Header.Values(name); len(values) > 0 {
+			forwarded[name] = values
+		}
+	}
+	upstream, err := dial(upstreamURL, r.Header.Get("Sec-WebSocket-Protocol"), from, forwarded)
+	if err != nil {
+		printError(fmt.Errorf("%s connecting to %s: %v", label, upstreamURL, err))
+		http.Error(w, "connecting to upstream server: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer upstream.Close()
+	var protocols []string
+	if selected := upstream.Subprotocol(); selected != "" {
+		protocols = []string{selected}
+	}
+	client, err := acceptWebSocket(w, r, protocols)
+	if err != nil {
+		printError(fmt.Errorf("%s %s: %v", label, r.RemoteAddr, err))
+		upstream.WriteControl(CloseMessage, FormatCloseMessage(1001, ""), time.Now().Add(time.Second))
+		return
+	}
+	defer client.Close()
+	client.chaos = chaos
+	client.msgLimit = newRateLimiter(msgRate)
+
+	if jsonOutput {
+		emit(event{Event: "connect", Conn: label, URL: upstreamURL, Subprotocol: upstream.Subprotocol()})
+	} else {
+		printLine("%s %s connected to %s", yellow(label), r.RemoteAddr, yellow(upstreamURL))
+	}
+	rec, f := openProxyRecording(id, upstreamURL, upstream.Subprotocol())
+	if f != nil {
+		defer f.Close()
+	}
+
+	errs := make(chan error, 2)
+	go func() { errs <- s.forward(label, client, upstream, true, rec) }()
+	go func() { errs <- s.forward(label, upstream, client, false, rec) }()
+	err = <-errs
+	client.Close()
+	upstream.Close()
+	<-errs
+
+	rec.exit(err, exitStatus(err))
+	if jsonOutput {
+		e := exitEvent(err, exitStatus(err))
+		e.Event, e.Conn, e.ExitStatus = "disconnect", label, nil
+		emit(e)
+	} else {
+		printLine("%s disconnected: %v", yellow(label), err)
+	}
+}
+
+// forward forwards the messages read from src to dst until src fails or
+// closes, passing its close code on. sent is whether src is the client.
+func (s *proxyServer) forward(label string, src, dst Conn, sent bool, rec *sessionRecorder) error {
+	for {
+		messageType, data, err := src.ReadMessage()
+		if err != nil {
+			var ce *CloseError
+			if errors.As(err, &ce) {
+				dst.WriteControl(CloseMessage, FormatCloseMessage(ce.Code, ce.Text), time.Now().Add(time.Second))
+			}
+			return err
+		}
+		msg := message{messageType: messageType, data: data, time: time.Now()}
+		if jsonOutput {
+			e := messageEvent(sent, msg)
+			e.Conn = label
+			emit(e)
+		} else if sent {
+			printLine("%s client: %s", yellow(label), formatMessage(msg))
+		} else {
+			printLine("%s server: %s", yellow(label), cyan(formatMessage(msg)))
+		}
+		rec.message(sent, msg)
+		for _, m := range manipulate(label, s.rules, sent, msg) {
+			if err := dst.WriteMessage(m.messageType, m.data); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// manipulate applies the first of rules that applies to msg, returning the
+// messages to forward in its place.
+func manipulate(label string, rules []*rule, sent bool, msg message) []message {
+	for i, r := range rules {
+		if r.From == "client" && !sent || r.From == "server" && sent {
+			continue
+		}
+		submatches, ok := r.matches(msg)
+		if !ok {
+			continue
+		}
+		note := func(format string, args ...interface{}) {
+			printLine("%s rule %d: %s", yellow(label), i+1, fmt.Sprintf(format, args...))
+		}
+		switch r.Action {
+		case "drop":
+			note("dropped")
+			return nil
+		case "delay":
+			note("delaying %v", r.delay)
+			time.Sleep(r.delay)
+		case "duplicate":
+			note("forwarding %d times", r.Count)
+			out := make([]message, r.Count)
+			for j := range out {
+				out[j] = msg
+			}
+			return out
+		case "rewrite", "inject":
+			m, err := parseInput(r.expand(r.Message, msg, submatches))
+			if err != nil {
+				printError(fmt.Errorf("%s rule %d: %v", label, i+1, err))
+				return []message{msg}
+			}
+			if r.Action == "rewrite" {
+				note("rewritten to %s", formatMessage(m))
+				return []message{m}
+			}
+			note("injecting %s", formatMessage(m))
+			return []message{msg, m}
+		}
+		return []message{msg}
+	}
+	return []message{msg}
+}
+
+// openProxyRecording starts recording connection id to a -record file of
+// its own, named after -record with the number appended: session-1.wsdrec
+// for session.wsdrec. Recordings are from the client's point of view, so
+// that each can be replayed or mocked, and have the messages but not the
+// raw handshake or frames. If there is no -record, or the file cannot be
+// created, the recorder is nil.
+func openProxyRecording(id int64, url, subprotocol string) (*sessionRecorder, *os.File) {
+	if recordFile == "" {
+		return nil, nil
+	}
+	ext := filepath.Ext(recordFile)
+	name := fmt.Sprintf("%s-%d%s", strings.TrimSuffix(recordFile, ext), id, ext)
+	f, err := os.Create(name)
+	if err != nil {
+		printError(err)
+		return nil, nil
+	}
+	rec := newFileRecorder(f)
+	e := handshakeEvent(url, nil, nil)
+	e.Status, e.Subprotocol = http.StatusSwitchingProtocols, subprotocol
+	rec.record(e)
+	return rec, f
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// recordVersion is the version of the -record format.
+const recordVersion = 1
+
+// recorder records the session for -record and -har, or is nil if neither
+// is given.
+var recorder *sessionRecorder
+
+// sessionRecorder records a session. With -record it is written to a
+// .wsdrec file, in the format of -output jsonl with nanosecond timestamps.
+// The first line is a recording event with the format version. Then, for
+// every connection, come the handshake event with the raw request and
+// response, and for every frame sent or received a frame event with its
+// payload as it was on the wire. Message events carry the complete,
+// decompressed payload of each message; these are what replay sends and
+// compares. The recording ends with the exit event.
+//
+// With -har the session is collected in a HAR log instead, which is written
+// at exit.
+type sessionRecorder struct {
+	mu  sync.Mutex
+	enc *json.Encoder // for -record, or nil
+	har *harLog       // for -har, or nil
+	err error         // why writing the -record file stopped
+}
+
+// openRecorder creates the -record file, if any, and starts recording if
+// -record or -har is given.
+func openRecorder() error {
+	if recordFile == "" && harFileName == "" {
+		return nil
+	}
+	if webTransport {
+		return errors.New("-record and -har do not support -webtransport")
+	}
+	r := &sessionRecorder{}
+	if recordFile != "" {
+		f, err := os.Create(recordFile)
+		if err != nil {
+			return err
+		}
+		r = newFileRecorder(f)
+	}
+	if harFileName != "" {
+		r.har = newHARLog()
+	}
+	recorder = r
+	return nil
+}
+
+// newFileRecorder returns a recorder writing the -record format to w,
+// starting with the format version.
+func newFileRecorder(w io.Writer) *sessionRecorder {
+	r := &sessionRecorder{enc: json.NewEncoder(w)}
+	r.enc.SetEscapeHTML(false)
+	r.record(event{Event: "recording", Version: recordVersion})
+	return r
+}
+
+// record records e, stamping it with the current time unless it has one. If
+// writing the -record file fails, the error is reported and writing it
+// stops.
+func (r *sessionRecorder) record(e event) {
+	if r == nil {
+		return
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.har != nil {
+		r.har.add(e)
+	}
+	if r.enc == nil || r.err != nil {
+		return
+	}
+	if err := r.enc.Encode(e); err != nil {
+		r.err = err
+		printError(fmt.Errorf("writing -record file, recording stopped: %v", err))
+	}
+}
+
+func (r *sessionRecorder) handshake(url string, tap *handshakeTap, resp *http.Response) {
+	r.record(handshakeEvent(url, tap, resp))
+}
+
+func (r *sessionRecorder) message(sent bool, msg message) {
+	if r == nil {
+		return
+	}
+	e := messageEvent(sent, msg)
+	if !msg.time.IsZero() {
+		e.Time = msg.time
+	}
+	r.record(e)
+}
+
+// exit records why the session ended and writes the -har file.
+func (r *sessionRecorder) exit(err error, status int) {
+	if r == nil {
+		return
+	}
+	r.record(exitEvent(err, status))
+	if r.har != nil {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		if err := writeHAR(harFileName, r.har); err != nil {
+			printError(fmt.Errorf("writing -har file: %v", err))
+		}
+	}
+}
+
+// recordFrame is the frame hook of -record. HAR logs have no frames.
+func recordFrame(sent bool, f frame) {
+	if recorder.enc == nil {
+		return
+	}
+	e := frameEvent(sent, f)
+	e.setPayload(f.payload)
+	recorder.record(e)
+}
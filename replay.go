@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// recording is a session loaded for replay.
+type recording struct {
+	url         string
+	subprotocol string
+	messages    []recordedMessage
+}
+
+// recordedMessage is a message of a recording, at its time since the
+// connection was established.
+type recordedMessage struct {
+	sent bool
+	at   time.Duration
+	message
+}
+
+// loadRecording reads a -record file, or a HAR file if path ends in .har.
+// Only the first connection is loaded.
+func loadRecording(path string) (*recording, error) {
+	if strings.EqualFold(filepath.Ext(path), ".har") {
+		return loadHAR(path)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	rec := &recording{}
+	var start time.Time
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1<<30)
+	for line := 1; scanner.Scan(); line++ {
+		var e event
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, line, err)
+		}
+		if line == 1 {
+			if e.Event != "recording" {
+				return nil, fmt.Errorf("%s is not a wsd recording", path)
+			}
+			if e.Version != recordVersion {
+				return nil, fmt.Errorf("%s: unsupported recording version %d", path, e.Version)
+			}
+			continue
+		}
+		switch e.Event {
+		case "handshake":
+			if e.Status != 101 && e.Status != 200 {
+				continue
+			}
+			if !start.IsZero() {
+				return rec, nil
+			}
+			start, rec.url, rec.subprotocol = e.Time, e.URL, e.Subprotocol
+		case "message":
+			msg, err := e.message()
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: %v", path, line, err)
+			}
+			rec.messages = append(rec.messages, recordedMessage{sent: e.Direction == "out", at: e.Time.Sub(start), message: msg})
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if start.IsZero() {
+		return nil, fmt.Errorf("%s has no successful handshake", path)
+	}
+	return rec, nil
+}
+
+// message returns the message of a message event.
+func (e *event) message() (message, error) {
+	msg := message{messageType: TextMessage, seq: e.Seq, time: e.Time}
+	if e.Opcode == "binary" {
+		msg.messageType = BinaryMessage
+	}
+	if e.Payload != nil {
+		msg.data = []byte(*e.Payload)
+	}
+	if e.Encoding == "base64" {
+		data, err := base64.StdEncoding.DecodeString(*e.Payload)
+		if err != nil {
+			return message{}, fmt.Errorf("invalid base64 payload: %v", err)
+		}
+		msg.data = data
+	}
+	return msg, nil
+}
+
+// parseRecordingArgs loads the recording given as the argument of the replay
+// and mock commands. It is replayed against the URL it was recorded from
+// unless -url is given, offering the subprotocol that was selected unless
+// -protocol is.
+func parseRecordingArgs() (*recording, error) {
+	if flag.NArg() != 1 {
+		return nil, fmt.Errorf("usage: wsd %s [flags] session.wsdrec|session.har", command)
+	}
+	rec, err := loadRecording(flag.Arg(0))
+	if err != nil {
+		return nil, err
+	}
+	if !flagGiven("url") {
+		url = rec.url
+	}
+	urls = []string{url}
+	if !flagGiven("protocol") {
+		protocol = rec.subprotocol
+	}
+	return rec, nil
+}
+
+// replaySpeed is the factor -speed scales the recorded timing by.
+var replaySpeed float64
+
+// checkReplayFlags validates -speed.
+func checkReplayFlags() error {
+	s, err := strconv.ParseFloat(strings.TrimSuffix(speed, "x"), 64)
+	if err != nil || s <= 0 {
+		return fmt.Errorf("invalid -speed %q, expected a positive factor such as 2x or 0.5x", speed)
+	}
+	replaySpeed = s
+	return nil
+}
+
+// replayError is returned when the responses of a replay differ from the
+// recording.
+type replayError struct {
+	differed, missing, unexpected int
+}
+
+func (e *replayError) Error() string {
+	return fmt.Sprintf("replay differs from the recording: %d responses differed, %d missing, %d unexpected", e.differed, e.missing, e.unexpected)
+}
+
+// replay sends the messages the client sent in rec, at their recorded times
+// scaled by -speed, or as fast as possible with -no-delay. Received messages
+// are compared in order against those received in the recording. Once all
+// messages are sent, replay waits up to -replay-wait for the remaining
+// responses, then closes the connection.
+func replay(ws Conn, rec *recording) error {
+	ctx, cancel := context.WithCancelCause(context.Background())
+	defer cancel(nil)
+
+	var sent, expected []message
+	for _, m := range rec.messages {
+		if m.sent {
+			sent = append(sent, m.message)
+		} else {
+			expected = append(expected, m.message)
+		}
+	}
+
+	in := make(chan message)
+	out := make(chan message)
+	go func() { cancel(inLoop(ctx, ws, "", in)) }()
+	go func() { cancel(outLoop(ctx, ws, "", out)) }()
+	go func() { cancel(closeOnSignal(ctx, ws, closeCode, closeReason, closeTimeout)) }()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		start := time.Now()
+		for _, m := range rec.messages {
+			if !m.sent {
+				continue
+			}
+			if !noDelay {
+				select {
+				case <-time.After(time.Until(start.Add(time.Duration(float64(m.at) / replaySpeed)))):
+				case <-ctx.Done():
+					return
+				}
+			}
+			select {
+			case out <- message{messageType: m.messageType, data: m.data}:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	var received, differed, unexpected int
+	var wait <-chan time.Time
+	var prev time.Time
+loop:
+	for {
+		select {
+		case msg := <-in:
+			received++
+			printMessage(msg, stamp(msg, prev))
+			prev = msg.time
+			if received > len(expected) {
+				unexpected++
+				printError(fmt.Errorf("message %d was not received in the recording", received))
+			} else if want := expected[received-1]; msg.messageType != want.messageType || string(msg.data) != string(want.data) {
+				differed++
+				printError(fmt.Errorf("message %d differs from the recording, which received %s", received, formatMessage(want)))
+			}
+			if done == nil && received >= len(expected) {
+				break loop
+			}
+		case <-done:
+			done = nil
+			if received >= len(expected) {
+				break loop
+			}
+			wait = time.After(replayWait)
+		case <-wait:
+			break loop
+		case <-ctx.Done():
+			break loop
+		}
+	}
+
+	missing := max(len(expected)-received, 0)
+	printLine("replayed %d messages, %d of %d responses matched", len(sent), received-differed-unexpected, len(expected))
+
+	var err error
+	if ctx.Err() == nil {
+		ws.WriteControl(CloseMessage, FormatCloseMessage(1000, ""), time.Now().Add(time.Second))
+	} else if err = context.Cause(ctx); exitStatus(err) == exitOK {
+		err = nil
+	}
+	ws.Close()
+	if err == nil && differed+missing+unexpected > 0 {
+		err = &replayError{differed, missing, unexpected}
+	}
+	return err
+}
+
+// formatMessage formats a message on one line: text quoted and binary data
+// hex encoded.
+func formatMessage(msg message) string {
+	if msg.messageType == BinaryMessage {
+		return "binary " + hex.EncodeToString(msg.data)
+	}
+	return strconv.Quote(string(msg.data))
+}
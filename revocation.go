@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+// revocationClient fetches OCSP responses and CRLs.
+var revocationClient = &http.Client{Timeout: 10 * time.Second}
+
+// checkRevocationFlag validates -check-revocation.
+func checkRevocationFlag() error {
+	switch checkRevocation {
+	case "", "ocsp", "crl", "all":
+		return nil
+	}
+	return fmt.Errorf("unknown -check-revocation mode %q, expected ocsp, crl or all", checkRevocation)
+}
+
+// revocationStatus is the result of one revocation lookup.
+type revocationStatus struct {
+	method string // "ocsp" or "crl"
+	url    string
+	status string // "good", "revoked" or "unknown"
+	detail string
+}
+
+// printRevocation looks up the revocation status of each certificate in the
+// server's chain, except the root, and prints it.
+func printRevocation(cs tls.ConnectionState) {
+	chain := cs.PeerCertificates
+	if len(cs.VerifiedChains) > 0 {
+		chain = cs.VerifiedChains[0]
+	}
+	for i := 0; i+1 < len(chain); i++ {
+		cert, issuer := chain[i], chain[i+1]
+		statuses := lookupRevocation(cert, issuer)
+		if jsonOutput {
+			for _, s := range statuses {
+				emit(event{Event: "revocation", Certificate: cert.Subject.String(), Source: s.method, URL: s.url, Revocation: s.status, Message: s.detail})
+			}
+			continue
+		}
+
+		printLine("revocation status of %s:", yellow(cert.Subject))
+		for _, s := range statuses {
+			status := s.status
+			switch s.status {
+			case "good":
+				status = green(status)
+			case "revoked":
+				status = red(status)
+			default:
+				status = yellow(status)
+			}
+			if s.detail != "" {
+				status += " (" + s.detail + ")"
+			}
+			printLine("  %s %s: %s", s.method, orNone(s.url), status)
+		}
+	}
+}
+
+func lookupRevocation(cert, issuer *x509.Certificate) []revocationStatus {
+	var statuses []revocationStatus
+	if checkRevocation == "ocsp" || checkRevocation == "all" {
+		if len(cert.OCSPServer) == 0 {
+			statuses = append(statuses, revocationStatus{method: "ocsp", status: "unknown", detail: "no OCSP responder"})
+		}
+		for _, url := range cert.OCSPServer {
+			statuses = append(statuses, checkOCSP(cert, issuer, url))
+		}
+	}
+	if checkRevocation == "crl" || checkRevocation == "all" {
+		if len(cert.CRLDistributionPoints) == 0 {
+			statuses = append(statuses, revocationStatus{method: "crl", status: "unknown", detail: "no CRL distribution point"})
+		}
+		for _, url := range cert.CRLDistributionPoints {
+			statuses = append(statuses, checkCRL(cert, issuer, url))
+		}
+	}
+	return statuses
+}
+
+func checkOCSP(cert, issuer *x509.Certificate, url string) revocationStatus {
+	s := revocationStatus{method: "ocsp", url: url, status: "unknown"}
+	req, err := ocsp.CreateRequest(cert, issuer, nil)
+	if err != nil {
+		s.detail = err.Error()
+		return s
+	}
+	body, err := fetch(http.MethodPost, url, "application/ocsp-request", req)
+	if err != nil {
+		s.detail = err.Error()
+		return s
+	}
+	resp, err := ocsp.ParseResponseForCert(body, cert, issuer)
+	if err != nil {
+		s.detail = err.Error()
+		return s
+	}
+
+	switch resp.Status {
+	case ocsp.Good:
+		s.status = "good"
+		if !resp.NextUpdate.IsZero() {
+			s.detail = "next update " + resp.NextUpdate.Format(time.RFC3339)
+		}
+	case ocsp.Revoked:
+		s.status = "revoked"
+		s.detail = fmt.Sprintf("at %s, reason %s", resp.RevokedAt.Format(time.RFC3339), revocationReason(resp.RevocationReason))
+	}
+	return s
+}
+
+func checkCRL(cert, issuer *x509.Certificate, url string) revocationStatus {
+	s := revocationStatus{method: "crl", url: url, status: "unknown"}
+	body, err := fetch(http.MethodGet, url, "", nil)
+	if err != nil {
+		s.detail = err.Error()
+		return s
+	}
+	crl, err := x509.ParseRevocationList(body)
+	if err != nil {
+		s.detail = err.Error()
+		return s
+	}
+	if err := crl.CheckSignatureFrom(issuer); err != nil {
+		s.detail = err.Error()
+		return s
+	}
+
+	for _, entry := range crl.RevokedCertificateEntries {
+		if entry.SerialNumber.Cmp(cert.SerialNumber) == 0 {
+			s.status = "revoked"
+			s.detail = fmt.Sprintf("at %s, reason %s", entry.RevocationTime.Format(time.RFC3339), revocationReason(entry.ReasonCode))
+			return s
+		}
+	}
+	s.status = "good"
+	if !crl.NextUpdate.IsZero() {
+		s.detail = "next update " + crl.NextUpdate.Format(time.RFC3339)
+	}
+	return s
+}
+
+func fetch(method, url, contentType string, body []byte) ([]byte, error) {
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	resp, err := revocationClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s", resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, 16<<20))
+}
+
+// revocationReasons are the CRL reason codes of RFC 5280 section 5.3.1.
+var revocationReasons = map[int]string{
+	0:  "unspecified",
+	1:  "key compromise",
+	2:  "CA compromise",
+	3:  "affiliation changed",
+	4:  "superseded",
+	5:  "cessation of operation",
+	6:  "certificate hold",
+	8:  "remove from CRL",
+	9:  "privilege withdrawn",
+	10: "AA compromise",
+}
+
+func revocationReason(code int) string {
+	if reason, ok := revocationReasons[code]; ok {
+		return reason
+	}
+	return fmt.Sprintf("%d", code)
+}
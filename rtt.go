@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/itchyny/gojq"
+)
+
+// rttWindow is the number of the latest probes averaged by -rtt.
+const rttWindow = 10
+
+// rtt tracks the probes of -rtt, or is nil if it is not given.
+var rtt *rttTracker
+
+// checkRTTFlags validates -rtt and its options.
+func checkRTTFlags() error {
+	if !rttMode {
+		if flagGiven("rtt-probe") || flagGiven("rtt-match") {
+			return errors.New("-rtt-probe and -rtt-match require -rtt")
+		}
+		return nil
+	}
+	switch {
+	case command != "":
+		return fmt.Errorf("-rtt is not supported by %s", command)
+	case connections > 1:
+		return errors.New("-rtt does not support -connections")
+	case rttInterval <= 0:
+		return errors.New("-rtt-interval must be positive")
+	}
+	if _, err := parseInput(expandMessage(rttProbe, 1, 1)); err != nil {
+		return fmt.Errorf("-rtt-probe: %v", err)
+	}
+	t := &rttTracker{pending: map[int64]time.Time{}, texts: map[string]int64{}}
+	if rttMatch != "" {
+		query, err := gojq.Parse(rttMatch)
+		if err == nil {
+			t.match, err = gojq.Compile(query)
+		}
+		if err != nil {
+			return fmt.Errorf("invalid -rtt-match %q: %v", rttMatch, err)
+		}
+	}
+	rtt = t
+	return nil
+}
+
+// rttTracker pairs the probes of -rtt with the messages answering them. By
+// default a probe is answered by a message echoing it, or with -rtt-match
+// by a message from which the expression extracts the probe's {{seq}}.
+type rttTracker struct {
+	match *gojq.Code
+
+	mu      sync.Mutex
+	sent    int
+	pending map[int64]time.Time // when the unanswered probes were sent
+	texts   map[string]int64    // the unanswered probes by their payload
+	samples []time.Duration
+}
+
+// probeLoop sends a probe every -rtt-interval until ctx is done.
+func (t *rttTracker) probeLoop(ctx context.Context, out chan<- message) error {
+	ticker := time.NewTicker(rttInterval)
+	defer ticker.Stop()
+	for {
+		t.mu.Lock()
+		t.sent++
+		// Numbered on from any earlier connection's, after reconnecting.
+		seq := int64(t.sent)
+		// Validated by checkRTTFlags.
+		msg, _ := parseInput(expandMessage(rttProbe, 1, t.sent))
+		t.pending[seq] = time.Now()
+		if t.match == nil {
+			t.texts[string(msg.data)] = seq
+		}
+		t.mu.Unlock()
+		select {
+		case out <- msg:
+		case <-ctx.Done():
+			return nil
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// received reports whether msg answers a probe, printing its round-trip
+// time if so. A nil tracker matches no messages.
+func (t *rttTracker) received(msg message) bool {
+	if t == nil {
+		return false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var seq int64
+	var ok bool
+	if t.match != nil {
+		seq, ok = sequenceNumber(t.match, msg.data)
+	} else {
+		seq, ok = t.texts[string(msg.data)]
+		delete(t.texts, string(msg.data))
+	}
+	sentAt, pending := t.pending[seq]
+	if !ok || !pending {
+		return false
+	}
+	delete(t.pending, seq)
+	d := msg.time.Sub(sentAt)
+	t.samples = append(t.samples, d)
+	metrics.observeRTT(d)
+
+	if jsonOutput {
+		emit(event{Event: "rtt", Conn: msg.conn, Seq: int(seq), RTT: float64(d) / float64(time.Millisecond)})
+		return true
+	}
+	window := t.samples[max(0, len(t.samples)-rttWindow):]
+	printLine("rtt %d: %s (avg %v, last %d %v)", seq, green(d.Round(time.Microsecond)),
+		average(t.samples), len(window), average(window))
+	return true
+}
+
+// average returns the mean of samples.
+func average(samples []time.Duration) time.Duration {
+	var sum time.Duration
+	for _, d := range samples {
+		sum += d
+	}
+	return (sum / time.Duration(len(samples))).Round(time.Microsecond)
+}
+
+// summary prints the probes answered and a histogram of their round-trip
+// times, and exports them with -latency-hdr and -latency-csv. A nil tracker
+// prints nothing.
+func (t *rttTracker) summary() {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.sent == 0 {
+		return
+	}
+	if !jsonOutput {
+		printLine("rtt: %d probes sent, %d answered, %d unanswered", t.sent, len(t.samples), len(t.pending))
+		if len(t.samples) > 0 {
+			printLine("rtt: avg %v, %s", average(t.samples), formatPercentiles(t.samples))
+			printHistogram(t.samples)
+		}
+	}
+	reportLatencies(t.samples, rttInterval, connectedAt)
+}
+
+// histogramWidth is the width of the longest bar of a histogram.
+const histogramWidth = 40
+
+// printHistogram prints a histogram of samples with buckets bounded by 1, 2
+// and 5 times the powers of ten, from a microsecond up.
+func printHistogram(samples []time.Duration) {
+	var bounds []time.Duration
+	for d := time.Microsecond; len(bounds) == 0 || bounds[len(bounds)-1] < maxDuration(samples); d *= 10 {
+		bounds = append(bounds, d, 2*d, 5*d)
+	}
+	counts := make([]int, len(bounds))
+	for _, s := range samples {
+		for i, b := range bounds {
+			if s <= b {
+				counts[i]++
+				break
+			}
+		}
+	}
+
+	first, last, most := -1, 0, 0
+	for i, c := range counts {
+		if c > 0 {
+			if first < 0 {
+				first = i
+			}
+			last = i
+			most = max(most, c)
+		}
+	}
+	for i := first; i <= last; i++ {
+		bar := strings.Repeat("█", (counts[i]*histogramWidth+most-1)/most)
+		printLine("  ≤ %-7v %s %d", bounds[i], green(bar), counts[i])
+	}
+}
+
+// maxDuration returns the greatest of samples.
+func maxDuration(samples []time.Duration) time.Duration {
+	var m time.Duration
+	for _, d := range samples {
+		m = max(m, d)
+	}
+	return m
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"time"
+
+	"github.com/itchyny/gojq"
+)
+
+// rule is an entry of a -rules file, a JSON array of rules such as
+//
+//	[
+//	  {"match": "^ping$", "reply": "pong"},
+//	  {"match": "^join (\\w+)$", "reply": "{\"joined\":\"$1\"}"},
+//	  {"jq": ".type == \"hello\"", "reply": "{\"type\":\"welcome\"}"}
+//	]
+//
+// A rule applies to a message that matches the regular expression match and
+// for which the jq expression produces a value other than false or null,
+// each if given. Regular expression submatches are expanded in the reply,
+// which is then parsed like an input line.
+//
+// In proxy mode, rules instead have an action on the messages they apply
+// to, optionally only on those from the client or the server:
+//
+//	[
+//	  {"from": "server", "match": "\"price\":", "action": "drop"},
+//	  {"from": "client", "jq": ".type == \"buy\"", "action": "delay", "delay": "2s"},
+//	  {"match": "^ping$", "action": "rewrite", "message": "PING"},
+//	  {"from": "server", "match": "^tick$", "action": "duplicate", "count": 3},
+//	  {"from": "server", "match": "^welcome", "action": "inject", "message": "{\"type\":\"error\"}"}
+//	]
+//
+// rewrite forwards message in its place and inject forwards message after
+// it, each expanded and parsed like a reply. drop does not forward it,
+// delay holds it and the messages after it for delay, and duplicate
+// forwards it count times, twice by default.
+type rule struct {
+	Match string `json:"match"`
+	JQ    string `json:"jq"`
+	Reply string `json:"reply"`
+
+	From    string `json:"from"`
+	Action  string `json:"action"`
+	Message string `json:"message"`
+	Delay   string `json:"delay"`
+	Count   int    `json:"count"`
+
+	re    *regexp.Regexp
+	code  *gojq.Code
+	delay time.Duration
+}
+
+// loadRules reads and compiles a -rules file.
+func loadRules(path string) ([]*rule, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var rules []*rule
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	for i, r := range rules {
+		if r.Match != "" {
+			if r.re, err = regexp.Compile(r.Match); err != nil {
+				return nil, fmt.Errorf("%s: rule %d: %v", path, i+1, err)
+			}
+		}
+		if r.JQ != "" {
+			query, err := gojq.Parse(r.JQ)
+			if err == nil {
+				r.code, err = gojq.Compile(query)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("%s: rule %d: invalid jq expression %q: %v", path, i+1, r.JQ, err)
+			}
+		}
+		if err := r.check(); err != nil {
+			return nil, fmt.Errorf("%s: rule %d: %v", path, i+1, err)
+		}
+	}
+	return rules, nil
+}
+
+// check validates the proxy fields of r.
+func (r *rule) check() error {
+	switch r.From {
+	case "", "client", "server":
+	default:
+		return fmt.Errorf("unknown from %q, expected client or server", r.From)
+	}
+	switch r.Action {
+	case "", "drop":
+	case "rewrite", "inject":
+		if r.Message == "" {
+			return fmt.Errorf("%s requires a message", r.Action)
+		}
+	case "delay":
+		d, err := time.ParseDuration(r.Delay)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("invalid delay %q", r.Delay)
+		}
+		r.delay = d
+	case "duplicate":
+		if r.Count == 0 {
+			r.Count = 2
+		}
+		if r.Count < 1 {
+			return fmt.Errorf("invalid count %d", r.Count)
+		}
+	default:
+		return fmt.Errorf("unknown action %q, expected rewrite, drop, delay, duplicate or inject", r.Action)
+	}
+	return nil
+}
+
+// matches reports whether r applies to msg, along with the submatch indexes
+// of the regular expression, if any.
+func (r *rule) matches(msg message) ([]int, bool) {
+	var submatches []int
+	if r.re != nil {
+		if submatches = r.re.FindSubmatchIndex(msg.data); submatches == nil {
+			return nil, false
+		}
+	}
+	if r.code != nil {
+		var v interface{}
+		dec := json.NewDecoder(bytes.NewReader(msg.data))
+		dec.UseNumber()
+		if err := dec.Decode(&v); err != nil {
+			return nil, false
+		}
+		result, _ := r.code.Run(v).Next()
+		if result == nil || result == false {
+			return nil, false
+		}
+		if _, isErr := result.(error); isErr {
+			return nil, false
+		}
+	}
+	return submatches, true
+}
+
+// expand returns template with the submatches of msg expanded, as in
+// regexp.Regexp.Expand.
+func (r *rule) expand(template string, msg message, submatches []int) string {
+	if r.re == nil {
+		return template
+	}
+	return string(r.re.Expand(nil, []byte(template), msg.data, submatches))
+}
+
+// applyRules returns the message to reply to msg with, from the first rule
+// that applies to it, if any.
+func applyRules(rules []*rule, msg message) (message, bool, error) {
+	for _, r := range rules {
+		if submatches, ok := r.matches(msg); ok {
+			reply, err := parseInput(r.expand(r.Reply, msg, submatches))
+			return reply, true, err
+		}
+	}
+	return message{}, false, nil
+}
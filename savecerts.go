@@ -0,0 +1,56 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// saveCerts writes the server's certificate chain to dir as leaf.pem,
+// intermediate-1.pem, ... and root.pem. The verified chain is saved if
+// there is one, since it includes the root even when the server does not
+// send it.
+func saveCerts(cs tls.ConnectionState, dir string) error {
+	chain := cs.PeerCertificates
+	if len(cs.VerifiedChains) > 0 {
+		chain = cs.VerifiedChains[0]
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+
+	var names []string
+	for i, cert := range chain {
+		name := fmt.Sprintf("intermediate-%d.pem", i)
+		switch {
+		case i == 0:
+			name = "leaf.pem"
+		case i == len(chain)-1 && isSelfSigned(cert):
+			name = "root.pem"
+		}
+		data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+		if err := os.WriteFile(filepath.Join(dir, name), data, 0o644); err != nil {
+			return err
+		}
+		names = append(names, name)
+	}
+
+	if jsonOutput {
+		for i, name := range names {
+			emit(event{Event: "saved", Certificate: chain[i].Subject.String(), Message: filepath.Join(dir, name)})
+		}
+		return nil
+	}
+	for i, name := range names {
+		printLine("saved %s to %s", yellow(chain[i].Subject), filepath.Join(dir, name))
+	}
+	return nil
+}
+
+func isSelfSigned(cert *x509.Certificate) bool {
+	return bytes.Equal(cert.RawIssuer, cert.RawSubject) && cert.CheckSignatureFrom(cert) == nil
+}
@@ -0,0 +1,547 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/itchyny/gojq"
+	"gopkg.in/yaml.v3"
+)
+
+// defaultStepTimeout is how long the steps of a scenario without a timeout
+// wait for the server.
+const defaultStepTimeout = 5 * time.Second
+
+// scenario is a test run by wsd test, a YAML file of steps such as
+//
+//	name: chat smoke test
+//	url: ws://localhost:8080/chat
+//	timeout: 5s
+//	steps:
+//	  - send: '{"type":"join","room":"lobby"}'
+//	  - expect:
+//	      json: {type: joined, room: lobby}
+//	  - send: {type: say, text: hello}
+//	  - expect:
+//	      match: hello
+//	      jq: .from != null
+//	      timeout: 2s
+//	  - close: 1000
+//
+// The steps run in turn until one fails:
+//
+//   - connect connects, again if already connected, optionally to another
+//     url and with extra headers. The first step that needs a connection
+//     connects if none is open.
+//   - send sends a line, parsed like an input line, or a mapping or list,
+//     encoded as a JSON text message, or with -decode.
+//   - expect waits for a message that matches all of: the JSON subset json,
+//     whose objects may have more fields in the message, the exact text, the
+//     regular expression match, and the jq expression jq, which must
+//     produce a value other than false or null. Other messages are skipped.
+//   - expect_close waits for the server to close the connection, with the
+//     given code unless it is 0.
+//   - close closes the connection with the given code and waits for the
+//     server's close frame.
+//   - sleep waits for a duration.
+//
+// expect, expect_close and close fail after the timeout of the step or else
+// of the scenario.
+type scenario struct {
+	Name    string         `yaml:"name"`
+	URL     string         `yaml:"url"`
+	Timeout string         `yaml:"timeout"`
+	Steps   []scenarioStep `yaml:"steps"`
+
+	file    string
+	timeout time.Duration
+	golden  *goldenRecorder
+}
+
+type scenarioStep struct {
+	Connect     *scenarioConnect `yaml:"connect"`
+	Send        interface{}      `yaml:"send"`
+	Expect      *scenarioExpect  `yaml:"expect"`
+	ExpectClose *int             `yaml:"expect_close"`
+	Close       *int             `yaml:"close"`
+	Sleep       string           `yaml:"sleep"`
+
+	msg   message
+	sleep time.Duration
+}
+
+type scenarioConnect struct {
+	URL     string            `yaml:"url"`
+	Headers map[string]string `yaml:"headers"`
+}
+
+type scenarioExpect struct {
+	JSON    interface{} `yaml:"json"`
+	Text    *string     `yaml:"text"`
+	Match   string      `yaml:"match"`
+	JQ      string      `yaml:"jq"`
+	Timeout string      `yaml:"timeout"`
+
+	re      *regexp.Regexp
+	code    *gojq.Code
+	timeout time.Duration
+}
+
+// parseScenarioArgs checks that test is given scenario files. They are
+// loaded by loadScenarios once the flags are processed.
+func parseScenarioArgs() error {
+	if flag.NArg() == 0 {
+		return errors.New("usage: wsd test [flags] scenario.yaml...")
+	}
+	urls = []string{url}
+	return nil
+}
+
+// loadScenarios loads the scenario files given as arguments to test.
+func loadScenarios() ([]*scenario, error) {
+	var scenarios []*scenario
+	for _, file := range flag.Args() {
+		s, err := loadScenario(file)
+		if err != nil {
+			return nil, err
+		}
+		scenarios = append(scenarios, s)
+	}
+	return scenarios, nil
+}
+
+// loadScenario reads and validates a scenario file. Its URLs are expanded
+// like the URL given with -url, with environment variables and -param.
+func loadScenario(file string) (*scenario, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	s := &scenario{file: file, timeout: defaultStepTimeout}
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(s); err != nil {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+	if s.Name == "" {
+		s.Name = file
+	}
+	if flagGiven("url") || s.URL == "" {
+		s.URL = url
+	} else if s.URL, err = expandURL(s.URL); err != nil {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+	if s.Timeout != "" {
+		if s.timeout, err = time.ParseDuration(s.Timeout); err != nil || s.timeout <= 0 {
+			return nil, fmt.Errorf("%s: invalid timeout %q", file, s.Timeout)
+		}
+	}
+	if len(s.Steps) == 0 {
+		return nil, fmt.Errorf("%s: no steps", file)
+	}
+	for i := range s.Steps {
+		st := &s.Steps[i]
+		if err := st.check(s.timeout); err != nil {
+			return nil, fmt.Errorf("%s: step %d: %v", file, i+1, err)
+		}
+		if st.Connect != nil && st.Connect.URL != "" {
+			if st.Connect.URL, err = expandURL(st.Connect.URL); err != nil {
+				return nil, fmt.Errorf("%s: step %d: %v", file, i+1, err)
+			}
+		}
+	}
+	return s, nil
+}
+
+// check validates st and compiles its fields.
+func (st *scenarioStep) check(timeout time.Duration) error {
+	actions := 0
+	for _, set := range []bool{st.Connect != nil, st.Send != nil, st.Expect != nil, st.ExpectClose != nil, st.Close != nil, st.Sleep != ""} {
+		if set {
+			actions++
+		}
+	}
+	if actions != 1 {
+		return errors.New("expected one of connect, send, expect, expect_close, close and sleep")
+	}
+	var err error
+	switch {
+	case st.Send != nil:
+		if line, ok := st.Send.(string); ok {
+			st.msg, err = parseInput(line)
+			return err
+		}
+		data, err := json.Marshal(st.Send)
+		if err != nil {
+			return fmt.Errorf("send: %v", err)
+		}
+		if encoder != nil {
+			st.msg, err = encodeJSONInput(string(data))
+			return err
+		}
+		st.msg = message{messageType: TextMessage, data: data}
+	case st.Expect != nil:
+		return st.Expect.check(timeout)
+	case st.Sleep != "":
+		if st.sleep, err = time.ParseDuration(st.Sleep); err != nil || st.sleep < 0 {
+			return fmt.Errorf("invalid sleep %q", st.Sleep)
+		}
+	}
+	return nil
+}
+
+func (e *scenarioExpect) check(timeout time.Duration) error {
+	var err error
+	e.timeout = timeout
+	if e.Timeout != "" {
+		if e.timeout, err = time.ParseDuration(e.Timeout); err != nil || e.timeout <= 0 {
+			return fmt.Errorf("invalid timeout %q", e.Timeout)
+		}
+	}
+	if e.JSON != nil {
+		// Round-trip through JSON so that numbers compare as float64, as
+		// they are decoded from messages.
+		data, err := json.Marshal(e.JSON)
+		if err != nil {
+			return fmt.Errorf("json: %v", err)
+		}
+		json.Unmarshal(data, &e.JSON)
+	}
+	if e.Match != "" {
+		if e.re, err = regexp.Compile(e.Match); err != nil {
+			return fmt.Errorf("match: %v", err)
+		}
+	}
+	if e.JQ != "" {
+		query, err := gojq.Parse(e.JQ)
+		if err == nil {
+			e.code, err = gojq.Compile(query)
+		}
+		if err != nil {
+			return fmt.Errorf("invalid jq expression %q: %v", e.JQ, err)
+		}
+	}
+	return nil
+}
+
+// matches reports whether msg matches all the conditions of e.
+func (e *scenarioExpect) matches(msg message) bool {
+	if e.Text != nil && string(msg.data) != *e.Text {
+		return false
+	}
+	if e.re != nil && !e.re.Match(msg.data) {
+		return false
+	}
+	if e.JSON == nil && e.code == nil {
+		return true
+	}
+	var v interface{}
+	if err := json.Unmarshal(msg.data, &v); err != nil {
+		return false
+	}
+	if e.JSON != nil && !jsonSubset(e.JSON, v) {
+		return false
+	}
+	if e.code != nil {
+		result, _ := e.code.Run(v).Next()
+		if _, isErr := result.(error); isErr || result == nil || result == false {
+			return false
+		}
+	}
+	return true
+}
+
+// jsonSubset reports whether got has the values of want, with objects in
+// got allowed to have more fields.
+func jsonSubset(want, got interface{}) bool {
+	switch w := want.(type) {
+	case map[string]interface{}:
+		g, ok := got.(map[string]interface{})
+		if !ok {
+			return false
+		}
+		for k, v := range w {
+			if gv, ok := g[k]; !ok || !jsonSubset(v, gv) {
+				return false
+			}
+		}
+		return true
+	case []interface{}:
+		g, ok := got.([]interface{})
+		if !ok || len(g) != len(w) {
+			return false
+		}
+		for i := range w {
+			if !jsonSubset(w[i], g[i]) {
+				return false
+			}
+		}
+		return true
+	}
+	return reflect.DeepEqual(want, got)
+}
+
+// describe returns what st does, for the report.
+func (st *scenarioStep) describe(s *scenario) string {
+	switch {
+	case st.Connect != nil:
+		if st.Connect.URL != "" {
+			return "connect " + st.Connect.URL
+		}
+		return "connect " + s.URL
+	case st.Send != nil:
+		return "send " + truncate(string(st.msg.data), 60)
+	case st.Expect != nil:
+		var conds []string
+		if st.Expect.JSON != nil {
+			data, _ := json.Marshal(st.Expect.JSON)
+			conds = append(conds, "json "+string(data))
+		}
+		if st.Expect.Text != nil {
+			conds = append(conds, fmt.Sprintf("text %q", *st.Expect.Text))
+		}
+		if st.Expect.Match != "" {
+			conds = append(conds, "match "+st.Expect.Match)
+		}
+		if st.Expect.JQ != "" {
+			conds = append(conds, "jq "+st.Expect.JQ)
+		}
+		if len(conds) == 0 {
+			return "expect a message"
+		}
+		return "expect " + truncate(strings.Join(conds, ", "), 60)
+	case st.ExpectClose != nil:
+		if *st.ExpectClose == 0 {
+			return "expect close"
+		}
+		return fmt.Sprintf("expect close %d", *st.ExpectClose)
+	case st.Close != nil:
+		return fmt.Sprintf("close %d", *st.Close)
+	}
+	return "sleep " + st.sleep.String()
+}
+
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n] + "..."
+}
+
+// scenarioConn is the connection of a scenario, with its messages read in
+// the background so that steps can wait for them with a timeout.
+type scenarioConn struct {
+	ws       Conn
+	received chan message
+	err      error // why reading ended, once received is closed
+	last     []byte
+	golden   *goldenRecorder
+}
+
+func newScenarioConn(ws Conn, golden *goldenRecorder) *scenarioConn {
+	c := &scenarioConn{ws: ws, received: make(chan message, 64), golden: golden}
+	go func() {
+		defer close(c.received)
+		for {
+			messageType, data, err := ws.ReadMessage()
+			if err != nil {
+				c.err = err
+				return
+			}
+			c.received <- message{messageType: messageType, data: data}
+		}
+	}()
+	return c
+}
+
+// next returns the next message, or an error if none arrives within
+// timeout or the connection ends.
+func (c *scenarioConn) next(timeout <-chan time.Time) (message, error) {
+	select {
+	case msg, ok := <-c.received:
+		if !ok {
+			return message{}, c.err
+		}
+		c.last = msg.data
+		c.golden.record(msg)
+		return msg, nil
+	case <-timeout:
+		return message{}, errTimeout
+	}
+}
+
+var errTimeout = errors.New("timed out")
+
+// runTests runs the scenarios of test and reports their outcome.
+func runTests(scenarios []*scenario) int {
+	failures := 0
+	for _, s := range scenarios {
+		if !s.run() {
+			failures++
+		}
+	}
+	printLine("scenarios: %d passed, %d failed", len(scenarios)-failures, failures)
+	statsd.flush()
+	tracer.flush()
+	if failures > 0 {
+		return exitFailCondition
+	}
+	return exitOK
+}
+
+// run runs the steps of s until one fails, and reports whether all passed.
+// With -expect-golden the messages the steps received are then compared
+// with the golden file of s, named after its file.
+func (s *scenario) run() bool {
+	printLine("scenario %s", yellow(s.Name))
+	if expectGolden != "" {
+		name := strings.TrimSuffix(filepath.Base(s.file), filepath.Ext(s.file))
+		s.golden = &goldenRecorder{path: filepath.Join(expectGolden, name+".jsonl")}
+	}
+	var c *scenarioConn
+	defer func() {
+		if c != nil {
+			c.ws.Close()
+		}
+	}()
+	for i := range s.Steps {
+		st := &s.Steps[i]
+		start := time.Now()
+		var err error
+		if c == nil && st.Sleep == "" && st.Connect == nil {
+			c, err = s.connect(nil)
+		}
+		if err == nil {
+			c, err = s.step(c, st)
+		}
+		outcome := casePassed
+		if err != nil {
+			outcome = caseFailed
+		}
+		if jsonOutput {
+			e := event{Event: "step", Case: s.Name, Seq: i + 1, Message: st.describe(s), Outcome: outcome.String()}
+			if err != nil {
+				e.Reason = err.Error()
+			}
+			emit(e)
+		} else {
+			line := fmt.Sprintf("  %s %s %s", green("pass"), st.describe(s), faint(time.Since(start).Round(time.Millisecond)))
+			if err != nil {
+				line = fmt.Sprintf("  %s %s: %v", red("fail"), st.describe(s), err)
+			}
+			printLine("%s", line)
+		}
+		if err != nil {
+			if jsonOutput {
+				emit(event{Event: "scenario", Case: s.Name, Outcome: caseFailed.String()})
+			}
+			return false
+		}
+	}
+	outcome := casePassed
+	if s.golden.finish() != nil {
+		outcome = caseFailed
+	}
+	if jsonOutput {
+		emit(event{Event: "scenario", Case: s.Name, Outcome: outcome.String()})
+	}
+	return outcome == casePassed
+}
+
+// connect opens a connection for s, with extra headers.
+func (s *scenario) connect(connect *scenarioConnect) (*scenarioConn, error) {
+	target := s.URL
+	extra := http.Header{}
+	if connect != nil {
+		if connect.URL != "" {
+			target = connect.URL
+		}
+		for name, value := range connect.Headers {
+			extra.Set(name, value)
+		}
+	}
+	ws, err := dial(target, protocol, origin, extra)
+	if err != nil {
+		return nil, err
+	}
+	return newScenarioConn(ws, s.golden), nil
+}
+
+// step runs st on c and returns the connection of the next step.
+func (s *scenario) step(c *scenarioConn, st *scenarioStep) (*scenarioConn, error) {
+	switch {
+	case st.Connect != nil:
+		if c != nil {
+			c.ws.Close()
+		}
+		return s.connect(st.Connect)
+	case st.Send != nil:
+		return c, c.ws.WriteMessage(st.msg.messageType, st.msg.data)
+	case st.Expect != nil:
+		timeout := time.After(st.Expect.timeout)
+		for {
+			msg, err := c.next(timeout)
+			if err != nil {
+				return c, c.failure("no matching message", st.Expect.timeout, err)
+			}
+			if st.Expect.matches(msg) {
+				return c, nil
+			}
+		}
+	case st.ExpectClose != nil:
+		return c, c.awaitClose(*st.ExpectClose, s.timeout)
+	case st.Close != nil:
+		c.ws.WriteControl(CloseMessage, FormatCloseMessage(*st.Close, ""), time.Now().Add(time.Second))
+		return c, c.awaitClose(0, s.timeout)
+	}
+	time.Sleep(st.sleep)
+	return c, nil
+}
+
+// awaitClose waits for the server's close frame, with code unless it is 0,
+// skipping messages.
+func (c *scenarioConn) awaitClose(code int, timeout time.Duration) error {
+	deadline := time.After(timeout)
+	for {
+		_, err := c.next(deadline)
+		if err == nil {
+			continue
+		}
+		var ce *CloseError
+		if !errors.As(err, &ce) {
+			return c.failure("no close frame", timeout, err)
+		}
+		if code != 0 && ce.Code != code {
+			return fmt.Errorf("closed with %s, expected %d", formatClose(ce.Code, ce.Text), code)
+		}
+		return nil
+	}
+}
+
+// failure describes why a step waiting for the server failed, with the
+// last message received.
+func (c *scenarioConn) failure(what string, timeout time.Duration, err error) error {
+	var ce *CloseError
+	switch {
+	case err == errTimeout:
+		err = fmt.Errorf("%s within %v", what, timeout)
+	case errors.As(err, &ce):
+		err = fmt.Errorf("%s: closed with %s", what, formatClose(ce.Code, ce.Text))
+	default:
+		err = fmt.Errorf("%s: %v", what, err)
+	}
+	if c.last != nil {
+		err = fmt.Errorf("%v; last message received: %s", err, truncate(string(c.last), 80))
+	}
+	return err
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	encoding_asn1 "encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/cryptobyte"
+	"golang.org/x/crypto/cryptobyte/asn1"
+)
+
+// defaultCTLogList is Google's list of Certificate Transparency logs, as used
+// by Chrome.
+const defaultCTLogList = "https://www.gstatic.com/ct/log_list/v3/log_list.json"
+
+// sctListOID is the X.509 extension with the SCTs embedded in a certificate
+// (RFC 6962 section 3.3).
+var sctListOID = encoding_asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 11129, 2, 4, 2}
+
+// sctInfo is a signed certificate timestamp, as shown by -scts.
+type sctInfo struct {
+	LogID     string    `json:"log_id"`
+	Log       string    `json:"log,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+	Status    string    `json:"status"`
+}
+
+// sct is a parsed SignedCertificateTimestamp (RFC 6962 section 3.2).
+type sct struct {
+	version    uint8
+	logID      [32]byte
+	timestamp  uint64
+	extensions []byte
+	hashAlg    uint8
+	sigAlg     uint8
+	signature  []byte
+}
+
+// ctLog is a log from the -ct-log-list.
+type ctLog struct {
+	Description string `json:"description"`
+	LogID       []byte `json:"log_id"`
+	Key         []byte `json:"key"`
+}
+
+var (
+	ctLogsOnce sync.Once
+	ctLogs     map[[32]byte]ctLog
+)
+
+// loadCTLogs loads the -ct-log-list, a file or URL in the format of Chrome's
+// log list (version 3), once.
+func loadCTLogs() map[[32]byte]ctLog {
+	ctLogsOnce.Do(func() {
+		var data []byte
+		var err error
+		if strings.HasPrefix(ctLogList, "http://") || strings.HasPrefix(ctLogList, "https://") {
+			data, err = fetch(http.MethodGet, ctLogList, "", nil)
+		} else {
+			data, err = os.ReadFile(ctLogList)
+		}
+		var list struct {
+			Operators []struct {
+				Logs      []ctLog `json:"logs"`
+				TiledLogs []ctLog `json:"tiled_logs"`
+			} `json:"operators"`
+		}
+		if err == nil {
+			err = json.Unmarshal(data, &list)
+		}
+		if err != nil {
+			printError(fmt.Errorf("loading CT log list %s: %v", ctLogList, err))
+			return
+		}
+
+		ctLogs = map[[32]byte]ctLog{}
+		for _, op := range list.Operators {
+			for _, log := range append(op.Logs, op.TiledLogs...) {
+				if len(log.LogID) == 32 {
+					ctLogs[[32]byte(log.LogID)] = log
+				}
+			}
+		}
+	})
+	return ctLogs
+}
+
+// printSCTs prints the signed certificate timestamps of the server's
+// certificate, both those embedded in it and those sent in the TLS
+// handshake, and verifies them against the known CT logs.
+func printSCTs(cs tls.ConnectionState) {
+	chain := cs.PeerCertificates
+	if len(cs.VerifiedChains) > 0 {
+		chain = cs.VerifiedChains[0]
+	}
+	if len(chain) == 0 {
+		return
+	}
+	cert := chain[0]
+	var issuer *x509.Certificate
+	if len(chain) > 1 {
+		issuer = chain[1]
+	}
+
+	var scts []sctInfo
+	var sources []string
+	for _, ext := range cert.Extensions {
+		if !ext.Id.Equal(sctListOID) {
+			continue
+		}
+		var list []byte
+		if _, err := encoding_asn1.Unmarshal(ext.Value, &list); err != nil {
+			printError(fmt.Errorf("parsing embedded SCTs: %v", err))
+			break
+		}
+		for _, info := range checkSCTList(list, cert, issuer, true) {
+			scts = append(scts, info)
+			sources = append(sources, "embedded")
+		}
+	}
+	for _, raw := range cs.SignedCertificateTimestamps {
+		scts = append(scts, checkSCT(raw, cert, issuer, false))
+		sources = append(sources, "tls")
+	}
+
+	if jsonOutput {
+		for i := range scts {
+			emit(event{Event: "sct", Certificate: cert.Subject.String(), Source: sources[i], SCT: &scts[i]})
+		}
+		return
+	}
+	printLine("signed certificate timestamps of %s:", yellow(cert.Subject))
+	if len(scts) == 0 {
+		printLine("  none")
+	}
+	for i, s := range scts {
+		status := s.Status
+		switch s.Status {
+		case "verified":
+			status = green(status)
+		case "invalid":
+			status = red(status)
+		default:
+			status = yellow(status)
+		}
+		name := s.Log
+		if name == "" {
+			name = "log " + s.LogID
+		}
+		printLine("  %s, %s at %s: %s", sources[i], name, s.Timestamp.UTC().Format(time.RFC3339), status)
+	}
+}
+
+// checkSCTList checks each SCT in a SignedCertificateTimestampList.
+func checkSCTList(data []byte, cert, issuer *x509.Certificate, embedded bool) []sctInfo {
+	var infos []sctInfo
+	s := cryptobyte.String(data)
+	var list cryptobyte.String
+	if !s.ReadUint16LengthPrefixed(&list) {
+		printError(errors.New("parsing SCT list: malformed"))
+		return nil
+	}
+	for !list.Empty() {
+		var raw cryptobyte.String
+		if !list.ReadUint16LengthPrefixed(&raw) {
+			printError(errors.New("parsing SCT list: malformed"))
+			break
+		}
+		infos = append(infos, checkSCT(raw, cert, issuer, embedded))
+	}
+	return infos
+}
+
+// checkSCT parses an SCT and verifies its signature. Embedded SCTs were
+// issued for the precertificate, which is the certificate without them.
+func checkSCT(raw []byte, cert, issuer *x509.Certificate, embedded bool) sctInfo {
+	sct, err := parseSCT(raw)
+	if err != nil {
+		return sctInfo{Status: "malformed"}
+	}
+	info := sctInfo{
+		LogID:     base64.StdEncoding.EncodeToString(sct.logID[:]),
+		Timestamp: time.UnixMilli(int64(sct.timestamp)),
+		Status:    "unknown log",
+	}
+	log, ok := loadCTLogs()[sct.logID]
+	if !ok {
+		return info
+	}
+	info.Log = log.Description
+
+	b := cryptobyte.NewBuilder(nil)
+	b.AddUint8(sct.version)
+	b.AddUint8(0) // certificate_timestamp
+	b.AddUint64(sct.timestamp)
+	if embedded {
+		if issuer == nil {
+			info.Status = "unverified, issuer unknown"
+			return info
+		}
+		tbs, err := removeSCTExtension(cert.RawTBSCertificate)
+		if err != nil {
+			info.Status = "malformed"
+			return info
+		}
+		keyHash := sha256.Sum256(issuer.RawSubjectPublicKeyInfo)
+		b.AddUint16(1) // precert_entry
+		b.AddBytes(keyHash[:])
+		b.AddUint24LengthPrefixed(func(b *cryptobyte.Builder) { b.AddBytes(tbs) })
+	} else {
+		b.AddUint16(0) // x509_entry
+		b.AddUint24LengthPrefixed(func(b *cryptobyte.Builder) { b.AddBytes(cert.Raw) })
+	}
+	b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) { b.AddBytes(sct.extensions) })
+	signed, err := b.Bytes()
+	if err != nil {
+		info.Status = "malformed"
+		return info
+	}
+
+	info.Status = "invalid"
+	if verifySCTSignature(log.Key, sct, signed) {
+		info.Status = "verified"
+	}
+	return info
+}
+
+func parseSCT(raw []byte) (*sct, error) {
+	s := cryptobyte.String(raw)
+	var sct sct
+	var logID, extensions, signature cryptobyte.String
+	if !s.ReadUint8(&sct.version) || sct.version != 0 ||
+		!s.ReadBytes((*[]byte)(&logID), 32) ||
+		!s.ReadUint64(&sct.timestamp) ||
+		!s.ReadUint16LengthPrefixed(&extensions) ||
+		!s.ReadUint8(&sct.hashAlg) ||
+		!s.ReadUint8(&sct.sigAlg) ||
+		!s.ReadUint16LengthPrefixed(&signature) ||
+		!s.Empty() {
+		return nil, errors.New("malformed SCT")
+	}
+	sct.logID = [32]byte(logID)
+	sct.extensions = extensions
+	sct.signature = signature
+	return &sct, nil
+}
+
+// verifySCTSignature verifies an SCT signature, which logs make with
+// SHA-256 and either ECDSA or RSA.
+func verifySCTSignature(spki []byte, sct *sct, signed []byte) bool {
+	const sha256Alg = 4
+	if sct.hashAlg != sha256Alg {
+		return false
+	}
+	key, err := x509.ParsePKIXPublicKey(spki)
+	if err != nil {
+		return false
+	}
+	digest := sha256.Sum256(signed)
+	switch key := key.(type) {
+	case *ecdsa.PublicKey:
+		return ecdsa.VerifyASN1(key, digest[:], sct.signature)
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], sct.signature) == nil
+	}
+	return false
+}
+
+// removeSCTExtension returns a DER TBSCertificate without the embedded SCT
+// list extension, which is what the log signed.
+func removeSCTExtension(tbs []byte) ([]byte, error) {
+	input := cryptobyte.String(tbs)
+	var fields cryptobyte.String
+	if !input.ReadASN1(&fields, asn1.SEQUENCE) {
+		return nil, errors.New("malformed certificate")
+	}
+
+	extensionsTag := asn1.Tag(3).Constructed().ContextSpecific()
+	b := cryptobyte.NewBuilder(nil)
+	b.AddASN1(asn1.SEQUENCE, func(b *cryptobyte.Builder) {
+		for !fields.Empty() {
+			var field cryptobyte.String
+			var tag asn1.Tag
+			if !fields.ReadAnyASN1Element(&field, &tag) {
+				b.SetError(errors.New("malformed certificate"))
+				return
+			}
+			if tag != extensionsTag {
+				b.AddBytes(field)
+				continue
+			}
+
+			var wrapper, extensions cryptobyte.String
+			if !field.ReadASN1(&wrapper, extensionsTag) || !wrapper.ReadASN1(&extensions, asn1.SEQUENCE) {
+				b.SetError(errors.New("malformed certificate extensions"))
+				return
+			}
+			b.AddASN1(extensionsTag, func(b *cryptobyte.Builder) {
+				b.AddASN1(asn1.SEQUENCE, func(b *cryptobyte.Builder) {
+					for !extensions.Empty() {
+						var ext, body cryptobyte.String
+						var oid encoding_asn1.ObjectIdentifier
+						if !extensions.ReadASN1Element(&ext, asn1.SEQUENCE) {
+							b.SetError(errors.New("malformed certificate extension"))
+							return
+						}
+						e := ext
+						if !e.ReadASN1(&body, asn1.SEQUENCE) || !body.ReadASN1ObjectIdentifier(&oid) {
+							b.SetError(errors.New("malformed certificate extension"))
+							return
+						}
+						if !oid.Equal(sctListOID) {
+							b.AddBytes(ext)
+						}
+					}
+				})
+			})
+		}
+	})
+	return b.Bytes()
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+
+	"github.com/zalando/go-keyring"
+)
+
+// checkSecretHeaders validates -header-from-cmd and -header-from-keychain.
+func checkSecretHeaders() error {
+	for _, spec := range headersFromCmd {
+		if _, _, err := parseHeaderFromCmd(spec); err != nil {
+			return err
+		}
+	}
+	for _, spec := range headersFromKeychain {
+		if _, _, _, err := parseHeaderFromKeychain(spec); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func parseHeaderFromCmd(spec string) (name, command string, err error) {
+	name, command, ok := strings.Cut(spec, "=")
+	command = strings.TrimPrefix(command, "!")
+	if !ok || name == "" || command == "" {
+		return "", "", fmt.Errorf("invalid -header-from-cmd %q, expected Name=!command", spec)
+	}
+	return name, command, nil
+}
+
+func parseHeaderFromKeychain(spec string) (name, service, account string, err error) {
+	name, entry, _ := strings.Cut(spec, "=")
+	service, account, ok := strings.Cut(entry, ":")
+	if name == "" || !ok || service == "" || account == "" {
+		return "", "", "", fmt.Errorf("invalid -header-from-keychain %q, expected Name=service:account", spec)
+	}
+	return name, service, account, nil
+}
+
+// resolveSecretHeaders adds the headers of -header-from-cmd and
+// -header-from-keychain to the -H headers, so that secrets need not be given
+// on the command line.
+func resolveSecretHeaders() error {
+	for _, spec := range headersFromCmd {
+		name, command, _ := parseHeaderFromCmd(spec)
+		value, err := runSecretCommand(command)
+		if err != nil {
+			return fmt.Errorf("-header-from-cmd %s: %v", name, err)
+		}
+		headers = append(headers, name+": "+value)
+	}
+	for _, spec := range headersFromKeychain {
+		name, service, account, _ := parseHeaderFromKeychain(spec)
+		value, err := keyring.Get(service, account)
+		if err != nil {
+			return fmt.Errorf("-header-from-keychain %s: %s %s: %v", name, service, account, err)
+		}
+		headers = append(headers, name+": "+firstLine(value))
+	}
+	return nil
+}
+
+// runSecretCommand runs command with the shell and returns the first line
+// of its output, as password managers like pass print the password there.
+// Its stderr is passed through, for prompts.
+func runSecretCommand(command string) (string, error) {
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.Command("cmd", "/C", command)
+	} else {
+		cmd = exec.Command("sh", "-c", command)
+	}
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return "", err
+	}
+	value := firstLine(out.String())
+	if value == "" {
+		return "", fmt.Errorf("%q printed nothing", command)
+	}
+	return value, nil
+}
+
+func firstLine(s string) string {
+	line, _, _ := strings.Cut(s, "\n")
+	return strings.TrimSuffix(line, "\r")
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// checkServeFlags validates -behavior and the flags that go with it.
+func checkServeFlags() error {
+	switch behavior {
+	case "echo", "broadcast":
+	case "drip":
+		if dripFile == "" {
+			return errors.New("-behavior drip requires -drip-file")
+		}
+		if dripInterval <= 0 {
+			return errors.New("-drip-interval must be positive")
+		}
+	case "rules":
+		if rulesFile == "" {
+			return errors.New("-behavior rules requires -rules")
+		}
+	default:
+		return fmt.Errorf("unknown -behavior %q, expected echo, broadcast, drip or rules", behavior)
+	}
+	return nil
+}
+
+// testServer is the WebSocket server of the serve command, which treats the
+// messages of each client according to -behavior.
+type testServer struct {
+	mu      sync.Mutex
+	clients map[*frameConn]bool
+
+	drip  []message
+	rules []*rule
+}
+
+// runServe serves on -listen until interrupted.
+func runServe() error {
+	s := &testServer{clients: map[*frameConn]bool{}}
+	var err error
+	switch behavior {
+	case "drip":
+		s.drip, err = readDripFile(dripFile)
+	case "rules":
+		s.rules, err = loadRules(rulesFile)
+	}
+	if err != nil {
+		return err
+	}
+	printLine("serving %s on %s", behavior, yellow(listenAddr))
+	return listenAndServe(s)
+}
+
+// readDripFile reads the messages of -drip-file, one per line, parsed like
+// input lines. Empty lines are skipped.
+func readDripFile(path string) ([]message, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var messages []message
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1<<30)
+	for line := 1; scanner.Scan(); line++ {
+		if scanner.Text() == "" {
+			continue
+		}
+		msg, err := parseInput(scanner.Text())
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, line, err)
+		}
+		messages = append(messages, msg)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(messages) == 0 {
+		return nil, fmt.Errorf("%s has no messages", path)
+	}
+	return messages, nil
+}
+
+func (s *testServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ws, err := acceptWebSocket(w, r, splitProtocols(protocol))
+	if err != nil {
+		printError(fmt.Errorf("%s: %v", r.RemoteAddr, err))
+		return
+	}
+	defer ws.Close()
+	client := r.RemoteAddr
+	printLine("%s connected to %s", yellow(client), r.URL.Path)
+
+	s.mu.Lock()
+	s.clients[ws] = true
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.clients, ws)
+		s.mu.Unlock()
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if behavior == "drip" {
+		go s.dripTo(ctx, ws)
+	}
+
+	for {
+		messageType, data, err := ws.ReadMessage()
+		if err != nil {
+			printLine("%s disconnected: %v", yellow(client), err)
+			return
+		}
+		msg := message{messageType: messageType, data: data}
+		printLine("%s: %s", yellow(client), cyan(formatMessage(msg)))
+
+		switch behavior {
+		case "echo":
+			err = ws.WriteMessage(messageType, data)
+		case "broadcast":
+			s.broadcast(msg)
+		case "rules":
+			if reply, ok, ruleErr := applyRules(s.rules, msg); ruleErr != nil {
+				printError(fmt.Errorf("%s: %v", client, ruleErr))
+			} else if ok {
+				err = ws.WriteMessage(reply.messageType, reply.data)
+			}
+		}
+		if err != nil {
+			printLine("%s disconnected: %v", yellow(client), err)
+			return
+		}
+	}
+}
+
+// broadcastTimeout is how long a broadcast waits for each client to take a
+// message, after which the client is disconnected.
+const broadcastTimeout = 5 * time.Second
+
+// broadcast sends msg to every client connected, at once so that a client
+// that stopped reading holds up no other. Clients that fail to take it are
+// disconnected.
+func (s *testServer) broadcast(msg message) {
+	s.mu.Lock()
+	clients := make([]*frameConn, 0, len(s.clients))
+	for ws := range s.clients {
+		clients = append(clients, ws)
+	}
+	s.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for _, ws := range clients {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ws.SetWriteDeadline(time.Now().Add(broadcastTimeout))
+			err := ws.WriteMessage(msg.messageType, msg.data)
+			ws.SetWriteDeadline(time.Time{})
+			if err != nil {
+				s.mu.Lock()
+				delete(s.clients, ws)
+				s.mu.Unlock()
+				ws.Close()
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// dripTo sends the -drip-file messages to ws in a loop, one every
+// -drip-interval.
+func (s *testServer) dripTo(ctx context.Context, ws *frameConn) {
+	ticker := time.NewTicker(dripInterval)
+	defer ticker.Stop()
+	for i := 0; ; i++ {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+		msg := s.drip[i%len(s.drip)]
+		if ws.WriteMessage(msg.messageType, msg.data) != nil {
+			return
+		}
+	}
+}
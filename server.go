@@ -0,0 +1,175 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// checkServerTLSFlags validates -tls, -tls-cert and -tls-key.
+func checkServerTLSFlags() error {
+	if tlsKey != "" && tlsCert == "" {
+		return errors.New("-tls-key requires -tls-cert")
+	}
+	if (serverTLS || tlsCert != "") && !contains([]string{"mock", "serve", "proxy"}, command) {
+		return errors.New("-tls and -tls-cert are only supported by mock, serve and proxy")
+	}
+	return nil
+}
+
+// listenAndServe serves handler on -listen, over TLS if -tls or -tls-cert is
+// given.
+func listenAndServe(handler http.Handler) error {
+	if !serverTLS && tlsCert == "" {
+		return http.ListenAndServe(listenAddr, handler)
+	}
+	var cert tls.Certificate
+	var err error
+	if tlsCert != "" {
+		cert, err = loadClientCert(tlsCert, tlsKey, "")
+	} else {
+		cert, err = selfSignedCert()
+	}
+	if err != nil {
+		return err
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return err
+	}
+	pin := sha256.Sum256(leaf.RawSubjectPublicKeyInfo)
+	printLine("certificate %s, valid for %s", leaf.Subject.CommonName, strings.Join(certNames(leaf), ", "))
+	printLine("  fingerprint: SHA-256 %s", fingerprint(leaf.Raw))
+	printLine("  pin: sha256//%s", base64.StdEncoding.EncodeToString(pin[:]))
+
+	server := &http.Server{
+		Addr:    listenAddr,
+		Handler: handler,
+		// Upgrades need HTTP/1.1, so HTTP/2 is not offered.
+		TLSConfig:    &tls.Config{Certificates: []tls.Certificate{cert}, NextProtos: []string{"http/1.1"}},
+		TLSNextProto: map[string]func(*http.Server, *tls.Conn, http.Handler){},
+	}
+	return server.ListenAndServeTLS("", "")
+}
+
+// selfSignedCert generates a self-signed ECDSA certificate for localhost,
+// the loopback addresses and the host of -listen, valid for 30 days.
+func selfSignedCert() (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "wsd self-signed"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(30 * 24 * time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+	if hostname, err := os.Hostname(); err == nil && hostname != "localhost" {
+		template.DNSNames = append(template.DNSNames, hostname)
+	}
+	if host, _, err := net.SplitHostPort(listenAddr); err == nil && host != "" {
+		if ip := net.ParseIP(host); ip != nil {
+			if !ip.IsLoopback() {
+				template.IPAddresses = append(template.IPAddresses, ip)
+			}
+		} else if !contains(template.DNSNames, host) {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
+
+// certNames returns the DNS names and IP addresses a certificate is valid
+// for.
+func certNames(cert *x509.Certificate) []string {
+	names := append([]string{}, cert.DNSNames...)
+	for _, ip := range cert.IPAddresses {
+		names = append(names, ip.String())
+	}
+	return names
+}
+
+// acceptWebSocket completes the opening handshake of an upgrade request on
+// the server side, selecting the first subprotocol offered by the client that
+// is in protocols. If the request is not a valid upgrade, an error response
+// is written and an error returned.
+func acceptWebSocket(w http.ResponseWriter, r *http.Request, protocols []string) (*frameConn, error) {
+	fail := func(status int, reason string) (*frameConn, error) {
+		http.Error(w, reason, status)
+		return nil, errors.New(reason)
+	}
+	if r.Method != http.MethodGet {
+		return fail(http.StatusMethodNotAllowed, "upgrade request method is not GET")
+	}
+	if !headerContains(r.Header, "Connection", "upgrade") || !headerContains(r.Header, "Upgrade", "websocket") {
+		return fail(http.StatusBadRequest, "not a WebSocket upgrade request")
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		return fail(http.StatusUpgradeRequired, "unsupported Sec-WebSocket-Version")
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if nonce, err := base64.StdEncoding.DecodeString(key); err != nil || len(nonce) != 16 {
+		return fail(http.StatusBadRequest, "invalid Sec-WebSocket-Key")
+	}
+
+	var subprotocol string
+	for _, offered := range strings.Split(r.Header.Get("Sec-WebSocket-Protocol"), ",") {
+		if offered = strings.TrimSpace(offered); offered != "" && contains(protocols, offered) {
+			subprotocol = offered
+			break
+		}
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		return fail(http.StatusInternalServerError, "connection cannot be taken over")
+	}
+	conn, brw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, err
+	}
+	sum := sha1.Sum([]byte(key + keyGUID))
+	response := "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + base64.StdEncoding.EncodeToString(sum[:]) + "\r\n"
+	if subprotocol != "" {
+		response += "Sec-WebSocket-Protocol: " + subprotocol + "\r\n"
+	}
+	if _, err := conn.Write([]byte(response + "\r\n")); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("writing handshake response: %v", err)
+	}
+
+	ws := newFrameConn(conn, brw.Reader, subprotocol)
+	ws.server = true
+	ws.skipUTF8Validation = noUTF8Validation
+	return ws, nil
+}
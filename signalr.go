@@ -0,0 +1,483 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	neturl "net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// signalrSeparator ends each message of the SignalR JSON hub protocol, and
+// the handshake messages of both protocols.
+const signalrSeparator = 0x1e
+
+// signalrKeepAlive is how often a ping is sent, as SignalR clients do.
+const signalrKeepAlive = 15 * time.Second
+
+// SignalR hub message types.
+const (
+	signalrInvocation       = 1
+	signalrStreamItem       = 2
+	signalrCompletion       = 3
+	signalrStreamInvocation = 4
+	signalrCancelInvocation = 5
+	signalrPing             = 6
+	signalrClose            = 7
+)
+
+// checkSignalRFlags validates -signalr and its options.
+func checkSignalRFlags() error {
+	if !signalr {
+		if flagGiven("signalr-protocol") {
+			return errors.New("-signalr-protocol requires -signalr")
+		}
+		return nil
+	}
+	switch {
+	case command != "":
+		return fmt.Errorf("-signalr is not supported by %s", command)
+	case signalrProtocol != "json" && signalrProtocol != "messagepack":
+		return fmt.Errorf("unknown -signalr-protocol %q, expected json or messagepack", signalrProtocol)
+	}
+	appNegotiate = negotiateSignalR
+	return selectAppProtocol("-signalr", func() appSession {
+		return &signalrSession{pending: map[string]signalrCall{}}
+	})
+}
+
+// signalrNegotiation is the response to a negotiate request: the
+// connection to open, a redirect to another service, as done by Azure
+// SignalR, or an error.
+type signalrNegotiation struct {
+	ConnectionID        string `json:"connectionId"`
+	ConnectionToken     string `json:"connectionToken"`
+	NegotiateVersion    int    `json:"negotiateVersion"`
+	AvailableTransports []struct {
+		Transport string `json:"transport"`
+	} `json:"availableTransports"`
+	URL         string `json:"url"`
+	AccessToken string `json:"accessToken"`
+	Error       string `json:"error"`
+}
+
+// signalrMaxRedirects limits the redirects followed when negotiating.
+const signalrMaxRedirects = 10
+
+// negotiateSignalR negotiates a connection to the hub at url, following
+// redirects, and returns the URL of its WebSocket with the connection's
+// token, and the access token of the last redirect as a header.
+func negotiateSignalR(url string) (string, http.Header, error) {
+	client, header, err := negotiationClient()
+	if err != nil {
+		return "", nil, err
+	}
+
+	for redirects := 0; ; redirects++ {
+		u, err := neturl.Parse(url)
+		if err != nil {
+			return "", nil, err
+		}
+		hub := *u
+		switch u.Scheme {
+		case "ws":
+			u.Scheme = "http"
+		case "wss":
+			u.Scheme = "https"
+		}
+		u.Path = strings.TrimSuffix(u.Path, "/") + "/negotiate"
+		query := u.Query()
+		query.Set("negotiateVersion", "1")
+		u.RawQuery = query.Encode()
+
+		n, err := postNegotiate(client, u.String(), header)
+		if err != nil {
+			return "", nil, fmt.Errorf("negotiating with %s: %v", u.Redacted(), err)
+		}
+		switch {
+		case n.Error != "":
+			return "", nil, fmt.Errorf("negotiating with %s: %s", u.Redacted(), n.Error)
+		case n.URL != "":
+			if redirects >= signalrMaxRedirects {
+				return "", nil, fmt.Errorf("negotiating: stopped after %d redirects", signalrMaxRedirects)
+			}
+			printLine("negotiation redirected to %s", yellow(n.URL))
+			url = n.URL
+			if n.AccessToken != "" {
+				header.Set("Authorization", "Bearer "+n.AccessToken)
+			}
+			continue
+		}
+		var webSockets bool
+		for _, t := range n.AvailableTransports {
+			webSockets = webSockets || t.Transport == "WebSockets"
+		}
+		if !webSockets {
+			return "", nil, fmt.Errorf("negotiating with %s: WebSockets transport not available", u.Redacted())
+		}
+
+		token := n.ConnectionToken
+		if n.NegotiateVersion == 0 {
+			token = n.ConnectionID
+		}
+		switch hub.Scheme {
+		case "http":
+			hub.Scheme = "ws"
+		case "https":
+			hub.Scheme = "wss"
+		}
+		query = hub.Query()
+		query.Set("id", token)
+		hub.RawQuery = query.Encode()
+		extra := http.Header{}
+		if auth := header.Get("Authorization"); auth != "" {
+			extra.Set("Authorization", auth)
+		}
+		return hub.String(), extra, nil
+	}
+}
+
+func postNegotiate(client *http.Client, url string, header http.Header) (*signalrNegotiation, error) {
+	req, err := http.NewRequest(http.MethodPost, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header = header.Clone()
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New(resp.Status)
+	}
+	var n signalrNegotiation
+	if err := json.Unmarshal(body, &n); err != nil {
+		return nil, fmt.Errorf("invalid response: %v", err)
+	}
+	return &n, nil
+}
+
+// signalrMessage is a hub message, decoded from either protocol.
+type signalrMessage struct {
+	Type         int               `json:"type"`
+	InvocationID string            `json:"invocationId"`
+	Target       string            `json:"target"`
+	Arguments    []json.RawMessage `json:"arguments"`
+	Item         json.RawMessage   `json:"item"`
+	Result       json.RawMessage   `json:"result"`
+	Error        string            `json:"error"`
+}
+
+// signalrCall is an invocation awaiting its completion.
+type signalrCall struct {
+	target string
+	sentAt time.Time
+}
+
+// signalrSession speaks the SignalR hub protocol of -signalr-protocol:
+// JSON messages ended by a record separator, or MessagePack ones preceded
+// by their length. Invocations of the client are shown as their target and
+// arguments, and stream items and results as their invocation's. Input
+// lines are commands:
+//
+//	invoke <target> [arguments...]  invoke a hub method and show its result
+//	send <target> [arguments...]    invoke a hub method without a result
+//	stream <target> [arguments...]  invoke a streaming hub method
+//	cancel <invocation ID>          cancel a stream
+//
+// Arguments that are not JSON are sent as a single string.
+type signalrSession struct {
+	ctx context.Context
+
+	mu         sync.Mutex
+	handshaken bool
+	queued     []message // the messages sent before the handshake completed
+	lastID     int
+	pending    map[string]signalrCall
+	buf        []byte // the start of a MessagePack message split across messages
+}
+
+func (s *signalrSession) open(ctx context.Context, send func(message)) {
+	s.ctx = ctx
+	handshake, _ := json.Marshal(map[string]interface{}{"protocol": signalrProtocol, "version": 1})
+	send(message{messageType: TextMessage, data: append(handshake, signalrSeparator)})
+}
+
+func (s *signalrSession) input(line string) ([]message, error) {
+	command, rest, _ := strings.Cut(strings.TrimSpace(line), " ")
+	command = strings.ToLower(command)
+	target, args, _ := strings.Cut(strings.TrimSpace(rest), " ")
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var msg message
+	switch command {
+	case "invoke", "send", "stream":
+		if target == "" {
+			return nil, fmt.Errorf("usage: %s <target> [arguments...]", command)
+		}
+		typ, id := signalrInvocation, ""
+		if command != "send" {
+			s.lastID++
+			id = strconv.Itoa(s.lastID)
+			s.pending[id] = signalrCall{target: target, sentAt: time.Now()}
+		}
+		if command == "stream" {
+			typ = signalrStreamInvocation
+		}
+		msg = s.encode(typ, id, target, parseArgs(args))
+	case "cancel":
+		if target == "" {
+			return nil, errors.New("usage: cancel <invocation ID>")
+		}
+		delete(s.pending, target)
+		msg = s.encode(signalrCancelInvocation, target, "", nil)
+	default:
+		return nil, errors.New("unknown SignalR command, expected invoke, send, stream or cancel")
+	}
+	if !s.handshaken {
+		s.queued = append(s.queued, msg)
+		return nil, nil
+	}
+	return []message{msg}, nil
+}
+
+// encode encodes a message sent by the client in the hub protocol: an
+// invocation if target is not empty, or else a cancelation or a ping.
+func (s *signalrSession) encode(typ int, id, target string, args []interface{}) message {
+	if signalrProtocol == "json" {
+		m := map[string]interface{}{"type": typ}
+		if id != "" {
+			m["invocationId"] = id
+		}
+		if target != "" {
+			m["target"], m["arguments"] = target, args
+		}
+		data, _ := json.Marshal(m)
+		return message{messageType: TextMessage, data: append(data, signalrSeparator)}
+	}
+
+	var fields []interface{}
+	switch typ {
+	case signalrInvocation, signalrStreamInvocation:
+		var invocationID interface{}
+		if id != "" {
+			invocationID = id
+		}
+		for i := range args {
+			args[i] = fromJSON(args[i])
+		}
+		fields = []interface{}{typ, map[string]string{}, invocationID, target, args}
+		if typ == signalrStreamInvocation {
+			fields = append(fields, []string{})
+		}
+	case signalrCancelInvocation:
+		fields = []interface{}{typ, map[string]string{}, id}
+	default:
+		fields = []interface{}{typ}
+	}
+	data, _ := encodeMsgpack(fields)
+	var length []byte
+	length = binary.AppendUvarint(length, uint64(len(data)))
+	return message{messageType: BinaryMessage, data: append(length, data...)}
+}
+
+func (s *signalrSession) receive(msg message, send func(message)) ([]message, error) {
+	s.mu.Lock()
+	handshaken := s.handshaken
+	s.mu.Unlock()
+	data := msg.data
+	if !handshaken {
+		// The handshake response, which the first messages may follow.
+		response, rest, ok := bytes.Cut(data, []byte{signalrSeparator})
+		if !ok {
+			return []message{msg}, nil
+		}
+		var r struct {
+			Error string `json:"error"`
+		}
+		json.Unmarshal(response, &r)
+		if r.Error != "" {
+			return nil, fmt.Errorf("SignalR handshake failed: %s", r.Error)
+		}
+		s.handshake(send)
+		if data = rest; len(data) == 0 {
+			return nil, nil
+		}
+	}
+
+	records, err := s.records(msg.messageType, data)
+	if err != nil {
+		return nil, err
+	}
+	var shown []message
+	for _, m := range records {
+		if text, ok := s.show(m, msg); ok {
+			m := msg
+			m.messageType, m.data = TextMessage, []byte(text)
+			shown = append(shown, m)
+		}
+	}
+	return shown, nil
+}
+
+// handshake sends the messages queued until the handshake completed, and
+// starts pinging the server.
+func (s *signalrSession) handshake(send func(message)) {
+	s.mu.Lock()
+	s.handshaken = true
+	queued := s.queued
+	s.queued = nil
+	s.mu.Unlock()
+	printLine("handshake completed, using the %s hub protocol", signalrProtocol)
+	for _, q := range queued {
+		send(q)
+	}
+	go func() {
+		ticker := time.NewTicker(signalrKeepAlive)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				send(s.encode(signalrPing, "", "", nil))
+			case <-s.ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// records decodes the hub messages in the data of a message.
+func (s *signalrSession) records(messageType int, data []byte) ([]signalrMessage, error) {
+	var records []signalrMessage
+	if messageType == TextMessage {
+		for _, record := range bytes.Split(data, []byte{signalrSeparator}) {
+			if len(record) == 0 {
+				continue
+			}
+			var m signalrMessage
+			if err := json.Unmarshal(record, &m); err != nil {
+				return records, fmt.Errorf("invalid SignalR message %q: %v", truncate(string(record), 60), err)
+			}
+			records = append(records, m)
+		}
+		return records, nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b := append(s.buf, data...)
+	for len(b) > 0 {
+		n, size := binary.Uvarint(b)
+		if size <= 0 || uint64(len(b)-size) < n {
+			break
+		}
+		m, err := decodeSignalRMsgpack(b[size : size+int(n)])
+		if err != nil {
+			s.buf = nil
+			return records, err
+		}
+		records, b = append(records, m), b[size+int(n):]
+	}
+	s.buf = b
+	return records, nil
+}
+
+// decodeSignalRMsgpack decodes a hub message of the MessagePack protocol,
+// an array of its fields in an order depending on its type.
+func decodeSignalRMsgpack(data []byte) (signalrMessage, error) {
+	var m signalrMessage
+	j, err := decodeMsgpack(data)
+	if err != nil {
+		return m, fmt.Errorf("invalid SignalR message: %v", err)
+	}
+	var fields []json.RawMessage
+	if err := json.Unmarshal(j, &fields); err != nil || len(fields) == 0 {
+		return m, fmt.Errorf("invalid SignalR message %s", j)
+	}
+	field := func(i int, v interface{}) {
+		if i < len(fields) {
+			json.Unmarshal(fields[i], v)
+		}
+	}
+	field(0, &m.Type)
+	switch m.Type {
+	case signalrInvocation, signalrStreamInvocation:
+		field(2, &m.InvocationID)
+		field(3, &m.Target)
+		field(4, &m.Arguments)
+	case signalrStreamItem:
+		field(2, &m.InvocationID)
+		field(3, &m.Item)
+	case signalrCompletion:
+		var kind int
+		field(2, &m.InvocationID)
+		field(3, &kind)
+		switch kind {
+		case 1:
+			field(4, &m.Error)
+		case 3:
+			field(4, &m.Result)
+		}
+	case signalrClose:
+		field(1, &m.Error)
+	}
+	return m, nil
+}
+
+// show returns the text to show for a hub message received in msg, if any.
+func (s *signalrSession) show(m signalrMessage, msg message) (string, bool) {
+	switch m.Type {
+	case signalrInvocation, signalrStreamInvocation:
+		return m.Target + formatArgs(m.Arguments), true
+	case signalrStreamItem:
+		return s.call(m.InvocationID, msg, false) + formatArgs([]json.RawMessage{m.Item}), true
+	case signalrCompletion:
+		name := s.call(m.InvocationID, msg, true)
+		switch {
+		case m.Error != "":
+			printError(fmt.Errorf("%s failed: %s", name, m.Error))
+		case m.Result != nil:
+			return name + formatArgs([]json.RawMessage{m.Result}), true
+		default:
+			printLine("%s completed", name)
+		}
+	case signalrClose:
+		if m.Error != "" {
+			printLine("server closed the connection: %s", m.Error)
+		} else {
+			printLine("server closed the connection")
+		}
+	case signalrPing:
+	default:
+		return fmt.Sprintf("unknown SignalR message type %d", m.Type), true
+	}
+	return "", false
+}
+
+// call describes the invocation with id, with its target and the time it
+// has taken, ending it if done.
+func (s *signalrSession) call(id string, msg message, done bool) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, ok := s.pending[id]
+	if !ok {
+		return "invocation " + id
+	}
+	if done {
+		delete(s.pending, id)
+	}
+	return fmt.Sprintf("%s %s (%v)", c.target, id, msg.time.Sub(c.sentAt).Round(time.Microsecond))
+}
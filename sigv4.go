@@ -0,0 +1,309 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	neturl "net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// emptyPayloadHash is the SHA-256 hash of the empty body of the upgrade
+// request.
+const emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// awsCredentials are the AWS credentials the handshake is signed with.
+type awsCredentials struct {
+	AccessKeyID     string `json:"AccessKeyId"`
+	SecretAccessKey string `json:"SecretAccessKey"`
+	SessionToken    string `json:"Token"`
+}
+
+// signSigV4 signs the handshake with url with AWS Signature Version 4, in
+// the Authorization, X-Amz-Date and X-Amz-Security-Token headers. Only the
+// host is signed along with them, since the WebSocket headers differ between
+// attempts.
+func signSigV4(header http.Header, url string, creds *awsCredentials, now time.Time) error {
+	u, err := neturl.Parse(url)
+	if err != nil {
+		return err
+	}
+	region, service, _ := strings.Cut(awsSigV4, ":")
+	if service == "" {
+		service = "execute-api"
+	}
+	host := header.Get("Host")
+	if host == "" {
+		host = u.Host
+	}
+
+	amzDate := now.UTC().Format("20060102T150405Z")
+	scope := amzDate[:8] + "/" + region + "/" + service + "/aws4_request"
+	header.Set("X-Amz-Date", amzDate)
+	canonicalHeaders := "host:" + host + "\nx-amz-date:" + amzDate + "\n"
+	signedHeaders := "host;x-amz-date"
+	if creds.SessionToken != "" {
+		header.Set("X-Amz-Security-Token", creds.SessionToken)
+		canonicalHeaders += "x-amz-security-token:" + creds.SessionToken + "\n"
+		signedHeaders += ";x-amz-security-token"
+	}
+
+	canonicalRequest := strings.Join([]string{
+		http.MethodGet,
+		canonicalURI(u.Path),
+		canonicalQuery(u.Query()),
+		canonicalHeaders,
+		signedHeaders,
+		emptyPayloadHash,
+	}, "\n")
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := []byte("AWS4" + creds.SecretAccessKey)
+	for _, part := range []string{amzDate[:8], region, service, "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		creds.AccessKeyID, scope, signedHeaders, signature))
+	return nil
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// canonicalURI returns the canonical URI of the path: each segment encoded
+// twice, as SigV4 requires for services other than S3. The segments are
+// encoded from the decoded path, since Go leaves some characters that AWS
+// encodes unescaped.
+func canonicalURI(path string) string {
+	if path == "" {
+		return "/"
+	}
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		segments[i] = awsURIEncode(awsURIEncode(segment, true), true)
+	}
+	return strings.Join(segments, "/")
+}
+
+// canonicalQuery returns the query parameters sorted by name and value, in
+// the encoding SigV4 requires.
+func canonicalQuery(query neturl.Values) string {
+	var params []string
+	for name, values := range query {
+		for _, value := range values {
+			params = append(params, awsURIEncode(name, true)+"="+awsURIEncode(value, true))
+		}
+	}
+	sort.Strings(params)
+	return strings.Join(params, "&")
+}
+
+// awsURIEncode percent-encodes everything but unreserved characters and,
+// unless encodeSlash is set, slashes.
+func awsURIEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~', c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// loadAWSCredentials looks for AWS credentials the way the AWS SDKs do: in
+// the environment, the shared credentials and config files, the container
+// credentials endpoint of ECS and EKS, and the EC2 instance metadata service.
+func loadAWSCredentials() (*awsCredentials, error) {
+	if id, secret := os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY"); id != "" && secret != "" {
+		return &awsCredentials{AccessKeyID: id, SecretAccessKey: secret, SessionToken: os.Getenv("AWS_SESSION_TOKEN")}, nil
+	}
+	creds, err := sharedAWSCredentials()
+	if creds != nil || err != nil {
+		return creds, err
+	}
+	if creds, err := containerAWSCredentials(); creds != nil || err != nil {
+		return creds, err
+	}
+	if creds := instanceAWSCredentials(); creds != nil {
+		return creds, nil
+	}
+	return nil, errors.New("no AWS credentials found in the environment, shared credentials file, container or instance metadata")
+}
+
+// sharedAWSCredentials reads the credentials of the AWS_PROFILE, or the
+// default profile, from ~/.aws/credentials or ~/.aws/config.
+func sharedAWSCredentials() (*awsCredentials, error) {
+	profile := os.Getenv("AWS_PROFILE")
+	if profile == "" {
+		profile = "default"
+	}
+	home, _ := os.UserHomeDir()
+	files := []struct{ path, section string }{
+		{os.Getenv("AWS_SHARED_CREDENTIALS_FILE"), profile},
+		{os.Getenv("AWS_CONFIG_FILE"), "profile " + profile},
+	}
+	if files[0].path == "" {
+		files[0].path = filepath.Join(home, ".aws", "credentials")
+	}
+	if files[1].path == "" {
+		files[1].path = filepath.Join(home, ".aws", "config")
+	}
+	if profile == "default" {
+		files[1].section = "default"
+	}
+
+	for _, file := range files {
+		values, err := readINISection(file.path, file.section)
+		if err != nil {
+			return nil, err
+		}
+		if values["aws_access_key_id"] != "" && values["aws_secret_access_key"] != "" {
+			return &awsCredentials{
+				AccessKeyID:     values["aws_access_key_id"],
+				SecretAccessKey: values["aws_secret_access_key"],
+				SessionToken:    values["aws_session_token"],
+			}, nil
+		}
+	}
+	return nil, nil
+}
+
+// readINISection returns the keys and values of a section of an INI file. A
+// missing file has no sections.
+func readINISection(path, section string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	values := map[string]string{}
+	var in bool
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "" || line[0] == '#' || line[0] == ';':
+		case line[0] == '[':
+			in = strings.TrimSpace(strings.Trim(line, "[]")) == section
+		case in:
+			if key, value, ok := strings.Cut(line, "="); ok {
+				values[strings.TrimSpace(key)] = strings.TrimSpace(value)
+			}
+		}
+	}
+	return values, scanner.Err()
+}
+
+// containerAWSCredentials fetches the credentials of an ECS task or EKS pod
+// from the endpoint given in the environment, if any.
+func containerAWSCredentials() (*awsCredentials, error) {
+	url := os.Getenv("AWS_CONTAINER_CREDENTIALS_FULL_URI")
+	if relative := os.Getenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI"); relative != "" {
+		url = "http://169.254.170.2" + relative
+	}
+	if url == "" {
+		return nil, nil
+	}
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	token := os.Getenv("AWS_CONTAINER_AUTHORIZATION_TOKEN")
+	if file := os.Getenv("AWS_CONTAINER_AUTHORIZATION_TOKEN_FILE"); file != "" {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		token = strings.TrimSpace(string(data))
+	}
+	if token != "" {
+		req.Header.Set("Authorization", token)
+	}
+	body, err := metadataRequest(req)
+	if err != nil {
+		return nil, fmt.Errorf("getting container credentials: %v", err)
+	}
+	return parseAWSCredentials(body)
+}
+
+// instanceAWSCredentials fetches the credentials of the EC2 instance's role
+// with IMDSv2. Outside EC2 the metadata service does not answer, so errors
+// mean there are no credentials.
+func instanceAWSCredentials() *awsCredentials {
+	if strings.EqualFold(os.Getenv("AWS_EC2_METADATA_DISABLED"), "true") {
+		return nil
+	}
+	const endpoint = "http://169.254.169.254/latest/"
+	req, _ := http.NewRequest(http.MethodPut, endpoint+"api/token", nil)
+	req.Header.Set("X-Aws-Ec2-Metadata-Token-Ttl-Seconds", "60")
+	token, err := metadataRequest(req)
+	if err != nil {
+		return nil
+	}
+	get := func(path string) ([]byte, error) {
+		req, _ := http.NewRequest(http.MethodGet, endpoint+path, nil)
+		req.Header.Set("X-Aws-Ec2-Metadata-Token", string(token))
+		return metadataRequest(req)
+	}
+	role, err := get("meta-data/iam/security-credentials/")
+	if err != nil {
+		return nil
+	}
+	name, _, _ := strings.Cut(strings.TrimSpace(string(role)), "\n")
+	body, err := get("meta-data/iam/security-credentials/" + name)
+	if err != nil {
+		return nil
+	}
+	creds, _ := parseAWSCredentials(body)
+	return creds
+}
+
+func metadataRequest(req *http.Request) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New(resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+}
+
+func parseAWSCredentials(body []byte) (*awsCredentials, error) {
+	var creds awsCredentials
+	if err := json.Unmarshal(body, &creds); err != nil {
+		return nil, fmt.Errorf("invalid credentials: %v", err)
+	}
+	if creds.AccessKeyID == "" || creds.SecretAccessKey == "" {
+		return nil, errors.New("invalid credentials: no AccessKeyId or SecretAccessKey")
+	}
+	return &creds, nil
+}
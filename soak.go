@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"runtime"
+	"strconv"
+	"time"
+
+	"github.com/HdrHistogram/hdrhistogram-go"
+	"github.com/itchyny/gojq"
+)
+
+// soakSeqCode is the compiled -soak-seq expression, or nil.
+var soakSeqCode *gojq.Code
+
+// checkSoakFlags validates the flags of bench -soak.
+func checkSoakFlags() error {
+	switch {
+	case soakSeq != "" && !soak:
+		return errors.New("-soak-seq requires -soak")
+	case !soak:
+		return nil
+	case churnRate > 0:
+		return errors.New("-soak and -churn cannot be combined")
+	case soakInterval <= 0:
+		return errors.New("-soak-interval must be positive")
+	case soakSeq == "":
+		return nil
+	}
+	query, err := gojq.Parse(soakSeq)
+	if err == nil {
+		soakSeqCode, err = gojq.Compile(query)
+	}
+	if err != nil {
+		return fmt.Errorf("invalid -soak-seq %q: %v", soakSeq, err)
+	}
+	return nil
+}
+
+// soakStats are the results of bench -soak beyond those of bench.
+type soakStats struct {
+	disconnects int
+	reconnects  *hdrhistogram.Histogram // from a disconnect to reconnecting
+
+	// gaps counts the jumps forward in the -soak-seq sequence numbers,
+	// which missed the messages in between, and reordered the numbers that
+	// were not greater than the one before.
+	gaps, missed, reordered int
+}
+
+// soakConn keeps connection n of bench -soak open until ctx is done,
+// reconnecting whenever it drops, a second after failing to.
+func soakConn(ctx context.Context, n int, stats *benchStats) {
+	label := strconv.Itoa(n)
+	var droppedAt time.Time
+	for {
+		opened, err := benchConn(ctx, n, stats)
+		if !opened.IsZero() && !droppedAt.IsZero() {
+			d := opened.Sub(droppedAt)
+			stats.mu.Lock()
+			stats.soak.reconnects.RecordValue(int64(d))
+			stats.mu.Unlock()
+			metrics.reconnected()
+			printLine("%sreconnected in %v", connPrefix(label), d.Round(time.Millisecond))
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		if !opened.IsZero() {
+			droppedAt = time.Now()
+			stats.mu.Lock()
+			stats.soak.disconnects++
+			stats.mu.Unlock()
+			printLine("%sdisconnected after %v: %v", connPrefix(label), droppedAt.Sub(opened).Round(time.Second), err)
+			continue
+		}
+		select {
+		case <-time.After(time.Second):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// sequenceNumber returns the sequence number extracted from a received
+// message by the jq expression code, such as -soak-seq.
+func sequenceNumber(code *gojq.Code, data []byte) (int64, bool) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return 0, false
+	}
+	result, ok := code.Run(v).Next()
+	if !ok {
+		return 0, false
+	}
+	seq, err := strconv.ParseInt(fmt.Sprint(result), 10, 64)
+	return seq, err == nil
+}
+
+// soakSequencer follows the -soak-seq sequence numbers of a connection.
+type soakSequencer struct {
+	last int64
+	seen bool
+}
+
+// check checks the sequence number of a message received on connection n
+// against the one before it, if any.
+func (q *soakSequencer) check(n int, data []byte, stats *benchStats) {
+	seq, ok := sequenceNumber(soakSeqCode, data)
+	if !ok {
+		return
+	}
+	last, seen := q.last, q.seen
+	q.last, q.seen = seq, true
+	if !seen || seq == last+1 {
+		return
+	}
+	stats.mu.Lock()
+	defer stats.mu.Unlock()
+	if seq > last {
+		stats.soak.gaps++
+		stats.soak.missed += int(seq - last - 1)
+		printLine("%ssequence gap: expected %d, received %d", connPrefix(strconv.Itoa(n)), last+1, seq)
+	} else {
+		stats.soak.reordered++
+		printLine("%ssequence out of order: received %d after %d", connPrefix(strconv.Itoa(n)), seq, last)
+	}
+}
+
+// reportSoak prints the results so far every -soak-interval until ctx is
+// done.
+func reportSoak(ctx context.Context, stats *benchStats, start time.Time) {
+	ticker := time.NewTicker(soakInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			printLine("after %v:", time.Since(start).Round(time.Second))
+			stats.print(time.Since(start))
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// printSoak prints the results of -soak. s.mu must be held.
+func (s *benchStats) printSoak() {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	printLine("disconnects: %d, reconnected in %s", s.soak.disconnects, formatHistogramPercentiles(s.soak.reconnects))
+	if soakSeqCode != nil {
+		printLine("sequence:    %d gaps missing %d messages, %d out of order", s.soak.gaps, s.soak.missed, s.soak.reordered)
+	}
+	printLine("memory:      %d bytes in use, %d bytes from the OS, %d goroutines", mem.HeapAlloc, mem.Sys, runtime.NumGoroutine())
+}
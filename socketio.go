@@ -0,0 +1,345 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	neturl "net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Engine.IO packet types, the first character of a text message.
+const (
+	engineOpen    = '0'
+	engineClose   = '1'
+	enginePing    = '2'
+	enginePong    = '3'
+	engineMessage = '4'
+	engineNoop    = '6'
+)
+
+// Socket.IO packet types, the first character of an Engine.IO message.
+const (
+	socketioConnect = iota
+	socketioDisconnect
+	socketioEvent
+	socketioAck
+	socketioConnectError
+	socketioBinaryEvent
+	socketioBinaryAck
+)
+
+// checkSocketIOFlags validates -socketio and its options, and points the
+// URLs at the Engine.IO endpoint: /socket.io/ unless they have a path, with
+// the query selecting version 4 of Engine.IO over WebSocket.
+func checkSocketIOFlags() error {
+	if !socketio {
+		if flagGiven("socketio-namespace") || socketioAuth != "" || socketioRequestAck {
+			return errors.New("-socketio-namespace, -socketio-auth and -socketio-ack require -socketio")
+		}
+		return nil
+	}
+	if command != "" {
+		return fmt.Errorf("-socketio is not supported by %s", command)
+	}
+	if !strings.HasPrefix(socketioNamespace, "/") || strings.Contains(socketioNamespace, ",") {
+		return fmt.Errorf("invalid -socketio-namespace %q", socketioNamespace)
+	}
+	var auth map[string]interface{}
+	if socketioAuth != "" && json.Unmarshal([]byte(socketioAuth), &auth) != nil {
+		return errors.New("-socketio-auth must be a JSON object")
+	}
+	for i, u := range urls {
+		pu, err := neturl.Parse(u)
+		if err != nil {
+			return err
+		}
+		if pu.Path == "" || pu.Path == "/" {
+			pu.Path = "/socket.io/"
+		}
+		q := pu.Query()
+		if q.Get("EIO") == "" {
+			q.Set("EIO", "4")
+		}
+		q.Set("transport", "websocket")
+		pu.RawQuery = q.Encode()
+		urls[i] = pu.String()
+	}
+	url = urls[0]
+	return selectAppProtocol("-socketio", func() appSession {
+		return &socketioSession{acks: map[int]socketioCall{}}
+	})
+}
+
+// socketioPacket is a Socket.IO packet, encoded as
+//
+//	<type>[<attachments>-][<namespace>,][<ack ID>][<JSON data>]
+//
+// in an Engine.IO message. The namespace is omitted if it is "/", and the
+// binary attachments follow in binary messages of their own.
+type socketioPacket struct {
+	typ         int
+	attachments int
+	namespace   string
+	ackID       int // -1 if none
+	data        json.RawMessage
+}
+
+func parseSocketIOPacket(s string) (socketioPacket, error) {
+	p := socketioPacket{namespace: "/", ackID: -1}
+	if s == "" || s[0] < '0' || s[0] > '6' {
+		return p, fmt.Errorf("invalid Socket.IO packet %q", s)
+	}
+	p.typ, s = int(s[0]-'0'), s[1:]
+	if p.typ == socketioBinaryEvent || p.typ == socketioBinaryAck {
+		n, rest, ok := strings.Cut(s, "-")
+		attachments, err := strconv.Atoi(n)
+		if !ok || err != nil {
+			return p, fmt.Errorf("invalid attachment count in Socket.IO packet %q", s)
+		}
+		p.attachments, s = attachments, rest
+	}
+	if strings.HasPrefix(s, "/") {
+		p.namespace, s, _ = strings.Cut(s, ",")
+	}
+	digits := len(s) - len(strings.TrimLeft(s, "0123456789"))
+	if digits > 0 {
+		p.ackID, _ = strconv.Atoi(s[:digits])
+		s = s[digits:]
+	}
+	if s != "" {
+		if !json.Valid([]byte(s)) {
+			return p, fmt.Errorf("invalid data in Socket.IO packet %q", s)
+		}
+		p.data = json.RawMessage(s)
+	}
+	return p, nil
+}
+
+// message returns the packet as an Engine.IO message.
+func (p socketioPacket) message() message {
+	var b strings.Builder
+	b.WriteByte(engineMessage)
+	b.WriteString(strconv.Itoa(p.typ))
+	if p.attachments > 0 {
+		fmt.Fprintf(&b, "%d-", p.attachments)
+	}
+	if p.namespace != "/" {
+		b.WriteString(p.namespace + ",")
+	}
+	if p.ackID >= 0 {
+		b.WriteString(strconv.Itoa(p.ackID))
+	}
+	b.Write(p.data)
+	return message{messageType: TextMessage, data: []byte(b.String())}
+}
+
+// socketioCall is an event sent awaiting its acknowledgement.
+type socketioCall struct {
+	event  string
+	sentAt time.Time
+}
+
+// socketioSession speaks Engine.IO and Socket.IO in the namespace of
+// -socketio-namespace. Events are shown as their name followed by their
+// arguments, and an input line is an event to emit in the same form:
+//
+//	chat "hello" {"room": 1}
+//
+// Arguments that are not JSON are sent as a single string.
+type socketioSession struct {
+	mu        sync.Mutex
+	connected bool
+	queued    []message // the events sent before joining the namespace
+	lastAck   int       // the ID of the last acknowledgement requested
+	acks      map[int]socketioCall
+	binary    *socketioPacket // the packet awaiting binary attachments
+	attached  [][]byte
+}
+
+// open sends nothing: the server opens the Engine.IO session, and the
+// namespace is joined once it has.
+func (s *socketioSession) open(ctx context.Context, send func(message)) {}
+
+func (s *socketioSession) input(line string) ([]message, error) {
+	event, rest, _ := strings.Cut(strings.TrimSpace(line), " ")
+	if event == "" {
+		return nil, errors.New("usage: <event> [arguments...]")
+	}
+	data, _ := json.Marshal(append([]interface{}{event}, parseArgs(rest)...))
+	p := socketioPacket{typ: socketioEvent, namespace: socketioNamespace, ackID: -1, data: data}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if socketioRequestAck {
+		s.lastAck++
+		p.ackID = s.lastAck
+		s.acks[p.ackID] = socketioCall{event: event, sentAt: time.Now()}
+	}
+	if !s.connected {
+		s.queued = append(s.queued, p.message())
+		return nil, nil
+	}
+	return []message{p.message()}, nil
+}
+
+func (s *socketioSession) receive(msg message, send func(message)) ([]message, error) {
+	if msg.messageType == BinaryMessage {
+		return s.attach(msg, send)
+	}
+	text := string(msg.data)
+	if text == "" {
+		return []message{msg}, nil
+	}
+	switch text[0] {
+	case engineOpen:
+		var open struct {
+			SID          string `json:"sid"`
+			PingInterval int    `json:"pingInterval"`
+			PingTimeout  int    `json:"pingTimeout"`
+		}
+		json.Unmarshal(msg.data[1:], &open)
+		printLine("engine.io session %s (ping interval %v, timeout %v)", open.SID,
+			time.Duration(open.PingInterval)*time.Millisecond, time.Duration(open.PingTimeout)*time.Millisecond)
+		send(socketioPacket{typ: socketioConnect, namespace: socketioNamespace, ackID: -1, data: json.RawMessage(socketioAuth)}.message())
+		return nil, nil
+	case enginePing:
+		send(message{messageType: TextMessage, data: append([]byte{enginePong}, msg.data[1:]...)})
+		return nil, nil
+	case enginePong, engineNoop:
+		return nil, nil
+	case engineClose:
+		printLine("engine.io session closed by the server")
+		return nil, nil
+	case engineMessage:
+		p, err := parseSocketIOPacket(text[1:])
+		if err != nil {
+			return nil, err
+		}
+		if p.attachments > 0 {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			s.binary, s.attached = &p, nil
+			return nil, nil
+		}
+		return s.packet(p, msg, send)
+	}
+	return []message{msg}, nil
+}
+
+// attach adds a binary message to the attachments of the packet awaiting
+// them, handling the packet once it has all.
+func (s *socketioSession) attach(msg message, send func(message)) ([]message, error) {
+	s.mu.Lock()
+	if s.binary == nil {
+		s.mu.Unlock()
+		return []message{msg}, nil
+	}
+	s.attached = append(s.attached, msg.data)
+	p := *s.binary
+	if len(s.attached) < p.attachments {
+		s.mu.Unlock()
+		return nil, nil
+	}
+	var v interface{}
+	json.Unmarshal(p.data, &v)
+	var b bytes.Buffer
+	enc := json.NewEncoder(&b)
+	enc.SetEscapeHTML(false)
+	enc.Encode(replacePlaceholders(v, s.attached))
+	p.data = bytes.TrimSpace(b.Bytes())
+	s.binary, s.attached = nil, nil
+	s.mu.Unlock()
+	return s.packet(p, msg, send)
+}
+
+// replacePlaceholders replaces the placeholders of the binary attachments
+// in the data of a packet with the attachments, as hex-encoded strings.
+func replacePlaceholders(v interface{}, attachments [][]byte) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		if v["_placeholder"] == true {
+			if num, ok := v["num"].(float64); ok && int(num) >= 0 && int(num) < len(attachments) {
+				a := attachments[int(num)]
+				return fmt.Sprintf("<%d bytes: %s>", len(a), hex.EncodeToString(a))
+			}
+		}
+		for k, e := range v {
+			v[k] = replacePlaceholders(e, attachments)
+		}
+	case []interface{}:
+		for i, e := range v {
+			v[i] = replacePlaceholders(e, attachments)
+		}
+	}
+	return v
+}
+
+// packet handles a Socket.IO packet received in msg, returning an event to
+// show as a text message.
+func (s *socketioSession) packet(p socketioPacket, msg message, send func(message)) ([]message, error) {
+	ns := ""
+	if p.namespace != "/" {
+		ns = p.namespace + " "
+	}
+	switch p.typ {
+	case socketioConnect:
+		var connected struct {
+			SID string `json:"sid"`
+		}
+		json.Unmarshal(p.data, &connected)
+		s.mu.Lock()
+		s.connected = true
+		queued := s.queued
+		s.queued = nil
+		s.mu.Unlock()
+		printLine("connected to namespace %s as %s", p.namespace, connected.SID)
+		for _, q := range queued {
+			send(q)
+		}
+		return nil, nil
+	case socketioDisconnect:
+		printLine("disconnected from namespace %s", p.namespace)
+		return nil, nil
+	case socketioConnectError:
+		var e struct {
+			Message string `json:"message"`
+		}
+		if json.Unmarshal(p.data, &e) != nil || e.Message == "" {
+			e.Message = string(p.data)
+		}
+		return nil, fmt.Errorf("connecting to namespace %s: %s", p.namespace, e.Message)
+	case socketioEvent, socketioBinaryEvent:
+		var args []json.RawMessage
+		var event string
+		if json.Unmarshal(p.data, &args) != nil || len(args) == 0 || json.Unmarshal(args[0], &event) != nil {
+			return nil, fmt.Errorf("invalid Socket.IO event %s", p.data)
+		}
+		if p.ackID >= 0 {
+			// Acknowledged without arguments, for the server's callback.
+			send(socketioPacket{typ: socketioAck, namespace: p.namespace, ackID: p.ackID, data: json.RawMessage("[]")}.message())
+		}
+		msg.messageType, msg.data = TextMessage, []byte(ns+event+formatArgs(args[1:]))
+		return []message{msg}, nil
+	case socketioAck, socketioBinaryAck:
+		var args []json.RawMessage
+		json.Unmarshal(p.data, &args)
+		s.mu.Lock()
+		call, ok := s.acks[p.ackID]
+		delete(s.acks, p.ackID)
+		s.mu.Unlock()
+		name := fmt.Sprintf("ack %d", p.ackID)
+		if ok {
+			name += fmt.Sprintf(" (%s, %v)", call.event, msg.time.Sub(call.sentAt).Round(time.Microsecond))
+		}
+		msg.messageType, msg.data = TextMessage, []byte(ns+name+formatArgs(args))
+		return []message{msg}, nil
+	}
+	return []message{msg}, nil
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	neturl "net/url"
+	"strings"
+)
+
+// checkSockJSFlags validates -sockjs.
+func checkSockJSFlags() error {
+	if !sockJS {
+		return nil
+	}
+	if command != "" {
+		return fmt.Errorf("-sockjs is not supported by %s", command)
+	}
+	appNegotiate = negotiateSockJS
+	return selectAppProtocol("-sockjs", func() appSession { return &sockJSSession{} })
+}
+
+// sockJSInfo is the response to the info request of a SockJS endpoint.
+type sockJSInfo struct {
+	WebSocket bool `json:"websocket"`
+}
+
+// sockJSIDChars are the characters of the session IDs made up.
+const sockJSIDChars = "abcdefghijklmnopqrstuvwxyz0123456789"
+
+// negotiateSockJS requests the info of the SockJS endpoint at url, and
+// returns the URL of the WebSocket transport of a new session of it:
+//
+//	<endpoint>/<server ID>/<session ID>/websocket
+func negotiateSockJS(url string) (string, http.Header, error) {
+	client, header, err := negotiationClient()
+	if err != nil {
+		return "", nil, err
+	}
+	u, err := neturl.Parse(url)
+	if err != nil {
+		return "", nil, err
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/")
+	info := *u
+	switch info.Scheme {
+	case "ws":
+		info.Scheme = "http"
+	case "wss":
+		info.Scheme = "https"
+	}
+	info.Path += "/info"
+	req, err := http.NewRequest(http.MethodGet, info.String(), nil)
+	if err != nil {
+		return "", nil, err
+	}
+	req.Header = header
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", nil, fmt.Errorf("requesting the SockJS info: %v", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return "", nil, fmt.Errorf("requesting the SockJS info: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", nil, fmt.Errorf("requesting the SockJS info from %s: %s", info.Redacted(), resp.Status)
+	}
+	var i sockJSInfo
+	if err := json.Unmarshal(body, &i); err != nil {
+		return "", nil, fmt.Errorf("invalid SockJS info from %s: %v", info.Redacted(), err)
+	}
+	if !i.WebSocket {
+		return "", nil, fmt.Errorf("the SockJS endpoint %s has the websocket transport disabled", info.Redacted())
+	}
+
+	session := make([]byte, 8)
+	for j := range session {
+		session[j] = sockJSIDChars[rand.Intn(len(sockJSIDChars))]
+	}
+	u.Path += fmt.Sprintf("/%03d/%s/websocket", rand.Intn(1000), session)
+	return u.String(), nil, nil
+}
+
+// sockJSSession speaks the SockJS framing of the WebSocket transport:
+//
+//	o                   the session is open
+//	h                   a heartbeat
+//	a["msg1","msg2"]    messages
+//	c[3000,"Go away!"]  the session is closed
+//
+// The messages are shown each as a text message, and heartbeats are
+// hidden. An input line is sent as a message.
+type sockJSSession struct{}
+
+// open sends nothing: the server opens the session.
+func (s *sockJSSession) open(ctx context.Context, send func(message)) {}
+
+func (s *sockJSSession) input(line string) ([]message, error) {
+	return []message{jsonMessage([]string{line})}, nil
+}
+
+func (s *sockJSSession) receive(msg message, send func(message)) ([]message, error) {
+	if msg.messageType != TextMessage || len(msg.data) == 0 {
+		return []message{msg}, nil
+	}
+	frame := msg.data[1:]
+	switch msg.data[0] {
+	case 'o':
+		printLine("sockjs session open")
+		return nil, nil
+	case 'h':
+		return nil, nil
+	case 'a', 'm':
+		var data []string
+		var err error
+		if msg.data[0] == 'a' {
+			err = json.Unmarshal(frame, &data)
+		} else {
+			data = make([]string, 1)
+			err = json.Unmarshal(frame, &data[0])
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid SockJS frame %q", truncate(string(msg.data), 60))
+		}
+		shown := make([]message, len(data))
+		for i, d := range data {
+			shown[i] = msg
+			shown[i].data = []byte(d)
+		}
+		return shown, nil
+	case 'c':
+		var reason []json.RawMessage
+		json.Unmarshal(frame, &reason)
+		printLine("sockjs session closed by the server%s", formatArgs(reason))
+		return nil, nil
+	}
+	return nil, fmt.Errorf("invalid SockJS frame %q", truncate(string(msg.data), 60))
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/mattn/go-isatty"
+)
+
+// statsInterval is how often the status line of -stats is updated.
+const statsInterval = time.Second
+
+// traffic counts the messages and bytes of -stats, or is nil if it is not
+// given.
+var traffic *trafficStats
+
+// checkStatsFlags validates -stats.
+func checkStatsFlags() error {
+	switch {
+	case !showStats:
+		return nil
+	case command != "":
+		return fmt.Errorf("-stats is not supported by %s", command)
+	case jsonOutput:
+		return errors.New("-stats is not supported by -output jsonl")
+	}
+	traffic = &trafficStats{}
+	return nil
+}
+
+// trafficStats counts the messages and bytes sent and received.
+type trafficStats struct {
+	since                    time.Time
+	sent, received           atomic.Int64
+	bytesSent, bytesReceived atomic.Int64
+}
+
+// count counts a message of n bytes. A nil trafficStats counts nothing.
+func (s *trafficStats) count(sent bool, n int) {
+	if s == nil {
+		return
+	}
+	if sent {
+		s.sent.Add(1)
+		s.bytesSent.Add(int64(n))
+	} else {
+		s.received.Add(1)
+		s.bytesReceived.Add(int64(n))
+	}
+}
+
+// counters returns the messages and bytes sent and received so far.
+func (s *trafficStats) counters() [4]int64 {
+	return [4]int64{s.sent.Load(), s.bytesSent.Load(), s.received.Load(), s.bytesReceived.Load()}
+}
+
+// start starts updating the status line. A nil trafficStats does nothing.
+func (s *trafficStats) start() {
+	if s == nil {
+		return
+	}
+	s.since = time.Now()
+	go s.update()
+}
+
+// update updates the status line with the rates over the last statsInterval
+// and the totals, until the status line is stopped.
+func (s *trafficStats) update() {
+	ticker := time.NewTicker(statsInterval)
+	defer ticker.Stop()
+	last, lastTime := s.counters(), s.since
+	for now := range ticker.C {
+		c := s.counters()
+		seconds := now.Sub(lastTime).Seconds()
+		rate := func(i int) float64 { return float64(c[i]-last[i]) / seconds }
+		line := fmt.Sprintf("↑ %.1f msg/s %s/s (%d, %s)  ↓ %.1f msg/s %s/s (%d, %s)",
+			rate(0), humanize.Bytes(uint64(rate(1))), c[0], humanize.Bytes(uint64(c[1])),
+			rate(2), humanize.Bytes(uint64(rate(3))), c[2], humanize.Bytes(uint64(c[3])))
+		if !liveStatus.set(line) {
+			return
+		}
+		last, lastTime = c, now
+	}
+}
+
+// summary stops the status line and prints the totals and average rates in
+// a table. A nil trafficStats prints nothing.
+func (s *trafficStats) summary() {
+	if s == nil {
+		return
+	}
+	liveStatus.stop()
+	c := s.counters()
+	seconds := time.Since(s.since).Seconds()
+	printLine("%-9s %10s %10s %10s %12s", "", "messages", "bytes", "msg/s", "bytes/s")
+	printLine("%-9s %10d %10s %10.1f %12s", "sent", c[0], humanize.Bytes(uint64(c[1])),
+		float64(c[0])/seconds, humanize.Bytes(uint64(float64(c[1])/seconds))+"/s")
+	printLine("%-9s %10d %10s %10.1f %12s", "received", c[2], humanize.Bytes(uint64(c[3])),
+		float64(c[2])/seconds, humanize.Bytes(uint64(float64(c[3])/seconds))+"/s")
+}
+
+// liveStatus is the status line of -stats. In interactive mode it is shown in
+// front of the prompt, and otherwise on stderr if that is a terminal.
+var liveStatus statusLine
+
+// statusLine is a line of output kept below all other output, redrawn in
+// place.
+type statusLine struct {
+	mu      sync.Mutex
+	text    string
+	stopped bool
+}
+
+// set shows text on the status line and reports whether it is still shown,
+// that is, not stopped.
+func (l *statusLine) set(text string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.stopped {
+		return false
+	}
+	l.text = text
+	l.draw()
+	return true
+}
+
+// pause clears the status line for other output and returns the function
+// that redraws it after. Other output is held back until then.
+func (l *statusLine) pause() (resume func()) {
+	l.mu.Lock()
+	l.clear()
+	return func() {
+		l.draw()
+		l.mu.Unlock()
+	}
+}
+
+// stop clears the status line for good.
+func (l *statusLine) stop() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.clear()
+	l.text, l.stopped = "", true
+}
+
+func (l *statusLine) draw() {
+	switch {
+	case l.text == "":
+	case interactive && promptShown.Load():
+		fmt.Printf("\r\033[K%s > ", faint(l.text))
+	case !interactive && isatty.IsTerminal(os.Stderr.Fd()):
+		fmt.Fprintf(os.Stderr, "\r\033[K%s", faint(l.text))
+	}
+}
+
+func (l *statusLine) clear() {
+	switch {
+	case l.text == "":
+	case interactive:
+		fmt.Print("\r\033[K")
+	case isatty.IsTerminal(os.Stderr.Fd()):
+		fmt.Fprint(os.Stderr, "\r\033[K")
+	}
+}
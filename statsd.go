@@ -0,0 +1,111 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// statsd pushes the metrics to -statsd, or is nil if it is not given.
+var statsd *statsdClient
+
+// checkStatsdFlags validates -statsd and its options.
+func checkStatsdFlags() error {
+	switch {
+	case statsdAddr == "" && statsdTags != "":
+		return errors.New("-statsd-tags requires -statsd")
+	case statsdAddr == "":
+		return nil
+	case command == "serve" || command == "mock" || command == "replay":
+		return fmt.Errorf("-statsd is not supported by %s", command)
+	case webTransport:
+		return errors.New("-statsd does not support -webtransport")
+	case statsdInterval <= 0:
+		return errors.New("-statsd-interval must be positive")
+	}
+	conn, err := net.Dial("udp", statsdAddr)
+	if err != nil {
+		return fmt.Errorf("-statsd: %v", err)
+	}
+	var suffix string
+	if statsdTags != "" {
+		suffix = "|#" + statsdTags
+	}
+	if metrics == nil {
+		metrics = newMetricSet()
+	}
+	statsd = &statsdClient{conn: conn, suffix: suffix}
+	return nil
+}
+
+// statsdClient sends the metrics to a StatsD server over UDP: the timers as
+// they are observed, and the counters and gauges every -statsd-interval.
+type statsdClient struct {
+	conn   net.Conn
+	suffix string // the DogStatsD tags of -statsd-tags, if any
+
+	mu   sync.Mutex
+	last map[string]int64 // the counters as last sent
+}
+
+// start starts sending the counters and gauges. A nil statsdClient does
+// nothing.
+func (c *statsdClient) start() {
+	if c == nil {
+		return
+	}
+	go func() {
+		for range time.Tick(statsdInterval) {
+			c.flush()
+		}
+	}()
+}
+
+// flush sends the counters, as the increase since they were last sent, and
+// the gauges. A nil statsdClient sends nothing.
+func (c *statsdClient) flush() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	counters := map[string]int64{
+		"connects":          metrics.connects.Load(),
+		"connect_failures":  metrics.failures.Load(),
+		"reconnects":        metrics.reconnects.Load(),
+		"messages.received": metrics.messages[0].Load(),
+		"messages.sent":     metrics.messages[1].Load(),
+		"bytes.received":    metrics.bytes[0].Load(),
+		"bytes.sent":        metrics.bytes[1].Load(),
+	}
+	var lines []string
+	for name, value := range counters {
+		if delta := value - c.last[name]; delta > 0 {
+			lines = append(lines, c.line(name, delta, "c"))
+		}
+	}
+	c.last = counters
+	lines = append(lines, c.line("connections", metrics.open.Load(), "g"))
+	c.send(lines...)
+}
+
+// timing sends a timer. A nil statsdClient sends nothing.
+func (c *statsdClient) timing(name string, d time.Duration) {
+	if c == nil {
+		return
+	}
+	c.send(fmt.Sprintf("wsd.%s:%g|ms%s", name, float64(d)/float64(time.Millisecond), c.suffix))
+}
+
+func (c *statsdClient) line(name string, value int64, typ string) string {
+	return fmt.Sprintf("wsd.%s:%d|%s%s", name, value, typ, c.suffix)
+}
+
+// send sends lines in one packet. Errors are ignored, as StatsD metrics are
+// sent on a best-effort basis.
+func (c *statsdClient) send(lines ...string) {
+	c.conn.Write([]byte(strings.Join(lines, "\n")))
+}
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	neturl "net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// stompSubprotocols are the subprotocols of STOMP over WebSocket, in order
+// of preference.
+var stompSubprotocols = []string{"v12.stomp", "v11.stomp", "v10.stomp"}
+
+// checkStompFlags validates -stomp and its options, and offers the STOMP
+// subprotocols unless -protocol does.
+func checkStompFlags() error {
+	if !stomp {
+		if stompHost != "" || stompLogin != "" || flagGiven("stomp-heartbeat") || len(stompSubscribe) > 0 {
+			return errors.New("-stomp-host, -stomp-login, -stomp-heartbeat and -stomp-subscribe require -stomp")
+		}
+		return nil
+	}
+	switch {
+	case command != "":
+		return fmt.Errorf("-stomp is not supported by %s", command)
+	case stompHeartbeat < 0:
+		return errors.New("-stomp-heartbeat must not be negative")
+	case stompLogin != "" && !strings.Contains(stompLogin, ":"):
+		return errors.New("-stomp-login must be login:passcode")
+	}
+	if protocol == "" {
+		protocol = strings.Join(stompSubprotocols, ",")
+	}
+	return selectAppProtocol("-stomp", func() appSession { return &stompSession{} })
+}
+
+// stompFrame is a STOMP frame: a command, headers and a body, encoded as
+//
+//	COMMAND
+//	name:value
+//
+//	body^@
+//
+// with the header values escaped except in CONNECT and CONNECTED frames.
+type stompFrame struct {
+	command string
+	headers [][2]string
+	body    string
+}
+
+// header returns the value of the first header of the frame with name.
+func (f stompFrame) header(name string) string {
+	for _, h := range f.headers {
+		if h[0] == name {
+			return h[1]
+		}
+	}
+	return ""
+}
+
+var (
+	stompEscaper   = strings.NewReplacer(`\`, `\\`, "\r", `\r`, "\n", `\n`, ":", `\c`)
+	stompUnescaper = strings.NewReplacer(`\\`, `\`, `\r`, "\r", `\n`, "\n", `\c`, ":")
+)
+
+func (f stompFrame) message() message {
+	var b strings.Builder
+	b.WriteString(f.command + "\n")
+	for _, h := range f.headers {
+		if f.command != "CONNECT" {
+			h[0], h[1] = stompEscaper.Replace(h[0]), stompEscaper.Replace(h[1])
+		}
+		b.WriteString(h[0] + ":" + h[1] + "\n")
+	}
+	b.WriteString("\n" + f.body + "\x00")
+	return message{messageType: TextMessage, data: []byte(b.String())}
+}
+
+func parseStompFrame(data string) (stompFrame, error) {
+	// Heart-beats may precede the frame, and its lines may end in CRLF.
+	data = strings.TrimLeft(data, "\r\n")
+	end, sep := strings.Index(data, "\n\n"), 2
+	if i := strings.Index(data, "\n\r\n"); i >= 0 && (end < 0 || i < end) {
+		end, sep = i, 3
+	}
+	if end < 0 {
+		return stompFrame{}, fmt.Errorf("invalid STOMP frame %q", truncate(data, 60))
+	}
+	head, body := data[:end], data[end+sep:]
+	lines := strings.Split(strings.ReplaceAll(head, "\r\n", "\n"), "\n")
+	f := stompFrame{command: lines[0], body: strings.TrimRight(body, "\x00\r\n")}
+	for _, line := range lines[1:] {
+		name, value, ok := strings.Cut(line, ":")
+		if !ok {
+			return stompFrame{}, fmt.Errorf("invalid STOMP header %q", line)
+		}
+		if f.command != "CONNECTED" {
+			name, value = stompUnescaper.Replace(name), stompUnescaper.Replace(value)
+		}
+		f.headers = append(f.headers, [2]string{name, value})
+	}
+	return f, nil
+}
+
+// String formats a frame for display: its command, then its headers
+// indented and its body.
+func (f stompFrame) String() string {
+	var b strings.Builder
+	b.WriteString(f.command)
+	for _, h := range f.headers {
+		b.WriteString("\n  " + h[0] + ": " + h[1])
+	}
+	if f.body != "" {
+		b.WriteString("\n" + f.body)
+	}
+	return b.String()
+}
+
+// stompSession speaks STOMP, connecting with the credentials of
+// -stomp-login, subscribing to the destinations of -stomp-subscribe and
+// keeping up the heart-beats negotiated from -stomp-heartbeat. Frames
+// received are shown with their headers. Input lines are commands:
+//
+//	subscribe <destination>
+//	unsubscribe <id>
+//	send <destination> <body>
+//	disconnect
+type stompSession struct {
+	ctx context.Context
+
+	mu           sync.Mutex
+	connected    bool
+	queued       []message // the frames sent before the server connected
+	lastSub      int
+	lastReceipt  int
+	lastReceived time.Time
+}
+
+func (s *stompSession) open(ctx context.Context, send func(message)) {
+	s.ctx = ctx
+	host := stompHost
+	if host == "" {
+		if u, err := neturl.Parse(url); err == nil {
+			host = u.Hostname()
+		}
+	}
+	beat := strconv.FormatInt(stompHeartbeat.Milliseconds(), 10)
+	connect := stompFrame{command: "CONNECT", headers: [][2]string{
+		{"accept-version", "1.2,1.1,1.0"},
+		{"host", host},
+		{"heart-beat", beat + "," + beat},
+	}}
+	if stompLogin != "" {
+		login, passcode, _ := strings.Cut(stompLogin, ":")
+		connect.headers = append(connect.headers, [2]string{"login", login}, [2]string{"passcode", passcode})
+	}
+	send(connect.message())
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, destination := range stompSubscribe {
+		s.queued = append(s.queued, s.subscribe(destination))
+	}
+}
+
+// subscribe returns a SUBSCRIBE frame for destination, with the next ID.
+func (s *stompSession) subscribe(destination string) message {
+	s.lastSub++
+	return stompFrame{command: "SUBSCRIBE", headers: [][2]string{
+		{"id", "sub-" + strconv.Itoa(s.lastSub)},
+		{"destination", destination},
+		{"ack", "auto"},
+	}}.message()
+}
+
+func (s *stompSession) input(line string) ([]message, error) {
+	command, args, _ := strings.Cut(strings.TrimSpace(line), " ")
+	args = strings.TrimSpace(args)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var msg message
+	switch strings.ToLower(command) {
+	case "subscribe":
+		if args == "" {
+			return nil, errors.New("usage: subscribe <destination>")
+		}
+		msg = s.subscribe(args)
+	case "unsubscribe":
+		if args == "" {
+			return nil, errors.New("usage: unsubscribe <id>")
+		}
+		msg = stompFrame{command: "UNSUBSCRIBE", headers: [][2]string{{"id", args}}}.message()
+	case "send":
+		destination, body, _ := strings.Cut(args, " ")
+		if destination == "" {
+			return nil, errors.New("usage: send <destination> <body>")
+		}
+		contentType := "text/plain"
+		if json.Valid([]byte(body)) {
+			contentType = "application/json"
+		}
+		msg = stompFrame{command: "SEND", headers: [][2]string{
+			{"destination", destination},
+			{"content-type", contentType},
+			{"content-length", strconv.Itoa(len(body))},
+		}, body: body}.message()
+	case "disconnect":
+		s.lastReceipt++
+		msg = stompFrame{command: "DISCONNECT", headers: [][2]string{{"receipt", strconv.Itoa(s.lastReceipt)}}}.message()
+	default:
+		return nil, errors.New("unknown STOMP command, expected subscribe, unsubscribe, send or disconnect")
+	}
+	if !s.connected {
+		s.queued = append(s.queued, msg)
+		return nil, nil
+	}
+	return []message{msg}, nil
+}
+
+func (s *stompSession) receive(msg message, send func(message)) ([]message, error) {
+	s.mu.Lock()
+	s.lastReceived = msg.time
+	s.mu.Unlock()
+	data := string(msg.data)
+	if strings.Trim(data, "\r\n") == "" {
+		// A heart-beat.
+		return nil, nil
+	}
+	if msg.messageType != TextMessage {
+		return []message{msg}, nil
+	}
+	f, err := parseStompFrame(data)
+	if err != nil {
+		return nil, err
+	}
+	switch f.command {
+	case "CONNECTED":
+		s.negotiate(f, send)
+		return nil, nil
+	case "RECEIPT":
+		printLine("receipt %s", f.header("receipt-id"))
+		return nil, nil
+	case "ERROR":
+		text := f.header("message")
+		if f.body != "" {
+			text += ": " + f.body
+		}
+		return nil, fmt.Errorf("STOMP error: %s", text)
+	}
+	msg.data = []byte(f.String())
+	return []message{msg}, nil
+}
+
+// negotiate handles the CONNECTED frame: it sends the frames queued until
+// then and keeps up the heart-beats negotiated, each way at the longer of
+// the intervals offered by the client and wanted by the other side.
+func (s *stompSession) negotiate(f stompFrame, send func(message)) {
+	var sx, sy int64
+	fmt.Sscanf(f.header("heart-beat"), "%d,%d", &sx, &sy)
+	c := stompHeartbeat.Milliseconds()
+	var out, in time.Duration
+	if c > 0 && sy > 0 {
+		out = time.Duration(max(c, sy)) * time.Millisecond
+	}
+	if c > 0 && sx > 0 {
+		in = time.Duration(max(c, sx)) * time.Millisecond
+	}
+
+	s.mu.Lock()
+	s.connected = true
+	queued := s.queued
+	s.queued = nil
+	s.mu.Unlock()
+
+	version := f.header("version")
+	if version == "" {
+		version = "1.0"
+	}
+	line := "connected with STOMP " + version
+	if server := f.header("server"); server != "" {
+		line += " to " + server
+	}
+	printLine("%s, heart-beats %s out, %s in", line, orNone(formatHeartbeat(out)), orNone(formatHeartbeat(in)))
+	for _, q := range queued {
+		send(q)
+	}
+	if out > 0 || in > 0 {
+		go s.heartbeat(out, in, send)
+	}
+}
+
+func formatHeartbeat(d time.Duration) string {
+	if d == 0 {
+		return ""
+	}
+	return "every " + d.String()
+}
+
+// heartbeat sends a heart-beat every out, and reports the server silent
+// for twice in, until the connection is closed.
+func (s *stompSession) heartbeat(out, in time.Duration, send func(message)) {
+	var sendBeat, checkBeat <-chan time.Time
+	if out > 0 {
+		t := time.NewTicker(out)
+		defer t.Stop()
+		sendBeat = t.C
+	}
+	if in > 0 {
+		t := time.NewTicker(in)
+		defer t.Stop()
+		checkBeat = t.C
+	}
+	var silent bool
+	for {
+		select {
+		case <-sendBeat:
+			send(message{messageType: TextMessage, data: []byte("\n")})
+		case now := <-checkBeat:
+			s.mu.Lock()
+			since := now.Sub(s.lastReceived)
+			s.mu.Unlock()
+			// Twice the interval, for the latency of the network.
+			if since > 2*in && !silent {
+				printError(fmt.Errorf("no heart-beat from the server for %v", since.Round(time.Second)))
+			}
+			silent = since > 2*in
+		case <-s.ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// throttleChunk is the most bytes read or written at once by a throttled
+// connection, so that large messages flow evenly.
+const throttleChunk = 1024
+
+// checkThrottleFlags validates -throttle-up, -throttle-down and -msg-rate.
+func checkThrottleFlags() error {
+	if throttleUp < 0 || throttleDown < 0 || msgRate < 0 {
+		return errors.New("-throttle-up, -throttle-down and -msg-rate must not be negative")
+	}
+	if (throttleUp > 0 || throttleDown > 0 || msgRate > 0) && webTransport {
+		return errors.New("-throttle-up, -throttle-down and -msg-rate do not support -webtransport")
+	}
+	return nil
+}
+
+// rateLimiter paces events to a rate, letting none through in bursts.
+type rateLimiter struct {
+	mu       sync.Mutex
+	interval time.Duration // between events
+	next     time.Time     // when the next event may happen
+}
+
+// newRateLimiter returns a limiter of perSecond events per second, or nil
+// if perSecond is 0.
+func newRateLimiter(perSecond float64) *rateLimiter {
+	if perSecond <= 0 {
+		return nil
+	}
+	return &rateLimiter{interval: time.Duration(float64(time.Second) / perSecond)}
+}
+
+// wait waits until n events may happen. A nil limiter does not wait.
+func (l *rateLimiter) wait(n int) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	d := l.next.Sub(now)
+	l.next = l.next.Add(time.Duration(n) * l.interval)
+	l.mu.Unlock()
+	time.Sleep(d)
+}
+
+// throttledConn limits the bandwidth of a connection in each direction,
+// for -throttle-up and -throttle-down.
+type throttledConn struct {
+	net.Conn
+	up, down *rateLimiter
+}
+
+// throttle returns conn throttled by -throttle-up and -throttle-down, or
+// conn itself if neither is given.
+func throttle(conn net.Conn) net.Conn {
+	if throttleUp == 0 && throttleDown == 0 {
+		return conn
+	}
+	return &throttledConn{
+		Conn: conn,
+		up:   newRateLimiter(float64(throttleUp)),
+		down: newRateLimiter(float64(throttleDown)),
+	}
+}
+
+func (c *throttledConn) Read(b []byte) (int, error) {
+	if c.down != nil && len(b) > throttleChunk {
+		b = b[:throttleChunk]
+	}
+	n, err := c.Conn.Read(b)
+	c.down.wait(n)
+	return n, err
+}
+
+func (c *throttledConn) Write(b []byte) (int, error) {
+	if c.up == nil {
+		return c.Conn.Write(b)
+	}
+	var written int
+	for len(b) > 0 {
+		chunk := b[:min(len(b), throttleChunk)]
+		c.up.wait(len(chunk))
+		n, err := c.Conn.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		b = b[n:]
+	}
+	return written, nil
+}
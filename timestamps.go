@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// connectedAt is when the connection was established. Relative timestamps
+// are measured from it.
+var connectedAt time.Time
+
+// checkTimestampFlags validates -timestamps and -timestamp-format.
+func checkTimestampFlags() error {
+	switch timestamps {
+	case "", "absolute", "relative", "delta":
+	default:
+		return fmt.Errorf("unknown timestamps mode %q, expected absolute, relative or delta", timestamps)
+	}
+	switch timestampFormat {
+	case "rfc3339", "unix-ms":
+	default:
+		return fmt.Errorf("unknown timestamp format %q, expected rfc3339 or unix-ms", timestampFormat)
+	}
+	return nil
+}
+
+// stamp returns the prefix printed before a received message for
+// -timestamps and -seq, or "" if neither is set. prev is when the previous
+// message was received.
+func stamp(msg message, prev time.Time) string {
+	var fields []string
+	if showSeq {
+		fields = append(fields, "#"+strconv.Itoa(msg.seq))
+	}
+	switch timestamps {
+	case "absolute":
+		fields = append(fields, formatTime(msg.time))
+	case "relative":
+		fields = append(fields, formatOffset(msg.time.Sub(connectedAt)))
+	case "delta":
+		if prev.IsZero() {
+			prev = connectedAt
+		}
+		fields = append(fields, formatOffset(msg.time.Sub(prev)))
+	}
+	if len(fields) == 0 {
+		return ""
+	}
+	return "[" + strings.Join(fields, " ") + "] "
+}
+
+func formatTime(t time.Time) string {
+	if timestampFormat == "unix-ms" {
+		return strconv.FormatInt(t.UnixMilli(), 10)
+	}
+	return t.Format("2006-01-02T15:04:05.000Z07:00")
+}
+
+// formatOffset formats a relative or delta timestamp, as a duration or, with
+// unix-ms, in milliseconds.
+func formatOffset(d time.Duration) string {
+	if timestampFormat == "unix-ms" {
+		return "+" + strconv.FormatInt(d.Milliseconds(), 10)
+	}
+	return "+" + d.Round(time.Millisecond).String()
+}
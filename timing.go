@@ -0,0 +1,56 @@
+package main
+
+import "time"
+
+// connTiming records how long each phase of connecting took, as shown by
+// -timing. Phases that did not happen, such as the TLS handshake of a ws
+// connection, are zero.
+type connTiming struct {
+	dns     time.Duration
+	connect time.Duration
+	tls     time.Duration
+	upgrade time.Duration
+}
+
+// timingInfo is a connTiming in milliseconds, for -output jsonl.
+type timingInfo struct {
+	DNS     float64 `json:"dns_ms"`
+	Connect float64 `json:"connect_ms"`
+	TLS     float64 `json:"tls_ms,omitempty"`
+	Upgrade float64 `json:"upgrade_ms"`
+	Total   float64 `json:"total_ms"`
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// print prints the timing of a connection attempt, which may have failed.
+// The total leaves out time spent on -check-revocation and the like.
+func (t *connTiming) print(url string) {
+	total := t.dns + t.connect + t.tls + t.upgrade
+	if jsonOutput {
+		emit(event{Event: "timing", URL: url, Timing: &timingInfo{
+			DNS:     milliseconds(t.dns),
+			Connect: milliseconds(t.connect),
+			TLS:     milliseconds(t.tls),
+			Upgrade: milliseconds(t.upgrade),
+			Total:   milliseconds(total),
+		}})
+		return
+	}
+
+	printLine("timing of %s:", yellow(url))
+	printLine("  dns lookup:     %s", formatPhase(t.dns))
+	printLine("  tcp connect:    %s", formatPhase(t.connect))
+	printLine("  tls handshake:  %s", formatPhase(t.tls))
+	printLine("  ws upgrade:     %s", formatPhase(t.upgrade))
+	printLine("  total:          %s", green(total.Round(time.Microsecond)))
+}
+
+func formatPhase(d time.Duration) string {
+	if d == 0 {
+		return "-"
+	}
+	return d.Round(time.Microsecond).String()
+}
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/youmark/pkcs8"
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+// newTLSConfig builds the TLS configuration for wss connections from the
+// flags.
+func newTLSConfig() (*tls.Config, error) {
+	config := &tls.Config{
+		InsecureSkipVerify: insecureSkipVerify,
+		// The server name defaults to the URL's host, see tlsHandshake.
+		ServerName: sni,
+	}
+	if caCert != "" || caPath != "" || noSystemCA {
+		pool, err := loadCertPool(caCert, caPath, !noSystemCA)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = pool
+	}
+	var err error
+	if config.MinVersion, err = parseTLSVersion("tls-min", tlsMin); err != nil {
+		return nil, err
+	}
+	if config.MaxVersion, err = parseTLSVersion("tls-max", tlsMax); err != nil {
+		return nil, err
+	}
+	for _, proto := range strings.Split(alpn, ",") {
+		if proto = strings.TrimSpace(proto); proto != "" {
+			config.NextProtos = append(config.NextProtos, proto)
+		}
+	}
+	if useHTTP2 && len(config.NextProtos) == 0 {
+		config.NextProtos = []string{"h2"}
+	}
+	if webTransport && len(config.NextProtos) == 0 {
+		config.NextProtos = []string{"h3"}
+	}
+	if ciphers != "" {
+		if config.CipherSuites, err = parseCipherSuites(ciphers); err != nil {
+			return nil, err
+		}
+	}
+	if config.KeyLogWriter, err = openKeyLog(); err != nil {
+		return nil, err
+	}
+	if len(pins) > 0 {
+		hashes, err := parsePins(pins)
+		if err != nil {
+			return nil, err
+		}
+		config.VerifyConnection = func(cs tls.ConnectionState) error {
+			return checkPins(cs, hashes)
+		}
+	}
+
+	switch {
+	case certFile != "" && pkcs12File != "":
+		return nil, errors.New("-cert and -pkcs12 cannot be combined")
+	case certFile != "":
+		cert, err := loadClientCert(certFile, keyFile, keyPassword)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	case keyFile != "":
+		return nil, errors.New("-key requires -cert")
+	case pkcs12File != "":
+		cert, err := loadPKCS12(pkcs12File, pkcs12Password)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+var (
+	keyLogOnce   sync.Once
+	keyLogWriter io.Writer
+	keyLogErr    error
+)
+
+// openKeyLog opens the -keylog file, or else SSLKEYLOGFILE, once for all
+// connections, returning nil if neither is set. The file is left open until
+// wsd exits.
+func openKeyLog() (io.Writer, error) {
+	keyLogOnce.Do(func() {
+		path := keyLog
+		if path == "" {
+			path = os.Getenv("SSLKEYLOGFILE")
+		}
+		if path == "" {
+			return
+		}
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+		if err != nil {
+			keyLogErr = err
+			return
+		}
+		keyLogWriter = f
+	})
+	return keyLogWriter, keyLogErr
+}
+
+// loadPKCS12 loads a client certificate, its private key and any
+// intermediate certificates from a PKCS#12 (.p12 or .pfx) bundle.
+func loadPKCS12(file, password string) (tls.Certificate, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	key, leaf, chain, err := pkcs12.DecodeChain(data, password)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("%s: %v", file, err)
+	}
+	cert := tls.Certificate{
+		Certificate: [][]byte{leaf.Raw},
+		PrivateKey:  key,
+		Leaf:        leaf,
+	}
+	for _, c := range chain {
+		cert.Certificate = append(cert.Certificate, c.Raw)
+	}
+	return cert, nil
+}
+
+// loadClientCert loads a client certificate chain and its private key from
+// PEM files. If keyFile is empty the key is read from certFile. Encrypted
+// PKCS#8 keys and legacy encrypted PEM keys are decrypted with password.
+func loadClientCert(certFile, keyFile, password string) (tls.Certificate, error) {
+	certPEM, err := os.ReadFile(certFile)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	if keyFile == "" {
+		keyFile = certFile
+	}
+	keyPEM, err := os.ReadFile(keyFile)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	key, err := parsePrivateKeyPEM(keyPEM, password)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("%s: %v", keyFile, err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("%s: %v", keyFile, err)
+	}
+	// X509KeyPair checks that the key matches the certificate.
+	cert, err := tls.X509KeyPair(certPEM, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}))
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("%s: %v", certFile, err)
+	}
+	return cert, nil
+}
+
+// parsePrivateKeyPEM parses the first private key in a PEM file.
+func parsePrivateKeyPEM(data []byte, password string) (interface{}, error) {
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return nil, errors.New("no private key found")
+		}
+
+		// Legacy encrypted PEM is deprecated, but still produced by
+		// "openssl rsa -aes256" and friends.
+		der := block.Bytes
+		if x509.IsEncryptedPEMBlock(block) {
+			if password == "" {
+				return nil, errors.New("private key is encrypted, use -key-password")
+			}
+			var err error
+			if der, err = x509.DecryptPEMBlock(block, []byte(password)); err != nil {
+				return nil, err
+			}
+		}
+
+		switch block.Type {
+		case "ENCRYPTED PRIVATE KEY":
+			if password == "" {
+				return nil, errors.New("private key is encrypted, use -key-password")
+			}
+			return pkcs8.ParsePKCS8PrivateKey(der, []byte(password))
+		case "PRIVATE KEY":
+			return x509.ParsePKCS8PrivateKey(der)
+		case "RSA PRIVATE KEY":
+			return x509.ParsePKCS1PrivateKey(der)
+		case "EC PRIVATE KEY":
+			return x509.ParseECPrivateKey(der)
+		}
+	}
+}
+
+// loadCertPool returns a pool of the CA certificates in file and in the
+// files in dir, added to the system pool if withSystem is set.
+func loadCertPool(file, dir string, withSystem bool) (*x509.CertPool, error) {
+	pool := x509.NewCertPool()
+	if withSystem {
+		var err error
+		if pool, err = x509.SystemCertPool(); err != nil {
+			return nil, fmt.Errorf("loading system CA certificates: %v", err)
+		}
+	}
+
+	if file != "" {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("%s: no PEM certificates found", file)
+		}
+	}
+
+	if dir != "" {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			return nil, err
+		}
+		found := false
+		for _, entry := range entries {
+			// Files that are not PEM certificates, such as CRLs kept
+			// alongside them, are skipped.
+			data, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+			if err == nil && pool.AppendCertsFromPEM(data) {
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("%s: no PEM certificates found", dir)
+		}
+	}
+	return pool, nil
+}
+
+// printALPN prints the application protocol the server selected from those
+// offered with -alpn.
+func printALPN(cs tls.ConnectionState) {
+	if jsonOutput {
+		emit(event{Event: "alpn", ALPN: cs.NegotiatedProtocol})
+		return
+	}
+	printLine("alpn negotiated %s", yellow(orNone(cs.NegotiatedProtocol)))
+}
+
+// pinError is returned when no certificate presented by the server matches
+// a -pin.
+type pinError struct{}
+
+func (pinError) Error() string {
+	return "tls: no certificate matches the pinned public keys"
+}
+
+// parsePins parses -pin values of the form sha256//BASE64, as used by curl.
+// Several pins may be given in one value, separated by semicolons.
+func parsePins(values []string) (map[[sha256.Size]byte]bool, error) {
+	hashes := map[[sha256.Size]byte]bool{}
+	for _, value := range values {
+		for _, pin := range strings.Split(value, ";") {
+			encoded, ok := strings.CutPrefix(strings.TrimSpace(pin), "sha256//")
+			if !ok {
+				return nil, fmt.Errorf("invalid pin %q, expected sha256//BASE64", pin)
+			}
+			b, err := base64.StdEncoding.DecodeString(encoded)
+			if err != nil || len(b) != sha256.Size {
+				return nil, fmt.Errorf("invalid pin %q, expected a base64 SHA-256 hash", pin)
+			}
+			hashes[[sha256.Size]byte(b)] = true
+		}
+	}
+	return hashes, nil
+}
+
+// checkPins returns an error unless the SHA-256 hash of the public key
+// (SubjectPublicKeyInfo) of one of the certificates presented by the server
+// is pinned.
+func checkPins(cs tls.ConnectionState, hashes map[[sha256.Size]byte]bool) error {
+	for _, cert := range cs.PeerCertificates {
+		if hashes[sha256.Sum256(cert.RawSubjectPublicKeyInfo)] {
+			return nil
+		}
+	}
+	return pinError{}
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// parseTLSVersion parses the TLS version given by flag name. An empty value
+// leaves the default.
+func parseTLSVersion(name, s string) (uint16, error) {
+	if s == "" {
+		return 0, nil
+	}
+	if v, ok := tlsVersions[s]; ok {
+		return v, nil
+	}
+	return 0, fmt.Errorf("invalid -%s %q, expected 1.0, 1.1, 1.2 or 1.3", name, s)
+}
+
+// parseCipherSuites parses a comma-separated list of cipher suite names as
+// defined by IANA, e.g. TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256. Insecure
+// suites are allowed, since reproducing what picky clients offer is the
+// point. TLS 1.3 suites are refused: Go always offers all of them and
+// ignores the configured list for TLS 1.3.
+func parseCipherSuites(s string) ([]uint16, error) {
+	ids := map[string]uint16{}
+	tls13 := map[string]bool{}
+	for _, suite := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+		ids[suite.Name] = suite.ID
+		tls13[suite.Name] = len(suite.SupportedVersions) == 1 && suite.SupportedVersions[0] == tls.VersionTLS13
+	}
+
+	var suites []uint16
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		id, ok := ids[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown cipher suite %q", name)
+		}
+		if tls13[name] {
+			return nil, fmt.Errorf("cipher suite %q is TLS 1.3 only, -ciphers sets the TLS 1.0-1.2 suites", name)
+		}
+		suites = append(suites, id)
+	}
+	return suites, nil
+}
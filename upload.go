@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// checkUploadFlags validates -upload and the flags that go with it.
+func checkUploadFlags() error {
+	if uploadFile == "" {
+		if chunkSize != 0 || chunkDelay != 0 || uploadFragmented {
+			return errors.New("-chunk-size, -chunk-delay and -upload-fragmented need -upload")
+		}
+		return nil
+	}
+	if _, err := os.Stat(uploadFile); err != nil {
+		return err
+	}
+	if chunkSize < 0 {
+		return fmt.Errorf("invalid -chunk-size %d", chunkSize)
+	}
+	if uploadFragmented && chunkSize == 0 {
+		return errors.New("-upload-fragmented needs -chunk-size")
+	}
+	return nil
+}
+
+// upload sends the -upload file as binary data: as one message, as a
+// message per -chunk-size bytes or, with -upload-fragmented, as one message
+// in frames of -chunk-size bytes. -chunk-delay is waited between chunks.
+// Messages go through out like input lines; frames are written directly.
+func upload(ctx context.Context, ws Conn, out chan<- message) error {
+	f, err := os.Open(uploadFile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var fw frameWriter
+	if uploadFragmented {
+		if fw, err = frameWriterOf(ws); err != nil {
+			return err
+		}
+	}
+	size := chunkSize
+	if size == 0 {
+		info, err := f.Stat()
+		if err != nil {
+			return err
+		}
+		size = int(info.Size())
+	}
+
+	r := bufio.NewReader(f)
+	buf := make([]byte, size)
+	opcode := BinaryMessage
+	total, chunks := 0, 0
+	for {
+		n, err := io.ReadFull(r, buf)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		// An empty file is still sent, as an empty message.
+		if n == 0 && chunks > 0 {
+			break
+		}
+		_, err = r.Peek(1)
+		if err != nil && err != io.EOF {
+			return err
+		}
+		last := err == io.EOF
+
+		if chunks > 0 && chunkDelay > 0 {
+			select {
+			case <-time.After(chunkDelay):
+			case <-ctx.Done():
+				return nil
+			}
+		}
+		chunk := append([]byte(nil), buf[:n]...)
+		if fw != nil {
+			if err := fw.WriteFrame(frame{fin: last, opcode: opcode, masked: true, payload: chunk}); err != nil {
+				return err
+			}
+			trafficLog.message(true, opcode, chunk, time.Now())
+			opcode = continuationFrame
+		} else {
+			select {
+			case out <- message{messageType: BinaryMessage, data: chunk}:
+			case <-ctx.Done():
+				return nil
+			}
+		}
+		total += n
+		chunks++
+		if last {
+			break
+		}
+	}
+
+	unit := "message"
+	if fw != nil {
+		unit = "frame"
+	}
+	if chunks != 1 {
+		unit += "s"
+	}
+	printLine("uploaded %s: %d bytes in %d %s", yellow(uploadFile), total, chunks, unit)
+	return nil
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// wampSubprotocol is the subprotocol of WAMP v2 with JSON serialization.
+const wampSubprotocol = "wamp.2.json"
+
+// WAMP message types, the first element of a message.
+const (
+	wampHello        = 1
+	wampWelcome      = 2
+	wampAbort        = 3
+	wampGoodbye      = 6
+	wampError        = 8
+	wampPublish      = 16
+	wampPublished    = 17
+	wampSubscribe    = 32
+	wampSubscribed   = 33
+	wampUnsubscribe  = 34
+	wampUnsubscribed = 35
+	wampEvent        = 36
+	wampCall         = 48
+	wampResult       = 50
+)
+
+// wampNames name the WAMP message types, for the messages not otherwise
+// shown.
+var wampNames = map[int]string{
+	1: "HELLO", 2: "WELCOME", 3: "ABORT", 4: "CHALLENGE", 5: "AUTHENTICATE",
+	6: "GOODBYE", 8: "ERROR", 16: "PUBLISH", 17: "PUBLISHED", 32: "SUBSCRIBE",
+	33: "SUBSCRIBED", 34: "UNSUBSCRIBE", 35: "UNSUBSCRIBED", 36: "EVENT",
+	48: "CALL", 49: "CANCEL", 50: "RESULT", 64: "REGISTER", 65: "REGISTERED",
+	66: "UNREGISTER", 67: "UNREGISTERED", 68: "INVOCATION", 69: "INTERRUPT",
+	70: "YIELD",
+}
+
+// checkWAMPFlags validates -wamp and its options, and offers the WAMP
+// subprotocol unless -protocol does.
+func checkWAMPFlags() error {
+	if !wamp {
+		if flagGiven("wamp-realm") || len(wampSubscriptions) > 0 {
+			return errors.New("-wamp-realm and -wamp-subscribe require -wamp")
+		}
+		return nil
+	}
+	switch {
+	case command != "":
+		return fmt.Errorf("-wamp is not supported by %s", command)
+	case wampRealm == "":
+		return errors.New("-wamp-realm must not be empty")
+	}
+	if protocol == "" {
+		protocol = wampSubprotocol
+	}
+	return selectAppProtocol("-wamp", func() appSession {
+		return &wampSession{
+			requests:      map[int64]wampRequest{},
+			subscriptions: map[int64]string{},
+		}
+	})
+}
+
+// wampRequest is a request sent awaiting its answer.
+type wampRequest struct {
+	typ    int
+	uri    string // the topic or procedure of the request
+	sentAt time.Time
+}
+
+// wampSession speaks WAMP v2 as a caller, publisher and subscriber,
+// joining the realm of -wamp-realm and subscribing to the topics of
+// -wamp-subscribe. Events are shown as their topic and arguments, and
+// results as their call's procedure, request ID and latency, and
+// arguments. Input lines are commands:
+//
+//	subscribe <topic>
+//	unsubscribe <topic>
+//	publish <topic> [arguments...]
+//	call <procedure> [arguments...]
+//
+// Arguments that are not JSON are sent as a single string.
+type wampSession struct {
+	mu            sync.Mutex
+	joined        bool
+	queued        []message // the messages sent before the router welcomed the session
+	lastRequest   int64
+	requests      map[int64]wampRequest
+	subscriptions map[int64]string // the topics of the subscriptions by ID
+}
+
+func (s *wampSession) open(ctx context.Context, send func(message)) {
+	roles := map[string]interface{}{"caller": struct{}{}, "publisher": struct{}{}, "subscriber": struct{}{}}
+	send(jsonMessage([]interface{}{wampHello, wampRealm, map[string]interface{}{"roles": roles}}))
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, topic := range wampSubscriptions {
+		s.queued = append(s.queued, s.request(wampSubscribe, topic, struct{}{}, topic))
+	}
+}
+
+// request returns a message of a request of typ about uri, with the next
+// request ID followed by fields, and records it pending.
+func (s *wampSession) request(typ int, uri string, fields ...interface{}) message {
+	s.lastRequest++
+	s.requests[s.lastRequest] = wampRequest{typ: typ, uri: uri, sentAt: time.Now()}
+	return jsonMessage(append([]interface{}{typ, s.lastRequest}, fields...))
+}
+
+func (s *wampSession) input(line string) ([]message, error) {
+	command, rest, _ := strings.Cut(strings.TrimSpace(line), " ")
+	command = strings.ToLower(command)
+	uri, args, _ := strings.Cut(strings.TrimSpace(rest), " ")
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var msg message
+	switch command {
+	case "subscribe":
+		if uri == "" {
+			return nil, errors.New("usage: subscribe <topic>")
+		}
+		msg = s.request(wampSubscribe, uri, struct{}{}, uri)
+	case "unsubscribe":
+		if uri == "" {
+			return nil, errors.New("usage: unsubscribe <topic>")
+		}
+		id, ok := int64(0), false
+		for sub, topic := range s.subscriptions {
+			if topic == uri {
+				id, ok = sub, true
+			}
+		}
+		if !ok {
+			return nil, fmt.Errorf("not subscribed to %s", uri)
+		}
+		msg = s.request(wampUnsubscribe, uri, id)
+	case "publish":
+		if uri == "" {
+			return nil, errors.New("usage: publish <topic> [arguments...]")
+		}
+		msg = s.request(wampPublish, uri, map[string]bool{"acknowledge": true}, uri, parseArgs(args))
+	case "call":
+		if uri == "" {
+			return nil, errors.New("usage: call <procedure> [arguments...]")
+		}
+		msg = s.request(wampCall, uri, struct{}{}, uri, parseArgs(args))
+	default:
+		return nil, errors.New("unknown WAMP command, expected subscribe, unsubscribe, publish or call")
+	}
+	if !s.joined {
+		s.queued = append(s.queued, msg)
+		return nil, nil
+	}
+	return []message{msg}, nil
+}
+
+func (s *wampSession) receive(msg message, send func(message)) ([]message, error) {
+	var fields []json.RawMessage
+	var typ int
+	if msg.messageType != TextMessage || json.Unmarshal(msg.data, &fields) != nil || len(fields) == 0 || json.Unmarshal(fields[0], &typ) != nil {
+		return []message{msg}, nil
+	}
+	// The arguments and keyword arguments of the message, if any, after
+	// the fields of its type.
+	payload := func(n int) string {
+		if len(fields) <= n {
+			return ""
+		}
+		return formatWAMPArgs(fields[n:])
+	}
+	var id int64
+	if len(fields) > 1 {
+		json.Unmarshal(fields[1], &id)
+	}
+
+	switch typ {
+	case wampWelcome:
+		var details struct {
+			AuthID   string `json:"authid"`
+			AuthRole string `json:"authrole"`
+		}
+		if len(fields) > 2 {
+			json.Unmarshal(fields[2], &details)
+		}
+		s.mu.Lock()
+		s.joined = true
+		queued := s.queued
+		s.queued = nil
+		s.mu.Unlock()
+		line := fmt.Sprintf("joined realm %s as session %d", wampRealm, id)
+		if details.AuthID != "" {
+			line += fmt.Sprintf(" (authid %s, role %s)", details.AuthID, details.AuthRole)
+		}
+		printLine("%s", line)
+		for _, q := range queued {
+			send(q)
+		}
+		return nil, nil
+	case wampAbort, wampGoodbye:
+		var reason string
+		if len(fields) > 2 {
+			json.Unmarshal(fields[2], &reason)
+		}
+		if typ == wampAbort {
+			return nil, fmt.Errorf("WAMP session aborted: %s%s", reason, formatArgs(fields[1:min(2, len(fields))]))
+		}
+		s.mu.Lock()
+		s.joined = false
+		s.mu.Unlock()
+		send(jsonMessage([]interface{}{wampGoodbye, struct{}{}, "wamp.close.goodbye_and_out"}))
+		printLine("left realm %s: %s", wampRealm, reason)
+		return nil, nil
+	case wampEvent:
+		s.mu.Lock()
+		topic, ok := s.subscriptions[id]
+		s.mu.Unlock()
+		if !ok {
+			topic = fmt.Sprintf("subscription %d", id)
+		}
+		msg.data = []byte(topic + payload(4))
+		return []message{msg}, nil
+	}
+
+	// The answers to requests, with the request's ID after their type, or
+	// after the type of the request for errors.
+	reqField := 1
+	if typ == wampError {
+		reqField = 2
+	}
+	var reqID int64
+	if len(fields) > reqField {
+		json.Unmarshal(fields[reqField], &reqID)
+	}
+	s.mu.Lock()
+	req, ok := s.requests[reqID]
+	delete(s.requests, reqID)
+	s.mu.Unlock()
+	if !ok {
+		return showWAMP(typ, fields, msg)
+	}
+	latency := msg.time.Sub(req.sentAt).Round(time.Microsecond)
+	switch typ {
+	case wampSubscribed:
+		var sub int64
+		if len(fields) > 2 {
+			json.Unmarshal(fields[2], &sub)
+		}
+		s.mu.Lock()
+		s.subscriptions[sub] = req.uri
+		s.mu.Unlock()
+		printLine("subscribed to %s", req.uri)
+		return nil, nil
+	case wampUnsubscribed:
+		s.mu.Lock()
+		for sub, topic := range s.subscriptions {
+			if topic == req.uri {
+				delete(s.subscriptions, sub)
+			}
+		}
+		s.mu.Unlock()
+		printLine("unsubscribed from %s", req.uri)
+		return nil, nil
+	case wampPublished:
+		printLine("published to %s (%v)", req.uri, latency)
+		return nil, nil
+	case wampResult:
+		msg.data = []byte(fmt.Sprintf("%s %d (%v)%s", req.uri, reqID, latency, payload(3)))
+		return []message{msg}, nil
+	case wampError:
+		var uri string
+		if len(fields) > 4 {
+			json.Unmarshal(fields[4], &uri)
+		}
+		return nil, fmt.Errorf("%s %s %d (%v) failed: %s%s", strings.ToLower(wampNames[req.typ]), req.uri, reqID, latency, uri, payload(5))
+	}
+	return showWAMP(typ, fields, msg)
+}
+
+// formatWAMPArgs formats the arguments and keyword arguments of a message,
+// each argument after a space, and then the keyword arguments if any.
+func formatWAMPArgs(payload []json.RawMessage) string {
+	var args []json.RawMessage
+	json.Unmarshal(payload[0], &args)
+	if len(payload) > 1 {
+		var kwargs map[string]json.RawMessage
+		if json.Unmarshal(payload[1], &kwargs) == nil && len(kwargs) > 0 {
+			args = append(args, payload[1])
+		}
+	}
+	return formatArgs(args)
+}
+
+// showWAMP returns a message not otherwise handled as a text message of
+// its type's name followed by its other fields.
+func showWAMP(typ int, fields []json.RawMessage, msg message) ([]message, error) {
+	name, ok := wampNames[typ]
+	if !ok {
+		name = fmt.Sprintf("type %d", typ)
+	}
+	msg.data = []byte(name + formatArgs(fields[1:]))
+	return []message{msg}, nil
+}
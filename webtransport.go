@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/http"
+	neturl "net/url"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/quic-go/webtransport-go"
+)
+
+// wtReadSize is the most data a single read from a WebTransport stream
+// returns as one message.
+const wtReadSize = 64 << 10
+
+// dialWebTransport opens a WebTransport session over HTTP/3 at url and a
+// bidirectional stream on it, which carries the messages. The subprotocols
+// are offered as WebTransport application protocols. Redirects are not
+// followed and -proxy does not apply, since QUIC runs over UDP.
+func dialWebTransport(url, protocol string, header http.Header, tlsConfig *tls.Config) (Conn, error) {
+	u, err := neturl.Parse(url)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "https":
+	case "wss":
+		u.Scheme = "https"
+	default:
+		return nil, fmt.Errorf("unsupported URL scheme %q for -webtransport, expected https or wss", u.Scheme)
+	}
+	if u.Port() == "" {
+		u.Host += ":443"
+	}
+
+	ctx := context.Background()
+	if handshakeTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, handshakeTimeout)
+		defer cancel()
+	}
+
+	protocols := splitProtocols(protocol)
+	transport := &webtransport.Transport{
+		TLSClientConfig:      tlsConfig,
+		ApplicationProtocols: protocols,
+	}
+	if showJWT {
+		inspectJWTs("URL", []byte(url))
+		inspectHeaderJWTs("request", header)
+	}
+	resp, session, err := transport.Dial(ctx, u.String(), header)
+
+	var tap *handshakeTap
+	if showHandshake || jsonOutput {
+		tap = newH2Tap(nil)
+		fmt.Fprintf(&tap.request, "CONNECT %s HTTP/3\r\n:protocol: webtransport\r\n:authority: %s\r\n", u.RequestURI(), u.Host)
+		header.Write(&tap.request)
+		tap.request.WriteString("\r\n")
+		if resp != nil {
+			fmt.Fprintf(&tap.response, "HTTP/3 %d\r\n", resp.StatusCode)
+			resp.Header.Write(&tap.response)
+			tap.response.WriteString("\r\n")
+		}
+	}
+	if showJWT && resp != nil {
+		inspectHeaderJWTs("response", resp.Header)
+	}
+	if jsonOutput {
+		emitHandshake(url, tap, resp)
+	} else if showHandshake {
+		printHandshake(tap, resp)
+	}
+	if err != nil {
+		if resp != nil && resp.StatusCode != http.StatusOK {
+			return nil, &handshakeError{resp.Status}
+		}
+		return nil, &dialError{err}
+	}
+
+	state := session.SessionState()
+	inspectTLS(state.ConnectionState.TLS)
+	stream, err := session.OpenStreamSync(ctx)
+	if err != nil {
+		session.CloseWithError(0, "")
+		return nil, &dialError{err}
+	}
+	return &wtConn{session: session, stream: stream, subprotocol: state.ApplicationProtocol}, nil
+}
+
+// wtConn implements Conn with a bidirectional WebTransport stream. Streams
+// have no message boundaries: each message is written as is, and whatever a
+// read returns is one received message, binary if it is not valid UTF-8.
+// Closing the connection closes the session, with the close code as the
+// session error code. Code 0, which means no error, stands for 1000. There is
+// no closing handshake, so once this side closed the session, reads fail
+// with the close it sent.
+type wtConn struct {
+	session     *webtransport.Session
+	stream      *webtransport.Stream
+	subprotocol string
+
+	mu        sync.Mutex
+	closeSent *CloseError
+}
+
+func (c *wtConn) ReadMessage() (int, []byte, error) {
+	buf := make([]byte, wtReadSize)
+	n, err := c.stream.Read(buf)
+	if n > 0 {
+		if utf8.Valid(buf[:n]) {
+			return TextMessage, buf[:n], nil
+		}
+		return BinaryMessage, buf[:n], nil
+	}
+	c.mu.Lock()
+	closeSent := c.closeSent
+	c.mu.Unlock()
+	if closeSent != nil {
+		return 0, nil, closeSent
+	}
+	var se *webtransport.SessionError
+	if errors.As(err, &se) {
+		code := int(se.ErrorCode)
+		if code == 0 {
+			code = 1000
+		}
+		return 0, nil, &CloseError{Code: code, Text: se.Message}
+	}
+	return 0, nil, err
+}
+
+func (c *wtConn) WriteMessage(messageType int, data []byte) error {
+	_, err := c.stream.Write(data)
+	return err
+}
+
+func (c *wtConn) WriteControl(messageType int, data []byte, deadline time.Time) error {
+	if messageType != CloseMessage {
+		return errors.New("webtransport: ping and pong are not supported")
+	}
+	code, text := uint32(1005), ""
+	if len(data) >= 2 {
+		code, text = uint32(binary.BigEndian.Uint16(data)), string(data[2:])
+	}
+	c.mu.Lock()
+	c.closeSent = &CloseError{Code: int(code), Text: text}
+	c.mu.Unlock()
+	if code == 1000 || code == 1005 {
+		code = 0
+	}
+	return c.session.CloseWithError(webtransport.SessionErrorCode(code), text)
+}
+
+func (c *wtConn) Subprotocol() string {
+	return c.subprotocol
+}
+
+func (c *wtConn) SetReadDeadline(t time.Time) error {
+	return c.stream.SetReadDeadline(t)
+}
+
+func (c *wtConn) SetWriteDeadline(t time.Time) error {
+	return c.stream.SetWriteDeadline(t)
+}
+
+func (c *wtConn) SetPongHandler(h func(appData string) error) {}
+
+func (c *wtConn) Close() error {
+	return c.session.CloseWithError(0, "")
+}
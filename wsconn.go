@@ -0,0 +1,326 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+var (
+	errCloseSent       = errors.New("websocket: close sent")
+	errMessageTooLarge = errors.New("websocket: message exceeds read limit")
+)
+
+// protocolError is a violation of RFC 6455 by the peer. The connection is
+// failed with the close code.
+type protocolError struct {
+	code int
+	text string
+}
+
+func (e *protocolError) Error() string {
+	return "websocket: " + e.text
+}
+
+// frameConn is one side of a WebSocket connection, implementing Conn on top
+// of a net.Conn. It is the client side unless server is set: clients mask
+// the frames they send, servers do not.
+type frameConn struct {
+	conn        net.Conn
+	br          *bufio.Reader
+	subprotocol string
+	readLimit   int64
+	server      bool
+
+	// skipUTF8Validation disables failing the connection when a text
+	// message or close reason is not valid UTF-8.
+	skipUTF8Validation bool
+
+	// inflate and deflate are set if permessage-deflate was negotiated.
+	inflate *inflater
+	deflate *deflater
+
+	// wireSize is the payload size on the wire of the last message read.
+	wireSize int
+
+	pongHandler func(appData string) error
+
+	// frameHook, if set, is called for every frame sent or received.
+	frameHook func(sent bool, f frame)
+
+	// chaos, if set, disrupts the frames written.
+	chaos *chaosMonkey
+
+	// msgLimit, if set, paces the data messages written for -msg-rate.
+	msgLimit *rateLimiter
+
+	// closeHooks are called when the connection is first closed.
+	closeHooks []func()
+	closeOnce  sync.Once
+
+	writeMu       sync.Mutex
+	writeDeadline time.Time
+	closeSent     bool
+}
+
+func newFrameConn(conn net.Conn, br *bufio.Reader, subprotocol string) *frameConn {
+	if br == nil {
+		br = bufio.NewReader(conn)
+	}
+	return &frameConn{
+		conn:        conn,
+		br:          br,
+		subprotocol: subprotocol,
+		readLimit:   maxMessageSize,
+	}
+}
+
+func (c *frameConn) ReadMessage() (int, []byte, error) {
+	var (
+		messageType int
+		compressed  bool
+		data        []byte
+	)
+	c.wireSize = 0
+
+	for {
+		f, err := readFrame(c.br, c.readLimit)
+		if err == errFrameTooLarge {
+			return 0, nil, c.fail(&protocolError{1009, "message exceeds read limit"})
+		}
+		if err != nil {
+			return 0, nil, err
+		}
+		if c.frameHook != nil {
+			c.frameHook(false, f)
+		}
+		if err := c.checkFrame(f, messageType != 0); err != nil {
+			return 0, nil, c.fail(err)
+		}
+
+		if isControl(f.opcode) {
+			if err := c.handleControl(f); err != nil {
+				return 0, nil, err
+			}
+			continue
+		}
+
+		if f.opcode != continuationFrame {
+			messageType, compressed = f.opcode, f.rsv1
+		}
+		data = append(data, f.payload...)
+		c.wireSize += len(f.payload)
+		if c.readLimit > 0 && int64(len(data)) > c.readLimit {
+			return 0, nil, c.fail(&protocolError{1009, "message exceeds read limit"})
+		}
+		if !f.fin {
+			continue
+		}
+
+		if compressed {
+			data, err = c.inflate.inflate(data, c.readLimit)
+			if err == errMessageTooLarge {
+				return 0, nil, c.fail(&protocolError{1009, "message exceeds read limit"})
+			}
+			if err != nil {
+				return 0, nil, c.fail(&protocolError{1007, "invalid compressed data: " + err.Error()})
+			}
+		}
+		if messageType == TextMessage && !c.skipUTF8Validation && !utf8.Valid(data) {
+			return 0, nil, c.fail(&protocolError{1007, "invalid UTF-8 in text message"})
+		}
+		return messageType, data, nil
+	}
+}
+
+// checkFrame validates a frame received from the peer. fragmented is set
+// while a fragmented message is being received.
+func (c *frameConn) checkFrame(f frame, fragmented bool) error {
+	switch {
+	case f.masked && !c.server:
+		return &protocolError{1002, "received masked frame from server"}
+	case !f.masked && c.server:
+		return &protocolError{1002, "received unmasked frame from client"}
+	case f.rsv1 && (c.inflate == nil || f.opcode == continuationFrame || isControl(f.opcode)):
+		return &protocolError{1002, "unexpected RSV1 bit"}
+	case f.rsv2 || f.rsv3:
+		return &protocolError{1002, "unexpected RSV2 or RSV3 bit"}
+	case isControl(f.opcode) && (!f.fin || len(f.payload) > 125):
+		return &protocolError{1002, "invalid control frame"}
+	case f.opcode == continuationFrame && !fragmented:
+		return &protocolError{1002, "unexpected continuation frame"}
+	case (f.opcode == TextMessage || f.opcode == BinaryMessage) && fragmented:
+		return &protocolError{1002, "expected continuation frame"}
+	case f.opcode > BinaryMessage && !isControl(f.opcode), f.opcode > PongMessage:
+		return &protocolError{1002, fmt.Sprintf("unknown opcode %d", f.opcode)}
+	}
+	return nil
+}
+
+func (c *frameConn) handleControl(f frame) error {
+	switch f.opcode {
+	case PingMessage:
+		err := c.WriteControl(PongMessage, f.payload, time.Now().Add(time.Second))
+		if err != nil && err != errCloseSent {
+			return err
+		}
+	case PongMessage:
+		if c.pongHandler != nil {
+			return c.pongHandler(string(f.payload))
+		}
+	case CloseMessage:
+		ce := &CloseError{Code: 1005}
+		switch {
+		case len(f.payload) == 1:
+			return c.fail(&protocolError{1002, "invalid close frame payload"})
+		case len(f.payload) >= 2:
+			ce.Code = int(binary.BigEndian.Uint16(f.payload))
+			ce.Text = string(f.payload[2:])
+			if !validCloseCode(ce.Code) {
+				return c.fail(&protocolError{1002, fmt.Sprintf("invalid close code %d", ce.Code)})
+			}
+			if !c.skipUTF8Validation && !utf8.Valid(f.payload[2:]) {
+				return c.fail(&protocolError{1007, "invalid UTF-8 in close reason"})
+			}
+		}
+		// Echo the close frame to complete the closing handshake.
+		c.WriteControl(CloseMessage, FormatCloseMessage(ce.Code, ""), time.Now().Add(time.Second))
+		return ce
+	}
+	return nil
+}
+
+// validCloseCode reports whether code may be sent in a close frame.
+func validCloseCode(code int) bool {
+	switch {
+	case code >= 1000 && code <= 1003, code >= 1007 && code <= 1014:
+		return true
+	case code >= 3000 && code <= 4999:
+		return true
+	}
+	return false
+}
+
+// fail sends a close frame for a protocol error and closes the connection.
+func (c *frameConn) fail(err error) error {
+	if pe, ok := err.(*protocolError); ok {
+		c.WriteControl(CloseMessage, FormatCloseMessage(pe.code, pe.text), time.Now().Add(time.Second))
+	}
+	c.conn.Close()
+	return err
+}
+
+func (c *frameConn) WriteMessage(messageType int, data []byte) error {
+	c.msgLimit.wait(1)
+	f := c.newFrame(messageType, data)
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	if c.closeSent {
+		return errCloseSent
+	}
+	if c.deflate != nil {
+		f.payload, f.rsv1 = c.deflate.deflate(data)
+	}
+	return c.writeFrame(f)
+}
+
+func (c *frameConn) WriteControl(messageType int, data []byte, deadline time.Time) error {
+	f := c.newFrame(messageType, data)
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	if c.closeSent {
+		return errCloseSent
+	}
+	if messageType == CloseMessage {
+		c.closeSent = true
+	}
+	c.conn.SetWriteDeadline(deadline)
+	err := c.writeFrame(f)
+	c.conn.SetWriteDeadline(c.writeDeadline)
+	return err
+}
+
+// newFrame returns a final frame carrying data, masked if c is the client
+// side.
+func (c *frameConn) newFrame(opcode int, data []byte) frame {
+	f := frame{fin: true, opcode: opcode, payload: data}
+	if !c.server {
+		f.masked, f.maskKey = true, newMaskKey()
+	}
+	return f
+}
+
+// writeFrame writes f to the connection. c.writeMu must be held.
+func (c *frameConn) writeFrame(f frame) error {
+	if c.frameHook != nil {
+		c.frameHook(true, f)
+	}
+	if c.chaos != nil {
+		return c.chaos.write(c.conn, appendFrame(nil, f))
+	}
+	_, err := c.conn.Write(appendFrame(nil, f))
+	return err
+}
+
+// WriteFrame writes a single frame as is, without validating it. A masking
+// key is generated if the frame is masked and has none.
+func (c *frameConn) WriteFrame(f frame) error {
+	if f.masked && f.maskKey == [4]byte{} {
+		f.maskKey = newMaskKey()
+	}
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	return c.writeFrame(f)
+}
+
+// WriteRaw writes b to the connection as is.
+func (c *frameConn) WriteRaw(b []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	_, err := c.conn.Write(b)
+	return err
+}
+
+func (c *frameConn) Subprotocol() string {
+	return c.subprotocol
+}
+
+func (c *frameConn) SetReadDeadline(t time.Time) error {
+	return c.conn.SetReadDeadline(t)
+}
+
+func (c *frameConn) SetWriteDeadline(t time.Time) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	c.writeDeadline = t
+	return c.conn.SetWriteDeadline(t)
+}
+
+func (c *frameConn) SetPongHandler(h func(appData string) error) {
+	c.pongHandler = h
+}
+
+func (c *frameConn) Close() error {
+	c.closeOnce.Do(func() {
+		for _, hook := range c.closeHooks {
+			hook()
+		}
+	})
+	return c.conn.Close()
+}
+
+// lastWireSize returns the payload size on the wire of the last message
+// read, before decompression.
+func (c *frameConn) lastWireSize() int {
+	return c.wireSize
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+// pipeConn returns the client side of a connection over a pipe, along with
+// the server end of the pipe and the frames the client sends on it.
+func pipeConn(t *testing.T) (*frameConn, net.Conn, <-chan frame) {
+	client, server := net.Pipe()
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	frames := make(chan frame, 16)
+	go func() {
+		defer close(frames)
+		br := bufio.NewReader(server)
+		for {
+			f, err := readFrame(br, 0)
+			if err != nil {
+				return
+			}
+			frames <- f
+		}
+	}()
+	return newFrameConn(client, nil, ""), server, frames
+}
+
+// serverSends writes the frames to the client as the server, unmasked.
+func serverSends(server net.Conn, frames ...frame) {
+	var b []byte
+	for _, f := range frames {
+		b = appendFrame(b, f)
+	}
+	go server.Write(b)
+}
+
+// nextFrame returns the next frame the client sent.
+func nextFrame(t *testing.T, frames <-chan frame) frame {
+	t.Helper()
+	select {
+	case f, ok := <-frames:
+		if !ok {
+			t.Fatal("connection closed without a frame")
+		}
+		return f
+	case <-time.After(time.Second):
+		t.Fatal("no frame sent")
+	}
+	return frame{}
+}
+
+// sentCloseCode returns the code of a close frame the client sent.
+func sentCloseCode(t *testing.T, f frame) int {
+	t.Helper()
+	if f.opcode != CloseMessage || len(f.payload) < 2 {
+		t.Fatalf("got opcode %d with payload %q, want a close frame", f.opcode, f.payload)
+	}
+	return int(f.payload[0])<<8 | int(f.payload[1])
+}
+
+func TestReadFragmentedMessage(t *testing.T) {
+	ws, server, frames := pipeConn(t)
+	serverSends(server,
+		frame{opcode: TextMessage, payload: []byte("hel")},
+		frame{fin: true, opcode: PingMessage, payload: []byte("p")},
+		frame{opcode: continuationFrame, payload: []byte("lo ")},
+		frame{fin: true, opcode: continuationFrame, payload: []byte("world")},
+	)
+	typ, data, err := ws.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if typ != TextMessage || string(data) != "hello world" {
+		t.Errorf("got %d %q, want text message %q", typ, data, "hello world")
+	}
+	// The ping in the middle of the message is answered.
+	pong := nextFrame(t, frames)
+	if pong.opcode != PongMessage || string(pong.payload) != "p" || !pong.masked {
+		t.Errorf("got %+v, want a masked pong of %q", pong, "p")
+	}
+}
+
+func TestProtocolErrors(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		frames []frame
+		code   int
+	}{
+		{"fragmented control frame", []frame{{opcode: PingMessage}}, 1002},
+		{"long control frame", []frame{{fin: true, opcode: PingMessage, payload: make([]byte, 126)}}, 1002},
+		{"masked frame", []frame{{fin: true, opcode: TextMessage, masked: true, maskKey: [4]byte{1, 2, 3, 4}}}, 1002},
+		{"unexpected continuation", []frame{{fin: true, opcode: continuationFrame}}, 1002},
+		{"interleaved message", []frame{{opcode: TextMessage}, {fin: true, opcode: BinaryMessage}}, 1002},
+		{"reserved opcode", []frame{{fin: true, opcode: 3}}, 1002},
+		{"RSV1 without compression", []frame{{fin: true, rsv1: true, opcode: TextMessage}}, 1002},
+		{"RSV2", []frame{{fin: true, rsv2: true, opcode: TextMessage}}, 1002},
+		{"invalid UTF-8", []frame{{fin: true, opcode: TextMessage, payload: []byte{0xff, 0xfe}}}, 1007},
+		{"close with one byte", []frame{{fin: true, opcode: CloseMessage, payload: []byte{3}}}, 1002},
+		{"close with code 1005", []frame{{fin: true, opcode: CloseMessage, payload: []byte{0x03, 0xed}}}, 1002},
+		{"close with code 2000", []frame{{fin: true, opcode: CloseMessage, payload: []byte{0x07, 0xd0}}}, 1002},
+		{"invalid UTF-8 close reason", []frame{{fin: true, opcode: CloseMessage, payload: []byte{0x03, 0xe8, 0xc3, 0x28}}}, 1007},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			ws, server, frames := pipeConn(t)
+			serverSends(server, tt.frames...)
+			_, _, err := ws.ReadMessage()
+			var pe *protocolError
+			if !errors.As(err, &pe) || pe.code != tt.code {
+				t.Fatalf("got %v, want a protocol error with code %d", err, tt.code)
+			}
+			if code := sentCloseCode(t, nextFrame(t, frames)); code != tt.code {
+				t.Errorf("failed with close code %d, want %d", code, tt.code)
+			}
+		})
+	}
+}
+
+func TestReadLimit(t *testing.T) {
+	ws, server, frames := pipeConn(t)
+	ws.readLimit = 4
+	serverSends(server,
+		frame{opcode: TextMessage, payload: []byte("abc")},
+		frame{fin: true, opcode: continuationFrame, payload: []byte("de")},
+	)
+	_, _, err := ws.ReadMessage()
+	var pe *protocolError
+	if !errors.As(err, &pe) || pe.code != 1009 {
+		t.Fatalf("got %v, want a protocol error with code 1009", err)
+	}
+	if code := sentCloseCode(t, nextFrame(t, frames)); code != 1009 {
+		t.Errorf("failed with close code %d, want 1009", code)
+	}
+}
+
+func TestSkipUTF8Validation(t *testing.T) {
+	ws, server, _ := pipeConn(t)
+	ws.skipUTF8Validation = true
+	serverSends(server, frame{fin: true, opcode: TextMessage, payload: []byte{0xff}})
+	if _, data, err := ws.ReadMessage(); err != nil || !bytes.Equal(data, []byte{0xff}) {
+		t.Errorf("got %q, %v", data, err)
+	}
+}
+
+func TestCloseHandshake(t *testing.T) {
+	ws, server, frames := pipeConn(t)
+	serverSends(server, frame{fin: true, opcode: CloseMessage, payload: FormatCloseMessage(4001, "bye ✓")})
+	_, _, err := ws.ReadMessage()
+	var ce *CloseError
+	if !errors.As(err, &ce) || ce.Code != 4001 || ce.Text != "bye ✓" {
+		t.Fatalf("got %v, want close 4001 %q", err, "bye ✓")
+	}
+	// The close frame is echoed, and nothing more can be sent.
+	if code := sentCloseCode(t, nextFrame(t, frames)); code != 4001 {
+		t.Errorf("echoed close code %d, want 4001", code)
+	}
+	if err := ws.WriteMessage(TextMessage, []byte("late")); err != errCloseSent {
+		t.Errorf("writing after the close frame: got %v, want %v", err, errCloseSent)
+	}
+}
+
+func TestCloseWithoutCode(t *testing.T) {
+	ws, server, frames := pipeConn(t)
+	serverSends(server, frame{fin: true, opcode: CloseMessage})
+	_, _, err := ws.ReadMessage()
+	var ce *CloseError
+	if !errors.As(err, &ce) || ce.Code != 1005 {
+		t.Fatalf("got %v, want close 1005", err)
+	}
+	if f := nextFrame(t, frames); f.opcode != CloseMessage {
+		t.Errorf("got opcode %d, want the close frame echoed", f.opcode)
+	}
+}
+
+func TestWriteMasksFrames(t *testing.T) {
+	ws, _, frames := pipeConn(t)
+	go ws.WriteMessage(BinaryMessage, []byte{1, 2, 3})
+	f := nextFrame(t, frames)
+	if !f.masked || !f.fin || f.opcode != BinaryMessage || !bytes.Equal(f.payload, []byte{1, 2, 3}) {
+		t.Errorf("got %+v", f)
+	}
+}
+
+func TestCompressedMessages(t *testing.T) {
+	ws, server, frames := pipeConn(t)
+	ws.inflate = &inflater{}
+	ws.deflate = &deflater{}
+	peer := &deflater{}
+
+	var sent []frame
+	for _, text := range []string{"hello hello hello", "hello hello hello"} {
+		payload, ok := peer.deflate([]byte(text))
+		if !ok {
+			t.Fatal("message not compressed")
+		}
+		sent = append(sent, frame{fin: true, rsv1: true, opcode: TextMessage, payload: payload})
+	}
+	serverSends(server, sent...)
+	for range sent {
+		typ, data, err := ws.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if typ != TextMessage || string(data) != "hello hello hello" {
+			t.Errorf("got %d %q", typ, data)
+		}
+	}
+
+	go ws.WriteMessage(TextMessage, []byte("compressed"))
+	f := nextFrame(t, frames)
+	if !f.rsv1 {
+		t.Fatal("sent message not compressed")
+	}
+	out, err := (&inflater{}).inflate(f.payload, 0)
+	if err != nil || string(out) != "compressed" {
+		t.Errorf("inflated %q, %v", out, err)
+	}
+}
+
+func TestCompressedContinuationRSV1(t *testing.T) {
+	ws, server, frames := pipeConn(t)
+	ws.inflate = &inflater{}
+	serverSends(server,
+		frame{rsv1: true, opcode: TextMessage},
+		frame{fin: true, rsv1: true, opcode: continuationFrame},
+	)
+	_, _, err := ws.ReadMessage()
+	var pe *protocolError
+	if !errors.As(err, &pe) || pe.code != 1002 {
+		t.Fatalf("got %v, want a protocol error with code 1002", err)
+	}
+	sentCloseCode(t, nextFrame(t, frames))
+}